@@ -21,6 +21,12 @@ func Checkout() int {
 		pathspecs = append(pathspecs, p)
 	}
 
+	return checkoutPathspecs(pathspecs, optDryRun)
+}
+
+// Check out binaries for pathspecs (all if empty) & report what happened
+// Returns the exit code for the command
+func checkoutPathspecs(pathspecs []string, optDryRun bool) int {
 	var filesCheckedOut int
 	var filesFailed int
 	var filesUpToDate int
@@ -13,14 +13,25 @@ import (
 // Fetch command line tool
 func Fetch() int {
 
-	// git-lob fetch [--prune] [--force] [<remote> [<ref>...]]
+	// git-lob fetch [--prune] [--force] [--profile=<name>] [--max-size=<size>] [<remote> [<ref>...]]
 
 	// Validate custom options
-	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{"prune", "force"})
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"profile", "max-size"}, []string{"prune", "force"})
 	if len(errorList) > 0 {
 		util.LogConsoleError(strings.Join(errorList, "\n"))
 		return 9
 	}
+	if ret := applyFetchProfileOption(); ret != 0 {
+		return ret
+	}
+	if maxsize := util.GlobalOptions.StringOpts["max-size"]; maxsize != "" {
+		n, err := util.ParseSize(maxsize)
+		if err != nil {
+			util.LogConsoleErrorf("git-lob: invalid --max-size: %v\n", maxsize)
+			return 9
+		}
+		util.GlobalOptions.FetchMaxSize = n
+	}
 
 	optPrune := util.GlobalOptions.BoolOpts.Contains("prune")
 	optForce := util.GlobalOptions.BoolOpts.Contains("force")
@@ -72,6 +83,9 @@ func Fetch() int {
 	} else {
 		util.LogConsole("Fetching recent binaries from", remoteName)
 	}
+	if util.GlobalOptions.FetchProfile != "" {
+		util.LogConsole("Using fetch profile", util.GlobalOptions.FetchProfile)
+	}
 
 	// Do the actual fetching in a Goroutine, because we want to update the download rate & time estimates
 	// on a regular schedule, regardless of whether any actual callbacks are received
@@ -133,6 +147,21 @@ func Fetch() int {
 	return 0
 }
 
+// Select the fetch profile given with --profile=<name>, if any, overriding git-lob.fetch-profile
+// Returns a non-zero exit code on failure (errors already reported)
+func applyFetchProfileOption() int {
+	profile := util.GlobalOptions.StringOpts["profile"]
+	if profile == "" {
+		return 0
+	}
+	err := util.ApplyFetchProfile(util.GlobalOptions, profile)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: %v\n", err.Error())
+		return 9
+	}
+	return 0
+}
+
 // Low-level LOB fetch command
 func FetchLob() int {
 
@@ -280,6 +309,15 @@ Options:
   --prune       As well as downloading files referenced by 'recent' commits, 
                 delete any local files you already have which now fall outside
                 this definition of 'recent'. See RECENT COMMITS below.
+  --profile=<name>
+                Only fetch the paths in this fetch profile, instead of those
+                in git-lob.fetch-include / fetch-exclude or the default
+                git-lob.fetch-profile. See FETCH PROFILES below.
+  --max-size=<size>
+                Don't download binaries larger than this, e.g. 500MB; they're
+                left as placeholders. Overrides git-lob.fetch-max-size, use
+                --max-size=0 to download everything. Use 'git lob fetch-lob'
+                to download specific large binaries.
   --quiet, -q   Print less output
   --verbose, -v Print more output
   --dry-run     Don't actually download anything, just report
@@ -299,6 +337,30 @@ Recent commits means:
   * Any ancestors of those branches/tags within git-lob.fetch-commits-other
     days of its last commit date
 
+FETCH PROFILES
+
+If different people or machines need different parts of a large repo, you
+can define named sets of paths in git config, e.g.:
+
+  git config git-lob.profile.audio.include "sound,music/*.wav"
+  git config git-lob.profile.levels.exclude "sound,music"
+
+and select one with --profile=<name>, or by default with
+git-lob.fetch-profile (e.g. in your global ~/.gitconfig). The profile's
+include & exclude paths replace git-lob.fetch-include & fetch-exclude, so
+they also limit which binaries are auto-fetched. 'git lob prune' only keeps
+recent binaries in the profile's paths too (see 'git lob help prune').
+
+ATTRIBUTES
+
+Repos can also decide what's fetched with the lob-fetch attribute in
+.gitattributes (resolved with git check-attr):
+
+  lob-fetch=never   Never fetched automatically; use 'git lob fetch-lob'
+  lob-fetch=always  Fetched even when outside git-lob.fetch-include /
+                    fetch-exclude or the fetch profile
+  lob-fetch=recent  The default
+
 REMOTES
   Type 'git lob help remotes' for details
 
@@ -314,6 +376,7 @@ func FetchLobHelp() {
   This is a low-level alternative to the main fetch command, allowing
   you to manually download a specific binary identified by its SHA. Files
   already on the remote are still skipped unless you use --force.
+  git-lob.fetch-max-size does not apply, since you asked for these binaries.
 
   These files are stored in your local binary store (shared store if 
   configured) ready to be checked out into your working copy either with
@@ -17,8 +17,21 @@ func SmudgeFilter() int {
 	} else {
 		filename = "[Unknown filename]"
 	}
+	if util.GlobalOptions.AutoFetchEnabled && checkoutHooksInstalled() {
+		// Hooks will fetch everything in one go after git is done, much faster
+		util.GlobalOptions.AutoFetchEnabled = false
+	}
 	return core.SmudgeFilterWithReaderWriter(os.Stdin, os.Stdout, filename)
 }
+func FilterProcess() int {
+	// Make sure we never write log output to stdout, filter uses it for the protocol
+	util.LogAllConsoleOutputToStdErr()
+	if util.GlobalOptions.AutoFetchEnabled && checkoutHooksInstalled() {
+		// Hooks will fetch everything in one go after git is done
+		util.GlobalOptions.AutoFetchEnabled = false
+	}
+	return core.FilterProcess(os.Stdin, os.Stdout)
+}
 func CleanFilter() int {
 	// Make sure we never write log output to stdout, filter uses it for content
 	util.LogAllConsoleOutputToStdErr()
@@ -48,6 +61,30 @@ Options:
   --dry-run            Don't actually delete anything, just report
 `)
 }
+func FilterProcessHelp() {
+	util.LogConsole(`Usage: git-lob filter-process [options]
+
+  Runs both the smudge and clean filters for many files in a single process,
+  using git's long-running filter process protocol (git 2.11 or later). This
+  is much faster than starting git-lob for every file, and when
+  git-lob.autofetch is enabled, binaries which aren't available locally are
+  fetched in one batch at the end of a checkout (git 2.15 or later) rather
+  than one at a time.
+
+  Not intended to be called directly; configure the filter with:
+
+  [filter "lob"]
+    process = git-lob filter-process
+    required = true
+
+  You can leave the smudge and clean settings in place for older versions of
+  git, newer versions will use process instead.
+
+Options:
+  --quiet, -q          Print less output
+  --verbose, -v        Print more output
+`)
+}
 func CleanFilterHelp() {
 	util.LogConsole(`Usage: git-lob filter-clean [options] <filename>
 
@@ -5,24 +5,57 @@ import (
 	"strings"
 
 	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/providers"
 	"github.com/atlassian/git-lob/util"
 )
 
 // Fsck command line tool
 func Fsck() int {
 
-	// git-lob fsck [--deep] [--shared]
+	// git-lob fsck [--deep] [--shared] [--delete] [--repair [--repair-from=<remote>]]
+	// git-lob fsck --remote <remote> [<ref>...]
 
 	// Validate custom options
-	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{"deep", "d", "shared", "s", "delete", "x"})
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"repair-from", "remote"},
+		[]string{"deep", "d", "shared", "s", "delete", "x", "repair", "r", "remote"})
 	if len(errorList) > 0 {
 		util.LogConsoleError(strings.Join(errorList, "\n"))
 		return 9
 	}
 
+	if util.GlobalOptions.BoolOpts.Contains("remote") || util.GlobalOptions.StringOpts["remote"] != "" {
+		return fsckRemote()
+	}
+
 	optDeep := util.GlobalOptions.BoolOpts.Contains("deep") || util.GlobalOptions.BoolOpts.Contains("d")
 	optShared := util.GlobalOptions.BoolOpts.Contains("shared") || util.GlobalOptions.BoolOpts.Contains("s")
 	optDelete := util.GlobalOptions.BoolOpts.Contains("delete") || util.GlobalOptions.BoolOpts.Contains("x")
+	optRepairFrom := util.GlobalOptions.StringOpts["repair-from"]
+	optRepair := util.GlobalOptions.BoolOpts.Contains("repair") || util.GlobalOptions.BoolOpts.Contains("r") ||
+		optRepairFrom != ""
+	if optRepair {
+		// Bad files have to be removed before they can be fetched again
+		optDelete = true
+	}
+
+	var provider providers.SyncProvider
+	if optRepair {
+		// Check the remote before doing anything, so we don't delete files we can't restore
+		if optRepairFrom == "" {
+			optRepairFrom = core.GetGitDefaultRemoteForPull()
+		}
+		var err error
+		provider, err = providers.GetProviderForRemote(optRepairFrom)
+		if err != nil {
+			util.LogConsoleErrorf("git-lob: %v\n", err)
+			return 6
+		}
+		if err = provider.ValidateConfig(optRepairFrom); err != nil {
+			util.LogConsoleErrorf("git-lob: remote %v has configuration problems:\n%v\n", optRepairFrom, err)
+			return 6
+		}
+		defer provider.Release()
+	}
 
 	if optShared {
 		// Check we have a shared store
@@ -40,16 +73,29 @@ func Fsck() int {
 		shas = util.GlobalOptions.Args
 	}
 
+	// Binaries with problems, in case we're repairing
+	var badSHAs []string
+	badSHASet := util.NewStringSet()
 	callback := func(data *core.FsckCallbackData) (quit bool) {
 		// Ensure we clear previous progress
 		util.LogConsolef("\r")
 		switch data.Type {
+		case core.FsckMissing, core.FsckCorruptData, core.FsckWrongSize:
+			if badSHASet.Add(data.SHA) {
+				badSHAs = append(badSHAs, data.SHA)
+			}
+		}
+		switch data.Type {
 		case core.FsckMissing:
 			util.LogErrorf(" * %v: file is missing, try fetch/prune (%v)\n", data.SHA[:7], data.Desc)
 		case core.FsckCorruptData:
 			util.LogErrorf(" * %v: content is corrupt (deleted: %v)\n", data.SHA[:7], optDelete)
 		case core.FsckWrongSize:
 			util.LogErrorf(" * %v: file is wrong size (%v deleted: %v)\n", data.SHA[:7], data.Desc, optDelete)
+		case core.FsckRepaired:
+			util.LogConsolef(" * %v: restored from %v\n", data.SHA[:7], data.Desc)
+		case core.FsckNotRepaired:
+			util.LogErrorf(" * %v: could not be restored (%v)\n", data.SHA[:7], data.Desc)
 		case core.FsckWorking:
 			// Do nothing, just progress below
 		}
@@ -60,6 +106,19 @@ func Fsck() int {
 	}
 	// Add newlines to messages since progress doesn't
 	err := core.Fsck(optDeep, optShared, optDelete, shas, callback)
+	if err != nil && optRepair && len(badSHAs) > 0 {
+		util.LogConsolef("\nRestoring %d binaries from %v\n", len(badSHAs), optRepairFrom)
+		notRestored := core.FsckRepair(optDeep, optShared, badSHAs, provider, optRepairFrom, callback)
+		if len(notRestored) > 0 {
+			util.LogConsoleErrorf("\n%d binaries could not be restored:\n", len(notRestored))
+			for _, sha := range notRestored {
+				util.LogConsoleError("  ", sha)
+			}
+			return 12
+		}
+		util.LogConsole("\nCompleted successfully, all problems repaired")
+		return 0
+	}
 	if err != nil {
 		util.LogConsoleError("\nError(s) in fsck, see above.")
 		return 12
@@ -68,8 +127,74 @@ func Fsck() int {
 	return 0
 }
 
+// Implementation of 'git-lob fsck --remote'
+func fsckRemote() int {
+	args := util.GlobalOptions.Args
+	remoteName := util.GlobalOptions.StringOpts["remote"]
+	if remoteName == "" {
+		// --remote <name>
+		if len(args) == 0 {
+			util.LogConsoleError("git-lob: --remote requires the name of a remote")
+			return 9
+		}
+		remoteName = args[0]
+		args = args[1:]
+	}
+
+	var refspecs []*core.GitRefSpec
+	for _, arg := range args {
+		r := core.ParseGitRefSpec(arg)
+		if r.RangeOp == "..." {
+			util.LogConsoleError("git-lob: '...' range operator is not supported for fsck, only '..'")
+			return 7
+		}
+		refspecs = append(refspecs, r)
+	}
+	if len(refspecs) == 0 {
+		refspecs = append(refspecs, &core.GitRefSpec{Ref1: "HEAD"})
+	}
+
+	provider, err := providers.GetProviderForRemote(remoteName)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: %v\n", err)
+		return 6
+	}
+	if err = provider.ValidateConfig(remoteName); err != nil {
+		util.LogConsoleErrorf("git-lob: remote %v has configuration problems:\n%v\n", remoteName, err)
+		return 6
+	}
+	defer provider.Release()
+
+	util.LogConsole("Checking binaries for", refspecs, "on", remoteName)
+	callback := func(data *core.FsckCallbackData) (quit bool) {
+		// Ensure we clear previous progress
+		util.LogConsolef("\r")
+		switch data.Type {
+		case core.FsckMissing:
+			util.LogErrorf(" * %v: %v\n", data.SHA[:7], data.Desc)
+		case core.FsckCorruptData:
+			util.LogErrorf(" * %v: content is corrupt on %v\n", data.SHA[:7], remoteName)
+		}
+		util.LogConsoleOverwrite(fmt.Sprintf("Progress: %d%%", data.PercentComplete), 14)
+		return false
+	}
+	verified, err := core.FsckRemote(provider, remoteName, refspecs, callback)
+	if err != nil {
+		util.LogConsoleErrorf("\nError(s) in fsck: %v\n", err.Error())
+		return 12
+	}
+	if verified {
+		util.LogConsole("\nCompleted successfully, all binaries are intact on", remoteName)
+	} else {
+		util.LogConsole("\nCompleted successfully, all binaries are present on", remoteName)
+		util.LogConsole("(this remote can't verify content, only that files are complete & the right size)")
+	}
+	return 0
+}
+
 func FsckHelp() {
 	util.LogConsole(`Usage: git-lob fsck [options] [SHA...]
+       git-lob fsck --remote <remote> [<ref>|<range>...]
 
   Validates that the local binary store is internally consistent. 
 
@@ -90,10 +215,25 @@ func FsckHelp() {
   incorrectly sized chunks, and content where the SHA doesn't agree (only
   checked with the --deep option) are deleted.
 
+  The --repair option goes further, and after deleting invalid files fetches
+  the affected binaries again from a remote, then checks them again. Any which
+  could not be restored (e.g. because the remote doesn't have them either) are
+  listed at the end.
+
+  With --remote, the remote store is checked instead of the local one. Every
+  binary needed to check out the refs given (or the commits in a range) is
+  checked to make sure it's complete on the remote. Smart servers which
+  support it (such as git-lob-serve) also recalculate the SHA of the content,
+  without anything being downloaded; for other remotes only the presence and
+  size of the files can be checked. Use this before deleting your last local
+  copy of something important.
+
   This command doesn't check your working copy, use 'git lob missing' to check
   why a binary file is still a placeholder.
 
 Parameters:
+  <ref>|<range> With --remote, the refs or '..' ranges to check binaries for.
+                Defaults to HEAD.
   SHA...        If you supply one or more 40-character SHA arguments, only
                 those binaries are checked rather than the entire store. The
                 SHA is the identifier of the binary content itself, not a Git
@@ -109,6 +249,13 @@ Options:
                 internally inconsistent; e.g. invalid meta files, partial 
                 chunks, and all files where --deep is used and SHA doesn't 
                 agree with content.
+  --repair, -r  Implies --delete, then re-downloads all binaries which had 
+                problems from the default remote and checks them again.
+  --repair-from=<remote>
+                Like --repair, but downloads from the named remote.
+  --remote <remote>
+                Check the binaries referenced by refs on a remote instead of
+                checking the local store.
   --quiet, -q   Print less output
   --verbose, -v Print more output
 
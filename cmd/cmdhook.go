@@ -0,0 +1,279 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Hooks which git-lob can be called from, with the function implementing each
+var hookMap = map[string]func(args []string, in io.Reader) int{
+	"pre-push":      PrePushHook,
+	"post-checkout": CheckoutHook,
+	"post-merge":    CheckoutHook,
+	"post-rewrite":  PostRewriteHook,
+}
+
+// Hooks which between them fetch binaries whenever git updates the working copy
+var checkoutHooks = []string{"post-checkout", "post-merge", "post-rewrite"}
+
+// Hook command line tool
+func Hook() int {
+
+	// git-lob hook <hook> [<args from git>...]
+	// git-lob hook install [<hook>...]
+
+	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{"force", "f"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	if len(util.GlobalOptions.Args) == 0 {
+		util.LogConsoleError("git-lob: hook requires the name of a hook, or 'install'")
+		return 9
+	}
+
+	hook := util.GlobalOptions.Args[0]
+	if hook == "install" {
+		optForce := util.GlobalOptions.BoolOpts.Contains("force") || util.GlobalOptions.BoolOpts.Contains("f")
+		return installHooks(util.GlobalOptions.Args[1:], optForce)
+	}
+	f, ok := hookMap[hook]
+	if !ok {
+		util.LogConsoleErrorf("git-lob: unsupported hook '%v'\n", hook)
+		return 9
+	}
+	return f(util.GlobalOptions.Args[1:], os.Stdin)
+}
+
+// Marker so we know which hook scripts we wrote & can replace
+const hookScriptMarker = "# Installed by git-lob"
+
+func getHooksDir() string {
+	hooksDir, ok := util.GlobalOptions.GitConfig["core.hookspath"]
+	if !ok {
+		hooksDir = filepath.Join(util.GetGitDir(), "hooks")
+	}
+	return hooksDir
+}
+
+// Whether a hook script calls git-lob for this hook
+func isHookInstalled(hook string) bool {
+	content, err := ioutil.ReadFile(filepath.Join(getHooksDir(), hook))
+	return err == nil && strings.Contains(string(content), fmt.Sprintf("git lob hook %v", hook))
+}
+
+// Whether all the hooks which fetch on checkout are installed, in which case the smudge filter
+// doesn't need to auto-fetch each file
+func checkoutHooksInstalled() bool {
+	for _, hook := range checkoutHooks {
+		if !isHookInstalled(hook) {
+			return false
+		}
+	}
+	return true
+}
+
+// Write scripts into the git hooks folder which call 'git lob hook'
+// Existing hooks which we didn't write are only replaced if force = true
+func installHooks(hooks []string, force bool) int {
+	if len(hooks) == 0 {
+		for hook := range hookMap {
+			hooks = append(hooks, hook)
+		}
+		sort.Strings(hooks)
+	}
+	hooksDir := getHooksDir()
+	err := os.MkdirAll(hooksDir, 0755)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: unable to create %v: %v\n", hooksDir, err.Error())
+		return 14
+	}
+	ret := 0
+	for _, hook := range hooks {
+		if _, ok := hookMap[hook]; !ok {
+			util.LogConsoleErrorf("git-lob: unsupported hook '%v'\n", hook)
+			ret = 9
+			continue
+		}
+		file := filepath.Join(hooksDir, hook)
+		if existing, err := ioutil.ReadFile(file); err == nil &&
+			!strings.Contains(string(existing), hookScriptMarker) && !force {
+			util.LogConsoleErrorf("git-lob: %v already exists, add 'git lob hook %v \"$@\"' to it or use --force\n", file, hook)
+			ret = 14
+			continue
+		}
+		script := fmt.Sprintf("#!/bin/sh\n%v\ngit lob hook %v \"$@\"\n", hookScriptMarker, hook)
+		err = ioutil.WriteFile(file, []byte(script), 0755)
+		if err != nil {
+			util.LogConsoleErrorf("git-lob: unable to write %v: %v\n", file, err.Error())
+			ret = 14
+			continue
+		}
+		util.LogConsole("Installed", hook, "hook")
+	}
+	return ret
+}
+
+// Implementation of the pre-push hook, which pushes binaries for exactly what git is pushing
+// Fails (so git doesn't push) if any binaries can't be pushed
+// args = <remote name> <remote url>, refs on stdin
+func PrePushHook(args []string, in io.Reader) int {
+	if len(args) == 0 {
+		util.LogConsoleError("git-lob: pre-push hook requires the remote name")
+		return 9
+	}
+	remoteName := args[0]
+	refspecs, err := core.ParseGitPrePushRefSpecs(in)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: %v\n", err.Error())
+		return 9
+	}
+	if len(refspecs) == 0 {
+		return 0
+	}
+	if providers.GetProviderNameForRemote(remoteName) == "" {
+		// Not a binary remote (or pushing to a URL), don't get in the way
+		util.LogDebugf("git-lob: %v has no git-lob-provider, not pushing binaries\n", remoteName)
+		return 0
+	}
+
+	provider, err := providers.GetProviderForRemote(remoteName)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: %v\n", err)
+		return 6
+	}
+	defer provider.Release()
+
+	// Check locks first; once binaries are pushed the commits no longer look new
+	if ret := checkLocksForPush(provider, remoteName, refspecs); ret != 0 {
+		return ret
+	}
+
+	util.LogConsole("Pushing binaries for", refspecs, "to", remoteName)
+	pushCounts, pusherr := pushRefSpecsWithProgress(provider, remoteName, refspecs, false, false, false)
+	if pusherr != nil {
+		util.LogErrorf("git-lob: push error(s):\n%v\n", pusherr.Error())
+		util.LogConsoleError("git-lob: binaries could not be pushed, so git push was stopped")
+		return 12
+	}
+	if pushCounts.ErrorCount > 0 || pushCounts.NotFoundCount > 0 {
+		util.LogConsoleError("git-lob: some binaries referenced by these commits could not be pushed (missing locally")
+		util.LogConsoleError("or errors uploading), so git push was stopped. Use 'git lob missing' to investigate.")
+		return 12
+	}
+	return 0
+}
+
+// Stop the push if it changes files someone else has locked
+// Remotes which don't support locking are ignored
+func checkLocksForPush(provider providers.SyncProvider, remoteName string, refspecs []*core.GitRefSpec) int {
+	conflicts, err := core.GetConflictingLocksForPush(provider, remoteName, refspecs)
+	if err != nil {
+		if providers.IsLockingNotSupportedError(err) {
+			util.LogDebugf("git-lob: %v\n", err.Error())
+			return 0
+		}
+		util.LogConsoleErrorf("git-lob: unable to check locks on %v: %v\n", remoteName, err.Error())
+		return 12
+	}
+	if len(conflicts) > 0 {
+		util.LogConsoleError("git-lob: these commits change files which are locked by someone else, so git push was stopped:")
+		for _, lock := range conflicts {
+			util.LogConsoleErrorf("  %v (locked by %v)\n", lock.Path, lock.Owner)
+		}
+		util.LogConsoleError("Ask them to unlock these files, or use 'git lob locks' for details.")
+		return 12
+	}
+	return 0
+}
+
+// Implementation of the post-checkout & post-merge hooks, which fetch everything needed for the
+// new HEAD in one batch (rather than per file in the smudge filter), then fill in the working copy
+// Args are ignored; either way we're interested in the new HEAD
+func CheckoutHook(args []string, in io.Reader) int {
+	remoteName := core.GetGitDefaultRemoteForPull()
+	if providers.GetProviderNameForRemote(remoteName) == "" {
+		// Nowhere to fetch from, but may still have binaries locally
+		util.LogDebugf("git-lob: %v has no git-lob-provider, not fetching binaries\n", remoteName)
+	} else {
+		provider, err := providers.GetProviderForRemote(remoteName)
+		if err != nil {
+			util.LogConsoleErrorf("git-lob: %v\n", err)
+			return 6
+		}
+		var fetcherr error
+		callbackChan := make(chan *util.ProgressCallbackData, 100)
+		go func() {
+			progress := func(data *util.ProgressCallbackData) (abort bool) {
+				callbackChan <- data
+				return false
+			}
+			fetcherr = core.FetchForCommit("HEAD", provider, remoteName, progress)
+			close(callbackChan)
+		}()
+		util.ReportProgressToConsole(callbackChan, "Fetch", time.Millisecond*500)
+		// Because no final newline from report progress
+		util.LogConsole("")
+		provider.Release()
+		if fetcherr != nil {
+			util.LogErrorf("git-lob: fetch error(s):\n%v\n", fetcherr.Error())
+			// Still check out whatever we can
+		}
+	}
+	return checkoutPathspecs(nil, false)
+}
+
+// Implementation of the post-rewrite hook, args = amend|rebase
+func PostRewriteHook(args []string, in io.Reader) int {
+	if len(args) > 0 && args[0] == "amend" {
+		// Working copy hasn't changed
+		return 0
+	}
+	return CheckoutHook(args, in)
+}
+
+func HookHelp() {
+	util.LogConsole(`Usage: git-lob hook <hook> [<args>...]
+       git-lob hook install [--force] [<hook>...]
+
+  Runs git-lob as part of a git hook, or installs hook scripts which do so.
+
+  'git lob hook install' writes scripts to .git/hooks (or core.hooksPath) for
+  all the supported hooks, or just the ones named. Existing hook scripts are
+  not overwritten unless you use --force; you can instead add the line
+  'git lob hook <hook> "$@"' to them yourself.
+
+Supported hooks:
+
+  pre-push      Pushes the binaries for the commits git is about to push, to
+                the same remote. If any binaries can't be pushed (e.g. they're
+                missing locally, or the upload fails) the git push is stopped,
+                so nobody receives commits with binaries they can't fetch.
+                If the remote supports locking, the push is also stopped if
+                it changes files locked by someone else (see 'git lob help
+                lock'). Remotes without a git-lob-provider are ignored.
+  post-checkout, post-merge, post-rewrite
+                After git has updated the working copy, fetches all the
+                binaries needed for the new HEAD (and recent history, see
+                git-lob.fetch-commits-head) from the default remote in one
+                batch, then runs 'git lob checkout'. When all 3 are installed
+                the smudge filter doesn't auto-fetch files one at a time, even
+                if git-lob.autofetch is enabled, since this is much faster.
+
+Options:
+  --force, -f   With install, replace existing hook scripts
+  --quiet, -q   Print less output
+  --verbose, -v Print more output
+
+`)
+}
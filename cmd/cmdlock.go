@@ -0,0 +1,272 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Get the remote to use for locking & a provider for it which supports locking
+// Returns a non-zero exit code on failure (errors already reported)
+func getLockingRemote() (remoteName string, provider providers.SmartSyncProvider, ret int) {
+	remoteName = util.GlobalOptions.StringOpts["remote"]
+	if remoteName == "" {
+		remoteName = core.GetGitDefaultRemoteForPush()
+	}
+	p, err := providers.GetProviderForRemote(remoteName)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: %v\n", err)
+		return remoteName, nil, 6
+	}
+	provider, err = core.GetLockingProvider(p, remoteName)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: %v, it must use a smart provider with a server that supports locking\n", err)
+		p.Release()
+		return remoteName, nil, 6
+	}
+	return remoteName, provider, 0
+}
+
+// Lock command line tool
+func Lock() int {
+
+	// git-lob lock [--remote=<remote>] <file>...
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"remote"}, nil)
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	if len(util.GlobalOptions.Args) == 0 {
+		util.LogConsoleError("git-lob: lock requires at least one file")
+		return 9
+	}
+	remoteName, provider, ret := getLockingRemote()
+	if ret != 0 {
+		return ret
+	}
+	defer provider.Release()
+
+	for _, file := range util.GlobalOptions.Args {
+		path, err := core.GetLockPath(file)
+		if err != nil {
+			util.LogConsoleErrorf("git-lob: %v\n", err.Error())
+			ret = 9
+			continue
+		}
+		ok, lock, err := provider.LockFile(remoteName, path)
+		if err != nil {
+			util.LogConsoleErrorf("git-lob: unable to lock %v: %v\n", path, err.Error())
+			ret = 12
+			continue
+		}
+		if !ok {
+			util.LogConsoleErrorf("%v is already locked by %v (since %v)\n", path, lock.Owner, core.FormatGitDate(lock.LockedAt.Local()))
+			ret = 12
+			continue
+		}
+		util.LogConsole("Locked", path)
+		updateLockCache(remoteName, path, true)
+		warnIfStillReadOnly(remoteName, path)
+	}
+	return ret
+}
+
+// Lockable files are only made writable by locks on the default push remote, since that's
+// where the pre-push hook checks them, so say so if a lock elsewhere leaves one read-only
+func warnIfStillReadOnly(remoteName, path string) {
+	pushRemote := core.GetGitDefaultRemoteForPush()
+	if remoteName == pushRemote {
+		return
+	}
+	lockable, err := core.GetLockableFiles([]string{path})
+	if err != nil || len(lockable) == 0 {
+		return
+	}
+	util.LogConsoleErrorf("Warning: %v stays read-only because it's only made writable by locks on %v\n", path, pushRemote)
+}
+
+// Record a lock we took or released locally, and make the file writable or read-only if lockable
+func updateLockCache(remoteName, path string, locked bool) {
+	var err error
+	if locked {
+		err = core.AddCachedLock(remoteName, path)
+	} else {
+		err = core.RemoveCachedLock(remoteName, path)
+	}
+	if err == nil {
+		_, err = core.UpdateLockableFilePermissions([]string{path})
+	}
+	if err != nil {
+		util.LogErrorf("git-lob: unable to update local lock state for %v: %v\n", path, err.Error())
+	}
+}
+
+// Unlock command line tool
+func Unlock() int {
+
+	// git-lob unlock [--remote=<remote>] [--force] <file>...
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"remote"}, []string{"force", "f"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	if len(util.GlobalOptions.Args) == 0 {
+		util.LogConsoleError("git-lob: unlock requires at least one file")
+		return 9
+	}
+	optForce := util.GlobalOptions.BoolOpts.Contains("force") || util.GlobalOptions.BoolOpts.Contains("f")
+	remoteName, provider, ret := getLockingRemote()
+	if ret != 0 {
+		return ret
+	}
+	defer provider.Release()
+
+	for _, file := range util.GlobalOptions.Args {
+		path, err := core.GetLockPath(file)
+		if err != nil {
+			util.LogConsoleErrorf("git-lob: %v\n", err.Error())
+			ret = 9
+			continue
+		}
+		ok, lock, err := provider.UnlockFile(remoteName, path, optForce)
+		if err != nil {
+			util.LogConsoleErrorf("git-lob: unable to unlock %v: %v\n", path, err.Error())
+			ret = 12
+			continue
+		}
+		if !ok {
+			util.LogConsoleErrorf("%v is locked by %v, use --force to release someone else's lock\n", path, lock.Owner)
+			ret = 12
+			continue
+		}
+		updateLockCache(remoteName, path, false)
+		if lock == nil {
+			util.LogConsole(path, "was not locked")
+		} else if optForce {
+			util.LogConsolef("Unlocked %v (was locked by %v)\n", path, lock.Owner)
+		} else {
+			util.LogConsole("Unlocked", path)
+		}
+	}
+	return ret
+}
+
+// Locks command line tool
+func Locks() int {
+
+	// git-lob locks [--remote=<remote>] [--mine]
+
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"remote"}, []string{"mine", "m"})
+	if len(errorList) > 0 {
+		util.LogConsoleError(strings.Join(errorList, "\n"))
+		return 9
+	}
+	optMine := util.GlobalOptions.BoolOpts.Contains("mine") || util.GlobalOptions.BoolOpts.Contains("m")
+	remoteName, provider, ret := getLockingRemote()
+	if ret != 0 {
+		return ret
+	}
+	defer provider.Release()
+
+	locks, owner, err := provider.ListLocks(remoteName)
+	if err != nil {
+		util.LogConsoleErrorf("git-lob: unable to list locks on %v: %v\n", remoteName, err.Error())
+		return 12
+	}
+	refreshLockCache(remoteName, owner, locks)
+	count := 0
+	for _, lock := range locks {
+		if optMine && lock.Owner != owner {
+			continue
+		}
+		util.LogConsolef("%v\t%v\t%v\n", lock.Path, lock.Owner, core.FormatGitDate(lock.LockedAt.Local()))
+		count++
+	}
+	if count == 0 {
+		util.LogConsole("No files are locked on", remoteName)
+	}
+	return 0
+}
+
+// Replace the local record of which locks we hold with what the server says, in case they
+// were taken or released elsewhere, and update the permissions of lockable files to match
+func refreshLockCache(remoteName, owner string, locks []*providers.FileLock) {
+	files := core.GetCachedLocks(remoteName)
+	var mine []string
+	for _, lock := range locks {
+		if lock.Owner == owner {
+			mine = append(mine, lock.Path)
+		}
+	}
+	err := core.WriteCachedLocks(remoteName, mine)
+	if err == nil {
+		_, err = core.UpdateLockableFilePermissions(append(files, mine...))
+	}
+	if err != nil {
+		util.LogErrorf("git-lob: unable to update local lock state: %v\n", err.Error())
+	}
+}
+
+func LockHelp() {
+	util.LogConsole(`Usage: git-lob lock [options] <file>...
+
+  Locks files on the remote, to tell everyone else that you're editing them.
+  Binary files can't be merged, so this stops two people making changes to
+  the same file at once. Other people can still edit the file locally, but
+  the git-lob pre-push hook won't let them push changes to it until you've
+  unlocked it (see 'git lob help hook').
+
+  Locks belong to whoever the server authenticates you as (e.g. your SSH
+  login), not your git config. Locking is only available on remotes with a
+  smart provider whose server supports it, such as git-lob-serve.
+
+  Files with the 'lockable' attribute in .gitattributes are kept read-only in
+  the working copy unless you hold the lock on them on the default push
+  remote; locking a file there makes it writable, but locking it on another
+  remote with --remote doesn't. Which locks you hold is recorded locally, so
+  this works offline; 'git lob locks' refreshes the record.
+
+Options:
+  --remote=<remote>   Lock on this remote instead of the default push remote
+  --quiet, -q         Print less output
+  --verbose, -v       Print more output
+
+`)
+}
+
+func UnlockHelp() {
+	util.LogConsole(`Usage: git-lob unlock [options] <file>...
+
+  Releases locks you hold on files (see 'git lob help lock'). You'll usually
+  do this once you've pushed your changes. Lockable files become read-only.
+
+Options:
+  --remote=<remote>   Unlock on this remote instead of the default push remote
+  --force, -f         Release the lock even if someone else holds it; the
+                      server may only allow this for administrators
+  --quiet, -q         Print less output
+  --verbose, -v       Print more output
+
+`)
+}
+
+func LocksHelp() {
+	util.LogConsole(`Usage: git-lob locks [options]
+
+  Lists the files which are locked on the remote, who locked them & when.
+  Also updates the local record of which locks you hold, in case you took or
+  released them elsewhere, and makes lockable files writable or read-only to
+  match.
+
+Options:
+  --remote=<remote>   List locks on this remote instead of the default push remote
+  --mine, -m          Only list your own locks
+  --quiet, -q         Print less output
+  --verbose, -v       Print more output
+
+`)
+}
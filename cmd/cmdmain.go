@@ -91,6 +91,12 @@ func MainImpl() int {
 			return 0
 		}
 		return SmudgeFilter()
+	case "filter-process":
+		if util.GlobalOptions.HelpRequested {
+			FilterProcessHelp()
+			return 0
+		}
+		return FilterProcess()
 	case "filter-clean":
 		if util.GlobalOptions.HelpRequested {
 			CleanFilterHelp()
@@ -103,6 +109,30 @@ func MainImpl() int {
 			return 0
 		}
 		return Fsck()
+	case "hook":
+		if util.GlobalOptions.HelpRequested {
+			HookHelp()
+			return 0
+		}
+		return Hook()
+	case "lock":
+		if util.GlobalOptions.HelpRequested {
+			LockHelp()
+			return 0
+		}
+		return Lock()
+	case "unlock":
+		if util.GlobalOptions.HelpRequested {
+			UnlockHelp()
+			return 0
+		}
+		return Unlock()
+	case "locks":
+		if util.GlobalOptions.HelpRequested {
+			LocksHelp()
+			return 0
+		}
+		return Locks()
 	case "help":
 		// Support help as a command since 'git lob --help' uses git's help system
 		// You have to use "git-lob --help" otherwise
@@ -32,11 +32,14 @@ var pruneCallbackImpl = func(t core.PruneCallbackType, lobsha string) {
 }
 
 func Prune() int {
-	errorList := validateCustomOptions(util.GlobalOptions, nil, []string{"unreferenced", "u", "safe", "k"})
+	errorList := validateCustomOptions(util.GlobalOptions, []string{"profile"}, []string{"unreferenced", "u", "safe", "k"})
 	if len(errorList) > 0 {
 		util.LogConsoleError(strings.Join(errorList, "\n"))
 		return 9
 	}
+	if ret := applyFetchProfileOption(); ret != 0 {
+		return ret
+	}
 
 	optOnlyUnreferenced := util.GlobalOptions.BoolOpts.Contains("unreferenced") || util.GlobalOptions.BoolOpts.Contains("u")
 	optSafeMode := util.GlobalOptions.BoolOpts.Contains("safe") || util.GlobalOptions.BoolOpts.Contains("k")
@@ -147,6 +150,8 @@ Options:
                        doubly verify with the remote that it has a copy
                        Also see git-lob.prune-safe config setting
   --unreferenced, -u   Only prune totally unreferenced binaries, not old ones
+  --profile=<name>     Only retain recent binaries in this fetch profile's
+                       paths (see 'git lob help fetch')
   --quiet, -q          Print less output
   --verbose, -v        Print more output
   --dry-run            Don't actually delete anything, just report
@@ -162,6 +167,18 @@ REACHABLE COMMITS & THE RETENTION PERIOD
     * They're used by other commits on those branches within 
       git-lob.retention-period-other days of the branch's last commit date
 
+  If a fetch profile is in use (--profile or git-lob.fetch-profile), only
+  binaries at the profile's paths are retained because they're recent, since
+  those are all fetch would download again. git-lob.fetch-include /
+  fetch-exclude on their own don't affect pruning, so binaries you fetched
+  outside those paths (e.g. with fetch-lob) are kept like any others.
+  Unpushed binaries are always retained.
+
+  The lob-fetch and lob-retain attributes in .gitattributes also apply: files
+  with lob-fetch=never aren't retained by date, lob-fetch=always files are
+  regardless of paths, and lob-retain=<days> replaces the retention period
+  for prior versions of matching files. See 'git lob help fetch'.
+
   See 'git lob help config' for a summary of these settings & their defaults, 
   in the 'prune' section.
 
@@ -116,6 +116,35 @@ func Push() int {
 		util.LogConsole("No cached state for this remote, first time may take a while on large repos")
 	}
 
+	pushCounts, pusherr := pushRefSpecsWithProgress(provider, remoteName, refspecs, optDryRun, optForce, optRecheck)
+
+	if pusherr != nil {
+		util.LogErrorf("git-lob: push error(s):\n%v\n", pusherr.Error())
+		return 12
+	}
+	if util.GlobalOptions.DryRun {
+		util.LogConsole("Done, run again without --dry-run to perform real push")
+	} else {
+		// Because no newlines in progress reporting
+		if pushCounts.ErrorCount > 0 {
+			util.LogConsole("WARNING: non-fatal errors were encountered, not all data was pushed.")
+		} else if pushCounts.NotFoundCount > 0 {
+			util.LogConsole("WARNING: some binaries referred to by commits to push were not found locally")
+			util.LogConsole("Push will re-try these next time.")
+		} else {
+			util.LogConsole("Successfully pushed binaries to", remoteName)
+		}
+	}
+	provider.Release()
+
+	return 0
+}
+
+// Push binaries for refspecs, reporting progress to the console
+// Returns what happened and any fatal error
+func pushRefSpecsWithProgress(provider providers.SyncProvider, remoteName string, refspecs []*core.GitRefSpec,
+	optDryRun, optForce, optRecheck bool) (*util.ProgressResults, error) {
+
 	// Do the actual pushing in Goroutine, because we want to update the download rate & time estimates
 	// on a regular schedule, regardless of whether any actual callbacks are received
 	// If we only updated when callbacks happened (ie when data was transferred), if the data transfer halts
@@ -149,26 +178,7 @@ func Push() int {
 	// (or zero callbacks, so we can reduce xfer rate)
 	pushCounts := util.ReportProgressToConsole(callbackChan, "Push", time.Millisecond*500)
 
-	if pusherr != nil {
-		util.LogErrorf("git-lob: push error(s):\n%v\n", pusherr.Error())
-		return 12
-	}
-	if util.GlobalOptions.DryRun {
-		util.LogConsole("Done, run again without --dry-run to perform real push")
-	} else {
-		// Because no newlines in progress reporting
-		if pushCounts.ErrorCount > 0 {
-			util.LogConsole("WARNING: non-fatal errors were encountered, not all data was pushed.")
-		} else if pushCounts.NotFoundCount > 0 {
-			util.LogConsole("WARNING: some binaries referred to by commits to push were not found locally")
-			util.LogConsole("Push will re-try these next time.")
-		} else {
-			util.LogConsole("Successfully pushed binaries to", remoteName)
-		}
-	}
-	provider.Release()
-
-	return 0
+	return pushCounts, pusherr
 }
 
 // Low level push command line tool
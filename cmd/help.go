@@ -28,6 +28,10 @@ var helpTopicMap = map[string]func(){
 	"prune":     PruneHelp,
 	"fsck":      FsckHelp,
 	"missing":   MissingHelp,
+	"hook":      HookHelp,
+	"lock":      LockHelp,
+	"unlock":    UnlockHelp,
+	"locks":     LocksHelp,
 }
 
 func Help() {
@@ -90,6 +94,8 @@ Checkout settings:
 
   git-lob.autofetch  Automatically download binaries required on checkout if
                      they're not already present in the binary store
+                     Installing the checkout hooks (see 'git lob help hook')
+                     is a faster alternative, since it fetches in one batch
 
 Fetch settings:
 
@@ -107,6 +113,18 @@ Fetch settings:
                                just like gitignore.
   git-lob.fetch-exclude        Do not fetch matching paths. Same comma
                                separator & wildcard rules as above
+  git-lob.profile.<name>.include
+  git-lob.profile.<name>.exclude
+                               Define a named fetch profile, with its own
+                               include & exclude paths as above
+  git-lob.fetch-profile        The fetch profile to use by default instead of
+                               fetch-include & fetch-exclude, e.g. in your
+                               global config. See 'git lob help fetch'
+  git-lob.fetch-max-size       Binaries larger than this (e.g. 2GB) are not
+                               downloaded by fetch or auto-fetch, and are
+                               left as placeholders. Use fetch --max-size=0 or
+                               'git lob fetch-lob' to get them.
+                               Default unlimited
   git-lob.fetch-delta-size     The file size above which git-lob will try to
                                download deltas between versions instead of
                                the entire file (smart servers only)
@@ -119,6 +137,15 @@ Push settings:
                                the entire file (smart servers only)
                                Default 1MB
 
+Transfer settings:
+
+  git-lob.max-upload-rate      Maximum total upload rate, per second, across
+                               all files being transferred, e.g. 500k or 2MB.
+                               Default unlimited
+  git-lob.max-download-rate    Maximum total download rate, per second, as
+                               above. Also applies to background autofetches.
+                               Default unlimited
+
 Remote settings:
   These settings are stored underneath the regular remote configuration in git.
 
@@ -128,6 +155,11 @@ Remote settings:
   Each provider will require other configuration options to fully specify the
   location. Run 'git lob help remotes' for more details.
 
+  git-lob.retries                 The number of times to retry transfers which
+                                  fail for transient reasons, such as a dropped
+                                  connection. Default 3. Can be overridden per
+                                  remote with remote.<name>.git-lob-retries
+
 Prune settings:
 
   git-lob.retention-period-refs  Period for which binaries on branches other 
@@ -241,11 +273,18 @@ Commands:
   checkout            Check the working copy and fill in any binary content
                       that's missing
   pull                Perform 'fetch' then 'checkout'
+  lock <file>         Lock files on a remote so others can't push changes
+  unlock <file>       Release locks on files
+  locks               List locked files on a remote
 
   filter-smudge       Execute the git smudge filter (when checking out)
                       This should be set up in .gitattributes
   filter-clean        Execute the git clean filter (when adding/committing)
                       This should be set up in .gitattributes
+  filter-process      Execute both filters for many files in one process
+                      (git 2.11+), set up as filter.lob.process
+  hook <hook>         Run git-lob from a git hook, e.g. pre-push
+  hook install        Install git hooks which call git-lob
 
   listproviders       List the available remote providers
   provider <name>     Print detail about named provider
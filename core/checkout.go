@@ -105,6 +105,19 @@ func Checkout(pathspecs []string, dryRun bool, callback CheckoutCallback) error
 
 	}
 
+	if !dryRun {
+		// Lockable files are read-only unless we hold the lock
+		var filenames []string
+		for _, filelob := range filelobs {
+			filenames = append(filenames, filelob.Filename)
+		}
+		changed, err := UpdateLockableFilePermissions(filenames)
+		if err != nil {
+			util.LogErrorf("Unable to update permissions of lockable files: %v\n", err.Error())
+		}
+		modifiedfiles = append(modifiedfiles, changed...)
+	}
+
 	var retErr error
 	if len(modifiedfiles) > 0 {
 		// Modifying files, even to a state that would show as unmodified in 'git diff' (because our filters
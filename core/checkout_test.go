@@ -333,6 +333,23 @@ var _ = Describe("Checkout", func() {
 		Expect(filesFailed).To(BeEquivalentTo(0), "No files should have failed")
 
 	})
+	It("Checks out all files without pathspecs regardless of fetch paths", func() {
+		var filesDone int
+		testCallback := func(t ProgressCallbackType, filelob *FileLOB, err error) {
+			if t == ProgressTransferBytes {
+				filesDone++
+			}
+		}
+		// Binaries outside the fetch paths may have been fetched some other way (e.g. fetch-lob)
+		GlobalOptions.GitConfig["git-lob.profile.nested.include"] = "some/folder/nested,file1.dat"
+		defer func() { GlobalOptions = NewOptions() }()
+		err := ApplyFetchProfile(GlobalOptions, "nested")
+		Expect(err).To(BeNil(), "Shouldn't fail applying profile")
+		GlobalOptions.FetchExcludePaths = []string{"second"}
+		err = Checkout(nil, false, testCallback)
+		Expect(err).To(BeNil(), "Shouldn't fail calling checkout")
+		Expect(filesDone).To(BeEquivalentTo(len(filenames)), "All files should be updated")
+	})
 	Describe("Changed working dir", func() {
 		BeforeEach(func() {
 			// Change to a subfolder
@@ -32,8 +32,7 @@ func Fetch(provider providers.SyncProvider, remoteName string, refspecs []*GitRe
 				int64(0), int64(1), 0, 0})
 		}
 		// Get HEAD LOBs first
-		headfilelobs, earliestCommit, err := GetGitAllFileLOBsToCheckoutAtCommitAndRecent("HEAD", util.GlobalOptions.FetchCommitsPeriodHEAD,
-			util.GlobalOptions.FetchIncludePaths, util.GlobalOptions.FetchExcludePaths)
+		headfilelobs, earliestCommit, err := getFileLOBsToFetchAtCommitAndRecent("HEAD", util.GlobalOptions.FetchCommitsPeriodHEAD)
 		if err != nil {
 			return errors.New(fmt.Sprintf("Error determining recent HEAD commits: %v", err.Error()))
 		}
@@ -65,8 +64,7 @@ func Fetch(provider providers.SyncProvider, remoteName string, refspecs []*GitRe
 				}
 				refSHAsDone.Add(ref.CommitSHA)
 
-				recentreflobs, earliestCommit, err := GetGitAllFileLOBsToCheckoutAtCommitAndRecent(ref.Name, util.GlobalOptions.FetchCommitsPeriodOther,
-					util.GlobalOptions.FetchIncludePaths, util.GlobalOptions.FetchExcludePaths)
+				recentreflobs, earliestCommit, err := getFileLOBsToFetchAtCommitAndRecent(ref.Name, util.GlobalOptions.FetchCommitsPeriodOther)
 				if err != nil {
 					return errors.New(fmt.Sprintf("Error determining recent commits on %v: %v", ref, err.Error()))
 				}
@@ -87,7 +85,10 @@ func Fetch(provider providers.SyncProvider, remoteName string, refspecs []*GitRe
 				callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("Calculating data to fetch for %v", refspec),
 					int64(i), int64(len(refspecs)), 0, 0})
 			}
-			reffileshas, err := GetGitAllFilesAndLOBsToCheckoutInRefSpec(refspec, util.GlobalOptions.FetchIncludePaths, util.GlobalOptions.FetchExcludePaths)
+			reffileshas, err := GetGitAllFilesAndLOBsToCheckoutInRefSpec(refspec, nil, nil)
+			if err == nil {
+				reffileshas, err = FilterFileLOBsToFetch(reffileshas)
+			}
 			if err != nil {
 				return errors.New(fmt.Sprintf("Error determining LOBs to fetch for %v: %v", refspec, err.Error()))
 			}
@@ -189,7 +190,7 @@ func Fetch(provider providers.SyncProvider, remoteName string, refspecs []*GitRe
 				return callback(data)
 			}
 
-			err := fetchLOBs(lobsToDownload, provider, remoteName, force, fetchCallback)
+			err := fetchLOBs(lobsToDownload, provider, remoteName, force, util.GlobalOptions.FetchMaxSize, fetchCallback)
 			if err != nil {
 				return err
 			}
@@ -216,8 +217,23 @@ func Fetch(provider providers.SyncProvider, remoteName string, refspecs []*GitRe
 
 }
 
+// Get the file LOBs to check out at a commit & those changed in recent history before it
+// (see GetGitAllFileLOBsToCheckoutAtCommitAndRecent) which should be fetched, according to
+// the fetch include/exclude paths & lob-fetch attributes (see LOBPolicy)
+func getFileLOBsToFetchAtCommitAndRecent(commit string, days int) ([]*FileLOB, string, error) {
+	// Don't filter paths yet, lob-fetch=always can override them
+	filelobs, earliestCommit, err := GetGitAllFileLOBsToCheckoutAtCommitAndRecent(commit, days, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	filelobs, err = FilterFileLOBsToFetch(filelobs)
+	return filelobs, earliestCommit, err
+}
+
 // Internal method for fetching
-func fetchLOBs(lobshas map[string]string, provider providers.SyncProvider, remoteName string, force bool, callback util.ProgressCallback) error {
+// LOBs larger than maxSize (if > 0) are left missing, only their metadata is downloaded
+func fetchLOBs(lobshas map[string]string, provider providers.SyncProvider, remoteName string, force bool,
+	maxSize int64, callback util.ProgressCallback) error {
 	// Download metafiles first
 	// This will allow us to estimate the time required
 	callback(&util.ProgressCallbackData{util.ProgressCalculate, "Downloading metadata",
@@ -234,6 +250,8 @@ func fetchLOBs(lobshas map[string]string, provider providers.SyncProvider, remot
 	var deltas []*LOBDelta
 	var deltaTotalBytes int64
 	var deltaSavings int64
+	var tooLargeCount int
+	var tooLargeBytes int64
 	smartProvider := providers.UpgradeToSmartSyncProvider(provider)
 
 	callback(&util.ProgressCallbackData{util.ProgressCalculate, "Calculating content files to download",
@@ -248,6 +266,12 @@ func fetchLOBs(lobshas map[string]string, provider providers.SyncProvider, remot
 			// We notified earlier
 			continue
 		}
+		if maxSize > 0 && info.Size > maxSize {
+			util.LogDebugf("Not fetching %v (%v) because it's larger than %v\n", sha, util.FormatSize(info.Size), util.FormatSize(maxSize))
+			tooLargeCount++
+			tooLargeBytes += info.Size
+			continue
+		}
 		// If this is a smart provider, try to download deltas where appropriate
 		if info.Size > util.GlobalOptions.FetchDeltasAboveSize && smartProvider != nil {
 			// This doesn't download, just prepares and gets size
@@ -267,6 +291,10 @@ func fetchLOBs(lobshas map[string]string, provider providers.SyncProvider, remot
 			files = append(files, GetLOBChunkRelativePath(sha, i))
 		}
 	}
+	if tooLargeCount > 0 {
+		callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("Skipping %d binaries larger than %v (%v in total)",
+			tooLargeCount, util.FormatSize(maxSize), util.FormatSize(tooLargeBytes)), 0, 0, 0, 0})
+	}
 	totalBytes := filesTotalBytes + deltaTotalBytes
 	callback(&util.ProgressCallbackData{util.ProgressCalculate, fmt.Sprintf("Metadata done, downloading content (%v)", util.FormatSize(totalBytes)),
 		0, 0, 0, 0})
@@ -340,7 +368,10 @@ func fetchMetadata(lobshas map[string]string, provider providers.SyncProvider, r
 	var metafilesDone int
 	metacallback := func(fileInProgress string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
 		// Don't bother to track partial completion, only 100 bytes each
-		if progressType == util.ProgressSkip || progressType == util.ProgressNotFound {
+		if progressType == util.ProgressRetry {
+			callback(&util.ProgressCallbackData{progressType, fileInProgress, 0, totalBytes,
+				int64(metafilesDone * ApproximateMetadataSize), metaTotalBytes})
+		} else if progressType == util.ProgressSkip || progressType == util.ProgressNotFound {
 			metafilesDone++
 			callback(&util.ProgressCallbackData{progressType, fileInProgress, totalBytes, totalBytes,
 				int64(metafilesDone * ApproximateMetadataSize), metaTotalBytes})
@@ -404,6 +435,11 @@ func fetchContentFiles(files []string, filesTotalBytes int64, provider providers
 	var bytesFromFilesDoneSoFar int64
 	contentcallback := func(fileInProgress string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
 
+		if progressType == util.ProgressRetry {
+			// File will start again, just report it
+			return callback(&util.ProgressCallbackData{progressType, fileInProgress, 0, totalBytes,
+				bytesFromFilesDoneSoFar, filesTotalBytes})
+		}
 		var ret bool
 		if lastFilename != fileInProgress && lastFilename != "" {
 			// we obviously never got a 100% call for previous file
@@ -562,24 +598,63 @@ func fetchSingleDelta(delta *LOBDelta, bytesSoFar int64, deltaTotalBytes int64,
 // Fetch the files required for a single LOB
 func FetchSingle(lobsha string, provider providers.SyncProvider, remoteName string, force bool, callback util.ProgressCallback) error {
 
-	var lobToDownload map[string]string
+	lobToDownload := make(map[string]string)
 	if force || IsLOBMissing(lobsha, false) {
 		// We don't know the filename, this is forced
 		lobToDownload[lobsha] = ""
 	}
 
 	if len(lobToDownload) > 0 {
-		return fetchLOBs(lobToDownload, provider, remoteName, force, callback)
+		// Explicitly requested so fetch regardless of size
+		return fetchLOBs(lobToDownload, provider, remoteName, force, 0, callback)
 	} else {
 		return nil
 	}
 }
 
+// Fetch the binaries needed to check out a commit, plus those changed in recent history before it
+// (git-lob.fetch-commits-head), which are missing locally, all in a single batch
+// This is used by the checkout hooks after git has updated the working copy, which is much
+// more efficient than auto-fetching each file separately in the smudge filter
+func FetchForCommit(commit string, provider providers.SyncProvider, remoteName string, callback util.ProgressCallback) error {
+	filelobs, _, err := getFileLOBsToFetchAtCommitAndRecent(commit, util.GlobalOptions.FetchCommitsPeriodHEAD)
+	if err != nil {
+		return fmt.Errorf("Error determining binaries needed for %v: %v", commit, err.Error())
+	}
+	lobsToDownload := make(map[string]string)
+	checked := util.NewStringSet()
+	for _, filelob := range filelobs {
+		if checked.Add(filelob.SHA) && IsLOBMissing(filelob.SHA, false) {
+			lobsToDownload[filelob.SHA] = filelob.Filename
+		}
+	}
+	if len(lobsToDownload) == 0 {
+		return nil
+	}
+	return fetchLOBs(lobsToDownload, provider, remoteName, false, util.GlobalOptions.FetchMaxSize, callback)
+}
+
 // Auto-fetch a single LOB from the default locations
 // If the required files are not found this won't cause an error
 func AutoFetch(lobsha string, reportProgress bool) error {
+	return AutoFetchLOBs(map[string]string{lobsha: ""}, reportProgress)
+}
+
+// Auto-fetch many LOBs in a single batch from the default locations
+// lobs = map of LOB SHA to filename (for deltas, may be blank); only those missing are fetched
+// If the required files are not found this won't cause an error
+func AutoFetchLOBs(lobs map[string]string, reportProgress bool) error {
+	lobsToDownload := make(map[string]string)
+	for lobsha, filename := range lobs {
+		if IsLOBMissing(lobsha, false) {
+			lobsToDownload[lobsha] = filename
+		}
+	}
+	if len(lobsToDownload) == 0 {
+		return nil
+	}
 	remoteName := GetGitDefaultRemoteForPull()
-	util.LogDebugf("Trying to auto-fetch %v from %v\n", lobsha, remoteName)
+	util.LogDebugf("Trying to auto-fetch %d binaries from %v\n", len(lobsToDownload), remoteName)
 	// check the remote config to make sure it's valid
 	provider, err := providers.GetProviderForRemote(remoteName)
 	if err != nil {
@@ -594,7 +669,7 @@ func AutoFetch(lobsha string, reportProgress bool) error {
 		// We need to run this in a goroutine to report progress deterministically
 		// 100 items in the queue should be good enough, this means that it won't block
 		callbackChan := make(chan *util.ProgressCallbackData, 100)
-		go func(lobsha string, provider providers.SyncProvider, remoteName string, progresschan chan<- *util.ProgressCallbackData) {
+		go func(provider providers.SyncProvider, remoteName string, progresschan chan<- *util.ProgressCallbackData) {
 
 			// Progress callback just passes the result back to the channel
 			progress := func(data *util.ProgressCallbackData) (abort bool) {
@@ -603,7 +678,7 @@ func AutoFetch(lobsha string, reportProgress bool) error {
 				return false
 			}
 
-			err := FetchSingle(lobsha, provider, remoteName, false, progress)
+			err := fetchLOBs(lobsToDownload, provider, remoteName, false, util.GlobalOptions.FetchMaxSize, progress)
 
 			close(progresschan)
 
@@ -611,7 +686,7 @@ func AutoFetch(lobsha string, reportProgress bool) error {
 				fetcherr = err
 			}
 
-		}(lobsha, provider, remoteName, callbackChan)
+		}(provider, remoteName, callbackChan)
 
 		// Report progress on operation every 0.5s
 		util.ReportProgressToConsole(callbackChan, "Fetch", time.Millisecond*500)
@@ -619,13 +694,14 @@ func AutoFetch(lobsha string, reportProgress bool) error {
 		util.LogConsole("")
 	} else {
 		// no progress, just do it
-		fetcherr = FetchSingle(lobsha, provider, remoteName, false, func(data *util.ProgressCallbackData) (abort bool) { return false })
+		fetcherr = fetchLOBs(lobsToDownload, provider, remoteName, false, util.GlobalOptions.FetchMaxSize,
+			func(data *util.ProgressCallbackData) (abort bool) { return false })
 	}
 
 	if fetcherr == nil {
-		util.LogDebugf("Successfully fetched %v from %v\n", lobsha, remoteName)
+		util.LogDebugf("Successfully fetched %d binaries from %v\n", len(lobsToDownload), remoteName)
 	} else {
-		util.LogDebugf("Failed to auto fetch %v from %v: %v\n", lobsha, remoteName, fetcherr)
+		util.LogDebugf("Failed to auto fetch %d binaries from %v: %v\n", len(lobsToDownload), remoteName, fetcherr)
 	}
 
 	return fetcherr
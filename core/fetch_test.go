@@ -35,6 +35,10 @@ var _ = Describe("Fetch", func() {
 			CreateGitRepoForTest(root)
 			oldwd, _ = os.Getwd()
 			os.Chdir(root)
+			lobshas = nil
+			correctLOBsMaster = nil
+			correctLOBsFeature1 = nil
+			correctLOBsFeature2 = nil
 
 			defaultOptions := NewOptions()
 
@@ -311,6 +315,48 @@ var _ = Describe("Fetch", func() {
 
 		})
 
+		It("Fetches everything needed for a commit in one batch", func() {
+			provider, err := GetProviderForRemote("origin")
+			Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
+			var filesTransferred int
+			callback := func(data *ProgressCallbackData) (abort bool) {
+				if data.Type == ProgressTransferBytes && data.ItemBytesDone == data.ItemBytes {
+					filesTransferred++
+				}
+				return false
+			}
+			err = FetchForCommit("HEAD", provider, "origin", callback)
+			Expect(err).To(BeNil(), "Should be no error fetching")
+			CheckLOBsExistForTest(correctLOBsMaster, GetLocalLOBRoot())
+			Expect(FileExists(GetLocalLOBMetaPath(lobshas[9]))).To(BeFalse(), "Should not fetch for other branches")
+
+			filesTransferred = 0
+			err = FetchForCommit("HEAD", provider, "origin", callback)
+			Expect(err).To(BeNil(), "Should be no error fetching")
+			Expect(filesTransferred).To(BeZero(), "Should not fetch anything already present")
+		})
+
+		It("Skips binaries larger than the max size unless requested", func() {
+			provider, err := GetProviderForRemote("origin")
+			Expect(err).To(BeNil(), "Shouldn't be an issue getting provider")
+			callback := func(data *ProgressCallbackData) (abort bool) { return false }
+			// All test files are 300 bytes
+			GlobalOptions.FetchMaxSize = 299
+			err = Fetch(provider, "origin", []*GitRefSpec{}, false, false, callback)
+			Expect(err).To(BeNil(), "Should be no error fetching")
+			for _, sha := range correctLOBsMaster {
+				Expect(FileExists(GetLocalLOBMetaPath(sha))).To(BeTrue(), "Metadata should still be fetched")
+				Expect(IsLOBMissing(sha, false)).To(BeTrue(), "Content should not be fetched")
+			}
+			err = FetchSingle(correctLOBsMaster[0], provider, "origin", false, callback)
+			Expect(err).To(BeNil(), "Should be no error fetching")
+			Expect(IsLOBMissing(correctLOBsMaster[0], false)).To(BeFalse(), "Explicitly requested binary should be fetched")
+
+			GlobalOptions.FetchMaxSize = 300
+			err = FetchForCommit("HEAD", provider, "origin", callback)
+			Expect(err).To(BeNil(), "Should be no error fetching")
+			CheckLOBsExistForTest(correctLOBsMaster, GetLocalLOBRoot())
+		})
 	})
 
 	Context("Fetch effects on push state", func() {
@@ -757,6 +803,9 @@ func (self *DummyFetchTransport) MetadataExists(lobsha string) (ex bool, sz int6
 	meta, ok := self.MetaContentMap[lobsha]
 	return ok, int64(len(meta)), nil
 }
+func (self *DummyFetchTransport) FilesExist(queries []smart.FileExistsRequest) ([]smart.FileExistsResponse, error) {
+	return filesExistForTest(self, queries)
+}
 func (*DummyFetchTransport) ChunkExists(lobsha string, chunk int) (ex bool, sz int64, e error) {
 	// We don't need this
 	return true, 0, nil
@@ -769,6 +818,22 @@ func (*DummyFetchTransport) LOBExists(lobsha string) (ex bool, sz int64, e error
 	// We don't need this
 	return true, 0, nil
 }
+func (*DummyFetchTransport) VerifyLOB(lobsha string) (ex bool, valid bool, e error) {
+	// We don't need this
+	return true, true, nil
+}
+func (*DummyFetchTransport) LockFile(path string) (ok bool, lock *FileLock, e error) {
+	// We don't need this
+	return false, nil, NewLockingNotSupportedError("origin")
+}
+func (*DummyFetchTransport) UnlockFile(path string, force bool) (ok bool, lock *FileLock, e error) {
+	// We don't need this
+	return false, nil, NewLockingNotSupportedError("origin")
+}
+func (*DummyFetchTransport) ListLocks() ([]*FileLock, string, error) {
+	// We don't need this
+	return nil, "", NewLockingNotSupportedError("origin")
+}
 func (*DummyFetchTransport) UploadMetadata(lobsha string, sz int64, data io.Reader) error {
 	// We don't need this
 	return nil
@@ -31,6 +31,11 @@ func SmudgeFilterWithReaderWriter(in io.Reader, out io.Writer, filename string)
 	if c == SHALineLen {
 		if match := shaRegex.FindStringSubmatch(string(buf)); match != nil {
 			sha := match[1]
+			if util.GlobalOptions.AutoFetchEnabled && IsLOBMissing(sha, false) && !ShouldAutoFetchFile(filename) {
+				// Outside the paths we fetch (see fetch include/exclude, profiles & lob-fetch), so don't auto-fetch
+				util.GlobalOptions.AutoFetchEnabled = false
+				defer func() { util.GlobalOptions.AutoFetchEnabled = true }()
+			}
 			lobinfo, err := RetrieveLOB(sha, out)
 			if err == nil {
 				util.LogDebugf("Successfully smudged %v: %v in %v chunks from %v\n", filename, util.FormatSize(lobinfo.Size), lobinfo.NumChunks, sha)
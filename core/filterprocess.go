@@ -0,0 +1,220 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// Implementation of git's long-running filter process protocol (filter.<driver>.process)
+// A single git-lob process handles every file in a checkout or add, instead of git starting
+// one process per file. If git supports delayed smudging, files whose binaries aren't available
+// locally (and which would be auto-fetched) are delayed, and then all fetched in one batch when
+// git asks which delayed files are ready.
+
+// Delayed smudge waiting for a batch fetch
+type delayedSmudge struct {
+	SHA     string
+	Content []byte
+}
+
+type filterProcess struct {
+	reader *util.PktLineReader
+	writer *util.PktLineWriter
+	// Capabilities git offered which we agreed to
+	caps util.StringSet
+	// Delayed smudges by pathname
+	delayed map[string]*delayedSmudge
+	// Pathnames fetched and ready for git to ask for again
+	available []string
+	// Pathnames smudged, whose permissions may need changing once git has written them
+	smudged  []string
+	shaRegex *regexp.Regexp
+}
+
+// Run the filter process protocol until git closes the input
+// Returns 0 on success, non-zero if the protocol failed (per-file errors are reported to git)
+func FilterProcess(in io.Reader, out io.Writer) int {
+	self := &filterProcess{
+		reader:   util.NewPktLineReader(in),
+		writer:   util.NewPktLineWriter(out),
+		caps:     util.NewStringSet(),
+		delayed:  make(map[string]*delayedSmudge),
+		shaRegex: regexp.MustCompile(SHALineMatchRegexStr),
+	}
+	err := self.handshake()
+	if err != nil {
+		util.LogErrorf("git-lob: filter process handshake failed: %v\n", err.Error())
+		return 3
+	}
+	for {
+		request, err := self.reader.ReadTextList()
+		if err == io.EOF && len(request) == 0 {
+			// git is done
+			break
+		}
+		if err != nil {
+			util.LogErrorf("git-lob: filter process error reading request: %v\n", err.Error())
+			return 3
+		}
+		err = self.handleRequest(parseFilterProcessKeys(request))
+		if err != nil {
+			util.LogErrorf("git-lob: filter process error: %v\n", err.Error())
+			return 3
+		}
+	}
+	if len(self.delayed) > 0 {
+		util.LogErrorf("git-lob: %d delayed files were never requested by git\n", len(self.delayed))
+	}
+	// git has written all the files now, so lockable ones can be made read-only
+	if _, err := UpdateLockableFilePermissions(self.smudged); err != nil {
+		util.LogErrorf("git-lob: unable to update permissions of lockable files: %v\n", err.Error())
+	}
+	return 0
+}
+
+// Convert key=value lines into a map
+func parseFilterProcessKeys(lines []string) map[string]string {
+	ret := make(map[string]string)
+	for _, line := range lines {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 {
+			ret[parts[0]] = parts[1]
+		}
+	}
+	return ret
+}
+
+func (self *filterProcess) handshake() error {
+	welcome, err := self.reader.ReadTextList()
+	if err != nil {
+		return err
+	}
+	welcomeSet := util.NewStringSetFromSlice(welcome)
+	if !welcomeSet.Contains("git-filter-client") || !welcomeSet.Contains("version=2") {
+		return fmt.Errorf("Unsupported client %v", welcome)
+	}
+	err = self.writer.WriteTextList("git-filter-server", "version=2")
+	if err != nil {
+		return err
+	}
+	offered, err := self.reader.ReadTextList()
+	if err != nil {
+		return err
+	}
+	var reply []string
+	for _, line := range offered {
+		switch line {
+		case "capability=clean", "capability=smudge", "capability=delay":
+			self.caps.Add(strings.TrimPrefix(line, "capability="))
+			reply = append(reply, line)
+		}
+	}
+	return self.writer.WriteTextList(reply...)
+}
+
+func (self *filterProcess) handleRequest(keys map[string]string) error {
+	pathname := keys["pathname"]
+	switch keys["command"] {
+	case "clean":
+		return self.filterContent(pathname, CleanFilterWithReaderWriter, self.reader.ContentReader())
+	case "smudge":
+		return self.smudge(pathname, keys["can-delay"] == "1")
+	case "list_available_blobs":
+		return self.listAvailableBlobs()
+	default:
+		// Unknown command, skip any content & tell git we can't do it
+		util.LogErrorf("git-lob: unsupported filter command %q\n", keys["command"])
+		if pathname != "" {
+			io.Copy(ioutil.Discard, self.reader.ContentReader())
+		}
+		return self.writer.WriteTextList("status=error")
+	}
+}
+
+// Send the result of a filter function to git, streaming the content
+func (self *filterProcess) filterContent(pathname string, filter func(io.Reader, io.Writer, string) int, in io.Reader) error {
+	err := self.writer.WriteTextList("status=success")
+	if err != nil {
+		return err
+	}
+	ret := filter(in, self.writer.ContentWriter(), pathname)
+	// Filters don't always consume everything (e.g. on error)
+	io.Copy(ioutil.Discard, in)
+	err = self.writer.WriteFlush()
+	if err != nil {
+		return err
+	}
+	if ret != 0 {
+		// Content so far should be discarded
+		return self.writer.WriteTextList("status=error")
+	}
+	// Empty list means status is unchanged
+	return self.writer.WriteFlush()
+}
+
+func (self *filterProcess) smudge(pathname string, canDelay bool) error {
+	if d, ok := self.delayed[pathname]; ok {
+		// Git asking again for something we delayed, content is empty this time
+		io.Copy(ioutil.Discard, self.reader.ContentReader())
+		delete(self.delayed, pathname)
+		// We already tried to fetch it, don't try again one at a time
+		autoFetch := util.GlobalOptions.AutoFetchEnabled
+		util.GlobalOptions.AutoFetchEnabled = false
+		defer func() { util.GlobalOptions.AutoFetchEnabled = autoFetch }()
+		return self.filterContent(pathname, SmudgeFilterWithReaderWriter, bytes.NewReader(d.Content))
+	}
+
+	self.smudged = append(self.smudged, pathname)
+	in := self.reader.ContentReader()
+	if !canDelay || !self.caps.Contains("delay") || !util.GlobalOptions.AutoFetchEnabled {
+		return self.filterContent(pathname, SmudgeFilterWithReaderWriter, in)
+	}
+
+	// Look at the start of the content to see if it's a placeholder for a binary we don't have
+	buf := make([]byte, SHALineLen+1)
+	c, _ := io.ReadFull(in, buf)
+	buf = buf[:c]
+	if c == SHALineLen {
+		if match := self.shaRegex.FindStringSubmatch(string(buf)); match != nil && IsLOBMissing(match[1], false) &&
+			ShouldAutoFetchFile(pathname) {
+			self.delayed[pathname] = &delayedSmudge{SHA: match[1], Content: buf}
+			return self.writer.WriteTextList("status=delayed")
+		}
+	}
+	return self.filterContent(pathname, SmudgeFilterWithReaderWriter, io.MultiReader(bytes.NewReader(buf), in))
+}
+
+func (self *filterProcess) listAvailableBlobs() error {
+	if len(self.available) == 0 && len(self.delayed) > 0 {
+		// Fetch everything that's been delayed so far in one go
+		lobs := make(map[string]string)
+		for pathname, d := range self.delayed {
+			lobs[d.SHA] = pathname
+			self.available = append(self.available, pathname)
+		}
+		sort.Strings(self.available)
+		err := AutoFetchLOBs(lobs, true)
+		if err != nil {
+			// Smudge will write placeholders & report what's missing
+			util.LogErrorf("git-lob: unable to fetch binaries: %v\n", err.Error())
+		}
+	}
+	// Everything is available now, one way or another
+	var lines []string
+	for _, pathname := range self.available {
+		lines = append(lines, "pathname="+pathname)
+	}
+	self.available = nil
+	err := self.writer.WriteTextList(lines...)
+	if err != nil {
+		return err
+	}
+	return self.writer.WriteTextList("status=success")
+}
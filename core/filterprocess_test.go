@@ -0,0 +1,186 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/atlassian/git-lob/providers"
+	. "github.com/atlassian/git-lob/util"
+)
+
+// Write what git would send to a filter process for a set of requests
+// Each request is a list of key=value lines, and content if the request needs it (nil if not)
+type filterProcessRequestForTest struct {
+	Keys    []string
+	Content []byte
+}
+
+func filterProcessInputForTest(requests []filterProcessRequestForTest) *bytes.Buffer {
+	var buf bytes.Buffer
+	w := NewPktLineWriter(&buf)
+	w.WriteTextList("git-filter-client", "version=2")
+	w.WriteTextList("capability=clean", "capability=smudge", "capability=delay", "capability=somethingelse")
+	for _, req := range requests {
+		w.WriteTextList(req.Keys...)
+		if req.Content != nil {
+			w.ContentWriter().Write(req.Content)
+			w.WriteFlush()
+		}
+	}
+	return &buf
+}
+
+var _ = Describe("Filter process", func() {
+	root := filepath.Join(os.TempDir(), "FilterProcessTest")
+	originRoot := filepath.Join(os.TempDir(), "FilterProcessOriginTest")
+	originBinStore := filepath.Join(os.TempDir(), "FilterProcessOriginBinStoreTest")
+	var oldwd string
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+	})
+
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+		ForceRemoveAll(originRoot)
+		ForceRemoveAll(originBinStore)
+		// Reset any option changes
+		GlobalOptions = NewOptions()
+	})
+
+	It("Negotiates capabilities and filters content", func() {
+		GlobalOptions.AutoFetchEnabled = false
+		data := []byte(strings.Repeat("Some binary content to clean and smudge\n", 100))
+		nonLOB := []byte("Not a placeholder")
+		missing := []byte(SHAPrefix + "0123456789abcdef0123456789abcdef01234567")
+		in := filterProcessInputForTest([]filterProcessRequestForTest{
+			{[]string{"command=clean", "pathname=file1.bin"}, data},
+			{[]string{"command=smudge", "pathname=file2.txt", "can-delay=1"}, nonLOB},
+			{[]string{"command=smudge", "pathname=file3.bin", "can-delay=1"}, missing},
+		})
+		var out bytes.Buffer
+		ret := FilterProcess(in, &out)
+		Expect(ret).To(Equal(0), "Filter process should succeed")
+
+		r := NewPktLineReader(&out)
+		lines, err := r.ReadTextList()
+		Expect(err).To(BeNil())
+		Expect(lines).To(Equal([]string{"git-filter-server", "version=2"}))
+		lines, err = r.ReadTextList()
+		Expect(err).To(BeNil())
+		Expect(lines).To(Equal([]string{"capability=clean", "capability=smudge", "capability=delay"}), "Should only agree to capabilities we support")
+
+		// clean
+		lines, _ = r.ReadTextList()
+		Expect(lines).To(Equal([]string{"status=success"}))
+		placeholder, err := ioutil.ReadAll(r.ContentReader())
+		Expect(err).To(BeNil())
+		Expect(string(placeholder)).To(HavePrefix(SHAPrefix), "Should be cleaned to a placeholder")
+		lines, _ = r.ReadTextList()
+		Expect(lines).To(BeEmpty(), "Status should be unchanged")
+		sha := strings.TrimPrefix(string(placeholder), SHAPrefix)
+		Expect(IsLOBMissing(sha, true)).To(BeFalse(), "Cleaned content should be stored")
+
+		// smudge non-LOB
+		lines, _ = r.ReadTextList()
+		Expect(lines).To(Equal([]string{"status=success"}))
+		content, _ := ioutil.ReadAll(r.ContentReader())
+		Expect(content).To(Equal(nonLOB), "Should not change non-LOB content")
+		r.ReadTextList()
+
+		// smudge missing LOB with no autofetch; not delayed
+		lines, _ = r.ReadTextList()
+		Expect(lines).To(Equal([]string{"status=success"}))
+		content, _ = ioutil.ReadAll(r.ContentReader())
+		Expect(content).To(Equal(missing), "Should write placeholder when LOB missing")
+		r.ReadTextList()
+
+		// Smudge placeholder we just stored
+		in = filterProcessInputForTest([]filterProcessRequestForTest{
+			{[]string{"command=smudge", "pathname=file1.bin"}, placeholder},
+		})
+		out.Reset()
+		ret = FilterProcess(in, &out)
+		Expect(ret).To(Equal(0), "Filter process should succeed")
+		r = NewPktLineReader(&out)
+		r.ReadTextList()
+		r.ReadTextList()
+		lines, _ = r.ReadTextList()
+		Expect(lines).To(Equal([]string{"status=success"}))
+		content, _ = ioutil.ReadAll(r.ContentReader())
+		Expect(content).To(Equal(data), "Should smudge to original data")
+	})
+
+	It("Delays smudges and fetches in one batch", func() {
+		CreateBareGitRepoForTest(originRoot)
+		originPathUrl := "file://" + strings.Replace(originRoot, "\\", "/", -1)
+		originBinStoreGit := strings.Replace(originBinStore, "\\", "/", -1)
+		f, err := os.OpenFile(filepath.Join(".git", "config"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		Expect(err).To(BeNil(), "Should not error trying to open config file")
+		f.WriteString(fmt.Sprintf(`
+[remote "origin"]
+    url = %v
+    fetch = +refs/heads/*:refs/remotes/origin/*
+    git-lob-path = %v
+    git-lob-provider = filesystem
+`, originPathUrl, originBinStoreGit))
+		f.Close()
+		LoadConfig(GlobalOptions)
+		providers.InitCoreProviders()
+		GlobalOptions.AutoFetchEnabled = true
+
+		info1 := CreateAndStoreLOBFileForTest(300, filepath.Join(root, "file1.bin"))
+		info2 := CreateAndStoreLOBFileForTest(500, filepath.Join(root, "file2.bin"))
+		err = os.Rename(GetLocalLOBRoot(), originBinStore)
+		Expect(err).To(BeNil(), "Should not error moving local store to remote")
+
+		in := filterProcessInputForTest([]filterProcessRequestForTest{
+			{[]string{"command=smudge", "pathname=file1.bin", "can-delay=1"}, []byte(SHAPrefix + info1.SHA)},
+			{[]string{"command=smudge", "pathname=file2.bin", "can-delay=1"}, []byte(SHAPrefix + info2.SHA)},
+			{[]string{"command=list_available_blobs"}, nil},
+			{[]string{"command=smudge", "pathname=file1.bin"}, []byte{}},
+			{[]string{"command=smudge", "pathname=file2.bin"}, []byte{}},
+			{[]string{"command=list_available_blobs"}, nil},
+		})
+		var out bytes.Buffer
+		ret := FilterProcess(in, &out)
+		Expect(ret).To(Equal(0), "Filter process should succeed")
+
+		r := NewPktLineReader(&out)
+		r.ReadTextList()
+		r.ReadTextList()
+		lines, _ := r.ReadTextList()
+		Expect(lines).To(Equal([]string{"status=delayed"}))
+		lines, _ = r.ReadTextList()
+		Expect(lines).To(Equal([]string{"status=delayed"}))
+		lines, _ = r.ReadTextList()
+		Expect(lines).To(Equal([]string{"pathname=file1.bin", "pathname=file2.bin"}), "Should list delayed files")
+		lines, _ = r.ReadTextList()
+		Expect(lines).To(Equal([]string{"status=success"}))
+		CheckLOBsExistForTest([]string{info1.SHA, info2.SHA}, GetLocalLOBRoot())
+
+		for _, info := range []*LOBInfo{info1, info2} {
+			lines, _ = r.ReadTextList()
+			Expect(lines).To(Equal([]string{"status=success"}))
+			content, _ := ioutil.ReadAll(r.ContentReader())
+			Expect(int64(len(content))).To(Equal(info.Size), "Should smudge fetched content")
+			r.ReadTextList()
+		}
+
+		lines, _ = r.ReadTextList()
+		Expect(lines).To(BeEmpty(), "Nothing left to be available")
+		lines, _ = r.ReadTextList()
+		Expect(lines).To(Equal([]string{"status=success"}))
+	})
+})
@@ -6,6 +6,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/atlassian/git-lob/providers"
 	"github.com/atlassian/git-lob/util"
 )
 
@@ -22,6 +23,10 @@ const (
 	// A binary is corrupt - either the metadata is invalid, or the SHA doesn't match the content (only detected with --deep) (desc = SHA)
 	// The files will be deleted if --delete was specified
 	FsckCorruptData FsckCallbackType = iota
+	// A binary with problems was fetched again from a remote and is now correct (desc = remote name)
+	FsckRepaired FsckCallbackType = iota
+	// A binary with problems could not be restored from a remote (desc = reason)
+	FsckNotRepaired FsckCallbackType = iota
 )
 
 // Collected callback data for a fsck operation
@@ -123,3 +128,113 @@ func Fsck(deep, shared, deleteBadFiles bool, shas []string, callback func(data *
 	return nil
 
 }
+
+// Validate that a remote has intact copies of every binary needed to check out refspecs
+// Smart servers which support it recalculate the SHA of each binary themselves, for other remotes
+// (or older servers) this only checks that all the files are present and of the right size
+// callback = FsckMissing if a binary is missing or incomplete on the remote (desc = detail),
+// FsckCorruptData if the content is wrong, return quit to abort
+// Returns whether content was verified rather than just size, and an error if any binaries had problems
+func FsckRemote(provider providers.SyncProvider, remoteName string, refspecs []*GitRefSpec,
+	callback func(data *FsckCallbackData) (quit bool)) (contentVerified bool, err error) {
+
+	// Same LOB is usually referenced many times, keep order so progress is predictable
+	var shas []string
+	shaSet := util.NewStringSet()
+	for _, refspec := range refspecs {
+		refshas, err := GetGitAllLOBsToCheckoutInRefSpec(refspec, nil, nil)
+		if err != nil {
+			return false, fmt.Errorf("Error determining binaries referenced by %v: %v", refspec, err.Error())
+		}
+		for _, sha := range refshas {
+			if shaSet.Add(sha) {
+				shas = append(shas, sha)
+			}
+		}
+	}
+
+	smartProvider := providers.UpgradeToSmartSyncProvider(provider)
+	contentVerified = smartProvider != nil
+	var errorList []string
+	for i, sha := range shas {
+		percent := int(float32(i+1) * 100 / float32(len(shas)))
+		var quit bool
+		if contentVerified {
+			exists, valid, verr := smartProvider.VerifyLOB(remoteName, sha)
+			if verr != nil {
+				// Server can't do it; fall back on checking sizes for this & the rest
+				util.LogDebugf("Unable to verify %v on %v, checking presence only: %v", sha, remoteName, verr.Error())
+				contentVerified = false
+			} else if !exists {
+				errorList = append(errorList, sha)
+				quit = callback(&FsckCallbackData{FsckMissing, sha, fmt.Sprintf("missing or incomplete on %v", remoteName), percent})
+			} else if !valid {
+				errorList = append(errorList, sha)
+				quit = callback(&FsckCallbackData{FsckCorruptData, sha, sha, percent})
+			} else {
+				quit = callback(&FsckCallbackData{FsckWorking, sha, "", percent})
+			}
+		}
+		if !contentVerified {
+			cerr := CheckRemoteLOBFilesForSHA(sha, provider, remoteName)
+			if cerr != nil {
+				errorList = append(errorList, sha)
+				quit = callback(&FsckCallbackData{FsckMissing, sha, cerr.Error(), percent})
+			} else {
+				quit = callback(&FsckCallbackData{FsckWorking, sha, "", percent})
+			}
+		}
+		if quit {
+			break
+		}
+	}
+
+	if len(errorList) > 0 {
+		return contentVerified, fmt.Errorf("%d binaries have problems on %v", len(errorList), remoteName)
+	}
+	return contentVerified, nil
+}
+
+// Restore binaries which Fsck found problems with by fetching them again from a remote,
+// then check them again (with the same deep / shared settings as Fsck)
+// Any bad files must already have been deleted (deleteBadFiles option to Fsck), otherwise
+// they won't be replaced
+// shas = the binaries which had problems
+// callback = called with FsckRepaired or FsckNotRepaired for each binary, return quit to abort
+// Returns the list of binaries which could not be restored
+func FsckRepair(deep, shared bool, shas []string, provider providers.SyncProvider, remoteName string,
+	callback func(data *FsckCallbackData) (quit bool)) []string {
+
+	var basedir string
+	if shared {
+		basedir = GetSharedLOBRoot()
+	} else {
+		basedir = GetLocalLOBRoot()
+	}
+	// Progress is reported per binary instead of during each download
+	fetchcallback := func(data *util.ProgressCallbackData) (abort bool) {
+		return false
+	}
+	var notRestored []string
+	for i, sha := range shas {
+		percent := int(float32(i+1) * 100 / float32(len(shas)))
+		err := FetchSingle(sha, provider, remoteName, false, fetchcallback)
+		if err == nil {
+			// Fetch doesn't report binaries the remote doesn't have, so check again
+			err = CheckLOBFilesForSHA(sha, basedir, deep)
+		}
+		var quit bool
+		if err != nil {
+			notRestored = append(notRestored, sha)
+			quit = callback(&FsckCallbackData{FsckNotRepaired, sha, err.Error(), percent})
+		} else {
+			quit = callback(&FsckCallbackData{FsckRepaired, sha, remoteName, percent})
+		}
+		if quit {
+			// Whatever's left wasn't restored either
+			notRestored = append(notRestored, shas[i+1:]...)
+			break
+		}
+	}
+	return notRestored
+}
@@ -9,6 +9,7 @@ import (
 
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/atlassian/git-lob/providers"
 	. "github.com/atlassian/git-lob/util"
 )
 
@@ -24,6 +25,8 @@ var _ = Describe("Fsck", func() {
 		oldwd, _ = os.Getwd()
 		CreateGitRepoForTest(root)
 		os.Chdir(root)
+		smallLOBs = nil
+		largeLOBs = nil
 
 		// Store a number of small LOBs
 		// filename doesn't matter, we just want to store the data
@@ -248,4 +251,102 @@ var _ = Describe("Fsck", func() {
 
 	})
 
+	It("Repairs from a remote", func() {
+		remoteStore := filepath.Join(os.TempDir(), "FsckRemote")
+		defer ForceRemoveAll(remoteStore)
+		os.MkdirAll(remoteStore, 0755)
+		GlobalOptions.GitConfig["remote.origin.git-lob-provider"] = "filesystem"
+		GlobalOptions.GitConfig["remote.origin.git-lob-path"] = remoteStore
+		providers.InitCoreProviders()
+		provider, err := providers.GetProviderForRemote("origin")
+		Expect(err).To(BeNil(), "Should get provider")
+		nullcallback := func(string, ProgressCallbackType, int64, int64) bool { return false }
+		// Everything but smallLOBs[1] is on the remote
+		for _, sha := range append(append([]string{}, smallLOBs[0], smallLOBs[2]), largeLOBs...) {
+			files, _, err := GetLOBFilesForSHA(sha, GetLocalLOBRoot(), true, false)
+			Expect(err).To(BeNil(), "Should get files")
+			err = provider.Upload("origin", files, GetLocalLOBRoot(), false, nullcallback)
+			Expect(err).To(BeNil(), "Should upload")
+		}
+
+		// Corrupt a chunk, truncate another, and lose one which isn't on the remote
+		f, _ := os.OpenFile(GetLocalLOBChunkPath(largeLOBs[0], 1), os.O_RDWR, 0644)
+		f.WriteAt([]byte{5, 4, 3, 2, 1}, 100)
+		f.Close()
+		os.Truncate(GetLocalLOBChunkPath(smallLOBs[2], 0), 10)
+		os.Remove(GetLocalLOBChunkPath(smallLOBs[1], 0))
+
+		var badSHAs []string
+		callback := func(data *FsckCallbackData) bool {
+			if data.Type != FsckWorking {
+				badSHAs = append(badSHAs, data.SHA)
+			}
+			return false
+		}
+		err = Fsck(true, false, true, nil, callback)
+		Expect(err).ToNot(BeNil(), "Should find problems")
+		Expect(badSHAs).To(ConsistOf([]string{largeLOBs[0], smallLOBs[1], smallLOBs[2]}), "Should find problems")
+
+		var repaired, notRepaired []string
+		repaircallback := func(data *FsckCallbackData) bool {
+			switch data.Type {
+			case FsckRepaired:
+				repaired = append(repaired, data.SHA)
+			case FsckNotRepaired:
+				notRepaired = append(notRepaired, data.SHA)
+			}
+			return false
+		}
+		notRestored := FsckRepair(true, false, badSHAs, provider, "origin", repaircallback)
+		Expect(notRestored).To(Equal([]string{smallLOBs[1]}), "Should not restore LOB missing from remote")
+		Expect(notRepaired).To(Equal([]string{smallLOBs[1]}), "Should report LOB which wasn't restored")
+		Expect(repaired).To(ConsistOf([]string{largeLOBs[0], smallLOBs[2]}), "Should report restored LOBs")
+		Expect(CheckLOBFilesForSHA(largeLOBs[0], GetLocalLOBRoot(), true)).To(BeNil(), "Corrupt LOB should be restored")
+		Expect(CheckLOBFilesForSHA(smallLOBs[2], GetLocalLOBRoot(), true)).To(BeNil(), "Wrong size LOB should be restored")
+	})
+
+	It("Checks binaries are on a remote", func() {
+		remoteStore := filepath.Join(os.TempDir(), "FsckRemote")
+		defer ForceRemoveAll(remoteStore)
+		os.MkdirAll(remoteStore, 0755)
+		GlobalOptions.GitConfig["remote.origin.git-lob-provider"] = "filesystem"
+		GlobalOptions.GitConfig["remote.origin.git-lob-path"] = remoteStore
+		providers.InitCoreProviders()
+		provider, err := providers.GetProviderForRemote("origin")
+		Expect(err).To(BeNil(), "Should get provider")
+
+		CreateInitialCommitForTest(root)
+		CreateCommitReferencingLOBsForTest(root, map[string]string{smallLOBs[0]: "file1.dat", largeLOBs[0]: "file2.dat"})
+		CreateCommitReferencingLOBsForTest(root, map[string]string{smallLOBs[1]: "file1.dat"})
+		nullcallback := func(string, ProgressCallbackType, int64, int64) bool { return false }
+		for _, sha := range []string{smallLOBs[1], largeLOBs[0]} {
+			files, _, _ := GetLOBFilesForSHA(sha, GetLocalLOBRoot(), true, false)
+			err = provider.Upload("origin", files, GetLocalLOBRoot(), false, nullcallback)
+			Expect(err).To(BeNil(), "Should upload")
+		}
+
+		var missingFiles []string
+		callback := func(data *FsckCallbackData) bool {
+			if data.Type == FsckMissing {
+				missingFiles = append(missingFiles, data.SHA)
+			}
+			return false
+		}
+		verified, err := FsckRemote(provider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "HEAD"}}, callback)
+		Expect(err).To(BeNil(), "Everything at HEAD should be on the remote")
+		Expect(verified).To(BeFalse(), "Filesystem remote can't verify content")
+		Expect(missingFiles).To(BeEmpty(), "Nothing should be missing at HEAD")
+
+		verified, err = FsckRemote(provider, "origin", []*GitRefSpec{&GitRefSpec{"HEAD^", "..", "HEAD"}}, callback)
+		Expect(err).ToNot(BeNil(), "Should find missing binary in range")
+		Expect(missingFiles).To(Equal([]string{smallLOBs[0]}), "Should report binary only in earlier commit")
+
+		// Truncated chunk on the remote
+		missingFiles = nil
+		os.Truncate(filepath.Join(remoteStore, GetLOBChunkRelativePath(largeLOBs[0], 1)), 10)
+		_, err = FsckRemote(provider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "HEAD"}}, callback)
+		Expect(err).ToNot(BeNil(), "Should find incomplete binary")
+		Expect(missingFiles).To(Equal([]string{largeLOBs[0]}), "Should report incomplete binary")
+	})
+
 })
@@ -487,6 +487,100 @@ func GitRefOrSHAIsValid(refOrSHA string) bool {
 	return err == nil
 }
 
+// Read the refs being pushed, as given to the pre-push hook on stdin:
+// <local ref> SP <local sha1> SP <remote ref> SP <remote sha1> LF
+// Returns the refspecs whose binaries need pushing: the range being added to the remote
+// ref if we know what it is, or all unpushed history of the local commit otherwise
+func ParseGitPrePushRefSpecs(in io.Reader) ([]*GitRefSpec, error) {
+	var refspecs []*GitRefSpec
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("Unexpected input to pre-push hook: %v", scanner.Text())
+		}
+		localSHA, remoteSHA := fields[1], fields[3]
+		if isGitZeroSHA(localSHA) {
+			// Deleting the remote ref, nothing to push
+			continue
+		}
+		if isGitZeroSHA(remoteSHA) || !GitRefOrSHAIsValid(remoteSHA) {
+			// New remote ref, or one we don't have (e.g. force push over someone else's work)
+			refspecs = append(refspecs, &GitRefSpec{Ref1: localSHA})
+		} else {
+			refspecs = append(refspecs, &GitRefSpec{Ref1: remoteSHA, RangeOp: "..", Ref2: localSHA})
+		}
+	}
+	return refspecs, scanner.Err()
+}
+
+func isGitZeroSHA(sha string) bool {
+	return strings.Trim(sha, "0") == ""
+}
+
+// Get the values of git attributes (from .gitattributes etc) for files relative to the repo root
+// Returns a map of filename to attribute name to value, where value is as reported by git
+// check-attr: "set", "unset" or the value; unspecified attributes and files are omitted
+func GetGitAttributesForFiles(files []string, attrs ...string) (map[string]map[string]string, error) {
+	ret := make(map[string]map[string]string)
+	if len(files) == 0 {
+		return ret, nil
+	}
+	reporoot, _, err := util.GetRepoRoot()
+	if err != nil {
+		return nil, err
+	}
+	args := append([]string{"check-attr", "-z", "--stdin"}, attrs...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = reporoot
+	cmd.Stdin = strings.NewReader(strings.Join(files, "\x00") + "\x00")
+	outp, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read git attributes %v: %v", attrs, err.Error())
+	}
+	// Output is <path> NUL <attribute> NUL <value> NUL
+	fields := strings.Split(string(outp), "\x00")
+	for i := 0; i+2 < len(fields); i += 3 {
+		file, attr, value := fields[i], fields[i+1], fields[i+2]
+		if value == "unspecified" {
+			continue
+		}
+		if ret[file] == nil {
+			ret[file] = make(map[string]string)
+		}
+		ret[file][attr] = value
+	}
+	return ret, nil
+}
+
+// Get the files (relative to the repo root) changed by the commits in a refspec which would
+// be pushed to a remote. For a range that's the commits in the range; otherwise it's all
+// ancestors of Ref1 which aren't on any of the remote's branches we know about
+func GetGitFilesChangedForPush(remoteName string, refspec *GitRefSpec) ([]string, error) {
+	args := []string{"log", "--format=", "--name-only", "--no-renames"}
+	if refspec.IsRange() {
+		args = append(args, fmt.Sprintf("%v..%v", refspec.Ref1, refspec.Ref2))
+	} else {
+		args = append(args, refspec.Ref1, "--not", fmt.Sprintf("--remotes=%v", remoteName))
+	}
+	outp, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list files changed in %v: %v", refspec, err.Error())
+	}
+	var ret []string
+	seen := util.NewStringSet()
+	for _, line := range strings.Split(string(outp), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && seen.Add(line) {
+			ret = append(ret, line)
+		}
+	}
+	return ret, nil
+}
+
 // Return a list of all local branches
 // Also FYI caches the current branch while we're at it so it's zero-cost to call
 // GetGitCurrentBranch after this
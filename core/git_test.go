@@ -158,6 +158,46 @@ var _ = Describe("Git tests", func() {
 
 	})
 
+	Describe("ParseGitPrePushRefSpecs", func() {
+		root := filepath.Join(os.TempDir(), "GitTestPrePush")
+		var oldwd string
+		BeforeEach(func() {
+			CreateGitRepoForTest(root)
+			oldwd, _ = os.Getwd()
+			os.Chdir(root)
+		})
+		AfterEach(func() {
+			os.Chdir(oldwd)
+			err := ForceRemoveAll(root)
+			if err != nil {
+				Fail(err.Error())
+			}
+		})
+		It("Converts pushed refs to refspecs", func() {
+			exec.Command("git", "commit", "--allow-empty", "-m", "First commit").Run()
+			first, _ := GitRefToFullSHA("HEAD")
+			exec.Command("git", "commit", "--allow-empty", "-m", "Second commit").Run()
+			second, _ := GitRefToFullSHA("HEAD")
+			zero := strings.Repeat("0", 40)
+			unknown := "1234567890123456789012345678901234567890"
+			input := fmt.Sprintf(`refs/heads/master %v refs/heads/master %v
+refs/heads/new %v refs/heads/new %v
+refs/heads/forced %v refs/heads/forced %v
+(delete) %v refs/heads/old %v
+`, second, first, second, zero, second, unknown, zero, first)
+			refspecs, err := ParseGitPrePushRefSpecs(strings.NewReader(input))
+			Expect(err).To(BeNil(), "Should parse")
+			Expect(refspecs).To(Equal([]*GitRefSpec{
+				&GitRefSpec{first, "..", second},
+				&GitRefSpec{Ref1: second},
+				&GitRefSpec{Ref1: second},
+			}), "Should push ranges where remote commit is known, and nothing for deletes")
+
+			_, err = ParseGitPrePushRefSpecs(strings.NewReader("rubbish\n"))
+			Expect(err).ToNot(BeNil(), "Should reject bad input")
+		})
+	})
+
 	Describe("GetGitCurrentBranch", func() {
 		root := filepath.Join(os.TempDir(), "GitTest2")
 		var oldwd string
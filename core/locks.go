@@ -0,0 +1,221 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Convert a file path (absolute or relative to the working dir) to the path used to identify
+// it in locks, which is relative to the repo root & always uses forward slashes
+func GetLockPath(file string) (string, error) {
+	reporoot, _, err := util.GetRepoRoot()
+	if err != nil {
+		return "", err
+	}
+	abs := file
+	if !filepath.IsAbs(file) {
+		curdir, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		abs = filepath.Join(curdir, file)
+	}
+	rel, err := filepath.Rel(reporoot, abs)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%v is not a file in the repository at %v", file, reporoot)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// Get a provider which supports locking, or a LockingNotSupportedError
+// Note that smart providers only know whether the server supports locking once connected, so
+// the lock methods may still return a LockingNotSupportedError
+func GetLockingProvider(provider providers.SyncProvider, remoteName string) (providers.SmartSyncProvider, error) {
+	smartProvider := providers.UpgradeToSmartSyncProvider(provider)
+	if smartProvider == nil {
+		return nil, providers.NewLockingNotSupportedError(remoteName)
+	}
+	return smartProvider, nil
+}
+
+// Find locks held by anyone else on files changed by the commits in refspecs
+// which would be pushed to remoteName (see GetGitFilesChangedForPush)
+// Returns a LockingNotSupportedError if the remote doesn't support locking
+func GetConflictingLocksForPush(provider providers.SyncProvider, remoteName string, refspecs []*GitRefSpec) ([]*providers.FileLock, error) {
+	lockingProvider, err := GetLockingProvider(provider, remoteName)
+	if err != nil {
+		return nil, err
+	}
+	locks, owner, err := lockingProvider.ListLocks(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	othersLocks := make(map[string]*providers.FileLock)
+	for _, lock := range locks {
+		if lock.Owner != owner {
+			othersLocks[lock.Path] = lock
+		}
+	}
+	if len(othersLocks) == 0 {
+		// No need to look at the commits
+		return nil, nil
+	}
+
+	var ret []*providers.FileLock
+	for _, refspec := range refspecs {
+		files, err := GetGitFilesChangedForPush(remoteName, refspec)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if lock, ok := othersLocks[file]; ok {
+				ret = append(ret, lock)
+				// Only report once
+				delete(othersLocks, file)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Files with the 'lockable' git attribute are kept read-only in the working copy unless you
+// hold a lock on them, so that you find out someone else is working on a file before you
+// change it rather than when you try to push. Which locks you hold is cached locally (per
+// remote) so this doesn't need to contact the server; the cache is updated by lock/unlock
+// and refreshed by listing locks.
+
+// Get the file which caches the paths we hold locks for on a remote
+// Kept apart from the remote state cache, which only records pushed binaries
+func getLockCacheFile(remoteName string) string {
+	return filepath.Join(util.GetGitDir(), "git-lob", "state", "locks", remoteName)
+}
+
+// Get the paths we hold locks for on a remote, as last known locally (sorted)
+func GetCachedLocks(remoteName string) []string {
+	var paths []string
+	f, err := os.OpenFile(getLockCacheFile(remoteName), os.O_RDONLY, 0644)
+	if err != nil {
+		// No locks
+		return paths
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths
+}
+
+// Overwrite the cache of paths we hold locks for on a remote
+func WriteCachedLocks(remoteName string, paths []string) error {
+	filename := getLockCacheFile(remoteName)
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return fmt.Errorf("Unable to create lock cache folder for %v: %v", filename, err.Error())
+	}
+	sorted := append([]string(nil), paths...)
+	sort.Strings(sorted)
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to write lock cache %v: %v", filename, err.Error())
+	}
+	defer f.Close()
+	for _, path := range sorted {
+		f.WriteString(path + "\n")
+	}
+	return nil
+}
+
+// Record in the local cache that we now hold a lock on path
+func AddCachedLock(remoteName, path string) error {
+	paths := GetCachedLocks(remoteName)
+	if found, _ := util.StringBinarySearch(paths, path); found {
+		return nil
+	}
+	return WriteCachedLocks(remoteName, append(paths, path))
+}
+
+// Record in the local cache that we no longer hold a lock on path
+func RemoveCachedLock(remoteName, path string) error {
+	paths := GetCachedLocks(remoteName)
+	found, i := util.StringBinarySearch(paths, path)
+	if !found {
+		return nil
+	}
+	return WriteCachedLocks(remoteName, append(paths[:i], paths[i+1:]...))
+}
+
+// Filter a list of files (relative to the repo root) down to those with the 'lockable' attribute
+func GetLockableFiles(files []string) ([]string, error) {
+	attrs, err := GetGitAttributesForFiles(files, "lockable")
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, file := range files {
+		if v := attrs[file]["lockable"]; v == "set" || v == "true" {
+			ret = append(ret, file)
+		}
+	}
+	return ret, nil
+}
+
+// Make lockable files among files (relative to the repo root, forward slashes) read-only,
+// unless we hold the lock on them on the default push remote, in which case make them writable
+// Files without the lockable attribute, or which aren't in the working copy, are left alone
+// Returns the files whose permissions were changed
+func UpdateLockableFilePermissions(files []string) ([]string, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	lockable, err := GetLockableFiles(files)
+	if err != nil || len(lockable) == 0 {
+		return nil, err
+	}
+	reporoot, _, err := util.GetRepoRoot()
+	if err != nil {
+		return nil, err
+	}
+	locked := GetCachedLocks(GetGitDefaultRemoteForPush())
+	var changed []string
+	for _, file := range lockable {
+		writable, _ := util.StringBinarySearch(locked, file)
+		modified, err := setFileWritable(filepath.Join(reporoot, filepath.FromSlash(file)), writable)
+		if err != nil && !os.IsNotExist(err) {
+			return changed, err
+		}
+		if modified {
+			changed = append(changed, file)
+		}
+	}
+	return changed, nil
+}
+
+// Add or remove write permission for a file, returns whether it changed
+func setFileWritable(file string, writable bool) (bool, error) {
+	stat, err := os.Stat(file)
+	if err != nil {
+		return false, err
+	}
+	mode := stat.Mode().Perm()
+	var newmode os.FileMode
+	if writable {
+		newmode = mode | 0200
+	} else {
+		newmode = mode &^ 0222
+	}
+	if newmode == mode {
+		return false, nil
+	}
+	util.LogDebugf("Setting %v writable=%v\n", file, writable)
+	return true, os.Chmod(file, newmode)
+}
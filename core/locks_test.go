@@ -0,0 +1,137 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/providers"
+	. "github.com/atlassian/git-lob/util"
+)
+
+// Provider which only implements listing locks
+type fakeLockingProvider struct {
+	SmartSyncProvider
+	locks []*FileLock
+	owner string
+}
+
+func (self *fakeLockingProvider) ListLocks(remoteName string) ([]*FileLock, string, error) {
+	return self.locks, self.owner, nil
+}
+
+var _ = Describe("Locks", func() {
+	root := filepath.Join(os.TempDir(), "LocksTest")
+	var oldwd string
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+		GlobalOptions = NewOptions()
+	})
+
+	It("Identifies lock paths", func() {
+		os.MkdirAll(filepath.Join(root, "art", "textures"), 0755)
+		os.Chdir(filepath.Join(root, "art"))
+		Expect(GetLockPath(filepath.Join("textures", "wall.psd"))).To(Equal("art/textures/wall.psd"))
+		Expect(GetLockPath(filepath.Join(root, "top.psd"))).To(Equal("top.psd"))
+		_, err := GetLockPath(filepath.Join("..", "..", "outside.psd"))
+		Expect(err).ToNot(BeNil(), "Should reject paths outside the repo")
+	})
+
+	It("Finds locks which conflict with a push", func() {
+		for _, f := range []string{"file1.bin", "file2.bin", "file3.bin"} {
+			ioutil.WriteFile(filepath.Join(root, f), []byte("initial "+f), 0644)
+		}
+		RunGitCommandForTest(true, "add", ".")
+		CommitAtDateForTest(time.Now().Add(-time.Hour), "Fred", "fred@bloggs.com", "Initial")
+		// Pretend that's been pushed already
+		RunGitCommandForTest(true, "update-ref", "refs/remotes/origin/master", "HEAD")
+		pushed := RunGitCommandForTest(true, "rev-parse", "HEAD")[:40]
+		ioutil.WriteFile(filepath.Join(root, "file2.bin"), []byte("changed"), 0644)
+		ioutil.WriteFile(filepath.Join(root, "file3.bin"), []byte("changed"), 0644)
+		RunGitCommandForTest(true, "add", ".")
+		CommitAtDateForTest(time.Now(), "Fred", "fred@bloggs.com", "Changes")
+
+		provider := &fakeLockingProvider{locks: []*FileLock{
+			// Not changed in new commits
+			&FileLock{Path: "file1.bin", Owner: "someone@else.com"},
+			&FileLock{Path: "file2.bin", Owner: "someone@else.com"},
+			// Our own lock is fine
+			&FileLock{Path: "file3.bin", Owner: "fred"},
+		}, owner: "fred"}
+		conflicts, err := GetConflictingLocksForPush(provider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}})
+		Expect(err).To(BeNil(), "Should be no error checking locks")
+		Expect(conflicts).To(HaveLen(1), "Should be one conflict")
+		Expect(conflicts[0].Path).To(Equal("file2.bin"))
+
+		provider.owner = "someone@else.com"
+		conflicts, err = GetConflictingLocksForPush(provider, "origin", []*GitRefSpec{&GitRefSpec{Ref1: pushed, RangeOp: "..", Ref2: "master"}})
+		Expect(err).To(BeNil(), "Should be no error checking locks")
+		Expect(conflicts).To(HaveLen(1), "Should be one conflict")
+		Expect(conflicts[0].Path).To(Equal("file3.bin"))
+
+		_, err = GetConflictingLocksForPush(&FileSystemSyncProvider{}, "origin", []*GitRefSpec{&GitRefSpec{Ref1: "master"}})
+		Expect(IsLockingNotSupportedError(err)).To(BeTrue(), "Dumb providers don't support locking")
+	})
+
+	It("Makes lockable files read-only unless locked", func() {
+		isWritable := func(file string) bool {
+			stat, err := os.Stat(filepath.Join(root, file))
+			Expect(err).To(BeNil())
+			return stat.Mode().Perm()&0200 != 0
+		}
+		ioutil.WriteFile(filepath.Join(root, ".gitattributes"), []byte("*.psd filter=lob lockable\n*.png filter=lob\n"), 0644)
+		os.MkdirAll(filepath.Join(root, "art"), 0755)
+		info := CreateAndStoreLOBFileForTest(500, filepath.Join(root, "art", "wall.psd"))
+		CreateAndStoreLOBFileForTest(500, filepath.Join(root, "art", "floor.psd"))
+		CreateAndStoreLOBFileForTest(500, filepath.Join(root, "art", "sky.png"))
+		RunGitCommandForTest(true, "add", ".")
+		CommitAtDateForTest(time.Now(), "Fred", "fred@bloggs.com", "Art")
+
+		attrs, err := GetGitAttributesForFiles([]string{"art/wall.psd", "art/sky.png", "other.txt"}, "lockable", "filter")
+		Expect(err).To(BeNil(), "Should be no error reading attributes")
+		Expect(attrs).To(Equal(map[string]map[string]string{
+			"art/wall.psd": {"lockable": "set", "filter": "lob"},
+			"art/sky.png":  {"filter": "lob"},
+		}))
+
+		// Checkout replaces placeholders & sets permissions
+		os.Remove(filepath.Join(root, "art", "wall.psd"))
+		callback := func(t ProgressCallbackType, filelob *FileLOB, err error) {}
+		err = Checkout(nil, false, callback)
+		Expect(err).To(BeNil(), "Should be no error checking out")
+		stat, err := os.Stat(filepath.Join(root, "art", "wall.psd"))
+		Expect(err).To(BeNil(), "Should have checked out file")
+		Expect(stat.Size()).To(BeEquivalentTo(info.Size), "Should have checked out content")
+		Expect(isWritable("art/wall.psd")).To(BeFalse(), "Lockable files should be read-only")
+		Expect(isWritable("art/floor.psd")).To(BeFalse(), "Lockable files should be read-only")
+		Expect(isWritable("art/sky.png")).To(BeTrue(), "Other files should be writable")
+
+		// Take a lock
+		Expect(AddCachedLock("origin", "art/wall.psd")).To(BeNil())
+		Expect(GetCachedLocks("origin")).To(Equal([]string{"art/wall.psd"}))
+		changed, err := UpdateLockableFilePermissions([]string{"art/wall.psd", "art/floor.psd", "art/sky.png"})
+		Expect(err).To(BeNil(), "Should be no error updating permissions")
+		Expect(changed).To(Equal([]string{"art/wall.psd"}), "Only locked file should change")
+		Expect(isWritable("art/wall.psd")).To(BeTrue(), "Locked file should be writable")
+		Expect(isWritable("art/floor.psd")).To(BeFalse(), "Unlocked file should still be read-only")
+		Expect(HasPushedBinaryState("origin")).To(BeFalse(), "Locks should not look like pushed state")
+
+		// And release it
+		Expect(RemoveCachedLock("origin", "art/wall.psd")).To(BeNil())
+		Expect(GetCachedLocks("origin")).To(BeEmpty())
+		UpdateLockableFilePermissions([]string{"art/wall.psd"})
+		Expect(isWritable("art/wall.psd")).To(BeFalse(), "Unlocked file should be read-only again")
+	})
+})
@@ -0,0 +1,133 @@
+package core
+
+import (
+	"strconv"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// Fetch & retention policies for binaries can be committed to the repo in .gitattributes, so
+// repo maintainers don't have to rely on every clone configuring them locally:
+//
+//   lob-fetch=never   Never fetched automatically (by fetch, auto-fetch or the checkout hooks)
+//                     and not retained by date when pruning; fetch-lob can still get them
+//   lob-fetch=recent  The default; fetched if recent & within the fetch include/exclude paths
+//   lob-fetch=always  Fetched if recent even when outside the fetch include/exclude paths or
+//                     the fetch profile in use (git-lob.fetch-max-size still applies)
+//   lob-retain=<days> When pruning, prior versions are kept for this many days of history
+//                     instead of git-lob.retention-period-head / retention-period-other
+//
+// Attributes are resolved with git check-attr, i.e. using the .gitattributes in the working copy.
+
+const (
+	LOBFetchNever  = "never"
+	LOBFetchRecent = "recent"
+	LOBFetchAlways = "always"
+)
+
+// Policy for a single file from its attributes
+type LOBPolicy struct {
+	// lob-fetch value, LOBFetchRecent if not specified (or not valid)
+	Fetch string
+	// lob-retain value, -1 if not specified (or not valid)
+	RetainDays int
+}
+
+// Whether the binary for a file should be fetched automatically, taking into account both
+// the lob-fetch attribute and the fetch include/exclude paths
+func (self *LOBPolicy) ShouldFetch(filename string) bool {
+	switch self.Fetch {
+	case LOBFetchNever:
+		return false
+	case LOBFetchAlways:
+		return true
+	default:
+		return util.FilenamePassesIncludeExcludeFilter(filename,
+			util.GlobalOptions.FetchIncludePaths, util.GlobalOptions.FetchExcludePaths)
+	}
+}
+
+// Whether prior versions of a file should be retained by date when pruning. Only a fetch
+// profile or the lob-fetch attribute limit this; plain fetch include/exclude paths don't,
+// since those are often set just to keep fetches small
+func (self *LOBPolicy) ShouldRetainByDate(filename string) bool {
+	switch self.Fetch {
+	case LOBFetchNever:
+		return false
+	case LOBFetchAlways:
+		return true
+	default:
+		return util.GlobalOptions.FetchProfile == "" || util.FilenamePassesIncludeExcludeFilter(filename,
+			util.GlobalOptions.FetchIncludePaths, util.GlobalOptions.FetchExcludePaths)
+	}
+}
+
+// Get the policies for files (relative to the repo root), returns a policy for every file
+func GetLOBPolicies(files []string) (map[string]*LOBPolicy, error) {
+	// Only ask git about each file once
+	var uniquefiles []string
+	seen := util.NewStringSet()
+	for _, file := range files {
+		if seen.Add(file) {
+			uniquefiles = append(uniquefiles, file)
+		}
+	}
+	attrs, err := GetGitAttributesForFiles(uniquefiles, "lob-fetch", "lob-retain")
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]*LOBPolicy, len(uniquefiles))
+	for _, file := range uniquefiles {
+		policy := &LOBPolicy{Fetch: LOBFetchRecent, RetainDays: -1}
+		switch fetch := attrs[file]["lob-fetch"]; fetch {
+		case "":
+			// not specified
+		case LOBFetchNever, LOBFetchRecent, LOBFetchAlways:
+			policy.Fetch = fetch
+		default:
+			util.LogErrorf("Ignoring invalid lob-fetch attribute for %v: %v\n", file, fetch)
+		}
+		if retain := attrs[file]["lob-retain"]; retain != "" {
+			days, err := strconv.ParseInt(retain, 10, 0)
+			if err == nil && days >= 0 {
+				policy.RetainDays = int(days)
+			} else {
+				util.LogErrorf("Ignoring invalid lob-retain attribute for %v: %v\n", file, retain)
+			}
+		}
+		ret[file] = policy
+	}
+	return ret, nil
+}
+
+// Filter file LOBs down to those whose binaries should be fetched automatically
+// (see LOBPolicy.ShouldFetch)
+func FilterFileLOBsToFetch(filelobs []*FileLOB) ([]*FileLOB, error) {
+	files := make([]string, 0, len(filelobs))
+	for _, filelob := range filelobs {
+		files = append(files, filelob.Filename)
+	}
+	policies, err := GetLOBPolicies(files)
+	if err != nil {
+		return nil, err
+	}
+	var ret []*FileLOB
+	for _, filelob := range filelobs {
+		if policies[filelob.Filename].ShouldFetch(filelob.Filename) {
+			ret = append(ret, filelob)
+		}
+	}
+	return ret, nil
+}
+
+// Whether the binary for a single file (relative to the repo root) should be auto-fetched
+func ShouldAutoFetchFile(filename string) bool {
+	policies, err := GetLOBPolicies([]string{filename})
+	if err != nil {
+		util.LogErrorf("Unable to determine fetch policy for %v: %v\n", filename, err.Error())
+		// Fall back on paths only
+		return util.FilenamePassesIncludeExcludeFilter(filename,
+			util.GlobalOptions.FetchIncludePaths, util.GlobalOptions.FetchExcludePaths)
+	}
+	return policies[filename].ShouldFetch(filename)
+}
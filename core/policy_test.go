@@ -0,0 +1,122 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Policy", func() {
+	root := filepath.Join(os.TempDir(), "PolicyTest")
+	var oldwd string
+
+	BeforeEach(func() {
+		CreateGitRepoForTest(root)
+		oldwd, _ = os.Getwd()
+		os.Chdir(root)
+		ioutil.WriteFile(".gitattributes", []byte(`*.wav lob-fetch=never
+music/* lob-fetch=always
+keep.dat lob-retain=30
+*.psd lob-retain=30
+bad.dat lob-fetch=sometimes lob-retain=forever
+`), 0644)
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		err := ForceRemoveAll(root)
+		if err != nil {
+			Fail(err.Error())
+		}
+		GlobalOptions = NewOptions()
+	})
+
+	It("Reads policies from attributes", func() {
+		policies, err := GetLOBPolicies([]string{"a.wav", "music/b.dat", "keep.dat", "other.dat", "bad.dat", "other.dat"})
+		Expect(err).To(BeNil(), "Should be no error getting policies")
+		Expect(policies).To(HaveLen(5), "Should be a policy for every file")
+		Expect(*policies["a.wav"]).To(Equal(LOBPolicy{Fetch: LOBFetchNever, RetainDays: -1}))
+		Expect(*policies["music/b.dat"]).To(Equal(LOBPolicy{Fetch: LOBFetchAlways, RetainDays: -1}))
+		Expect(*policies["keep.dat"]).To(Equal(LOBPolicy{Fetch: LOBFetchRecent, RetainDays: 30}))
+		Expect(*policies["other.dat"]).To(Equal(LOBPolicy{Fetch: LOBFetchRecent, RetainDays: -1}))
+		Expect(*policies["bad.dat"]).To(Equal(LOBPolicy{Fetch: LOBFetchRecent, RetainDays: -1}), "Invalid values should be ignored")
+	})
+
+	It("Filters files to fetch", func() {
+		GlobalOptions.FetchIncludePaths = []string{"textures"}
+		filelobs := []*FileLOB{
+			&FileLOB{Filename: "a.wav", SHA: "1"},
+			&FileLOB{Filename: "music/b.dat", SHA: "2"},
+			&FileLOB{Filename: "textures/t.dat", SHA: "3"},
+			&FileLOB{Filename: "textures/x.wav", SHA: "4"},
+			&FileLOB{Filename: "other.dat", SHA: "5"},
+		}
+		filtered, err := FilterFileLOBsToFetch(filelobs)
+		Expect(err).To(BeNil(), "Should be no error filtering")
+		Expect(filtered).To(Equal([]*FileLOB{filelobs[1], filelobs[2]}), "Should respect lob-fetch & include paths")
+		Expect(ShouldAutoFetchFile("music/c.dat")).To(BeTrue(), "lob-fetch=always overrides include paths")
+		Expect(ShouldAutoFetchFile("textures/c.wav")).To(BeFalse(), "lob-fetch=never overrides include paths")
+	})
+
+	It("Only limits retention by date to fetch paths with a fetch profile", func() {
+		policies, err := GetLOBPolicies([]string{"a.wav", "music/b.dat", "textures/t.dat", "other.dat"})
+		Expect(err).To(BeNil(), "Should be no error getting policies")
+		GlobalOptions.FetchIncludePaths = []string{"textures"}
+		Expect(policies["other.dat"].ShouldRetainByDate("other.dat")).To(BeTrue(), "fetch-include alone shouldn't limit retention")
+		Expect(policies["a.wav"].ShouldRetainByDate("a.wav")).To(BeFalse(), "lob-fetch=never shouldn't be retained by date")
+
+		GlobalOptions.GitConfig["git-lob.profile.art.include"] = "textures"
+		err = ApplyFetchProfile(GlobalOptions, "art")
+		Expect(err).To(BeNil(), "Shouldn't fail applying profile")
+		Expect(policies["other.dat"].ShouldRetainByDate("other.dat")).To(BeFalse(), "Profile should limit retention")
+		Expect(policies["textures/t.dat"].ShouldRetainByDate("textures/t.dat")).To(BeTrue(), "Profile paths should be retained")
+		Expect(policies["music/b.dat"].ShouldRetainByDate("music/b.dat")).To(BeTrue(), "lob-fetch=always overrides profile")
+	})
+
+	It("Retains binaries for lob-retain days when pruning", func() {
+		now := time.Now()
+		var keepshas, othershas []string
+		for i, date := range []time.Time{now.AddDate(0, 0, -20), now.AddDate(0, 0, -15), now} {
+			info := CreateAndStoreLOBFileForTest(int64(100+i), filepath.Join(root, "keep.dat"))
+			keepshas = append(keepshas, info.SHA)
+			info = CreateAndStoreLOBFileForTest(int64(200+i), filepath.Join(root, "other.dat"))
+			othershas = append(othershas, info.SHA)
+			exec.Command("git", "add", ".gitattributes", "keep.dat", "other.dat").Run()
+			CommitAtDateForTest(date, "Fred", "fred@bloggs.com", "Commit")
+		}
+		headsha, _ := GitRefToFullSHA("HEAD")
+		MarkBinariesAsPushed("origin", headsha, "")
+
+		// Default retention is 7 days before HEAD, which keeps the version replaced at HEAD
+		deleted, err := PruneOld(false, false, func(t PruneCallbackType, lobsha string) {})
+		Expect(err).To(BeNil(), "Should be no error pruning")
+		Expect(deleted).To(ConsistOf(othershas[0]), "Only the old version without lob-retain should be deleted")
+		CheckLOBsExistForTest(keepshas, GetLocalLOBRoot())
+		CheckLOBsExistForTest(othershas[1:], GetLocalLOBRoot())
+	})
+
+	It("Retains lob-retain files whose paths contain wildcard characters", func() {
+		now := time.Now()
+		filename := filepath.Join("art", "[old]", "x.psd")
+		os.MkdirAll(filepath.Join(root, "art", "[old]"), 0755)
+		var shas []string
+		for i, date := range []time.Time{now.AddDate(0, 0, -20), now.AddDate(0, 0, -15), now} {
+			info := CreateAndStoreLOBFileForTest(int64(100+i), filepath.Join(root, filename))
+			shas = append(shas, info.SHA)
+			exec.Command("git", "add", ".gitattributes", filename).Run()
+			CommitAtDateForTest(date, "Fred", "fred@bloggs.com", "Commit")
+		}
+		headsha, _ := GitRefToFullSHA("HEAD")
+		MarkBinariesAsPushed("origin", headsha, "")
+
+		deleted, err := PruneOld(false, false, func(t PruneCallbackType, lobsha string) {})
+		Expect(err).To(BeNil(), "Should be no error pruning")
+		Expect(deleted).To(BeEmpty(), "All versions are within the lob-retain period")
+		CheckLOBsExistForTest(shas, GetLocalLOBRoot())
+	})
+})
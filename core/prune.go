@@ -224,14 +224,47 @@ func PruneOld(dryRun, safeMode bool, callback PruneCallback) ([]string, error) {
 		} else {
 			callback(PruneWorking, "")
 			// This ref is itself included so perform usual 'all lobs at checkout + n days history' query
-			var lobs []string
-			lobs, earliestCommit, err = GetGitAllLOBsToCheckoutAtCommitAndRecent(commit, days, []string{}, []string{})
+			var filelobs []*FileLOB
+			filelobs, earliestCommit, err = GetGitAllFileLOBsToCheckoutAtCommitAndRecent(commit, days, nil, nil)
 			if err != nil {
 				return fmt.Errorf("Error determining recent commits from %v: %v", commit, err.Error())
 			}
-			for _, l := range lobs {
-				if retainSet.Add(l) {
-					callback(PruneRetainByDate, l)
+			// Only files in the fetch profile & not excluded by lob-fetch (unpushed LOBs are retained
+			// below regardless), and files with their own lob-retain period are dealt with separately
+			var files []string
+			for _, filelob := range filelobs {
+				files = append(files, filelob.Filename)
+			}
+			policies, err := GetLOBPolicies(files)
+			if err != nil {
+				return err
+			}
+			filesByRetainDays := make(map[int]util.StringSet)
+			for _, filelob := range filelobs {
+				policy := policies[filelob.Filename]
+				if !policy.ShouldRetainByDate(filelob.Filename) {
+					continue
+				}
+				if policy.RetainDays >= 0 {
+					if filesByRetainDays[policy.RetainDays] == nil {
+						filesByRetainDays[policy.RetainDays] = util.NewStringSet()
+					}
+					filesByRetainDays[policy.RetainDays].Add(filelob.Filename)
+				} else if retainSet.Add(filelob.SHA) {
+					callback(PruneRetainByDate, filelob.SHA)
+				}
+			}
+			for retainDays, files := range filesByRetainDays {
+				// Select by exact filename; passing these as include paths would treat them as
+				// patterns, which wouldn't match names containing wildcard characters like '['
+				retainlobs, _, err := GetGitAllFileLOBsToCheckoutAtCommitAndRecent(commit, retainDays, nil, nil)
+				if err != nil {
+					return fmt.Errorf("Error determining recent commits from %v: %v", commit, err.Error())
+				}
+				for _, filelob := range retainlobs {
+					if files.Contains(filelob.Filename) && retainSet.Add(filelob.SHA) {
+						callback(PruneRetainByDate, filelob.SHA)
+					}
 				}
 			}
 		}
@@ -307,6 +307,11 @@ func pushCommitDeltas(commit *PushCommitContentDetails, provider providers.Smart
 		// Push metadata for this individually
 		metacallback := func(fileInProgress string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
 			// Don't bother to track partial completion, only small
+			if progressType == util.ProgressRetry {
+				// File will start again, just report it
+				return callback(&util.ProgressCallbackData{progressType, fileInProgress, 0, totalBytes,
+					bytesDoneSoFar, refDeltaBytes})
+			}
 			if progressType == util.ProgressSkip || progressType == util.ProgressNotFound {
 				return callback(&util.ProgressCallbackData{progressType, fileInProgress, totalBytes, totalBytes,
 					bytesDoneSoFar + ApproximateMetadataSize, refDeltaBytes})
@@ -364,6 +369,11 @@ func pushCommitStandard(commit *PushCommitContentDetails, provider providers.Syn
 	var lastFilename string
 	var lastFileBytes int64
 	localcallback := func(fileInProgress string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
+		if progressType == util.ProgressRetry {
+			// File will start again, just report it
+			return callback(&util.ProgressCallbackData{progressType, fileInProgress, 0, totalBytes,
+				bytesDoneSoFar, refCommitsSize})
+		}
 		if lastFilename != fileInProgress {
 			// New file, always callback
 			if lastFilename != "" {
@@ -491,6 +501,11 @@ func PushSingle(sha string, provider providers.SyncProvider, remoteName string,
 	var lastFileBytes int64
 	var bytesFromFilesDoneSoFar int64
 	localcallback := func(fileInProgress string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
+		if progressType == util.ProgressRetry {
+			// File will start again, just report it
+			return callback(&util.ProgressCallbackData{progressType, fileInProgress, 0, totalBytes,
+				bytesFromFilesDoneSoFar, totalSize})
+		}
 		if lastFilename != fileInProgress {
 			// New file, always callback
 			if lastFilename != "" {
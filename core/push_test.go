@@ -512,6 +512,9 @@ func (self *DummyPushTransport) MetadataExists(lobsha string) (ex bool, sz int64
 	meta, ok := self.MetaContentMap[lobsha]
 	return ok, int64(len(meta)), nil
 }
+func (self *DummyPushTransport) FilesExist(queries []smart.FileExistsRequest) ([]smart.FileExistsResponse, error) {
+	return filesExistForTest(self, queries)
+}
 func (*DummyPushTransport) ChunkExists(lobsha string, chunk int) (ex bool, sz int64, e error) {
 	// We don't need this
 	return true, 0, nil
@@ -525,6 +528,23 @@ func (self *DummyPushTransport) LOBExists(lobsha string) (ex bool, sz int64, e e
 	_, metaok := self.MetaContentMap[lobsha]
 	return metaok && contentok, int64(len(content)), nil
 }
+func (self *DummyPushTransport) VerifyLOB(lobsha string) (ex bool, valid bool, e error) {
+	// Content is always valid if it's there
+	ex, _, e = self.LOBExists(lobsha)
+	return ex, ex, e
+}
+func (self *DummyPushTransport) LockFile(path string) (ok bool, lock *FileLock, e error) {
+	// We don't need this
+	return false, nil, NewLockingNotSupportedError("origin")
+}
+func (self *DummyPushTransport) UnlockFile(path string, force bool) (ok bool, lock *FileLock, e error) {
+	// We don't need this
+	return false, nil, NewLockingNotSupportedError("origin")
+}
+func (self *DummyPushTransport) ListLocks() ([]*FileLock, string, error) {
+	// We don't need this
+	return nil, "", NewLockingNotSupportedError("origin")
+}
 func (self *DummyPushTransport) UploadMetadata(lobsha string, sz int64, data io.Reader) error {
 	var buf bytes.Buffer
 	n, err := io.CopyN(&buf, data, sz)
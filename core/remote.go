@@ -14,13 +14,13 @@ import (
 
 // Do we have a remote state cache for this remote yet?
 func hasRemoteStateCache(remoteName string) bool {
-	dir := filepath.Join(util.GetGitDir(), "git-lob", "state", "remotes", remoteName)
-	return util.DirExists(dir)
+	dir := util.GetRemoteStateDir(remoteName)
+	return dir != "" && util.DirExists(dir)
 }
 
 // Gets the root directory of the remote state cache for a given remote
 func getRemoteStateCacheRoot(remoteName string) string {
-	ret := filepath.Join(util.GetGitDir(), "git-lob", "state", "remotes", remoteName)
+	ret := util.GetRemoteStateDir(remoteName)
 	err := os.MkdirAll(ret, 0755)
 	if err != nil {
 		util.LogErrorf("Unable to create remote state cache folder at %v: %v", ret, err)
@@ -135,6 +135,15 @@ func MarkBinariesAsPushed(remoteName, commitSHA, replaceCommitSHA string) error
 	if !GitRefIsFullSHA(commitSHA) {
 		return fmt.Errorf("Invalid commit SHA, must be full 40 char SHA, not '%v'", commitSHA)
 	}
+	if mirrors := providers.GetMirrorRemotes(remoteName); mirrors != nil {
+		// State is kept for each mirrored remote
+		for _, mirror := range mirrors {
+			if err := MarkBinariesAsPushed(mirror, commitSHA, replaceCommitSHA); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 	shas := GetPushedCommits(remoteName)
 
 	// confirm not there already
@@ -162,6 +171,14 @@ func MarkBinariesAsPushed(remoteName, commitSHA, replaceCommitSHA string) error
 
 // Overwrite entire pushed state for a remote
 func WritePushedState(remoteName string, shas []string) error {
+	if mirrors := providers.GetMirrorRemotes(remoteName); mirrors != nil {
+		for _, mirror := range mirrors {
+			if err := WritePushedState(mirror, shas); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 
 	filename := getRemoteStateCacheFile(remoteName)
 	// we just write the whole thing, sorted
@@ -181,9 +198,25 @@ func WritePushedState(remoteName string, shas []string) error {
 
 // Get a list of commits that have been pushed for a remote
 // remoteName can be "*" to return pushed list for all remotes combined
+// For mirror remotes, only commits recorded as pushed on all mirrored remotes are returned
 func GetPushedCommits(remoteName string) []string {
 	var shas []string
-	if remoteName == "*" {
+	if mirrors := providers.GetMirrorRemotes(remoteName); mirrors != nil {
+		for i, mirror := range mirrors {
+			mshas := GetPushedCommits(mirror)
+			if i == 0 {
+				shas = mshas
+				continue
+			}
+			var common []string
+			for _, sha := range shas {
+				if found, _ := util.StringBinarySearch(mshas, sha); found {
+					common = append(common, sha)
+				}
+			}
+			shas = common
+		}
+	} else if remoteName == "*" {
 		remotes, err := GetGitRemotes()
 		if err != nil {
 			return []string{}
@@ -217,6 +250,12 @@ func GetPushedCommits(remoteName string) []string {
 // parents of others. This makes the subsequent retrieval of commits to push slower
 // So remove SHAs that are ancestors of others and just keep the later SHAs that are pushed
 func CleanupPushState(remoteName string) {
+	if mirrors := providers.GetMirrorRemotes(remoteName); mirrors != nil {
+		for _, mirror := range mirrors {
+			CleanupPushState(mirror)
+		}
+		return
+	}
 	pushed := GetPushedCommits(remoteName)
 
 	consolidated := consolidateCommitsToLatestDescendants(pushed)
@@ -273,17 +312,49 @@ func consolidateCommitsToLatestDescendants(in []string) []string {
 // Reset the cached information about which binaries we have cached for a given remote
 // Warning: this will make the next push expensive while it recalculates
 func ResetPushedBinaryState(remoteName string) error {
+	if mirrors := providers.GetMirrorRemotes(remoteName); mirrors != nil {
+		for _, mirror := range mirrors {
+			if err := ResetPushedBinaryState(mirror); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 	return os.RemoveAll(getRemoteStateCacheRoot(remoteName))
 }
 
 // Do we have any pushed binary state recorded for a remote?
 func HasPushedBinaryState(remoteName string) bool {
+	if mirrors := providers.GetMirrorRemotes(remoteName); mirrors != nil {
+		for _, mirror := range mirrors {
+			if !hasRemoteStateCache(mirror) {
+				return false
+			}
+		}
+		return true
+	}
 	return hasRemoteStateCache(remoteName)
 }
 
 // Find the most recent ancestor of ref (or itself) at which we believe we've
 // already pushed all binaries. Returns a blank string if none have been pushed.
 func FindLatestAncestorWhereBinariesPushed(remoteName, ref string) (string, error) {
+	if mirrors := providers.GetMirrorRemotes(remoteName); mirrors != nil {
+		// Each mirrored remote may have got to a different point; the best ancestor of
+		// all of them is where everything has been pushed everywhere
+		var ancestors []string
+		for _, mirror := range mirrors {
+			ancestor, err := FindLatestAncestorWhereBinariesPushed(mirror, ref)
+			if err != nil || ancestor == "" {
+				return ancestor, err
+			}
+			ancestors = append(ancestors, ancestor)
+		}
+		if len(ancestors) == 1 {
+			return ancestors[0], nil
+		}
+		return GetGitBestAncestor(ancestors)
+	}
 
 	// Use the list of pushed SHAs plus this ref to determine the best common ancestor
 	pushedSHAs := GetPushedCommits(remoteName)
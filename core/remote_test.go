@@ -7,6 +7,7 @@ import (
 
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
 )
 
 var _ = Describe("Remote", func() {
@@ -70,6 +71,34 @@ var _ = Describe("Remote", func() {
 			pushed = GetPushedCommits(remote1Name)
 			Expect(pushed).To(Equal([]string{}), "Pushed should be empty after reset")
 		})
+
+		It("tracks push state per mirrored remote", func() {
+			defer func() { GlobalOptions = NewOptions() }()
+			GlobalOptions.GitConfig["remote.both.git-lob-provider"] = "mirror"
+			GlobalOptions.GitConfig["remote.both.git-lob-mirrors"] = "nas, offsite"
+
+			sha := "b09bfdf65bb51bb50307f93ab930dd7708a5b6dc"
+			sha2 := "c1234567890fdf651bb5f93ab930dd7708002341"
+
+			err := MarkBinariesAsPushed("both", sha, "")
+			Expect(err).To(BeNil(), "Shouldn't be an error marking pushed")
+			Expect(GetPushedCommits("nas")).To(Equal([]string{sha}), "Should record pushed on first mirror")
+			Expect(GetPushedCommits("offsite")).To(Equal([]string{sha}), "Should record pushed on second mirror")
+			Expect(HasPushedBinaryState("both")).To(BeTrue(), "Should have state for all mirrors")
+
+			// Pushing to one of the mirrors directly doesn't make it pushed to the mirror remote
+			err = MarkBinariesAsPushed("nas", sha2, "")
+			Expect(err).To(BeNil(), "Shouldn't be an error marking pushed")
+			Expect(GetPushedCommits("both")).To(Equal([]string{sha}), "Should only include commits pushed to all mirrors")
+			err = MarkBinariesAsPushed("offsite", sha2, "")
+			Expect(err).To(BeNil(), "Shouldn't be an error marking pushed")
+			Expect(GetPushedCommits("both")).To(Equal([]string{sha, sha2}), "Should include commits once pushed to all mirrors")
+
+			err = ResetPushedBinaryState("both")
+			Expect(err).To(BeNil(), "Shouldn't be an error undoing pushed")
+			Expect(GetPushedCommits("nas")).To(Equal([]string{}), "Should reset first mirror")
+			Expect(GetPushedCommits("offsite")).To(Equal([]string{}), "Should reset second mirror")
+		})
 	})
 
 	Context("Real git repo tests", func() {
@@ -19,6 +19,7 @@ import (
 
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/atlassian/git-lob/providers/smart"
 	"github.com/atlassian/git-lob/util"
 )
 
@@ -571,3 +572,18 @@ func ForceRemove(path string) error {
 	return err
 
 }
+
+// Answer a batch of existence queries for a test transport using its single file queries
+func filesExistForTest(t smart.Transport, queries []smart.FileExistsRequest) ([]smart.FileExistsResponse, error) {
+	var results []smart.FileExistsResponse
+	for _, q := range queries {
+		var r smart.FileExistsResponse
+		if q.Type == "meta" {
+			r.Exists, r.Size, _ = t.MetadataExists(q.LobSHA)
+		} else {
+			r.Exists, r.Size, _ = t.ChunkExists(q.LobSHA, q.ChunkIdx)
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
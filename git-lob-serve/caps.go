@@ -10,7 +10,14 @@ func queryCaps(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Conf
 
 	// This server always supports binary deltas
 	// Send/receive settings may cause actual requests to be rejected
-	caps := []string{"binary_delta"}
+	// Requests are always processed in order so pipelining is always supported too
+	// We can always recalculate the SHA of content we store, so verify is supported
+	// Lock records are stored alongside the LOBs so locking is always supported
+	caps := []string{"binary_delta", "pipelining", "verify", "locking"}
+	// Tells clients that asking about a whole LOB may fetch it from the upstream
+	if config.UpstreamProvider != "" {
+		caps = append(caps, "upstream")
+	}
 
 	result := smart.QueryCapsResponse{Caps: caps}
 	resp, err := smart.NewJsonResponse(req.Id, result)
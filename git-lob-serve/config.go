@@ -18,6 +18,17 @@ type Config struct {
 	EnableDeltaSend    bool
 	DeltaCachePath     string
 	DeltaSizeLimit     int64
+	// Provider to fetch missing LOBs from, if any (as in remote.<name>.git-lob-provider)
+	UpstreamProvider string
+	// Other settings for the upstream provider, without the 'upstream-' prefix
+	UpstreamSettings map[string]string
+	// Provider to copy new LOBs to in 'replicate' mode, and its other settings
+	ReplicateProvider string
+	ReplicateSettings map[string]string
+	// Identity of the connected user, which owns the locks they take (see getClientIdentity)
+	User string
+	// Users who may release locks held by someone else
+	LockAdmins []string
 }
 
 const defaultDeltaSizeLimit int64 = 2 * 1024 * 1024 * 1024
@@ -28,6 +39,8 @@ func NewConfig() *Config {
 		EnableDeltaReceive: true,
 		EnableDeltaSend:    true,
 		DeltaSizeLimit:     defaultDeltaSizeLimit, // 2GB
+		UpstreamSettings:   make(map[string]string),
+		ReplicateSettings:  make(map[string]string),
 	}
 }
 func LoadConfig() *Config {
@@ -115,5 +128,23 @@ func LoadConfig() *Config {
 		}
 	}
 
+	if v := settings["lock-admins"]; v != "" {
+		cfg.LockAdmins = strings.FieldsFunc(v, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+	}
+
+	for key, val := range settings {
+		if key == "upstream-provider" {
+			cfg.UpstreamProvider = val
+		} else if strings.HasPrefix(key, "upstream-") {
+			cfg.UpstreamSettings[strings.TrimPrefix(key, "upstream-")] = val
+		} else if key == "replicate-provider" {
+			cfg.ReplicateProvider = val
+		} else if strings.HasPrefix(key, "replicate-") {
+			cfg.ReplicateSettings[strings.TrimPrefix(key, "replicate-")] = val
+		}
+	}
+
 	return cfg
 }
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/providers/smart"
+)
+
+// File locks are stored as one small JSON file per locked path, in a .locks directory
+// alongside the LOBs for the repo. Each file is named after the SHA of the path so any path
+// can be stored without escaping. Locks are created by hard linking a complete temporary
+// file into place, which fails if it already exists, so several git-lob-serve processes can
+// try to lock the same file at once safely without any other coordination. Unlocking first
+// renames the lock out of the way, so the lock checked is the one removed even if it changes
+// hands at the same time, and links it back if it mustn't be released.
+//
+// Lock owners come from the identity the SSH server authenticated, never from the client, so
+// users can't take or release each other's locks by changing their git config. Only users
+// listed in the lock-admins setting can force-release someone else's lock.
+
+// Get the identity of the user connecting to this server, which owns the locks they take
+// GIT_LOB_USER if the SSH server sets it (e.g. per key in authorized_keys, when everyone
+// shares one account), otherwise the account they logged in as
+func getClientIdentity() string {
+	if u := strings.TrimSpace(os.Getenv("GIT_LOB_USER")); u != "" {
+		return u
+	}
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	// os/user isn't available in cross-compiled builds
+	if u := os.Getenv("USER"); u != "" {
+		return u
+	}
+	return os.Getenv("USERNAME")
+}
+
+func isLockAdmin(config *Config) bool {
+	for _, admin := range config.LockAdmins {
+		if admin == config.User {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the directory containing the lock records for a repo path
+func getLocksDir(config *Config, path string) string {
+	return filepath.Join(getLOBRoot(config, path), ".locks")
+}
+
+// Get the file containing the lock record for a file in the repo
+func getLockFilePath(lockpath string, config *Config, path string) string {
+	return filepath.Join(getLocksDir(config, path), fmt.Sprintf("%x", sha1.Sum([]byte(lockpath))))
+}
+
+// Normalise & check a path a client wants to lock
+func cleanLockPath(p string) (string, error) {
+	p = strings.Trim(strings.Replace(p, "\\", "/", -1), "/")
+	if p == "" {
+		return "", fmt.Errorf("Path to lock must not be blank")
+	}
+	return p, nil
+}
+
+// Read a lock record, returns nil if the file isn't locked
+func readLock(file string) (*providers.FileLock, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	lock := &providers.FileLock{}
+	err = json.Unmarshal(content, lock)
+	if err != nil {
+		return nil, fmt.Errorf("Corrupt lock record %v: %v", file, err.Error())
+	}
+	return lock, nil
+}
+
+// Create a lock record; returns false & the existing lock if someone else got there first
+func createLock(lock *providers.FileLock, config *Config, path string) (bool, *providers.FileLock, error) {
+	dir := getLocksDir(config, path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return false, nil, err
+	}
+	content, err := json.Marshal(lock)
+	if err != nil {
+		return false, nil, err
+	}
+	tempf, err := ioutil.TempFile(dir, "templock")
+	if err != nil {
+		return false, nil, err
+	}
+	_, err = tempf.Write(content)
+	tempf.Close()
+	defer os.Remove(tempf.Name())
+	if err != nil {
+		return false, nil, err
+	}
+	file := getLockFilePath(lock.Path, config, path)
+	err = os.Link(tempf.Name(), file)
+	if err != nil {
+		existing, readerr := readLock(file)
+		if readerr != nil {
+			return false, nil, readerr
+		}
+		if existing == nil {
+			// Not a conflict, something else went wrong
+			return false, nil, err
+		}
+		return false, existing, nil
+	}
+	return true, lock, nil
+}
+
+// Remove a lock record if canRemove agrees, returns the lock that was there (nil if none)
+// The record is renamed to a temporary file first so that another process can't release it
+// & someone else lock it again between checking & removing it
+func removeLock(file string, canRemove func(lock *providers.FileLock) error) (bool, *providers.FileLock, error) {
+	tempf, err := ioutil.TempFile(filepath.Dir(file), "templock")
+	if err != nil {
+		if os.IsNotExist(err) {
+			// No locks dir, so nothing locked
+			return true, nil, nil
+		}
+		return false, nil, err
+	}
+	tempname := tempf.Name()
+	tempf.Close()
+	// Not all platforms can rename over an existing file
+	os.Remove(tempname)
+	err = os.Rename(file, tempname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil, nil
+		}
+		return false, nil, err
+	}
+	defer os.Remove(tempname)
+	lock, err := readLock(tempname)
+	if err == nil && lock != nil {
+		err = canRemove(lock)
+		if err == nil {
+			return true, lock, nil
+		}
+	}
+	// Put it back; linking means we won't replace a lock someone else has taken meanwhile
+	if linkerr := os.Link(tempname, file); linkerr != nil {
+		return false, lock, fmt.Errorf("Unable to restore lock record %v: %v", file, linkerr.Error())
+	}
+	return false, lock, err
+}
+
+func lockFile(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *smart.JsonResponse {
+	params := smart.LockFileRequest{}
+	err := smart.ExtractStructFromJsonRawMessage(req.Params, &params)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	lockpath, err := cleanLockPath(params.Path)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	if config.User == "" {
+		return smart.NewJsonErrorResponse(req.Id, "Server is unable to identify you to lock files")
+	}
+	result := smart.LockFileResponse{}
+	lock := &providers.FileLock{Path: lockpath, Owner: config.User, LockedAt: time.Now().UTC()}
+	ok, existing, err := createLock(lock, config, path)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	// Re-locking your own lock is fine
+	result.Success = ok || existing.Owner == config.User
+	result.Lock = existing
+
+	resp, err := smart.NewJsonResponse(req.Id, result)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	return resp
+}
+
+func unlockFile(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *smart.JsonResponse {
+	params := smart.UnlockFileRequest{}
+	err := smart.ExtractStructFromJsonRawMessage(req.Params, &params)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	lockpath, err := cleanLockPath(params.Path)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	result := smart.UnlockFileResponse{}
+	file := getLockFilePath(lockpath, config, path)
+	// Someone else's lock without force is signalled by not succeeding, rather than an error
+	errNotOwner := fmt.Errorf("Lock is held by someone else")
+	ok, existing, err := removeLock(file, func(lock *providers.FileLock) error {
+		if lock.Owner == config.User {
+			return nil
+		}
+		if !params.Force {
+			return errNotOwner
+		}
+		if !isLockAdmin(config) {
+			return fmt.Errorf("Only lock admins can release locks held by someone else (%v holds %v)", lock.Owner, lockpath)
+		}
+		return nil
+	})
+	if err != nil && err != errNotOwner {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	result.Success = ok
+	result.Lock = existing
+
+	resp, err := smart.NewJsonResponse(req.Id, result)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	return resp
+}
+
+func listLocks(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *smart.JsonResponse {
+	result := smart.ListLocksResponse{Owner: config.User}
+	files, err := ioutil.ReadDir(getLocksDir(config, path))
+	if err != nil && !os.IsNotExist(err) {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), "templock") {
+			continue
+		}
+		lock, err := readLock(filepath.Join(getLocksDir(config, path), f.Name()))
+		if err != nil {
+			return smart.NewJsonErrorResponse(req.Id, err.Error())
+		}
+		if lock != nil {
+			result.Locks = append(result.Locks, lock)
+		}
+	}
+	sort.Sort(locksByPath(result.Locks))
+
+	resp, err := smart.NewJsonResponse(req.Id, result)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	return resp
+}
+
+type locksByPath []*providers.FileLock
+
+func (a locksByPath) Len() int           { return len(a) }
+func (a locksByPath) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a locksByPath) Less(i, j int) bool { return a[i].Path < a[j].Path }
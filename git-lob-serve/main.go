@@ -6,6 +6,8 @@ import (
 	"path/filepath"
 	"runtime/debug"
 
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/providers/smart"
 	"github.com/atlassian/git-lob/util"
 )
 
@@ -30,6 +32,9 @@ func MainImpl() int {
 
 	// Get set up
 	cfg := LoadConfig()
+	// Upstream for caching can be any of the providers the client supports
+	providers.InitCoreProviders()
+	smart.InitCoreProviders()
 
 	if cfg.BasePath == "" {
 		fmt.Fprintf(os.Stderr, "Missing required configuration setting: base-path\n")
@@ -61,11 +66,16 @@ func MainImpl() int {
 		fmt.Fprintf(os.Stderr, "Path argument missing, cannot continue\n")
 		return 18
 	}
+	if os.Args[1] == "replicate" {
+		return Replicate(cfg, os.Args[2:], os.Stdout, os.Stderr)
+	}
 	path := filepath.Clean(os.Args[1])
 	if filepath.IsAbs(path) && !cfg.AllowAbsolutePaths {
 		fmt.Fprintf(os.Stderr, "Path argument %v invalid, absolute paths are not allowed by this server\n", path)
 		return 18
 	}
 
+	cfg.User = getClientIdentity()
+
 	return Serve(os.Stdin, os.Stdout, os.Stderr, cfg, path)
 }
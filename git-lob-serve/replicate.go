@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Replication copies LOBs from this server's store to another store (usually another
+// git-lob-serve at a DR site). To avoid having to scan the whole store each time, when
+// replication is configured we append every LOB which is completed by an upload to
+// a change log in the base path. 'git-lob-serve replicate' copies the LOBs listed since
+// the last run, and records how far it got in a separate file. LOBs which fail to copy
+// are kept in a retry list so they don't hold up the rest of the change log.
+//
+// So that the change log doesn't grow forever, each run moves it aside to start a new one.
+// Servers append to it with a separate open for each LOB, so one may still be appending
+// to the old log just after it's moved; the offset refers to the old log until the next
+// run has read the rest of it, then it's deleted.
+
+// Change log, one '<sha> <path>' line per LOB completed
+const changeLogName = ".git-lob-changes"
+
+// Change log moved aside by the last run, read from the offset before the current one
+const previousChangeLogName = ".git-lob-changes.old"
+
+// Byte offset up to which replication has been attempted, into the previous change log if
+// there is one, otherwise the current change log
+const replicatedOffsetName = ".git-lob-replicated"
+
+// LOBs which failed to replicate, in the same format as the change log, tried again next time
+const replicateRetryName = ".git-lob-replicate-retry"
+
+// Remotes are configured per path since settings can include {path}
+const replicaRemoteName = "git-lob-serve-replica"
+
+// Record that a LOB has been completed so that it will be replicated
+// Failure is not fatal to the client, but will be reported on stderr
+func recordChangedLOB(sha string, config *Config, path string) {
+	if config.ReplicateProvider == "" {
+		return
+	}
+	file := filepath.Join(config.BasePath, changeLogName)
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open change log %v: %v\n", file, err.Error())
+		return
+	}
+	defer f.Close()
+	// Single write per line so that concurrent servers don't interleave
+	_, err = f.WriteString(fmt.Sprintf("%v %v\n", sha, filepath.ToSlash(path)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write to change log %v: %v\n", file, err.Error())
+	}
+}
+
+// Record a LOB as changed if all of its files are now present
+func recordChangedLOBIfComplete(sha string, config *Config, path string) {
+	if config.ReplicateProvider == "" {
+		return
+	}
+	if core.CheckLOBFilesForSHA(sha, getLOBRoot(config, path), false) == nil {
+		recordChangedLOB(sha, config, path)
+	}
+}
+
+// A LOB to replicate and the path (repository) it's in
+type replicateEntry struct {
+	Path string
+	SHA  string
+}
+
+// Read entries from a change log file starting at a byte offset
+// Returns the offset after the last complete line
+func readChangeLog(file string, offset int64) ([]replicateEntry, int64, error) {
+	f, err := os.OpenFile(file, os.O_RDONLY, 0644)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, offset, err
+	}
+	defer f.Close()
+	if s, err := f.Stat(); err == nil && s.Size() < offset {
+		// Change log has been deleted & started again
+		offset = 0
+	}
+	_, err = f.Seek(offset, os.SEEK_SET)
+	if err != nil {
+		return nil, offset, err
+	}
+	var ret []replicateEntry
+	rdr := bufio.NewReader(f)
+	for {
+		line, err := rdr.ReadString('\n')
+		if err != nil {
+			// Incomplete final line is still being written, leave for next time
+			break
+		}
+		offset += int64(len(line))
+		if entry, ok := parseChangeLogLine(line); ok {
+			ret = append(ret, entry)
+		}
+	}
+	return ret, offset, nil
+}
+
+// Parse a '<sha> <path>' line from the change log or retry list
+func parseChangeLogLine(line string) (replicateEntry, bool) {
+	fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 2)
+	if len(fields) != 2 || len(fields[0]) != 40 {
+		return replicateEntry{}, false
+	}
+	return replicateEntry{Path: filepath.FromSlash(fields[1]), SHA: fields[0]}, true
+}
+
+func readRetryList(config *Config) ([]replicateEntry, error) {
+	content, err := ioutil.ReadFile(filepath.Join(config.BasePath, replicateRetryName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ret []replicateEntry
+	for _, line := range strings.Split(string(content), "\n") {
+		if entry, ok := parseChangeLogLine(line); ok {
+			ret = append(ret, entry)
+		}
+	}
+	return ret, nil
+}
+
+// Replace the retry list with entries, removing it if there are none
+func writeRetryList(config *Config, entries []replicateEntry) error {
+	file := filepath.Join(config.BasePath, replicateRetryName)
+	if len(entries) == 0 {
+		err := os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		fmt.Fprintf(&buf, "%v %v\n", entry.SHA, filepath.ToSlash(entry.Path))
+	}
+	return ioutil.WriteFile(file, buf.Bytes(), 0644)
+}
+
+func readReplicatedOffset(config *Config) int64 {
+	content, err := ioutil.ReadFile(filepath.Join(config.BasePath, replicatedOffsetName))
+	if err != nil {
+		return 0
+	}
+	offset, _ := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	return offset
+}
+
+func writeReplicatedOffset(config *Config, offset int64) error {
+	return ioutil.WriteFile(filepath.Join(config.BasePath, replicatedOffsetName), []byte(fmt.Sprintf("%d\n", offset)), 0644)
+}
+
+// Find all the LOBs in the store, for the initial replication
+func findAllLOBs(config *Config) ([]replicateEntry, error) {
+	var ret []replicateEntry
+	err := filepath.Walk(config.BasePath, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if strings.HasPrefix(info.Name(), ".") && file != config.BasePath {
+				// Delta cache etc
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(info.Name(), "_meta") {
+			return nil
+		}
+		sha := strings.TrimSuffix(info.Name(), "_meta")
+		// LOBs are 2 directories below the path
+		lobroot := filepath.Dir(filepath.Dir(filepath.Dir(file)))
+		path, err := filepath.Rel(config.BasePath, lobroot)
+		if len(sha) == 40 && err == nil {
+			ret = append(ret, replicateEntry{Path: path, SHA: sha})
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// Implementation of 'git-lob-serve replicate [--all]'
+func Replicate(config *Config, args []string, out, outerr io.Writer) int {
+	all := false
+	for _, arg := range args {
+		if arg == "--all" {
+			all = true
+		} else {
+			fmt.Fprintf(outerr, "Unknown argument to replicate: %v\n", arg)
+			return 18
+		}
+	}
+	if config.ReplicateProvider == "" {
+		fmt.Fprintf(outerr, "Missing required configuration setting: replicate-provider\n")
+		return 12
+	}
+
+	var entries []replicateEntry
+	var err error
+	changeLog := filepath.Join(config.BasePath, changeLogName)
+	previousChangeLog := filepath.Join(config.BasePath, previousChangeLogName)
+	_, staterr := os.Stat(previousChangeLog)
+	havePrevious := staterr == nil
+	offset := readReplicatedOffset(config)
+	if all {
+		// Anything added to the change log while we scan may or may not be found, so
+		// remember where it is now and pick up from there next time
+		var s os.FileInfo
+		if s, err = os.Stat(changeLog); err == nil {
+			offset = s.Size()
+		} else {
+			offset = 0
+		}
+		entries, err = findAllLOBs(config)
+	} else {
+		if havePrevious {
+			// Finish the previous change log, the offset is into that one
+			entries, _, err = readChangeLog(previousChangeLog, offset)
+			offset = 0
+		}
+		if err == nil {
+			var more []replicateEntry
+			more, offset, err = readChangeLog(changeLog, offset)
+			entries = append(entries, more...)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(outerr, "Unable to find LOBs to replicate: %v\n", err.Error())
+		return 31
+	}
+	retries, err := readRetryList(config)
+	if err != nil {
+		fmt.Fprintf(outerr, "Unable to read replication retry list: %v\n", err.Error())
+		return 31
+	}
+	entries = append(retries, entries...)
+
+	// Group by path, so we only have to configure each destination once
+	// The same LOB can be completed more than once, e.g. if re-uploaded after a failure
+	var paths []string
+	shasByPath := make(map[string][]string)
+	seen := util.NewStringSet()
+	for _, entry := range entries {
+		if !seen.Add(entry.Path + "/" + entry.SHA) {
+			continue
+		}
+		if _, ok := shasByPath[entry.Path]; !ok {
+			paths = append(paths, entry.Path)
+		}
+		shasByPath[entry.Path] = append(shasByPath[entry.Path], entry.SHA)
+	}
+
+	var replicated, skipped int
+	var errorList []string
+	var failed []replicateEntry
+	for i, path := range paths {
+		remoteName := fmt.Sprintf("%v-%d", replicaRemoteName, i)
+		provider, err := configureProviderForRemote(remoteName, config.ReplicateProvider, config.ReplicateSettings, path)
+		if err != nil {
+			fmt.Fprintf(outerr, "Replication configuration invalid: %v\n", err.Error())
+			return 12
+		}
+		for _, sha := range shasByPath[path] {
+			wasSkipped, err := replicateLOB(sha, provider, remoteName, config, path)
+			if err != nil {
+				errorList = append(errorList, fmt.Sprintf("%v in %v: %v", sha, path, err.Error()))
+				failed = append(failed, replicateEntry{Path: path, SHA: sha})
+			} else if wasSkipped {
+				skipped++
+			} else {
+				replicated++
+			}
+		}
+		provider.Release()
+	}
+
+	fmt.Fprintf(out, "Replicated %d LOBs, %d already present\n", replicated, skipped)
+	// Failures are retried next time from the retry list, so the offset can always move on;
+	// write the retry list first so nothing is lost if we're interrupted in between
+	err = writeRetryList(config, failed)
+	if err == nil {
+		err = writeReplicatedOffset(config, offset)
+	}
+	if err == nil && havePrevious {
+		// Offset is now into the current change log
+		err = os.Remove(previousChangeLog)
+	}
+	if err != nil {
+		fmt.Fprintf(outerr, "Unable to record replication progress: %v\n", err.Error())
+		return 32
+	}
+	// Start a new change log; the offset still applies since it's the same file
+	err = os.Rename(changeLog, previousChangeLog)
+	if err != nil && !os.IsNotExist(err) {
+		// Not a problem for replication, the change log just carries on growing
+		fmt.Fprintf(outerr, "Unable to start a new change log: %v\n", err.Error())
+	}
+	if len(errorList) > 0 {
+		fmt.Fprintf(outerr, "Failed to replicate %d LOBs, they will be retried next time:\n  %v\n", len(errorList), strings.Join(errorList, "\n  "))
+		return 32
+	}
+	return 0
+}
+
+// Copy a single LOB to the replica, using a delta if the replica is a smart server
+// and we have a cached delta from a LOB which it already has
+func replicateLOB(sha string, provider providers.SyncProvider, remoteName string,
+	config *Config, path string) (skipped bool, err error) {
+
+	lobroot := getLOBRoot(config, path)
+	files, _, err := core.GetLOBFilesForSHA(sha, lobroot, true, false)
+	if err != nil {
+		// Deleted or never completed, nothing we can do
+		return true, nil
+	}
+
+	if smartProvider := providers.UpgradeToSmartSyncProvider(provider); smartProvider != nil {
+		if exists, _ := smartProvider.LOBExists(remoteName, sha); exists {
+			return true, nil
+		}
+		if replicateLOBDelta(sha, smartProvider, remoteName, config) {
+			return false, nil
+		}
+	}
+
+	skipped = true
+	callback := func(file string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) bool {
+		if progressType != util.ProgressSkip {
+			skipped = false
+		}
+		return false
+	}
+	err = provider.Upload(remoteName, files, lobroot, false, callback)
+	return skipped, err
+}
+
+// Try to send a LOB as a delta from the delta cache, returns whether successful
+func replicateLOBDelta(sha string, provider providers.SmartSyncProvider, remoteName string, config *Config) bool {
+	if config.DeltaCachePath == "" {
+		return false
+	}
+	deltafiles, _ := filepath.Glob(filepath.Join(config.DeltaCachePath, "*_"+sha))
+	if len(deltafiles) == 0 {
+		return false
+	}
+	var bases []string
+	for _, deltafile := range deltafiles {
+		bases = append(bases, strings.TrimSuffix(filepath.Base(deltafile), "_"+sha))
+	}
+	base, err := provider.GetFirstCompleteLOBFromList(remoteName, bases)
+	if err != nil || base == "" {
+		return false
+	}
+	deltafile := getLOBDeltaFilePath(base, sha, config, "")
+	f, err := os.OpenFile(deltafile, os.O_RDONLY, 0644)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	s, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	callback := func(string, util.ProgressCallbackType, int64, int64) bool { return false }
+	// Fall back on uploading the whole LOB if anything goes wrong
+	return provider.UploadDelta(remoteName, base, sha, f, s.Size(), callback) == nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/providers/smart"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Filesystem provider with enough smart features to test sending deltas
+type fakeSmartReplicaProvider struct {
+	providers.FileSystemSyncProvider
+	deltasUploaded []string
+	// LOBs which can't be uploaded
+	failSHAs []string
+}
+
+func (*fakeSmartReplicaProvider) TypeID() string {
+	return "fakesmart"
+}
+func (self *fakeSmartReplicaProvider) Upload(remoteName string, filenames []string, fromDir string, force bool, callback providers.SyncProgressCallback) error {
+	for _, sha := range self.failSHAs {
+		if strings.Contains(filenames[0], sha) {
+			return errors.New("Replica rejected " + sha)
+		}
+	}
+	return self.FileSystemSyncProvider.Upload(remoteName, filenames, fromDir, force, callback)
+}
+func (*fakeSmartReplicaProvider) root(remoteName string) string {
+	return util.GlobalOptions.GitConfig[fmt.Sprintf("remote.%v.git-lob-path", remoteName)]
+}
+func (self *fakeSmartReplicaProvider) LOBExists(remoteName, sha string) (bool, int64) {
+	_, sz, err := core.GetLOBFilesForSHA(sha, self.root(remoteName), true, false)
+	return err == nil, sz
+}
+func (self *fakeSmartReplicaProvider) VerifyLOB(remoteName, sha string) (bool, bool, error) {
+	exists, _ := self.LOBExists(remoteName, sha)
+	return exists, exists && core.CheckLOBFilesForSHA(sha, self.root(remoteName), true) == nil, nil
+}
+func (*fakeSmartReplicaProvider) LockFile(remoteName, path string) (bool, *providers.FileLock, error) {
+	return false, nil, providers.NewLockingNotSupportedError(remoteName)
+}
+func (*fakeSmartReplicaProvider) UnlockFile(remoteName, path string, force bool) (bool, *providers.FileLock, error) {
+	return false, nil, providers.NewLockingNotSupportedError(remoteName)
+}
+func (*fakeSmartReplicaProvider) ListLocks(remoteName string) ([]*providers.FileLock, string, error) {
+	return nil, "", providers.NewLockingNotSupportedError(remoteName)
+}
+func (*fakeSmartReplicaProvider) PrepareDeltaForDownload(remoteName, sha string, candidateBaseSHAs []string) (int64, string, error) {
+	return 0, "", errors.New("Not supported")
+}
+func (*fakeSmartReplicaProvider) DownloadDelta(remoteName, basesha, targetsha string, out io.Writer, callback providers.SyncProgressCallback) error {
+	return errors.New("Not supported")
+}
+func (self *fakeSmartReplicaProvider) GetFirstCompleteLOBFromList(remoteName string, candidateSHAs []string) (string, error) {
+	for _, sha := range candidateSHAs {
+		if core.CheckLOBFilesForSHA(sha, self.root(remoteName), false) == nil {
+			return sha, nil
+		}
+	}
+	return "", nil
+}
+func (self *fakeSmartReplicaProvider) UploadDelta(remoteName, basesha, targetsha string, in io.Reader, size int64, callback providers.SyncProgressCallback) error {
+	self.deltasUploaded = append(self.deltasUploaded, targetsha)
+	return core.ApplyLOBDeltaInBaseDir(self.root(remoteName), basesha, targetsha, in)
+}
+
+var _ = Describe("Replication", func() {
+	var config *Config
+	var replicaPath string
+	var fake *fakeSmartReplicaProvider
+	repopath := filepath.Join("test", "repo")
+	BeforeEach(func() {
+		config = NewConfig()
+		config.BasePath = filepath.Join(os.TempDir(), "git-lob-serve-test")
+		config.DeltaCachePath = filepath.Join(config.BasePath, ".deltacache")
+		os.MkdirAll(config.DeltaCachePath, 0755)
+		replicaPath = filepath.Join(os.TempDir(), "git-lob-serve-replica-test")
+		os.MkdirAll(filepath.Join(replicaPath, repopath), 0755)
+		fake = &fakeSmartReplicaProvider{}
+		providers.RegisterSyncProvider(fake)
+		config.ReplicateProvider = "fakesmart"
+		config.ReplicateSettings["path"] = filepath.Join(replicaPath, "{path}")
+	})
+	AfterEach(func() {
+		os.RemoveAll(config.BasePath)
+		os.RemoveAll(replicaPath)
+		util.GlobalOptions = util.NewOptions()
+	})
+
+	It("Replicates everything, then incrementally using deltas", func() {
+		lobroot := getLOBRoot(config, repopath)
+		replicaroot := filepath.Join(replicaPath, repopath)
+		basedata := bytes.Repeat([]byte("0123456789"), 200)
+		baseinfo, err := core.StoreLOBInBaseDir(lobroot, bytes.NewReader(basedata), nil)
+		Expect(err).To(BeNil(), "Should store base LOB")
+
+		var out, outerr bytes.Buffer
+		Expect(Replicate(config, []string{"--all"}, &out, &outerr)).To(Equal(0), outerr.String())
+		Expect(out.String()).To(ContainSubstring("Replicated 1 LOBs"), "Should replicate existing LOB")
+		Expect(core.CheckLOBFilesForSHA(baseinfo.SHA, replicaroot, true)).To(BeNil(), "Replica should have LOB")
+
+		// Generate a delta to a new version in a scratch store, then upload it to the server
+		scratch := filepath.Join(config.BasePath, ".scratch")
+		targetdata := append(append([]byte{}, basedata...), []byte("changed")...)
+		core.StoreLOBInBaseDir(scratch, bytes.NewReader(basedata), nil)
+		targetinfo, _ := core.StoreLOBInBaseDir(scratch, bytes.NewReader(targetdata), nil)
+		var delta bytes.Buffer
+		_, err = core.GenerateLOBDeltaInBaseDir(scratch, baseinfo.SHA, targetinfo.SHA, &delta)
+		Expect(err).To(BeNil(), "Should generate delta")
+
+		cli, srv := net.Pipe()
+		go Serve(srv, srv, &outerr, config, repopath)
+		trans := smart.NewPersistentTransport(cli)
+		ok, err := trans.UploadDelta(baseinfo.SHA, targetinfo.SHA, int64(delta.Len()), bytes.NewReader(delta.Bytes()), func(int64, int64) {})
+		Expect(err).To(BeNil(), "Should upload delta")
+		Expect(ok).To(BeTrue(), "Should accept delta")
+		cli.Close()
+
+		out.Reset()
+		Expect(Replicate(config, nil, &out, &outerr)).To(Equal(0), outerr.String())
+		Expect(out.String()).To(ContainSubstring("Replicated 1 LOBs"), "Should replicate new LOB")
+		Expect(fake.deltasUploaded).To(Equal([]string{targetinfo.SHA}), "Should send as delta")
+		Expect(core.CheckLOBFilesForSHA(targetinfo.SHA, replicaroot, true)).To(BeNil(), "Replica should have new LOB")
+
+		out.Reset()
+		Expect(Replicate(config, nil, &out, &outerr)).To(Equal(0), outerr.String())
+		Expect(out.String()).To(ContainSubstring("Replicated 0 LOBs, 0 already present"), "Should have nothing left to do")
+	})
+
+	It("Retries LOBs which failed to replicate", func() {
+		lobroot := getLOBRoot(config, repopath)
+		info, _ := core.StoreLOBInBaseDir(lobroot, bytes.NewReader([]byte("some data")), nil)
+		recordChangedLOBIfComplete(info.SHA, config, repopath)
+		config.ReplicateSettings["path"] = filepath.Join(replicaPath, "missing")
+
+		var out, outerr bytes.Buffer
+		Expect(Replicate(config, nil, &out, &outerr)).ToNot(Equal(0), "Should fail with bad config")
+		config.ReplicateSettings["path"] = filepath.Join(replicaPath, "{path}")
+		out.Reset()
+		Expect(Replicate(config, nil, &out, &outerr)).To(Equal(0), outerr.String())
+		Expect(out.String()).To(ContainSubstring("Replicated 1 LOBs"), "Should replicate LOB next time")
+	})
+
+	It("Carries on past LOBs which keep failing to replicate", func() {
+		lobroot := getLOBRoot(config, repopath)
+		replicaroot := filepath.Join(replicaPath, repopath)
+		bad, _ := core.StoreLOBInBaseDir(lobroot, bytes.NewReader([]byte("bad data")), nil)
+		recordChangedLOBIfComplete(bad.SHA, config, repopath)
+		good, _ := core.StoreLOBInBaseDir(lobroot, bytes.NewReader([]byte("good data")), nil)
+		recordChangedLOBIfComplete(good.SHA, config, repopath)
+		fake.failSHAs = []string{bad.SHA}
+
+		var out, outerr bytes.Buffer
+		Expect(Replicate(config, nil, &out, &outerr)).ToNot(Equal(0), "Should report failure")
+		Expect(out.String()).To(ContainSubstring("Replicated 1 LOBs"), "Should replicate the rest")
+		Expect(core.CheckLOBFilesForSHA(good.SHA, replicaroot, true)).To(BeNil(), "Replica should have good LOB")
+		changes, err := os.Stat(filepath.Join(config.BasePath, previousChangeLogName))
+		Expect(err).To(BeNil(), "Should have moved the change log aside")
+		Expect(readReplicatedOffset(config)).To(Equal(changes.Size()), "Should move past the change log")
+
+		newer, _ := core.StoreLOBInBaseDir(lobroot, bytes.NewReader([]byte("newer data")), nil)
+		recordChangedLOBIfComplete(newer.SHA, config, repopath)
+		out.Reset()
+		outerr.Reset()
+		Expect(Replicate(config, nil, &out, &outerr)).ToNot(Equal(0), "Should still report failure")
+		Expect(outerr.String()).To(ContainSubstring(bad.SHA), "Should retry failed LOB")
+		Expect(out.String()).To(ContainSubstring("Replicated 1 LOBs, 0 already present"), "Should only replicate new LOB")
+		Expect(core.CheckLOBFilesForSHA(newer.SHA, replicaroot, true)).To(BeNil(), "Replica should have new LOB")
+
+		fake.failSHAs = nil
+		out.Reset()
+		Expect(Replicate(config, nil, &out, &outerr)).To(Equal(0), outerr.String())
+		Expect(out.String()).To(ContainSubstring("Replicated 1 LOBs"), "Should replicate failed LOB once fixed")
+		Expect(core.CheckLOBFilesForSHA(bad.SHA, replicaroot, true)).To(BeNil(), "Replica should have failed LOB")
+		out.Reset()
+		Expect(Replicate(config, nil, &out, &outerr)).To(Equal(0), outerr.String())
+		Expect(out.String()).To(ContainSubstring("Replicated 0 LOBs, 0 already present"), "Should have nothing left to do")
+	})
+
+	It("Starts a new change log each time without missing late changes", func() {
+		lobroot := getLOBRoot(config, repopath)
+		replicaroot := filepath.Join(replicaPath, repopath)
+		first, _ := core.StoreLOBInBaseDir(lobroot, bytes.NewReader([]byte("first data")), nil)
+		recordChangedLOBIfComplete(first.SHA, config, repopath)
+
+		var out, outerr bytes.Buffer
+		Expect(Replicate(config, nil, &out, &outerr)).To(Equal(0), outerr.String())
+		Expect(out.String()).To(ContainSubstring("Replicated 1 LOBs"), "Should replicate LOB")
+		_, err := os.Stat(filepath.Join(config.BasePath, changeLogName))
+		Expect(os.IsNotExist(err)).To(BeTrue(), "Should have moved the change log aside")
+
+		// A server which opened the change log before it was moved still appends to the old one
+		late, _ := core.StoreLOBInBaseDir(lobroot, bytes.NewReader([]byte("late data")), nil)
+		f, _ := os.OpenFile(filepath.Join(config.BasePath, previousChangeLogName), os.O_WRONLY|os.O_APPEND, 0644)
+		f.WriteString(fmt.Sprintf("%v %v\n", late.SHA, filepath.ToSlash(repopath)))
+		f.Close()
+		newer, _ := core.StoreLOBInBaseDir(lobroot, bytes.NewReader([]byte("newer data")), nil)
+		recordChangedLOBIfComplete(newer.SHA, config, repopath)
+
+		out.Reset()
+		Expect(Replicate(config, nil, &out, &outerr)).To(Equal(0), outerr.String())
+		Expect(out.String()).To(ContainSubstring("Replicated 2 LOBs, 0 already present"), "Should replicate late & new LOBs only")
+		Expect(core.CheckLOBFilesForSHA(late.SHA, replicaroot, true)).To(BeNil(), "Replica should have late LOB")
+		Expect(core.CheckLOBFilesForSHA(newer.SHA, replicaroot, true)).To(BeNil(), "Replica should have new LOB")
+		previous, _ := ioutil.ReadFile(filepath.Join(config.BasePath, previousChangeLogName))
+		Expect(string(previous)).To(Equal(fmt.Sprintf("%v %v\n", newer.SHA, filepath.ToSlash(repopath))), "Old changes should be discarded")
+
+		out.Reset()
+		Expect(Replicate(config, nil, &out, &outerr)).To(Equal(0), outerr.String())
+		Expect(out.String()).To(ContainSubstring("Replicated 0 LOBs, 0 already present"), "Should have nothing left to do")
+	})
+})
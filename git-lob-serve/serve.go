@@ -18,6 +18,10 @@ var methodMap = map[string]MethodFunc{
 	"FileExists":           fileExists,
 	"FileExistsOfSize":     fileExistsOfSize,
 	"LOBExists":            lobExists,
+	"VerifyLOB":            verifyLOB,
+	"LockFile":             lockFile,
+	"UnlockFile":           unlockFile,
+	"ListLocks":            listLocks,
 	"UploadFile":           uploadFile,
 	"DownloadFilePrepare":  downloadFilePrepare,
 	"DownloadFileStart":    downloadFileStart,
@@ -34,6 +38,7 @@ var bytestreamResponseMethods = util.NewStringSetFromSlice([]string{
 })
 
 func Serve(in io.Reader, out io.Writer, outerr io.Writer, config *Config, path string) int {
+	defer releaseUpstreamProvider()
 
 	// Read input from client on stdin, buffered so we can detect terminators for JSON
 
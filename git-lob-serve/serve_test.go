@@ -8,15 +8,19 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 
 	"github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/cloudflare/bm"
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
 	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/providers"
 	"github.com/atlassian/git-lob/providers/smart"
+	"github.com/atlassian/git-lob/util"
 )
 
 var _ = Describe("git-lob-serve tests", func() {
@@ -60,11 +64,113 @@ var _ = Describe("git-lob-serve tests", func() {
 			trans := smart.NewPersistentTransport(cli)
 			caps, err := trans.QueryCaps()
 			Expect(err).To(BeNil(), "Should be no error")
-			Expect(caps).To(ConsistOf([]string{"binary_delta"}))
+			Expect(caps).To(ConsistOf([]string{"binary_delta", "pipelining", "verify", "locking"}))
 			Expect(outerr.String()).To(HaveLen(0), "Nothing should be written to stderr")
 
 		})
 
+		It("Locks and unlocks files (client + reference server)", func() {
+			var outerr bytes.Buffer
+			// Each user gets their own connection, identified by the server as over SSH
+			connectAs := func(user string) *smart.PersistentTransport {
+				userConfig := *config
+				userConfig.User = user
+				cli, srv := net.Pipe()
+				go Serve(srv, srv, &outerr, &userConfig, repopath)
+				return smart.NewPersistentTransport(cli)
+			}
+			config.LockAdmins = []string{"admin"}
+			fred := connectAs("fred")
+			defer fred.Release()
+			jane := connectAs("jane")
+			defer jane.Release()
+			admin := connectAs("admin")
+			defer admin.Release()
+
+			locks, owner, err := fred.ListLocks()
+			Expect(err).To(BeNil(), "Should be no error listing locks")
+			Expect(locks).To(BeEmpty(), "Should be no locks to start with")
+			Expect(owner).To(Equal("fred"), "Should tell client who it is")
+
+			ok, lock, err := fred.LockFile("art/wall.psd")
+			Expect(err).To(BeNil(), "Should be no error locking")
+			Expect(ok).To(BeTrue(), "Should get the lock")
+			Expect(lock.Owner).To(Equal("fred"), "Owner should be the authenticated user")
+			ok, lock, err = fred.LockFile("art/wall.psd")
+			Expect(err).To(BeNil(), "Should be no error locking")
+			Expect(ok).To(BeTrue(), "Should be able to re-lock own lock")
+			ok, lock, err = jane.LockFile("art/wall.psd")
+			Expect(err).To(BeNil(), "Should be no error locking")
+			Expect(ok).To(BeFalse(), "Should not get someone else's lock")
+			Expect(lock.Owner).To(Equal("fred"), "Should report existing lock")
+			ok, _, err = jane.LockFile("art/floor.psd")
+			Expect(err).To(BeNil(), "Should be no error locking")
+			Expect(ok).To(BeTrue(), "Should get the lock")
+			_, _, err = jane.LockFile("")
+			Expect(err).ToNot(BeNil(), "Should not lock blank path")
+			_, _, err = connectAs("").LockFile("art/door.psd")
+			Expect(err).ToNot(BeNil(), "Should not lock without knowing the user")
+
+			locks, _, err = jane.ListLocks()
+			Expect(err).To(BeNil(), "Should be no error listing locks")
+			Expect(locks).To(HaveLen(2))
+			Expect(locks[0].Path).To(Equal("art/floor.psd"))
+			Expect(locks[0].Owner).To(Equal("jane"))
+			Expect(locks[1].Path).To(Equal("art/wall.psd"))
+			Expect(locks[1].Owner).To(Equal("fred"))
+
+			ok, lock, err = jane.UnlockFile("art/wall.psd", false)
+			Expect(err).To(BeNil(), "Should be no error unlocking")
+			Expect(ok).To(BeFalse(), "Should not release someone else's lock")
+			_, _, err = jane.UnlockFile("art/wall.psd", true)
+			Expect(err).ToNot(BeNil(), "Should not force release unless an admin")
+			ok, lock, err = fred.UnlockFile("art/wall.psd", false)
+			Expect(err).To(BeNil(), "Should be no error unlocking")
+			Expect(ok).To(BeTrue(), "Should release own lock")
+			Expect(lock.Owner).To(Equal("fred"))
+			ok, lock, err = fred.UnlockFile("art/wall.psd", false)
+			Expect(err).To(BeNil(), "Should be no error unlocking")
+			Expect(ok).To(BeTrue(), "Unlocking when not locked is fine")
+			Expect(lock).To(BeNil(), "Should be no lock")
+			ok, _, err = admin.UnlockFile("art/floor.psd", true)
+			Expect(err).To(BeNil(), "Should be no error unlocking")
+			Expect(ok).To(BeTrue(), "Admin should force release someone else's lock")
+
+			locks, _, err = fred.ListLocks()
+			Expect(err).To(BeNil(), "Should be no error listing locks")
+			Expect(locks).To(BeEmpty(), "Should be no locks left")
+			leftover, _ := ioutil.ReadDir(getLocksDir(config, repopath))
+			Expect(leftover).To(BeEmpty(), "Should be no temporary lock files left")
+			Expect(outerr.String()).To(HaveLen(0), "Nothing should be written to stderr")
+		})
+
+		It("Doesn't release a lock taken by someone else while unlocking", func() {
+			ok, _, err := createLock(&providers.FileLock{Path: "art/wall.psd", Owner: "fred"}, config, repopath)
+			Expect(err).To(BeNil(), "Should be no error locking")
+			Expect(ok).To(BeTrue(), "Should get the lock")
+			file := getLockFilePath("art/wall.psd", config, repopath)
+			ok, lock, err := removeLock(file, func(lock *providers.FileLock) error {
+				// While fred's lock is set aside, jane takes it, then we decide not to release
+				ok, _, err := createLock(&providers.FileLock{Path: "art/wall.psd", Owner: "jane"}, config, repopath)
+				Expect(err).To(BeNil(), "Should be no error locking")
+				Expect(ok).To(BeTrue(), "Should get the lock")
+				return fmt.Errorf("Not releasing")
+			})
+			Expect(err).ToNot(BeNil(), "Should report the lock couldn't be restored")
+			Expect(ok).To(BeFalse(), "Should not have released")
+			Expect(lock.Owner).To(Equal("fred"), "Should return the lock which was checked")
+			lock, err = readLock(file)
+			Expect(err).To(BeNil(), "Should be no error reading lock")
+			Expect(lock.Owner).To(Equal("jane"), "Jane's lock should be untouched")
+
+			ok, lock, err = removeLock(file, func(lock *providers.FileLock) error { return nil })
+			Expect(err).To(BeNil(), "Should be no error unlocking")
+			Expect(ok).To(BeTrue(), "Should release")
+			Expect(lock.Owner).To(Equal("jane"))
+			leftover, _ := ioutil.ReadDir(getLocksDir(config, repopath))
+			Expect(leftover).To(BeEmpty(), "Should be no temporary lock files left")
+		})
+
 		It("Uploads & downloads simple files (client + reference server)", func() {
 			cli, srv := net.Pipe()
 			var outerr bytes.Buffer
@@ -143,6 +249,40 @@ var _ = Describe("git-lob-serve tests", func() {
 
 		})
 
+		It("Answers pipelined queries in order (client + reference server)", func() {
+			cli, srv := net.Pipe()
+			var outerr bytes.Buffer
+			go Serve(srv, srv, &outerr, config, repopath)
+			defer cli.Close()
+
+			trans := smart.NewPersistentTransport(cli)
+			err := trans.SetEnabledCaps([]string{"binary_delta", "pipelining"})
+			Expect(err).To(BeNil(), "Should be no error enabling caps")
+
+			metardr := strings.NewReader(metacontent)
+			err = trans.UploadMetadata(testsha, int64(len(metacontent)), metardr)
+			Expect(err).To(BeNil(), "Should not be an error in UploadMetadata")
+			chunkrdr := bytes.NewReader(testchunkdata)
+			err = trans.UploadChunk(testsha, testchunkidx, testchunkdatasz, chunkrdr, nil)
+			Expect(err).To(BeNil(), "Should not be an error in UploadChunk")
+
+			queries := []smart.FileExistsRequest{
+				{LobSHA: testsha, Type: "meta"},
+				{LobSHA: testsha, Type: "chunk", ChunkIdx: testchunkidx},
+				{LobSHA: testsha, Type: "chunk", ChunkIdx: testchunkidx + 1},
+				{LobSHA: "0000000000000000000000000000000000000000", Type: "meta"},
+			}
+			results, err := trans.FilesExist(queries)
+			Expect(err).To(BeNil(), "Should not be an error in FilesExist")
+			Expect(results).To(HaveLen(4))
+			Expect(results[0]).To(Equal(smart.FileExistsResponse{Exists: true, Size: int64(len(metacontent))}))
+			Expect(results[1]).To(Equal(smart.FileExistsResponse{Exists: true, Size: testchunkdatasz}))
+			Expect(results[2].Exists).To(BeFalse(), "Chunk should not exist")
+			Expect(results[3].Exists).To(BeFalse(), "Meta should not exist")
+			Expect(outerr.String()).To(HaveLen(0), "Nothing should be written to stderr")
+
+		})
+
 	})
 
 	Context("Delta tests which require valid binaries", func() {
@@ -168,6 +308,40 @@ var _ = Describe("git-lob-serve tests", func() {
 			core.ChunkSize = oldChunkSize
 		})
 
+		It("Verifies LOB content", func() {
+			cli, srv := net.Pipe()
+			var outerr bytes.Buffer
+			go Serve(srv, srv, &outerr, config, repopath)
+			defer cli.Close()
+			trans := smart.NewPersistentTransport(cli)
+
+			lobroot := getLOBRoot(config, repopath)
+			info, err := core.StoreLOBInBaseDir(lobroot, bytes.NewReader(bytes.Repeat([]byte("verify"), 200)), nil)
+			Expect(err).To(BeNil(), "Should store LOB")
+			exists, valid, err := trans.VerifyLOB(info.SHA)
+			Expect(err).To(BeNil(), "Should not be an error in VerifyLOB")
+			Expect(exists).To(BeTrue(), "LOB should exist")
+			Expect(valid).To(BeTrue(), "LOB should be valid")
+
+			// Same size but different content
+			chunk := filepath.Join(lobroot, core.GetLOBChunkRelativePath(info.SHA, 1))
+			f, err := os.OpenFile(chunk, os.O_RDWR, 0644)
+			Expect(err).To(BeNil(), "Should open chunk")
+			f.WriteAt([]byte("broken"), 10)
+			f.Close()
+			exists, valid, err = trans.VerifyLOB(info.SHA)
+			Expect(err).To(BeNil(), "Should not be an error in VerifyLOB")
+			Expect(exists).To(BeTrue(), "LOB should still exist")
+			Expect(valid).To(BeFalse(), "LOB should not be valid")
+
+			os.Remove(chunk)
+			exists, valid, err = trans.VerifyLOB(info.SHA)
+			Expect(err).To(BeNil(), "Should not be an error in VerifyLOB")
+			Expect(exists).To(BeFalse(), "LOB should be incomplete")
+			Expect(valid).To(BeFalse(), "LOB should not be valid")
+			Expect(outerr.String()).To(HaveLen(0), "Nothing should be written to stderr")
+		})
+
 		It("Uploads and downloads deltas", func() {
 			cli, srv := net.Pipe()
 			var outerr bytes.Buffer
@@ -333,4 +507,165 @@ var _ = Describe("git-lob-serve tests", func() {
 
 	})
 
+	Context("Caching proxy", func() {
+		var config *Config
+		var upstreamPath string
+		repopath := "test/repo"
+		BeforeEach(func() {
+			config = NewConfig()
+			config.BasePath = filepath.Join(os.TempDir(), "git-lob-serve-test")
+			os.MkdirAll(config.BasePath, 0755)
+			upstreamPath = filepath.Join(os.TempDir(), "git-lob-serve-upstream-test")
+			os.MkdirAll(filepath.Join(upstreamPath, repopath), 0755)
+			providers.InitCoreProviders()
+			config.UpstreamProvider = "filesystem"
+			config.UpstreamSettings["path"] = filepath.Join(upstreamPath, "{path}")
+		})
+		AfterEach(func() {
+			os.RemoveAll(config.BasePath)
+			os.RemoveAll(upstreamPath)
+			util.GlobalOptions = util.NewOptions()
+		})
+
+		It("Fetches missing LOBs from upstream and caches them", func() {
+			data := bytes.Repeat([]byte{'x'}, 1000)
+			info, err := core.StoreLOBInBaseDir(filepath.Join(upstreamPath, repopath), bytes.NewReader(data), nil)
+			Expect(err).To(BeNil(), "Should store upstream LOB")
+
+			cli, srv := net.Pipe()
+			var outerr bytes.Buffer
+			go Serve(srv, srv, &outerr, config, repopath)
+			defer cli.Close()
+			trans := smart.NewPersistentTransport(cli)
+
+			exists, sz, err := trans.LOBExists(info.SHA)
+			Expect(err).To(BeNil(), "Should not be an error in LOBExists")
+			Expect(exists).To(BeTrue(), "LOB should exist via upstream")
+			Expect(sz).To(BeEquivalentTo(1000), "LOB should be right size")
+			localChunk := getLOBChunkFilePath(info.SHA, 0, config, repopath)
+			Expect(util.FileExistsAndIsOfSize(localChunk, 1000)).To(BeTrue(), "Should have cached the LOB locally")
+
+			// Once cached, upstream is no longer needed
+			os.RemoveAll(upstreamPath)
+			var buf bytes.Buffer
+			err = trans.DownloadChunk(info.SHA, 0, &buf, nil)
+			Expect(err).To(BeNil(), "Should download from cache")
+			Expect(buf.Bytes()).To(Equal(data), "Should download correct content")
+
+			exists, _, err = trans.LOBExists("0000000000000000000000000000000000000000")
+			Expect(err).To(BeNil(), "Should not be an error in LOBExists")
+			Expect(exists).To(BeFalse(), "LOB missing from upstream should not exist")
+		})
+
+		It("Fetches individual files from upstream on download", func() {
+			data := bytes.Repeat([]byte{'y'}, 500)
+			info, err := core.StoreLOBInBaseDir(filepath.Join(upstreamPath, repopath), bytes.NewReader(data), nil)
+			Expect(err).To(BeNil(), "Should store upstream LOB")
+
+			cli, srv := net.Pipe()
+			var outerr bytes.Buffer
+			go Serve(srv, srv, &outerr, config, repopath)
+			defer cli.Close()
+			trans := smart.NewPersistentTransport(cli)
+
+			var buf bytes.Buffer
+			err = trans.DownloadMetadata(info.SHA, &buf)
+			Expect(err).To(BeNil(), "Should download metadata via upstream")
+			Expect(buf.String()).To(ContainSubstring(info.SHA), "Should be correct metadata")
+			buf.Reset()
+			exists, err := trans.ChunkExistsAndIsOfSize(info.SHA, 0, 500)
+			Expect(err).To(BeNil(), "Should not be an error in ChunkExistsAndIsOfSize")
+			Expect(exists).To(BeFalse(), "File existence checks should not fetch from upstream")
+			exists, _, err = trans.ChunkExists(info.SHA, 0)
+			Expect(err).To(BeNil(), "Should not be an error in ChunkExists")
+			Expect(exists).To(BeFalse(), "File existence checks should not fetch from upstream")
+			err = trans.DownloadChunk(info.SHA, 0, &buf, nil)
+			Expect(err).To(BeNil(), "Should download chunk")
+			Expect(buf.Bytes()).To(Equal(data), "Should download correct content")
+			exists, err = trans.ChunkExistsAndIsOfSize(info.SHA, 0, 500)
+			Expect(err).To(BeNil(), "Should not be an error in ChunkExistsAndIsOfSize")
+			Expect(exists).To(BeTrue(), "Chunk should exist once cached")
+		})
+
+		It("Serves downloads through the smart provider", func() {
+			data := bytes.Repeat([]byte{'z'}, 700)
+			info, err := core.StoreLOBInBaseDir(filepath.Join(upstreamPath, repopath), bytes.NewReader(data), nil)
+			Expect(err).To(BeNil(), "Should store upstream LOB")
+			factory := &pipeTransportFactoryForTest{config: config}
+			smart.RegisterTransportFactory(factory)
+			util.GlobalOptions.GitConfig["remote.origin.git-lob-url"] = "pipetest://server/" + repopath
+			provider := &smart.SmartSyncProviderImpl{}
+			defer provider.Release()
+
+			files := []string{core.GetLOBMetaRelativePath(info.SHA), core.GetLOBChunkRelativePath(info.SHA, 0),
+				core.GetLOBMetaRelativePath("0000000000000000000000000000000000000000")}
+			var notfound []string
+			callback := func(file string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) bool {
+				if progressType == util.ProgressNotFound {
+					notfound = append(notfound, file)
+				}
+				return false
+			}
+			destDir := filepath.Join(config.BasePath, "client")
+			err = provider.Download("origin", files, destDir, false, callback)
+			Expect(err).To(BeNil(), "Should download via upstream")
+			Expect(notfound).To(Equal(files[2:]), "Should only report LOBs missing from upstream as not found")
+			Expect(util.FileExistsAndIsOfSize(filepath.Join(destDir, files[1]), 700)).To(BeTrue(), "Should download chunk")
+			Expect(atomic.LoadInt32(&factory.lobExistsCalls)).To(BeNumerically(">", 0), "Should ask proxy about whole LOBs")
+		})
+
+		It("Doesn't ask a server which isn't a proxy about whole LOBs for missing files", func() {
+			config.UpstreamProvider = ""
+			factory := &pipeTransportFactoryForTest{config: config}
+			smart.RegisterTransportFactory(factory)
+			util.GlobalOptions.GitConfig["remote.origin.git-lob-url"] = "pipetest://server/" + repopath
+			provider := &smart.SmartSyncProviderImpl{}
+			defer provider.Release()
+
+			sha := "0000000000000000000000000000000000000000"
+			files := []string{core.GetLOBMetaRelativePath(sha), core.GetLOBChunkRelativePath(sha, 0)}
+			var notfound []string
+			callback := func(file string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) bool {
+				if progressType == util.ProgressNotFound {
+					notfound = append(notfound, file)
+				}
+				return false
+			}
+			err := provider.Download("origin", files, filepath.Join(config.BasePath, "client"), false, callback)
+			Expect(err).To(BeNil(), "Missing files aren't an error")
+			Expect(notfound).To(Equal(files), "Should report files as not found")
+			Expect(atomic.LoadInt32(&factory.lobExistsCalls)).To(BeEquivalentTo(0), "Should make no extra requests")
+		})
+	})
+
 })
+
+// Connects smart transports to a git-lob-serve instance in this process
+type pipeTransportFactoryForTest struct {
+	config         *Config
+	lobExistsCalls int32
+}
+
+// Counts LOBExists requests made by the client
+type countingTransportForTest struct {
+	smart.Transport
+	factory *pipeTransportFactoryForTest
+}
+
+func (self *countingTransportForTest) LOBExists(sha string) (bool, int64, error) {
+	atomic.AddInt32(&self.factory.lobExistsCalls, 1)
+	return self.Transport.LOBExists(sha)
+}
+
+func (self *pipeTransportFactoryForTest) WillHandleUrl(u *url.URL) bool {
+	return u.Scheme == "pipetest"
+}
+
+func (self *pipeTransportFactoryForTest) Connect(u *url.URL) (smart.Transport, error) {
+	cli, srv := net.Pipe()
+	go func() {
+		defer srv.Close()
+		Serve(srv, srv, ioutil.Discard, self.config, strings.TrimPrefix(u.Path, "/"))
+	}()
+	return &countingTransportForTest{Transport: smart.NewPersistentTransport(cli), factory: self}, nil
+}
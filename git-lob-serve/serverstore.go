@@ -68,6 +68,8 @@ func fileExists(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Con
 	if file == "" {
 		return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Unsupported file type: %v", freq.Type))
 	}
+	// Only what we have locally; clients ask about everything they're about to push, so
+	// fetching from upstream here would cross the WAN for every new file
 	s, err := os.Stat(file)
 	if err == nil {
 		result.Exists = true
@@ -93,7 +95,8 @@ func fileExistsOfSize(req *smart.JsonRequest, in io.Reader, out io.Writer, confi
 		return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Unsupported file type: %v", freq.Type))
 	}
 
-	result.Result = util.FileExistsAndIsOfSize(file, freq.Size)
+	s, err := os.Stat(file)
+	result.Result = err == nil && !s.IsDir() && s.Size() == freq.Size
 
 	resp, err := smart.NewJsonResponse(req.Id, result)
 	if err != nil {
@@ -102,6 +105,24 @@ func fileExistsOfSize(req *smart.JsonRequest, in io.Reader, out io.Writer, confi
 	return resp
 }
 
+// Stat a LOB file, first fetching it from the upstream if we don't have it and one is configured
+func statFileOrFetchFromUpstream(file string, config *Config, path string) (os.FileInfo, error) {
+	s, err := os.Stat(file)
+	if err == nil || config.UpstreamProvider == "" {
+		return s, err
+	}
+	relfile, err := filepath.Rel(getLOBRoot(config, path), file)
+	if err != nil {
+		return nil, err
+	}
+	err = fetchFromUpstream([]string{relfile}, config, path)
+	if err != nil {
+		// Log but otherwise treat like any other missing file
+		fmt.Fprintf(os.Stderr, "Unable to fetch %v from upstream: %v\n", relfile, err.Error())
+	}
+	return os.Stat(file)
+}
+
 func ensureDirExists(dir string, cfg *Config) error {
 	if !util.DirExists(dir) {
 		// Get permissions from base path & match (or default to user/group write)
@@ -167,6 +188,8 @@ func uploadFile(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Con
 		if err != nil {
 			receivedresult.ReceivedOK = false
 			receiveerr = fmt.Sprintf("Error when closing temp file: %v", err.Error())
+		} else {
+			recordChangedLOBIfComplete(upreq.LobSHA, config, path)
 		}
 
 	}
@@ -191,7 +214,7 @@ func downloadFilePrepare(req *smart.JsonRequest, in io.Reader, out io.Writer, co
 		return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Unsupported file type: %v", downreq.Type))
 	}
 	result := smart.DownloadFilePrepareResponse{}
-	s, err := os.Stat(file)
+	s, err := statFileOrFetchFromUpstream(file, config, path)
 	if err != nil {
 		// file doesn't exist, this should not have been called
 		return smart.NewJsonErrorResponse(req.Id, "File doesn't exist")
@@ -283,6 +306,13 @@ func lobExists(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Conf
 	}
 	result := smart.LOBExistsResponse{}
 	_, sz, err := core.GetLOBFilesForSHA(params.LobSHA, getLOBRoot(config, path), true, false)
+	if err != nil && config.UpstreamProvider != "" {
+		// Fill the cache from upstream so the client's downloads are served locally
+		// Upstream errors are treated the same as not existing
+		if fetchLOBFromUpstream(params.LobSHA, config, path) == nil {
+			_, sz, err = core.GetLOBFilesForSHA(params.LobSHA, getLOBRoot(config, path), true, false)
+		}
+	}
 	// in the case of error, assume missing so return default false
 	if err == nil {
 		result.Exists = true
@@ -295,6 +325,27 @@ func lobExists(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Conf
 	return resp
 }
 
+func verifyLOB(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *smart.JsonResponse {
+	params := smart.VerifyLOBRequest{}
+	err := smart.ExtractStructFromJsonRawMessage(req.Params, &params)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	result := smart.VerifyLOBResponse{}
+	// Only checks what's in this store, a caching proxy doesn't fetch from upstream
+	lobroot := getLOBRoot(config, path)
+	if core.CheckLOBFilesForSHA(params.LobSHA, lobroot, false) == nil {
+		result.Exists = true
+		// Now the expensive part; read all the content & check the SHA
+		result.Valid = core.CheckLOBFilesForSHA(params.LobSHA, lobroot, true) == nil
+	}
+	resp, err := smart.NewJsonResponse(req.Id, result)
+	if err != nil {
+		return smart.NewJsonErrorResponse(req.Id, err.Error())
+	}
+	return resp
+}
+
 func uploadDelta(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Config, path string) *smart.JsonResponse {
 	upreq := smart.UploadDeltaRequest{}
 	err := smart.ExtractStructFromJsonRawMessage(req.Params, &upreq)
@@ -363,6 +414,7 @@ func uploadDelta(req *smart.JsonRequest, in io.Reader, out io.Writer, config *Co
 	if err != nil {
 		return smart.NewJsonErrorResponse(req.Id, fmt.Sprintf("Error when applying delta: %v", err.Error()))
 	}
+	recordChangedLOB(upreq.TargetLobSHA, config, path)
 
 	// Now save the delta so we can use it later on in DownloadDelta for other clients
 	// Ignore any errors on renaming, just means it won't be in the cache (inconvenient but not fatal, temp will be deleted on return)
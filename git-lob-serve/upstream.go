@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/atlassian/git-lob/core"
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+// When an upstream is configured this server acts as a caching proxy; anything
+// a client asks to download which we don't have is fetched from the upstream
+// and stored locally, so it only has to cross the slow link once.
+// The upstream is any sync provider (including another smart server), configured
+// as if it were a git remote with this name
+const upstreamRemoteName = "git-lob-serve-upstream"
+
+// Provider used for the upstream, so it can be released when the client is done
+var upstreamProvider providers.SyncProvider
+
+// Get the provider for the upstream, or nil if none is configured
+func getUpstreamProvider(config *Config, path string) (providers.SyncProvider, error) {
+	if config.UpstreamProvider == "" {
+		return nil, nil
+	}
+	// Always re-apply settings, they depend on the path
+	p, err := configureProviderForRemote(upstreamRemoteName, config.UpstreamProvider, config.UpstreamSettings, path)
+	if err != nil {
+		return nil, fmt.Errorf("Upstream configuration invalid: %v", err)
+	}
+	upstreamProvider = p
+	return upstreamProvider, nil
+}
+
+// Set up the git config for a provider from settings in the server config, as if
+// they were in the section for remoteName, and return the provider
+func configureProviderForRemote(remoteName, providerType string, settings map[string]string, path string) (providers.SyncProvider, error) {
+	util.GlobalOptions.GitConfig[fmt.Sprintf("remote.%v.git-lob-provider", remoteName)] = providerType
+	for key, val := range settings {
+		// Allow settings to refer to the path requested, e.g. to use the same layout upstream
+		val = strings.Replace(val, "{path}", path, -1)
+		util.GlobalOptions.GitConfig[fmt.Sprintf("remote.%v.git-lob-%v", remoteName, key)] = val
+	}
+	return providers.GetProviderForRemote(remoteName)
+}
+
+func releaseUpstreamProvider() {
+	if upstreamProvider != nil {
+		upstreamProvider.Release()
+		upstreamProvider = nil
+	}
+}
+
+// Fetch files (relative to the LOB root) from the upstream into the local store
+// Files the upstream doesn't have are not an error, the caller should check afterwards
+func fetchFromUpstream(files []string, config *Config, path string) error {
+	provider, err := getUpstreamProvider(config, path)
+	if err != nil || provider == nil {
+		return err
+	}
+	lobroot := getLOBRoot(config, path)
+	err = ensureDirExists(lobroot, config)
+	if err != nil {
+		return err
+	}
+	return provider.Download(upstreamRemoteName, files, lobroot, false, nil)
+}
+
+// Fetch all the files for a LOB from the upstream into the local store
+func fetchLOBFromUpstream(sha string, config *Config, path string) error {
+	err := fetchFromUpstream([]string{core.GetLOBMetaRelativePath(sha)}, config, path)
+	if err != nil {
+		return err
+	}
+	// Meta tells us what chunks there should be (will fail if upstream didn't have it)
+	files, _, err := core.GetLOBFilesForSHA(sha, getLOBRoot(config, path), false, false)
+	if err != nil {
+		return err
+	}
+	// Chunks we already have at the right size are skipped
+	return fetchFromUpstream(files[1:], config, path)
+}
@@ -0,0 +1,495 @@
+package providers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// AzureBlobSyncProvider implements the basic SyncProvider interface for Azure Blob Storage
+type AzureBlobSyncProvider struct {
+	// Client used for all requests, http.DefaultClient if nil
+	HTTPClient *http.Client
+}
+
+func (*AzureBlobSyncProvider) TypeID() string {
+	return "azureblob"
+}
+
+func (*AzureBlobSyncProvider) HelpTextSummary() string {
+	return `azureblob: transfers binaries to/from an Azure Blob Storage container`
+}
+
+func (*AzureBlobSyncProvider) HelpTextDetail() string {
+	return `The "azureblob" provider synchronises files with a container in Azure Blob Storage
+
+Required parameters in remote section of .gitconfig:
+    git-lob-azure-container  The container to use as the root remote store. Must
+                             already exist.
+
+Optional parameters in the remote section:
+    git-lob-azure-account    The storage account name. If not specified, uses
+                             AZURE_STORAGE_ACCOUNT from your environment.
+    git-lob-azure-prefix     A prefix to put in front of every blob name, so that
+                             many repos can share one container.
+    git-lob-azure-sas        A shared access signature (SAS) token to authenticate
+                             with. Can also be set in other ways, see below.
+    git-lob-azure-endpoint   The URL of the blob service for the account. Default
+                             https://ACCOUNT.blob.core.windows.net. Set this to use
+                             the Azurite emulator, e.g.
+                             http://127.0.0.1:10000/devstoreaccount1
+    git-lob-retries          The number of times to retry a file which fails for a
+                             transient reason, e.g. throttling or network errors.
+                             Default 3, or git-lob.retries if set.
+
+Example configuration:
+    [remote "origin"]
+        url = git@blah.com/your/usual/git/repo
+        git-lob-provider = azureblob
+        git-lob-azure-account = mystorageaccount
+        git-lob-azure-container = binaries
+
+Authentication:
+
+  Either a SAS token or the account's shared key can be used. Settings are
+  read in this order:
+
+  1. remote.REMOTE.git-lob-azure-sas in your git config
+  2. AZURE_STORAGE_SAS_TOKEN in your environment
+  3. AZURE_STORAGE_KEY in your environment (shared key)
+
+  The SAS token must grant read, write & create permissions on the container
+  (plus list if you want to check for missing containers up-front). Shared keys
+  are never read from git config since they grant full access to the account.
+
+Testing with Azurite:
+
+  Start the emulator, create a container, then configure the remote with
+      git-lob-azure-account = devstoreaccount1
+      git-lob-azure-endpoint = http://127.0.0.1:10000/devstoreaccount1
+  and set AZURE_STORAGE_KEY to the well-known Azurite account key.
+`
+}
+
+// Version of the Blob service REST API we use
+const AzureBlobAPIVersion = "2019-12-12"
+
+// Connection details for one remote
+type azureBlobRemote struct {
+	account   string
+	container string
+	// Prefix for blob names, blank or ending in "/"
+	prefix string
+	// Base URL of the blob service for the account
+	endpoint *url.URL
+	// Shared key (decoded), if using shared key auth
+	key []byte
+	// SAS token parameters, if using SAS auth
+	sas url.Values
+}
+
+// Error response from the Blob service
+type AzureBlobError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (self *AzureBlobError) Error() string {
+	if self.Code != "" {
+		return fmt.Sprintf("%v (%d %v)", self.Message, self.StatusCode, self.Code)
+	}
+	return fmt.Sprintf("%v (%d)", self.Message, self.StatusCode)
+}
+
+// Build an error from a failed response & close the body
+func newAzureBlobError(resp *http.Response) error {
+	defer resp.Body.Close()
+	err := &AzureBlobError{StatusCode: resp.StatusCode, Code: resp.Header.Get("x-ms-error-code"), Message: resp.Status}
+	var body struct {
+		Code    string
+		Message string
+	}
+	if xml.NewDecoder(resp.Body).Decode(&body) == nil {
+		if body.Code != "" {
+			err.Code = body.Code
+		}
+		if body.Message != "" {
+			err.Message = strings.TrimSpace(strings.SplitN(body.Message, "\n", 2)[0])
+		}
+	}
+	return err
+}
+
+// Is an error transient, i.e. throttling, server-side or network problems?
+func isAzureBlobRetryableError(err error) bool {
+	switch e := err.(type) {
+	case *AzureBlobError:
+		return e.StatusCode >= 500 || e.StatusCode == 408 || e.StatusCode == 429
+	case net.Error:
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// Is an error one which will affect all requests, e.g. authentication or missing container?
+func isAzureBlobFatalError(err error) bool {
+	if e, ok := err.(*AzureBlobError); ok {
+		return e.StatusCode == 401 || e.StatusCode == 403 || e.Code == "ContainerNotFound"
+	}
+	return false
+}
+
+func (self *AzureBlobSyncProvider) getRemote(remoteName string) (*azureBlobRemote, error) {
+	remote := &azureBlobRemote{}
+	setting := fmt.Sprintf("remote.%v.git-lob-azure-container", remoteName)
+	remote.container = strings.TrimSpace(util.GlobalOptions.GitConfig[setting])
+	if remote.container == "" {
+		return nil, fmt.Errorf("Configuration invalid for 'azureblob', missing setting %v", setting)
+	}
+	setting = fmt.Sprintf("remote.%v.git-lob-azure-account", remoteName)
+	remote.account = strings.TrimSpace(util.GlobalOptions.GitConfig[setting])
+	if remote.account == "" {
+		remote.account = os.Getenv("AZURE_STORAGE_ACCOUNT")
+	}
+	if remote.account == "" {
+		return nil, fmt.Errorf("Configuration invalid for 'azureblob', missing setting %v or AZURE_STORAGE_ACCOUNT", setting)
+	}
+	prefix := strings.Trim(strings.TrimSpace(util.GlobalOptions.GitConfig[fmt.Sprintf("remote.%v.git-lob-azure-prefix", remoteName)]), "/")
+	if prefix != "" {
+		remote.prefix = prefix + "/"
+	}
+
+	setting = fmt.Sprintf("remote.%v.git-lob-azure-endpoint", remoteName)
+	endpoint := strings.TrimSpace(util.GlobalOptions.GitConfig[setting])
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%v.blob.core.windows.net", remote.account)
+	}
+	var err error
+	remote.endpoint, err = url.Parse(strings.TrimRight(endpoint, "/"))
+	if err != nil || (remote.endpoint.Scheme != "http" && remote.endpoint.Scheme != "https") || remote.endpoint.Host == "" {
+		return nil, fmt.Errorf("Invalid value for %v, must be an http or https URL: %v", setting, endpoint)
+	}
+
+	sas := strings.TrimSpace(util.GlobalOptions.GitConfig[fmt.Sprintf("remote.%v.git-lob-azure-sas", remoteName)])
+	if sas == "" {
+		sas = os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+	}
+	if sas != "" {
+		remote.sas, err = url.ParseQuery(strings.TrimPrefix(sas, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Azure SAS token: %v", err.Error())
+		}
+	} else if key := os.Getenv("AZURE_STORAGE_KEY"); key != "" {
+		remote.key, err = base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid AZURE_STORAGE_KEY: %v", err.Error())
+		}
+	} else {
+		return nil, errors.New("Unable to locate Azure authentication settings, need a SAS token or AZURE_STORAGE_KEY")
+	}
+	return remote, nil
+}
+
+func (self *AzureBlobSyncProvider) client() *http.Client {
+	if self.HTTPClient != nil {
+		return self.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Build a request for a path relative to the account endpoint; it's authenticated in do()
+func (self *AzureBlobSyncProvider) newRequest(remote *azureBlobRemote, method, path string, query url.Values,
+	body io.Reader, size int64) (*http.Request, error) {
+
+	u := *remote.endpoint
+	u.Path = remote.endpoint.Path + "/" + path
+	params := url.Values{}
+	for k, v := range query {
+		params[k] = v
+	}
+	for k, v := range remote.sas {
+		params[k] = v
+	}
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			// Make sure Content-Length: 0 is sent rather than chunked encoding
+			req.Body = http.NoBody
+		}
+	}
+	req.Header.Set("x-ms-version", AzureBlobAPIVersion)
+	return req, nil
+}
+
+// Sign a request with the account's shared key
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func azureBlobSignature(remote *azureBlobRemote, req *http.Request) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+	var msHeaders []string
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-ms-") {
+			msHeaders = append(msHeaders, k+":"+strings.Join(v, ","))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	resource := "/" + remote.account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	var params []string
+	for k, v := range query {
+		sort.Strings(v)
+		params = append(params, strings.ToLower(k)+":"+strings.Join(v, ","))
+	}
+	sort.Strings(params)
+	for _, p := range params {
+		resource += "\n" + p
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, we use x-ms-date instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}, "\n") + "\n"
+	for _, h := range msHeaders {
+		stringToSign += h + "\n"
+	}
+	stringToSign += resource
+
+	mac := hmac.New(sha256.New, remote.key)
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Authenticate & perform a request, returning an *AzureBlobError for failure responses
+func (self *AzureBlobSyncProvider) do(remote *azureBlobRemote, req *http.Request) (*http.Response, error) {
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	if remote.key != nil {
+		req.Header.Set("Authorization", fmt.Sprintf("SharedKey %v:%v", remote.account, azureBlobSignature(remote, req)))
+	}
+	resp, err := self.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		if req.Method == "HEAD" && resp.Header.Get("x-ms-error-code") == "" {
+			// No body in HEAD responses, make the message meaningful at least
+			resp.Status = fmt.Sprintf("%v %v", req.URL.Path, resp.Status)
+		}
+		return nil, newAzureBlobError(resp)
+	}
+	return resp, nil
+}
+
+// Get the path of a blob relative to the account endpoint
+func (self *AzureBlobSyncProvider) blobPath(remote *azureBlobRemote, filename string) string {
+	return remote.container + "/" + remote.prefix + filepath.ToSlash(filename)
+}
+
+// Describe where files are stored for messages
+func (self *AzureBlobSyncProvider) location(remote *azureBlobRemote) string {
+	return "Azure container " + remote.container
+}
+
+// Get the single file transfer helper for a remote
+func (self *AzureBlobSyncProvider) fileTransfer(remoteName string, remote *azureBlobRemote) *remoteFileTransfer {
+	return &remoteFileTransfer{
+		remoteName:  remoteName,
+		location:    self.location(remote),
+		isRetryable: isAzureBlobRetryableError,
+		isFatal:     isAzureBlobFatalError,
+		stat: func(filename string) (bool, int64, error) {
+			return self.blobProperties(remoteName, remote, filename)
+		},
+	}
+}
+
+// Get whether a blob exists & its size, retrying transient errors
+func (self *AzureBlobSyncProvider) blobProperties(remoteName string, remote *azureBlobRemote, filename string) (exists bool, size int64, err error) {
+	_, err = retryTransfer(isAzureBlobRetryableError, remoteName, self.location(remote), filename, 0, nil, func() error {
+		req, err := self.newRequest(remote, "HEAD", self.blobPath(remote, filename), nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		resp, err := self.do(remote, req)
+		if err != nil {
+			if e, ok := err.(*AzureBlobError); ok && e.StatusCode == 404 {
+				exists = false
+				return nil
+			}
+			return err
+		}
+		resp.Body.Close()
+		exists = true
+		size = resp.ContentLength
+		return nil
+	})
+	return exists, size, err
+}
+
+// Check the container is accessible, retrying transient errors
+// This saves us failing on every file
+func (self *AzureBlobSyncProvider) checkContainer(remoteName string, remote *azureBlobRemote) error {
+	_, err := retryTransfer(isAzureBlobRetryableError, remoteName, self.location(remote), remote.container, 0, nil, func() error {
+		req, err := self.newRequest(remote, "HEAD", remote.container, url.Values{"restype": {"container"}}, nil, 0)
+		if err != nil {
+			return err
+		}
+		resp, err := self.do(remote, req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	})
+	if e, ok := err.(*AzureBlobError); ok && e.StatusCode == 403 && remote.sas != nil {
+		// SAS tokens scoped to blobs can't read container properties; just try the files
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to access Azure container '%v' for remote '%v': %v", remote.container, remoteName, err.Error())
+	}
+	return nil
+}
+
+func (self *AzureBlobSyncProvider) ValidateConfig(remoteName string) error {
+	_, err := self.getRemote(remoteName)
+	return err
+}
+
+func (self *AzureBlobSyncProvider) Release() {
+	// Nothing to do, HTTP connections are pooled by the client
+}
+
+func (self *AzureBlobSyncProvider) FileExists(remoteName, filename string) bool {
+	remote, err := self.getRemote(remoteName)
+	if err != nil {
+		return false
+	}
+	exists, _, err := self.blobProperties(remoteName, remote, filename)
+	return err == nil && exists
+}
+
+func (self *AzureBlobSyncProvider) FileExistsAndIsOfSize(remoteName, filename string, sz int64) bool {
+	remote, err := self.getRemote(remoteName)
+	if err != nil {
+		return false
+	}
+	exists, size, err := self.blobProperties(remoteName, remote, filename)
+	return err == nil && exists && size == sz
+}
+
+// Upload one file to a block blob
+// Blobs are not visible until fully uploaded so no need for temporary names
+func (self *AzureBlobSyncProvider) putBlob(remote *azureBlobRemote, filename string, inf *os.File, size int64,
+	callback SyncProgressCallback) (userAborted bool, err error) {
+
+	userAborted, err = restartUpload(inf, filename, size, callback)
+	if userAborted || err != nil {
+		return userAborted, err
+	}
+	// Create a Reader which reports progress as it is read from
+	progressReader := NewSyncProgressReader(inf, filename, size, callback)
+	req, err := self.newRequest(remote, "PUT", self.blobPath(remote, filename), nil, progressReader, size)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	req.Header.Set("x-ms-blob-content-type", "application/octet-stream")
+	resp, err := self.do(remote, req)
+	if progressReader.Aborted {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return false, nil
+}
+
+func (self *AzureBlobSyncProvider) Upload(remoteName string, filenames []string, fromDir string,
+	force bool, callback SyncProgressCallback) error {
+
+	remote, err := self.getRemote(remoteName)
+	if err != nil {
+		return err
+	}
+
+	util.LogDebug("Uploading to Azure container", remote.container)
+
+	err = self.checkContainer(remoteName, remote)
+	if err != nil {
+		return err
+	}
+
+	transfer := self.fileTransfer(remoteName, remote)
+	return transferEachFile(filenames, func(filename string) ([]string, bool) {
+		return transfer.upload(filename, fromDir, force, callback, func(inf *os.File, size int64) (bool, error) {
+			return self.putBlob(remote, filename, inf, size, callback)
+		}, nil)
+	})
+}
+
+func (self *AzureBlobSyncProvider) Download(remoteName string, filenames []string, toDir string, force bool, callback SyncProgressCallback) error {
+
+	remote, err := self.getRemote(remoteName)
+	if err != nil {
+		return err
+	}
+
+	util.LogDebug("Downloading from Azure container", remote.container)
+
+	err = self.checkContainer(remoteName, remote)
+	if err != nil {
+		return err
+	}
+
+	transfer := self.fileTransfer(remoteName, remote)
+	return transferEachFile(filenames, func(filename string) ([]string, bool) {
+		return transfer.download(filename, toDir, force, callback, func() (io.ReadCloser, error) {
+			req, err := self.newRequest(remote, "GET", self.blobPath(remote, filename), nil, nil, 0)
+			if err != nil {
+				return nil, err
+			}
+			resp, err := self.do(remote, req)
+			if err != nil {
+				return nil, err
+			}
+			return resp.Body, nil
+		})
+	})
+}
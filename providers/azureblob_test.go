@@ -0,0 +1,110 @@
+package providers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+// Minimal in-memory stand-in for the Blob service, enough for the provider
+type fakeAzureBlobServer struct {
+	fakeHTTPServerForTest
+	blobs map[string][]byte
+}
+
+func (self *fakeAzureBlobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer self.mutex.Unlock()
+	if self.failRequest(w, r) {
+		return
+	}
+	if r.URL.Query().Get("restype") == "container" {
+		if r.URL.Path != "/devstoreaccount1/thecontainer" {
+			w.Header().Set("x-ms-error-code", "ContainerNotFound")
+			w.WriteHeader(404)
+		}
+		return
+	}
+	switch r.Method {
+	case "HEAD", "GET":
+		data, ok := self.blobs[r.URL.Path]
+		if !ok {
+			w.Header().Set("x-ms-error-code", "BlobNotFound")
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+	case "PUT":
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			w.WriteHeader(400)
+			return
+		}
+		if data, ok := self.receiveUpload(w, r); ok {
+			self.blobs[r.URL.Path] = data
+			w.WriteHeader(201)
+		}
+	}
+}
+
+var _ = Describe("Azure Blob", func() {
+	var server *httptest.Server
+	var fake *fakeAzureBlobServer
+	var azure *AzureBlobSyncProvider
+	var tmp string
+	BeforeEach(func() {
+		fake = &fakeAzureBlobServer{blobs: make(map[string][]byte)}
+		server = httptest.NewServer(fake)
+		azure = &AzureBlobSyncProvider{}
+		GlobalOptions.GitConfig["remote.origin.git-lob-azure-account"] = "devstoreaccount1"
+		GlobalOptions.GitConfig["remote.origin.git-lob-azure-container"] = "thecontainer"
+		GlobalOptions.GitConfig["remote.origin.git-lob-azure-endpoint"] = server.URL + "/devstoreaccount1"
+		GlobalOptions.GitConfig["remote.origin.git-lob-azure-sas"] = "?sv=2019-12-12&sig=abc%2Fdef"
+		tmp, _ = ioutil.TempDir("", "azuretest")
+	})
+	AfterEach(func() {
+		server.Close()
+		GlobalOptions = NewOptions()
+		os.RemoveAll(tmp)
+	})
+
+	It("Validates configuration", func() {
+		CheckValidateConfigForTest(azure, map[string]string{
+			"remote.origin.git-lob-azure-endpoint":  "ftp://nope",
+			"remote.origin.git-lob-azure-container": "",
+		})
+	})
+
+	It("Uploads, checks and downloads files", func() {
+		GlobalOptions.GitConfig["remote.origin.git-lob-azure-prefix"] = "/myrepo/"
+		blobPath := "/devstoreaccount1/thecontainer/myrepo/ab/cd/file1.bin"
+		CheckUploadDownloadForTest(azure, tmp, func() []byte { return fake.blobs[blobPath] })
+		for _, req := range fake.requests {
+			Expect(req.URL.Query().Get("sig")).To(Equal("abc/def"), "Should pass SAS token")
+			Expect(req.Header.Get("x-ms-version")).To(Equal(AzureBlobAPIVersion), "Should send API version")
+		}
+	})
+
+	It("Retries transient errors", func() {
+		CheckRetriesForTest(azure, &fake.fakeHTTPServerForTest, tmp)
+	})
+
+	It("Signs requests with a shared key", func() {
+		remote := &azureBlobRemote{account: "myaccount", key: []byte("secretkey")}
+		req, _ := http.NewRequest("PUT", "https://myaccount.blob.core.windows.net/mycontainer/a%20b/file.bin?timeout=30&comp=block", strings.NewReader("hello"))
+		req.ContentLength = 5
+		req.Header.Set("x-ms-date", "Sun, 11 Oct 2009 21:49:13 GMT")
+		req.Header.Set("x-ms-version", "2019-12-12")
+		req.Header.Set("x-ms-blob-type", "BlockBlob")
+		req.Header.Set("Content-Type", "application/octet-stream")
+		Expect(azureBlobSignature(remote, req)).To(Equal("IlBxKRaLgWwV9qyn3M5iSHB1Q5Hc8Ahj1majnGHW0Dg="), "Signature should match the reference")
+	})
+})
@@ -141,10 +141,12 @@ func (*FileSystemSyncProvider) uploadSingleFile(remoteName, filename, fromDir, t
 			return errorList, true
 		}
 	}
+	// Limit reading rather than writing so that the final write isn't delayed
+	limitedIn := util.UploadRateLimiter().Reader(inf)
 	var copysize int64 = 0
 	for {
 		var n int64
-		n, err = io.CopyN(outf, inf, FileSystemBufferSize)
+		n, err = io.CopyN(outf, limitedIn, FileSystemBufferSize)
 		copysize += n
 		if n > 0 && callback != nil && srcfi.Size() > 0 {
 			if callback(filename, util.ProgressTransferBytes, copysize, srcfi.Size()) {
@@ -282,10 +284,11 @@ func (*FileSystemSyncProvider) downloadSingleFile(remoteName, filename, fromDir,
 			return errorList, true
 		}
 	}
+	limitedOut := util.DownloadRateLimiter().Writer(outf)
 	var copysize int64 = 0
 	for {
 		var n int64
-		n, err = io.CopyN(outf, inf, FileSystemBufferSize)
+		n, err = io.CopyN(limitedOut, inf, FileSystemBufferSize)
 		copysize += n
 		if n > 0 && callback != nil && srcfi.Size() > 0 {
 			if callback(filename, util.ProgressTransferBytes, copysize, srcfi.Size()) {
@@ -0,0 +1,713 @@
+package providers
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/mitchellh/go-homedir"
+	"github.com/atlassian/git-lob/util"
+)
+
+// GCSSyncProvider implements the basic SyncProvider interface for Google Cloud Storage
+type GCSSyncProvider struct {
+	// Client used for all requests, http.DefaultClient if nil
+	HTTPClient *http.Client
+	// Access tokens by credentials file, re-used until they expire
+	tokens     map[string]*gcsToken
+	tokenMutex sync.Mutex
+}
+
+func (*GCSSyncProvider) TypeID() string {
+	return "gcs"
+}
+
+func (*GCSSyncProvider) HelpTextSummary() string {
+	return `gcs: transfers binaries to/from a Google Cloud Storage bucket`
+}
+
+func (*GCSSyncProvider) HelpTextDetail() string {
+	return `The "gcs" provider synchronises files with a bucket on Google Cloud Storage
+
+Required parameters in remote section of .gitconfig:
+    git-lob-gcs-bucket  The bucket to use as the root remote store. Must already exist.
+
+Optional parameters in the remote section:
+    git-lob-gcs-prefix  A prefix to put in front of every object name, so that many
+                        repos can share one bucket, e.g. "repos/myrepo".
+    git-lob-gcs-credentials
+                        The path of a service account key file (JSON) to
+                        authenticate with. Can also be set in other ways, see
+                        global settings below.
+    git-lob-gcs-endpoint
+                        The URL of the storage API to use instead of Google's,
+                        e.g. a local fake-gcs-server (http://localhost:4443).
+                        Credentials are optional when this is set.
+    git-lob-gcs-chunksize
+                        Files larger than this are uploaded in chunks using a
+                        resumable upload, so an interrupted upload can carry on
+                        where it left off. Rounded up to a multiple of 256KB.
+                        Default 8MB.
+    git-lob-retries     The number of times to retry a file which fails for a
+                        transient reason, e.g. rate limiting (429) or network
+                        errors. Default 3, or git-lob.retries if set.
+
+Example configuration:
+    [remote "origin"]
+        url = git@blah.com/your/usual/git/repo
+        git-lob-provider = gcs
+        git-lob-gcs-bucket = my.bucket.name
+        git-lob-gcs-prefix = datasets
+
+Authentication:
+
+  Requests are authenticated with a service account key, which you can create
+  in the IAM section of the Google Cloud console. The account needs the
+  Storage Object Admin role (or object create & view permissions) on the
+  bucket. The key file is located in this order:
+
+  1. remote.REMOTE.git-lob-gcs-credentials in your git config
+  2. git-lob.gcs-credentials in your git config
+  3. GOOGLE_APPLICATION_CREDENTIALS in your environment
+
+Testing with fake-gcs-server:
+
+  Run fake-gcs-server with -scheme http, create a bucket, then set
+  git-lob-gcs-endpoint to its URL (e.g. http://localhost:4443). No credentials
+  are needed.
+`
+}
+
+const GCSDefaultEndpoint = "https://storage.googleapis.com"
+
+// Resumable upload chunks must be a multiple of this size
+const GCSChunkGranularity = 256 * 1024
+
+const GCSDefaultChunkSize = 8 * 1024 * 1024
+
+// Give up on a resumable upload if the server doesn't accept this many chunks in a row
+const GCSMaxStalledChunks = 3
+
+// How long we keep an incomplete resumable upload to carry on with; Google expires them after a week
+const GCSUploadExpiry = 6 * 24 * time.Hour
+
+// OAuth scope needed to read & write objects
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// Connection details for one remote
+type gcsRemote struct {
+	bucket string
+	// Prefix for object names, blank or ending in "/"
+	prefix string
+	// Base URL of the storage API
+	endpoint string
+	// Service account key file, blank for unauthenticated access to a custom endpoint
+	credentials string
+	chunkSize   int64
+}
+
+// Fields we use from a service account key file
+type gcsServiceAccount struct {
+	Type        string `json:"type"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+type gcsToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	expiry      time.Time
+}
+
+// Error response from the storage API
+type GCSError struct {
+	StatusCode int
+	Message    string
+}
+
+func (self *GCSError) Error() string {
+	return fmt.Sprintf("%v (%d)", self.Message, self.StatusCode)
+}
+
+// Build an error from a failed response & close the body
+func newGCSError(resp *http.Response) error {
+	defer resp.Body.Close()
+	err := &GCSError{StatusCode: resp.StatusCode, Message: resp.Status}
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+		// OAuth token errors
+		ErrorDescription string `json:"error_description"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&body) == nil {
+		if body.Error.Message != "" {
+			err.Message = body.Error.Message
+		} else if body.ErrorDescription != "" {
+			err.Message = body.ErrorDescription
+		}
+	}
+	return err
+}
+
+// Is an error transient, i.e. rate limiting, server-side or network problems?
+func isGCSRetryableError(err error) bool {
+	switch e := err.(type) {
+	case *GCSError:
+		return e.StatusCode >= 500 || e.StatusCode == 408 || e.StatusCode == 429
+	case net.Error:
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// Is an error one which will affect all requests, e.g. authentication?
+func isGCSFatalError(err error) bool {
+	if e, ok := err.(*GCSError); ok {
+		return e.StatusCode == 401 || e.StatusCode == 403
+	}
+	return false
+}
+
+func (self *GCSSyncProvider) getRemote(remoteName string) (*gcsRemote, error) {
+	remote := &gcsRemote{}
+	setting := fmt.Sprintf("remote.%v.git-lob-gcs-bucket", remoteName)
+	remote.bucket = strings.TrimSpace(util.GlobalOptions.GitConfig[setting])
+	if remote.bucket == "" {
+		return nil, fmt.Errorf("Configuration invalid for 'gcs', missing setting %v", setting)
+	}
+	prefix := strings.Trim(strings.TrimSpace(util.GlobalOptions.GitConfig[fmt.Sprintf("remote.%v.git-lob-gcs-prefix", remoteName)]), "/")
+	if prefix != "" {
+		remote.prefix = prefix + "/"
+	}
+
+	setting = fmt.Sprintf("remote.%v.git-lob-gcs-endpoint", remoteName)
+	remote.endpoint = strings.TrimRight(strings.TrimSpace(util.GlobalOptions.GitConfig[setting]), "/")
+	customEndpoint := remote.endpoint != ""
+	if customEndpoint {
+		u, err := url.Parse(remote.endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("Invalid value for %v, must be an http or https URL: %v", setting, remote.endpoint)
+		}
+	} else {
+		remote.endpoint = GCSDefaultEndpoint
+	}
+
+	remote.chunkSize = GCSDefaultChunkSize
+	setting = fmt.Sprintf("remote.%v.git-lob-gcs-chunksize", remoteName)
+	if val := strings.TrimSpace(util.GlobalOptions.GitConfig[setting]); val != "" {
+		sz, err := util.ParseSize(val)
+		if err != nil || sz <= 0 {
+			return nil, fmt.Errorf("Invalid value for %v: %v", setting, val)
+		}
+		remote.chunkSize = ((sz + GCSChunkGranularity - 1) / GCSChunkGranularity) * GCSChunkGranularity
+	}
+
+	remote.credentials = strings.TrimSpace(util.GlobalOptions.GitConfig[fmt.Sprintf("remote.%v.git-lob-gcs-credentials", remoteName)])
+	if remote.credentials == "" {
+		remote.credentials = strings.TrimSpace(util.GlobalOptions.GitConfig["git-lob.gcs-credentials"])
+	}
+	if remote.credentials == "" {
+		remote.credentials = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if remote.credentials == "" {
+		if !customEndpoint {
+			return nil, errors.New("Unable to locate GCS credentials, set git-lob-gcs-credentials or GOOGLE_APPLICATION_CREDENTIALS")
+		}
+	} else {
+		var err error
+		remote.credentials, err = homedir.Expand(remote.credentials)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return remote, nil
+}
+
+func (self *GCSSyncProvider) client() *http.Client {
+	if self.HTTPClient != nil {
+		return self.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (self *GCSSyncProvider) loadServiceAccount(path string) (*gcsServiceAccount, *rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to read GCS credentials: %v", err.Error())
+	}
+	acct := &gcsServiceAccount{}
+	err = json.Unmarshal(data, acct)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid GCS credentials in %v: %v", path, err.Error())
+	}
+	if acct.Type != "service_account" || acct.ClientEmail == "" {
+		return nil, nil, fmt.Errorf("Invalid GCS credentials in %v: not a service account key", path)
+	}
+	if acct.TokenURI == "" {
+		acct.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	block, _ := pem.Decode([]byte(acct.PrivateKey))
+	if block == nil {
+		return nil, nil, fmt.Errorf("Invalid GCS credentials in %v: missing private key", path)
+	}
+	var key interface{}
+	key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	rsakey, ok := key.(*rsa.PrivateKey)
+	if err != nil || !ok {
+		return nil, nil, fmt.Errorf("Invalid GCS credentials in %v: private key is not RSA", path)
+	}
+	return acct, rsakey, nil
+}
+
+// Get an OAuth access token for a service account, exchanging a signed JWT for it
+// See https://developers.google.com/identity/protocols/oauth2/service-account
+func (self *GCSSyncProvider) getToken(path string) (string, error) {
+	self.tokenMutex.Lock()
+	defer self.tokenMutex.Unlock()
+	if tok, ok := self.tokens[path]; ok && time.Now().Before(tok.expiry) {
+		return tok.AccessToken, nil
+	}
+
+	acct, key, err := self.loadServiceAccount(path)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   acct.ClientEmail,
+		"scope": gcsScope,
+		"aud":   acct.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)},
+	}
+	resp, err := self.client().PostForm(acct.TokenURI, form)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != 200 {
+		return "", newGCSError(resp)
+	}
+	defer resp.Body.Close()
+	tok := &gcsToken{}
+	err = json.NewDecoder(resp.Body).Decode(tok)
+	if err != nil {
+		return "", fmt.Errorf("Invalid GCS token response: %v", err.Error())
+	}
+	// Leave a margin so tokens don't expire mid-request
+	tok.expiry = now.Add(time.Duration(tok.ExpiresIn)*time.Second - time.Minute)
+	if self.tokens == nil {
+		self.tokens = make(map[string]*gcsToken)
+	}
+	self.tokens[path] = tok
+	return tok.AccessToken, nil
+}
+
+// Authenticate & perform a request, returning a *GCSError for failure responses
+// Responses with a status in okStatus are also returned without error
+func (self *GCSSyncProvider) do(remote *gcsRemote, req *http.Request, okStatus ...int) (*http.Response, error) {
+	if remote.credentials != "" {
+		token, err := self.getToken(remote.credentials)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := self.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range okStatus {
+		if resp.StatusCode == s {
+			return resp, nil
+		}
+	}
+	if resp.StatusCode >= 300 {
+		return nil, newGCSError(resp)
+	}
+	return resp, nil
+}
+
+// Get the full object name for a file
+func (self *GCSSyncProvider) objectName(remote *gcsRemote, filename string) string {
+	return remote.prefix + filepath.ToSlash(filename)
+}
+
+// Get the JSON API URL for an object; the name is escaped as a single path segment
+func (self *GCSSyncProvider) objectURL(remote *gcsRemote, filename string) string {
+	return fmt.Sprintf("%v/storage/v1/b/%v/o/%v", remote.endpoint, url.PathEscape(remote.bucket),
+		url.PathEscape(self.objectName(remote, filename)))
+}
+
+// Describe where files are stored for messages
+func (self *GCSSyncProvider) location(remote *gcsRemote) string {
+	return "GCS bucket " + remote.bucket
+}
+
+// Get the single file transfer helper for a remote
+func (self *GCSSyncProvider) fileTransfer(remoteName string, remote *gcsRemote) *remoteFileTransfer {
+	return &remoteFileTransfer{
+		remoteName:  remoteName,
+		location:    self.location(remote),
+		isRetryable: isGCSRetryableError,
+		isFatal:     isGCSFatalError,
+		stat: func(filename string) (bool, int64, error) {
+			return self.objectSize(remoteName, remote, filename)
+		},
+	}
+}
+
+// Get whether an object exists & its size, retrying transient errors
+func (self *GCSSyncProvider) objectSize(remoteName string, remote *gcsRemote, filename string) (exists bool, size int64, err error) {
+	_, err = retryTransfer(isGCSRetryableError, remoteName, self.location(remote), filename, 0, nil, func() error {
+		req, err := http.NewRequest("GET", self.objectURL(remote, filename), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := self.do(remote, req, 404)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == 404 {
+			exists = false
+			return nil
+		}
+		var meta struct {
+			// JSON API returns int64 as strings
+			Size string `json:"size"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&meta)
+		if err != nil {
+			return err
+		}
+		size, err = strconv.ParseInt(meta.Size, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid size for %v: %v", filename, meta.Size)
+		}
+		exists = true
+		return nil
+	})
+	return exists, size, err
+}
+
+// Check the bucket is accessible, retrying transient errors
+// This saves us failing on every file
+func (self *GCSSyncProvider) checkBucket(remoteName string, remote *gcsRemote) error {
+	_, err := retryTransfer(isGCSRetryableError, remoteName, self.location(remote), remote.bucket, 0, nil, func() error {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%v/storage/v1/b/%v", remote.endpoint, url.PathEscape(remote.bucket)), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := self.do(remote, req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	})
+	if e, ok := err.(*GCSError); ok && e.StatusCode == 403 {
+		// Object permissions don't necessarily include reading bucket metadata; just try the files
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to access GCS bucket '%v' for remote '%v': %v", remote.bucket, remoteName, err.Error())
+	}
+	return nil
+}
+
+func (self *GCSSyncProvider) ValidateConfig(remoteName string) error {
+	remote, err := self.getRemote(remoteName)
+	if err != nil {
+		return err
+	}
+	if remote.credentials != "" {
+		_, _, err = self.loadServiceAccount(remote.credentials)
+	}
+	return err
+}
+
+func (self *GCSSyncProvider) Release() {
+	// Nothing to do, HTTP connections are pooled by the client
+}
+
+func (self *GCSSyncProvider) FileExists(remoteName, filename string) bool {
+	remote, err := self.getRemote(remoteName)
+	if err != nil {
+		return false
+	}
+	exists, _, err := self.objectSize(remoteName, remote, filename)
+	return err == nil && exists
+}
+
+func (self *GCSSyncProvider) FileExistsAndIsOfSize(remoteName, filename string, sz int64) bool {
+	remote, err := self.getRemote(remoteName)
+	if err != nil {
+		return false
+	}
+	exists, size, err := self.objectSize(remoteName, remote, filename)
+	return err == nil && exists && size == sz
+}
+
+// Upload a small file in one request
+func (self *GCSSyncProvider) uploadSimple(remote *gcsRemote, filename string, inf *os.File, size int64,
+	callback SyncProgressCallback) (aborted bool, err error) {
+
+	progressReader := NewSyncProgressReader(inf, filename, size, callback)
+	u := fmt.Sprintf("%v/upload/storage/v1/b/%v/o?uploadType=media&name=%v", remote.endpoint,
+		url.PathEscape(remote.bucket), url.QueryEscape(self.objectName(remote, filename)))
+	req, err := http.NewRequest("POST", u, progressReader)
+	if err != nil {
+		return false, err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := self.do(remote, req)
+	if progressReader.Aborted {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return false, nil
+}
+
+// Find out how much of a resumable upload the server has, returns size if complete
+func (self *GCSSyncProvider) queryUploadOffset(remote *gcsRemote, sessionURI string, size int64) (int64, error) {
+	req, err := http.NewRequest("PUT", sessionURI, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	resp, err := self.do(remote, req, 308)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 308 {
+		return size, nil
+	}
+	return gcsParseRange(resp.Header.Get("Range")), nil
+}
+
+// Get the next offset to upload from the Range header of a 308 response ("bytes=0-N")
+func gcsParseRange(r string) int64 {
+	if idx := strings.LastIndex(r, "-"); idx >= 0 {
+		if end, err := strconv.ParseInt(r[idx+1:], 10, 64); err == nil {
+			return end + 1
+		}
+	}
+	// Nothing received yet
+	return 0
+}
+
+// Upload a file in chunks using a resumable session. If we previously started uploading the
+// same file and didn't finish, it carries on from where the server got to.
+// Incomplete uploads are left for resuming if there's an error or the callback aborts.
+func (self *GCSSyncProvider) uploadResumable(remote *gcsRemote, filename string, inf *os.File, size int64,
+	state *resumableUploadState, callback SyncProgressCallback) (aborted bool, err error) {
+
+	object := self.objectName(remote, filename)
+	var offset int64
+	upload := state.Find(remote.bucket, object, size)
+	if upload != nil {
+		offset, err = self.queryUploadOffset(remote, upload.Id, size)
+		if err != nil {
+			if isGCSRetryableError(err) {
+				return false, err
+			}
+			// Session has gone (expired or cancelled), start again
+			util.LogDebugf("Unable to resume upload of %v, starting again: %v\n", filename, err.Error())
+			state.Remove(upload)
+			upload = nil
+			offset = 0
+		} else {
+			util.LogDebugf("Resuming upload of %v from %d bytes\n", filename, offset)
+		}
+	}
+	if upload == nil {
+		u := fmt.Sprintf("%v/upload/storage/v1/b/%v/o?uploadType=resumable&name=%v", remote.endpoint,
+			url.PathEscape(remote.bucket), url.QueryEscape(object))
+		req, err := http.NewRequest("POST", u, strings.NewReader("{}"))
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+		req.Header.Set("X-Upload-Content-Type", "application/octet-stream")
+		req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+		resp, err := self.do(remote, req)
+		if err != nil {
+			return false, err
+		}
+		resp.Body.Close()
+		sessionURI := resp.Header.Get("Location")
+		if sessionURI == "" {
+			return false, fmt.Errorf("No upload session returned for %v", filename)
+		}
+		upload = &resumableUpload{Bucket: remote.bucket, Name: object, Size: size, Id: sessionURI, Started: time.Now()}
+		state.Add(upload)
+	}
+
+	// Number of chunks in a row the server didn't accept, & whether it's lost everything once already
+	stalled := 0
+	restarted := false
+	for offset < size {
+		if callback != nil {
+			if callback(filename, util.ProgressTransferBytes, offset, size) {
+				return true, nil
+			}
+		}
+		chunk := remote.chunkSize
+		if offset+chunk > size {
+			chunk = size - offset
+		}
+		// Report progress of the whole file, not just this chunk
+		base := offset
+		chunkCallback := func(f string, t util.ProgressCallbackType, done, total int64) bool {
+			return callback != nil && callback(f, t, base+done, size)
+		}
+		progressReader := NewSyncProgressReader(io.NewSectionReader(inf, offset, chunk), filename, chunk, chunkCallback)
+		req, err := http.NewRequest("PUT", upload.Id, progressReader)
+		if err != nil {
+			return false, err
+		}
+		req.ContentLength = chunk
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+chunk-1, size))
+		resp, err := self.do(remote, req, 308)
+		if progressReader.Aborted {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 308 {
+			offset = size
+			continue
+		}
+		received := resp.Header.Get("Range")
+		next := gcsParseRange(received)
+		if received == "" && offset > 0 {
+			// Server has lost what we sent before; start again, but only once
+			if restarted {
+				return false, fmt.Errorf("Upload session for %v keeps losing data", filename)
+			}
+			util.LogDebugf("Server has no data for upload of %v, starting again\n", filename)
+			restarted = true
+		} else if next <= offset {
+			stalled++
+			if stalled >= GCSMaxStalledChunks {
+				return false, fmt.Errorf("Upload of %v is not progressing, server has %d of %d bytes", filename, next, size)
+			}
+		} else {
+			stalled = 0
+		}
+		offset = next
+	}
+	state.Remove(upload)
+	return false, nil
+}
+
+func (self *GCSSyncProvider) Upload(remoteName string, filenames []string, fromDir string,
+	force bool, callback SyncProgressCallback) error {
+
+	remote, err := self.getRemote(remoteName)
+	if err != nil {
+		return err
+	}
+
+	util.LogDebug("Uploading to GCS bucket", remote.bucket)
+
+	err = self.checkBucket(remoteName, remote)
+	if err != nil {
+		return err
+	}
+
+	state := loadResumableUploadState(remoteName, "gcs_uploads")
+	// Unlike S3, Google deletes abandoned sessions itself so we just forget them
+	for _, u := range state.Expired(remote.bucket, GCSUploadExpiry) {
+		state.Remove(u)
+	}
+	transfer := self.fileTransfer(remoteName, remote)
+	return transferEachFile(filenames, func(filename string) ([]string, bool) {
+		return transfer.upload(filename, fromDir, force, callback, func(inf *os.File, size int64) (bool, error) {
+			if size > remote.chunkSize {
+				// Resumable upload carries on from what the server has on each attempt
+				return self.uploadResumable(remote, filename, inf, size, state, callback)
+			}
+			userAborted, err := restartUpload(inf, filename, size, callback)
+			if userAborted || err != nil {
+				return userAborted, err
+			}
+			// Objects are not visible until fully uploaded so no need for temporary names
+			return self.uploadSimple(remote, filename, inf, size, callback)
+		}, nil)
+	})
+}
+
+func (self *GCSSyncProvider) Download(remoteName string, filenames []string, toDir string, force bool, callback SyncProgressCallback) error {
+
+	remote, err := self.getRemote(remoteName)
+	if err != nil {
+		return err
+	}
+
+	util.LogDebug("Downloading from GCS bucket", remote.bucket)
+
+	err = self.checkBucket(remoteName, remote)
+	if err != nil {
+		return err
+	}
+
+	transfer := self.fileTransfer(remoteName, remote)
+	return transferEachFile(filenames, func(filename string) ([]string, bool) {
+		return transfer.download(filename, toDir, force, callback, func() (io.ReadCloser, error) {
+			req, err := http.NewRequest("GET", self.objectURL(remote, filename)+"?alt=media", nil)
+			if err != nil {
+				return nil, err
+			}
+			resp, err := self.do(remote, req)
+			if err != nil {
+				return nil, err
+			}
+			return resp.Body, nil
+		})
+	})
+}
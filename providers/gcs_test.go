@@ -0,0 +1,257 @@
+package providers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+// Minimal in-memory stand-in for the GCS JSON API & OAuth token endpoint
+type fakeGCSServer struct {
+	fakeHTTPServerForTest
+	url      string
+	objects  map[string][]byte
+	sessions map[string][]byte
+	// Number of resumable chunk uploads to fail before behaving
+	chunkFailures int
+	// Number of resumable chunks to ignore, and to lose all received data on (after the first chunk)
+	stallChunks  int
+	forgetChunks int
+	tokens       int
+}
+
+func (self *fakeGCSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer self.mutex.Unlock()
+	if self.failRequest(w, r) {
+		return
+	}
+	path := r.URL.EscapedPath()
+	switch {
+	case path == "/token":
+		self.tokens++
+		fmt.Fprint(w, `{"access_token":"tok123","expires_in":3600,"token_type":"Bearer"}`)
+	case path == "/storage/v1/b/thebucket":
+		fmt.Fprint(w, `{"name":"thebucket"}`)
+	case strings.HasPrefix(path, "/storage/v1/b/thebucket/o/"):
+		name, _ := url.PathUnescape(strings.TrimPrefix(path, "/storage/v1/b/thebucket/o/"))
+		data, ok := self.objects[name]
+		if !ok {
+			w.WriteHeader(404)
+			fmt.Fprint(w, `{"error":{"code":404,"message":"No such object"}}`)
+		} else if r.URL.Query().Get("alt") == "media" {
+			w.Write(data)
+		} else {
+			fmt.Fprintf(w, `{"name":%q,"size":"%d"}`, name, len(data))
+		}
+	case path == "/upload/storage/v1/b/thebucket/o" && r.URL.Query().Get("uploadType") == "media":
+		if data, ok := self.receiveUpload(w, r); ok {
+			self.objects[r.URL.Query().Get("name")] = data
+			fmt.Fprint(w, `{}`)
+		}
+	case path == "/upload/storage/v1/b/thebucket/o" && r.URL.Query().Get("uploadType") == "resumable":
+		name := r.URL.Query().Get("name")
+		self.sessions[name] = nil
+		w.Header().Set("Location", self.url+"/session?name="+url.QueryEscape(name))
+	case path == "/session":
+		name := r.URL.Query().Get("name")
+		data, ok := self.sessions[name]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		var start, end, total int64
+		if n, _ := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); n == 3 {
+			chunk, _ := ioutil.ReadAll(r.Body)
+			if self.chunkFailures > 0 {
+				// Accept half the chunk then fail
+				self.chunkFailures--
+				self.sessions[name] = append(data, chunk[:len(chunk)/2]...)
+				w.WriteHeader(503)
+				return
+			}
+			if start != int64(len(data)) {
+				w.WriteHeader(400)
+				return
+			}
+			if self.stallChunks > 0 {
+				self.stallChunks--
+				chunk = nil
+			} else if self.forgetChunks > 0 && start > 0 {
+				self.forgetChunks--
+				self.sessions[name] = nil
+				w.WriteHeader(308)
+				return
+			}
+			data = append(data, chunk...)
+			self.sessions[name] = data
+		} else {
+			total, _ = strconv.ParseInt(strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes */"), 10, 64)
+		}
+		if int64(len(data)) == total {
+			self.objects[name] = data
+			delete(self.sessions, name)
+			fmt.Fprint(w, `{}`)
+			return
+		}
+		if len(data) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(data)-1))
+		}
+		w.WriteHeader(308)
+	default:
+		w.WriteHeader(400)
+	}
+}
+
+var _ = Describe("GCS", func() {
+	var server *httptest.Server
+	var fake *fakeGCSServer
+	var gcs *GCSSyncProvider
+	var tmp, oldwd string
+	BeforeEach(func() {
+		fake = &fakeGCSServer{objects: make(map[string][]byte), sessions: make(map[string][]byte)}
+		server = httptest.NewServer(fake)
+		fake.url = server.URL
+		gcs = &GCSSyncProvider{}
+		GlobalOptions.GitConfig["remote.origin.git-lob-gcs-bucket"] = "thebucket"
+		GlobalOptions.GitConfig["remote.origin.git-lob-gcs-endpoint"] = server.URL
+		// Upload state is stored in the git dir so work in a fake repo
+		oldwd, _ = os.Getwd()
+		tmp, _ = ioutil.TempDir("", "gcstest")
+		os.MkdirAll(filepath.Join(tmp, ".git"), 0755)
+		os.Chdir(tmp)
+	})
+	AfterEach(func() {
+		os.Chdir(oldwd)
+		server.Close()
+		GlobalOptions = NewOptions()
+		os.RemoveAll(tmp)
+	})
+
+	It("Validates configuration", func() {
+		// Custom endpoint doesn't need credentials, but Google does
+		os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+		CheckValidateConfigForTest(gcs, map[string]string{
+			"remote.origin.git-lob-gcs-chunksize": "bad",
+			"remote.origin.git-lob-gcs-endpoint":  "",
+		})
+	})
+
+	It("Uploads, checks and downloads files", func() {
+		GlobalOptions.GitConfig["remote.origin.git-lob-gcs-prefix"] = "datasets/"
+		CheckUploadDownloadForTest(gcs, tmp, func() []byte { return fake.objects["datasets/ab/cd/file1.bin"] })
+	})
+
+	It("Retries transient errors", func() {
+		CheckRetriesForTest(gcs, &fake.fakeHTTPServerForTest, tmp)
+	})
+
+	It("Uploads large files in resumable chunks", func() {
+		GlobalOptions.GitConfig["remote.origin.git-lob-gcs-chunksize"] = "256KB"
+		GlobalOptions.GitConfig["remote.origin.git-lob-retries"] = "0"
+		size := int64(600 * 1024)
+		CreateRandomFileForTest(size, filepath.Join(tmp, "content", "bigfile"))
+		var progress []int64
+		callback := func(file string, progressType ProgressCallbackType, bytesDone, totalBytes int64) bool {
+			progress = append(progress, bytesDone)
+			return false
+		}
+		statefile := filepath.Join(tmp, ".git", "git-lob", "state", "remotes", "origin", "gcs_uploads")
+
+		err := gcs.Upload("origin", []string{"bigfile"}, filepath.Join(tmp, "content"), false, callback)
+		Expect(err).To(BeNil(), "Should upload")
+		Expect(fake.objects["bigfile"]).To(HaveLen(int(size)), "Should upload all content")
+		Expect(progress[len(progress)-1]).To(Equal(size), "Should report completion")
+		Expect(FileExists(statefile)).To(BeFalse(), "Should not record completed upload")
+
+		// Now interrupt an upload & resume it in a later run; no retries so the first run fails
+		delete(fake.objects, "bigfile")
+		fake.chunkFailures = 1
+		err = gcs.Upload("origin", []string{"bigfile"}, filepath.Join(tmp, "content"), false, callback)
+		Expect(err).ToNot(BeNil(), "Should fail")
+		Expect(FileExists(statefile)).To(BeTrue(), "Should record incomplete upload")
+		Expect(fake.sessions["bigfile"]).To(HaveLen(128*1024), "Server should have part of the first chunk")
+
+		fake.requests = nil
+		err = gcs.Upload("origin", []string{"bigfile"}, filepath.Join(tmp, "content"), false, callback)
+		Expect(err).To(BeNil(), "Should resume upload")
+		Expect(fake.objects["bigfile"]).To(HaveLen(int(size)), "Should upload all content")
+		content, _ := ioutil.ReadFile(filepath.Join(tmp, "content", "bigfile"))
+		Expect(fake.objects["bigfile"]).To(Equal(content), "Resumed content should match")
+		for _, req := range fake.requests {
+			Expect(req.URL.Query().Get("uploadType")).ToNot(Equal("resumable"), "Should not start a new session")
+		}
+		Expect(FileExists(statefile)).To(BeFalse(), "Should not record completed upload")
+	})
+
+	It("Limits resumable uploads which don't progress", func() {
+		GlobalOptions.GitConfig["remote.origin.git-lob-gcs-chunksize"] = "256KB"
+		GlobalOptions.GitConfig["remote.origin.git-lob-retries"] = "0"
+		size := int64(600 * 1024)
+		CreateRandomFileForTest(size, filepath.Join(tmp, "content", "bigfile"))
+
+		// Server losing everything once just means starting again
+		fake.forgetChunks = 1
+		err := gcs.Upload("origin", []string{"bigfile"}, filepath.Join(tmp, "content"), false, nil)
+		Expect(err).To(BeNil(), "Should upload after restarting")
+		Expect(fake.objects["bigfile"]).To(HaveLen(int(size)), "Should upload all content")
+
+		delete(fake.objects, "bigfile")
+		fake.forgetChunks = 2
+		err = gcs.Upload("origin", []string{"bigfile"}, filepath.Join(tmp, "content"), true, nil)
+		Expect(err).ToNot(BeNil(), "Should not restart more than once")
+		Expect(fake.objects).ToNot(HaveKey("bigfile"), "Should not have uploaded")
+
+		fake.forgetChunks = 0
+		fake.stallChunks = GCSMaxStalledChunks
+		fake.requests = nil
+		err = gcs.Upload("origin", []string{"bigfile"}, filepath.Join(tmp, "content"), true, nil)
+		Expect(err).ToNot(BeNil(), "Should give up when no progress is made")
+		Expect(err.Error()).To(ContainSubstring("not progressing"), "Should report lack of progress")
+		chunks := 0
+		for _, req := range fake.requests {
+			if strings.HasPrefix(req.Header.Get("Content-Range"), "bytes 0-") {
+				chunks++
+			}
+		}
+		Expect(chunks).To(Equal(GCSMaxStalledChunks), "Should stop after the limit")
+	})
+
+	It("Authenticates with a service account", func() {
+		key, _ := rsa.GenerateKey(rand.Reader, 1024)
+		keyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		creds, _ := json.Marshal(map[string]string{
+			"type":         "service_account",
+			"client_email": "lob@project.iam.gserviceaccount.com",
+			"private_key":  string(keyPem),
+			"token_uri":    server.URL + "/token",
+		})
+		credsFile := filepath.Join(tmp, "creds.json")
+		ioutil.WriteFile(credsFile, creds, 0644)
+		GlobalOptions.GitConfig["remote.origin.git-lob-gcs-credentials"] = credsFile
+
+		Expect(gcs.ValidateConfig("origin")).To(BeNil(), "Credentials should be valid")
+		Expect(gcs.FileExists("origin", "missing.bin")).To(BeFalse(), "Should not exist")
+		Expect(gcs.FileExists("origin", "missing2.bin")).To(BeFalse(), "Should not exist")
+		Expect(fake.tokens).To(Equal(1), "Should re-use the token")
+		tokenReq := fake.requests[0]
+		Expect(tokenReq.Method).To(Equal("POST"), "Should request a token")
+		for _, req := range fake.requests[1:] {
+			Expect(req.Header.Get("Authorization")).To(Equal("Bearer tok123"), "Should send the token")
+		}
+	})
+})
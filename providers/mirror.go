@@ -0,0 +1,320 @@
+package providers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// MirrorSyncProvider combines several other remotes into one; reads come from the
+// first remote which has the file, writes go to all of them
+type MirrorSyncProvider struct {
+	// Providers of mirrored remotes used so far, to release with this one
+	used []SyncProvider
+}
+
+func (*MirrorSyncProvider) TypeID() string {
+	return "mirror"
+}
+
+func (*MirrorSyncProvider) HelpTextSummary() string {
+	return `mirror: reads from the first of a list of remotes which has a file, writes to all of them`
+}
+
+func (*MirrorSyncProvider) HelpTextDetail() string {
+	return `The "mirror" provider doesn't store anything itself; it combines other remotes
+which are configured with their own providers. Downloads try each remote in the
+order listed and use the first one which has the file, so put the fastest
+first. Uploads go to every remote, so a single push keeps them all up to date.
+
+Required parameters in remote section of .gitconfig:
+    git-lob-mirrors    Space or comma separated list of remote names, in the
+                       order they should be read from. These remotes must be
+                       configured with a git-lob-provider other than mirror,
+                       but do not need a git url.
+
+Example configuration:
+    [remote "origin"]
+        url = git@blah.com/your/usual/git/repo
+        git-lob-provider = mirror
+        git-lob-mirrors = nas offsite
+
+    [remote "nas"]
+        git-lob-provider = filesystem
+        git-lob-path = /Volumes/nas/binary/store
+
+    [remote "offsite"]
+        git-lob-provider = s3
+        git-lob-s3-bucket = my.binary.bucket
+
+Pushed state is recorded against each of the listed remotes rather than the
+mirror remote itself, so pushing to 'origin' also marks commits as pushed to
+'nas' and 'offsite', and a commit only counts as pushed to 'origin' once it's
+been pushed to all of them. Likewise a file is only considered to be present
+on the mirror remote if all of the listed remotes have it.
+`
+}
+
+// Get the list of remotes which a mirror remote is made of, in read order
+// Returns nil if remoteName is not a mirror remote. Remotes which are mirrors themselves
+// (including remoteName) are left out, so callers can safely recurse into the results;
+// ValidateConfig reports them as errors
+func GetMirrorRemotes(remoteName string) []string {
+	if GetProviderNameForRemote(remoteName) != "mirror" {
+		return nil
+	}
+	configured := getConfiguredMirrorRemotes(remoteName)
+	ret := make([]string, 0, len(configured))
+	for _, remote := range configured {
+		if isNestedMirror(remoteName, remote) {
+			continue
+		}
+		ret = append(ret, remote)
+	}
+	return ret
+}
+
+func getConfiguredMirrorRemotes(remoteName string) []string {
+	setting := util.GlobalOptions.GitConfig[fmt.Sprintf("remote.%v.git-lob-mirrors", remoteName)]
+	return strings.FieldsFunc(setting, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+func isNestedMirror(remoteName, mirror string) bool {
+	return mirror == remoteName || GetProviderNameForRemote(mirror) == "mirror"
+}
+
+// Get the providers for all the remotes in a mirror, in the same order as GetMirrorRemotes
+func (self *MirrorSyncProvider) getMirrors(remoteName string) ([]string, []SyncProvider, error) {
+	setting := fmt.Sprintf("remote.%v.git-lob-mirrors", remoteName)
+	remotes := getConfiguredMirrorRemotes(remoteName)
+	if len(remotes) == 0 {
+		return nil, nil, fmt.Errorf("Configuration invalid for 'mirror', missing setting %v", setting)
+	}
+	mirrorProviders := make([]SyncProvider, 0, len(remotes))
+	for _, remote := range remotes {
+		if isNestedMirror(remoteName, remote) {
+			return nil, nil, fmt.Errorf("Invalid value for %v, remote '%v' cannot itself be a mirror", setting, remote)
+		}
+		provider, err := GetProviderForRemote(remote)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Configuration invalid for 'mirror', remote '%v': %v", remote, err)
+		}
+		mirrorProviders = append(mirrorProviders, provider)
+		self.markUsed(provider)
+	}
+	return remotes, mirrorProviders, nil
+}
+
+func (self *MirrorSyncProvider) markUsed(provider SyncProvider) {
+	for _, p := range self.used {
+		if p == provider {
+			return
+		}
+	}
+	self.used = append(self.used, provider)
+}
+
+func (self *MirrorSyncProvider) ValidateConfig(remoteName string) error {
+	_, _, err := self.getMirrors(remoteName)
+	return err
+}
+
+func (self *MirrorSyncProvider) Release() {
+	for _, p := range self.used {
+		p.Release()
+	}
+	self.used = nil
+}
+
+// Each mirror is sent the whole list of files in one call, so providers can keep their
+// connections open. Progress is only passed on while uploading to the last mirror, so that
+// each file is reported once and only completes when every mirror has it
+func (self *MirrorSyncProvider) Upload(remoteName string, filenames []string, fromDir string, force bool, callback SyncProgressCallback) error {
+	remotes, mirrorProviders, err := self.getMirrors(remoteName)
+	if err != nil {
+		return err
+	}
+	var errorList []string
+	// Files which needed uploading to at least one mirror
+	uploaded := make(map[string]bool)
+	abort := false
+	for i, provider := range mirrorProviders {
+		last := i == len(mirrorProviders)-1
+		// Local files which are missing don't need trying on other mirrors (already reported)
+		notFound := make(map[string]bool)
+		mirrorCallback := func(file string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) bool {
+			switch progressType {
+			case util.ProgressNotFound:
+				notFound[file] = true
+			case util.ProgressRetry:
+				// Pass through
+			case util.ProgressSkip:
+				if bytesDone < totalBytes {
+					// Only interested in the final skip notification
+					return false
+				}
+				if !last {
+					return false
+				}
+				if uploaded[file] {
+					// Other mirrors needed an upload, so treat as progress
+					progressType = util.ProgressTransferBytes
+				}
+			default:
+				uploaded[file] = true
+				if !last {
+					return false
+				}
+			}
+			if callback != nil && callback(file, progressType, bytesDone, totalBytes) {
+				abort = true
+				return true
+			}
+			return false
+		}
+		err := provider.Upload(remotes[i], filenames, fromDir, force, mirrorCallback)
+		if abort {
+			break
+		}
+		if err != nil {
+			errorList = append(errorList, fmt.Sprintf("Upload to %v failed: %v", remotes[i], err))
+		}
+		if len(notFound) > 0 {
+			var found []string
+			for _, filename := range filenames {
+				if !notFound[filename] {
+					found = append(found, filename)
+				}
+			}
+			filenames = found
+		}
+		if len(filenames) == 0 {
+			break
+		}
+	}
+	if len(errorList) > 0 {
+		return errors.New(strings.Join(errorList, "\n"))
+	}
+	return nil
+}
+
+// Each mirror is sent the whole list of files still needed in one call, so providers can keep
+// their connections open; files not found (or which failed) on one mirror are tried on the next
+func (self *MirrorSyncProvider) Download(remoteName string, filenames []string, toDir string, force bool, callback SyncProgressCallback) error {
+	remotes, mirrorProviders, err := self.getMirrors(remoteName)
+	if err != nil {
+		return err
+	}
+	var errorList []string
+	// Files which couldn't be downloaded from a mirror which may have had them
+	failed := make(map[string]bool)
+	remaining := filenames
+	abort := false
+	for i, provider := range mirrorProviders {
+		done := make(map[string]bool)
+		notFound := make(map[string]bool)
+		// Files partly downloaded from this mirror, which will start again on the next one
+		started := make(map[string]bool)
+		mirrorCallback := func(file string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) bool {
+			switch progressType {
+			case util.ProgressNotFound:
+				// Try the next mirror before reporting
+				notFound[file] = true
+				return false
+			case util.ProgressSkip:
+				if bytesDone == totalBytes {
+					done[file] = true
+				}
+			case util.ProgressTransferBytes:
+				started[file] = true
+				if bytesDone == totalBytes {
+					done[file] = true
+				}
+			}
+			if callback != nil && callback(file, progressType, bytesDone, totalBytes) {
+				abort = true
+				return true
+			}
+			return false
+		}
+		err := provider.Download(remotes[i], remaining, toDir, force, mirrorCallback)
+		if abort {
+			break
+		}
+		var next []string
+		for _, filename := range remaining {
+			if done[filename] {
+				// First hit wins; any earlier errors are irrelevant now
+				delete(failed, filename)
+				continue
+			}
+			next = append(next, filename)
+			if err != nil && !notFound[filename] {
+				failed[filename] = true
+			}
+			if err != nil && started[filename] {
+				// Starting again from 0 on the next mirror
+				if callback != nil && callback(filename, util.ProgressRetry, 0, 0) {
+					abort = true
+					break
+				}
+			}
+		}
+		if err != nil {
+			errorList = append(errorList, fmt.Sprintf("Download from %v failed: %v", remotes[i], err))
+		}
+		remaining = next
+		if abort || len(remaining) == 0 {
+			break
+		}
+	}
+	anyFailed := abort
+	for _, filename := range remaining {
+		if abort {
+			break
+		}
+		if failed[filename] {
+			anyFailed = true
+			continue
+		}
+		// Not on any mirror
+		abort = callback != nil && callback(filename, util.ProgressNotFound, 0, 0)
+	}
+	// Errors only matter if they stopped a file being downloaded from any mirror
+	if anyFailed && len(errorList) > 0 {
+		return errors.New(strings.Join(errorList, "\n"))
+	}
+	return nil
+}
+
+// Files are only considered present if all mirrors have them, since this is what
+// decides whether pushing is needed or whether local copies can be pruned
+func (self *MirrorSyncProvider) FileExists(remoteName, filename string) bool {
+	remotes, mirrorProviders, err := self.getMirrors(remoteName)
+	if err != nil {
+		return false
+	}
+	for i, provider := range mirrorProviders {
+		if !provider.FileExists(remotes[i], filename) {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *MirrorSyncProvider) FileExistsAndIsOfSize(remoteName, filename string, sz int64) bool {
+	remotes, mirrorProviders, err := self.getMirrors(remoteName)
+	if err != nil {
+		return false
+	}
+	for i, provider := range mirrorProviders {
+		if !provider.FileExistsAndIsOfSize(remotes[i], filename, sz) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,149 @@
+package providers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Mirror", func() {
+	var tmp, nasRoot, offsiteRoot, localRoot string
+	var mirror *MirrorSyncProvider
+	BeforeEach(func() {
+		tmp, _ = ioutil.TempDir("", "mirrortest")
+		nasRoot = filepath.Join(tmp, "nas")
+		offsiteRoot = filepath.Join(tmp, "offsite")
+		localRoot = filepath.Join(tmp, "local")
+		os.MkdirAll(nasRoot, 0755)
+		os.MkdirAll(offsiteRoot, 0755)
+		InitCoreProviders()
+		mirror = &MirrorSyncProvider{}
+		GlobalOptions.GitConfig["remote.origin.git-lob-provider"] = "mirror"
+		GlobalOptions.GitConfig["remote.origin.git-lob-mirrors"] = "nas,offsite"
+		GlobalOptions.GitConfig["remote.nas.git-lob-provider"] = "filesystem"
+		GlobalOptions.GitConfig["remote.nas.git-lob-path"] = nasRoot
+		GlobalOptions.GitConfig["remote.offsite.git-lob-provider"] = "filesystem"
+		GlobalOptions.GitConfig["remote.offsite.git-lob-path"] = offsiteRoot
+	})
+	AfterEach(func() {
+		mirror.Release()
+		GlobalOptions = NewOptions()
+		os.RemoveAll(tmp)
+	})
+
+	It("Validates configuration", func() {
+		Expect(mirror.ValidateConfig("origin")).To(BeNil(), "Should be valid")
+		Expect(GetMirrorRemotes("origin")).To(Equal([]string{"nas", "offsite"}), "Should list mirrors in order")
+		Expect(GetMirrorRemotes("nas")).To(BeNil(), "Should not treat other providers as mirrors")
+		Expect(mirror.ValidateConfig("other")).ToNot(BeNil(), "Should require mirrors")
+		GlobalOptions.GitConfig["remote.origin.git-lob-mirrors"] = "nas origin"
+		Expect(mirror.ValidateConfig("origin")).ToNot(BeNil(), "Should not allow mirror of mirror")
+		Expect(GetMirrorRemotes("origin")).To(Equal([]string{"nas"}), "Should leave out mirror of mirror")
+		GlobalOptions.GitConfig["remote.other.git-lob-provider"] = "mirror"
+		GlobalOptions.GitConfig["remote.other.git-lob-mirrors"] = "origin"
+		GlobalOptions.GitConfig["remote.origin.git-lob-mirrors"] = "other nas"
+		Expect(GetMirrorRemotes("origin")).To(Equal([]string{"nas"}), "Should leave out nested mirrors")
+		Expect(GetMirrorRemotes("other")).To(BeEmpty(), "Should leave out nested mirrors")
+		GlobalOptions.GitConfig["remote.origin.git-lob-mirrors"] = "nas missing"
+		Expect(mirror.ValidateConfig("origin")).ToNot(BeNil(), "Should require mirrors to be configured")
+	})
+
+	It("Uploads to all mirrors, reporting each file once", func() {
+		CreateRandomFileForTest(1000, filepath.Join(localRoot, "file1.bin"))
+		CreateRandomFileForTest(500, filepath.Join(localRoot, "file2.bin"))
+		// Already on one of the mirrors
+		CreateRandomFileForTest(500, filepath.Join(nasRoot, "file2.bin"))
+		var completed, skipped []string
+		callback := func(file string, progressType ProgressCallbackType, bytesDone, totalBytes int64) bool {
+			Expect(bytesDone).To(BeNumerically("<=", totalBytes), "Should not report more than the file size")
+			if bytesDone == totalBytes {
+				if progressType == ProgressSkip {
+					skipped = append(skipped, file)
+				} else if progressType == ProgressTransferBytes {
+					completed = append(completed, file)
+				}
+			}
+			return false
+		}
+		err := mirror.Upload("origin", []string{"file1.bin", "file2.bin"}, localRoot, false, callback)
+		Expect(err).To(BeNil(), "Should upload")
+		Expect(completed).To(Equal([]string{"file1.bin", "file2.bin"}), "Should complete each file once")
+		Expect(skipped).To(BeEmpty(), "Should not skip files missing from some mirrors")
+		for _, root := range []string{nasRoot, offsiteRoot} {
+			Expect(FileExistsAndIsOfSize(filepath.Join(root, "file1.bin"), 1000)).To(BeTrue(), "Should upload to all mirrors")
+			Expect(FileExistsAndIsOfSize(filepath.Join(root, "file2.bin"), 500)).To(BeTrue(), "Should upload to all mirrors")
+		}
+		Expect(mirror.FileExistsAndIsOfSize("origin", "file1.bin", 1000)).To(BeTrue(), "Should exist on all mirrors")
+
+		completed = nil
+		err = mirror.Upload("origin", []string{"file1.bin", "file2.bin"}, localRoot, false, callback)
+		Expect(err).To(BeNil(), "Should not be an error")
+		Expect(completed).To(BeEmpty(), "Should not upload again")
+		Expect(skipped).To(Equal([]string{"file1.bin", "file2.bin"}), "Should skip files on all mirrors")
+	})
+
+	It("Sends each mirror all the files at once", func() {
+		counting := &countingSyncProviderForTest{}
+		RegisterSyncProvider(counting)
+		GlobalOptions.GitConfig["remote.nas.git-lob-provider"] = counting.TypeID()
+		GlobalOptions.GitConfig["remote.offsite.git-lob-provider"] = counting.TypeID()
+		CreateRandomFileForTest(1000, filepath.Join(localRoot, "file1.bin"))
+		CreateRandomFileForTest(500, filepath.Join(localRoot, "file2.bin"))
+		CreateRandomFileForTest(300, filepath.Join(offsiteRoot, "file3.bin"))
+		err := mirror.Upload("origin", []string{"file1.bin", "file2.bin"}, localRoot, false, nil)
+		Expect(err).To(BeNil(), "Should upload")
+		Expect(counting.uploads).To(Equal(2), "Should upload to each mirror once")
+		err = mirror.Download("origin", []string{"file1.bin", "file2.bin", "file3.bin"}, filepath.Join(tmp, "down"), false, nil)
+		Expect(err).To(BeNil(), "Should download")
+		Expect(counting.downloads).To(Equal(2), "Should only ask later mirrors for the files still needed")
+		Expect(counting.downloadedFiles).To(Equal(4), "Should only ask later mirrors for the files still needed")
+		Expect(FileExistsAndIsOfSize(filepath.Join(tmp, "down", "file3.bin"), 300)).To(BeTrue(), "Should fall back to later mirrors")
+	})
+
+	It("Downloads from the first mirror which has each file", func() {
+		CreateRandomFileForTest(100, filepath.Join(nasRoot, "file1.bin"))
+		CreateRandomFileForTest(200, filepath.Join(offsiteRoot, "file1.bin"))
+		CreateRandomFileForTest(300, filepath.Join(offsiteRoot, "file2.bin"))
+		Expect(mirror.FileExists("origin", "file2.bin")).To(BeFalse(), "Should not exist unless on all mirrors")
+		var downloaded, notfound []string
+		callback := func(file string, progressType ProgressCallbackType, bytesDone, totalBytes int64) bool {
+			if progressType == ProgressNotFound {
+				notfound = append(notfound, file)
+			} else if progressType == ProgressTransferBytes && bytesDone == totalBytes {
+				downloaded = append(downloaded, file)
+			}
+			return false
+		}
+		err := mirror.Download("origin", []string{"file1.bin", "file2.bin", "missing.bin"}, localRoot, false, callback)
+		Expect(err).To(BeNil(), "Should download")
+		Expect(downloaded).To(Equal([]string{"file1.bin", "file2.bin"}), "Should report downloads")
+		Expect(notfound).To(Equal([]string{"missing.bin"}), "Should only report files on no mirrors as missing")
+		Expect(FileExistsAndIsOfSize(filepath.Join(localRoot, "file1.bin"), 100)).To(BeTrue(), "Should prefer first mirror")
+		Expect(FileExistsAndIsOfSize(filepath.Join(localRoot, "file2.bin"), 300)).To(BeTrue(), "Should fall back to later mirrors")
+	})
+})
+
+// Filesystem provider which counts how often it's asked to transfer
+type countingSyncProviderForTest struct {
+	FileSystemSyncProvider
+	uploads, downloads, downloadedFiles int
+}
+
+func (*countingSyncProviderForTest) TypeID() string {
+	return "countingfs"
+}
+
+func (self *countingSyncProviderForTest) Upload(remoteName string, filenames []string, fromDir string, force bool, callback SyncProgressCallback) error {
+	self.uploads++
+	return self.FileSystemSyncProvider.Upload(remoteName, filenames, fromDir, force, callback)
+}
+
+func (self *countingSyncProviderForTest) Download(remoteName string, filenames []string, toDir string, force bool, callback SyncProgressCallback) error {
+	self.downloads++
+	self.downloadedFiles += len(filenames)
+	return self.FileSystemSyncProvider.Download(remoteName, filenames, toDir, force, callback)
+}
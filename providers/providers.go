@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/atlassian/git-lob/util"
 )
@@ -34,6 +35,8 @@ type SyncProvider interface {
 	// For each file, if the remote already has this file and it's the same size, skip.
 	// Must only return nil if remote is considered fully up to date with these files
 	// If force = true, files should be uploaded even if they're already there & the correct size
+	// If a file is retried after a transient error, the callback should be called with ProgressRetry
+	// before the progress of that file starts again from 0 (same applies to Download)
 	Upload(remoteName string, filenames []string, fromDir string, force bool, callback SyncProgressCallback) error
 	// Download the list of files (binary storage). The paths are relative and files should
 	// be placed relative to toDir. Ideally in-progress downloads should go to other locations
@@ -73,6 +76,55 @@ type SmartSyncProvider interface {
 	GetFirstCompleteLOBFromList(remoteName string, candidateSHAs []string) (string, error)
 	// Upload delta of LOB content (must be calculated first)
 	UploadDelta(remoteName, basesha, targetsha string, in io.Reader, size int64, callback SyncProgressCallback) error
+	// Check that a LOB exists in full on the remote, and that its content matches the SHA (the
+	// server recalculates it, without the client downloading anything)
+	// Returns an error if the remote doesn't support this, callers should use LOBExists instead
+	VerifyLOB(remoteName, sha string) (ex bool, valid bool, e error)
+
+	// File locking; these return an error if the remote doesn't support locking
+	// Locks are owned by whoever the remote authenticates you as, not anything the client says
+	// Lock a file (path relative to the repo root, always using forward slashes)
+	// If the file is already locked by someone else, returns ok=false and the existing lock
+	// Locking a file you already hold the lock for succeeds and returns the existing lock
+	LockFile(remoteName, path string) (ok bool, lock *FileLock, e error)
+	// Release a lock you hold; if force = true, releases a lock held by anyone (the remote may
+	// return an error if you're not allowed to)
+	// If the file is locked by someone else and force = false, returns ok=false and the existing lock
+	// Unlocking a file which isn't locked succeeds with a nil lock
+	UnlockFile(remoteName, path string, force bool) (ok bool, lock *FileLock, e error)
+	// List all the locks currently held on the remote, and the Owner which your own locks have
+	ListLocks(remoteName string) (locks []*FileLock, owner string, e error)
+}
+
+// A lock held on a file in the repository
+type FileLock struct {
+	// File path relative to the root of the repo, forward slashes
+	Path string
+	// Identity of the lock holder, as authenticated by the remote
+	Owner string
+	// When the lock was taken
+	LockedAt time.Time
+}
+
+// Custom error type to indicate that a remote doesn't support locking
+// Callers which only check locks opportunistically can ignore this error
+type LockingNotSupportedError struct {
+	RemoteName string
+}
+
+func (self *LockingNotSupportedError) Error() string {
+	return fmt.Sprintf("Remote '%v' does not support locking", self.RemoteName)
+}
+
+// Create a new LockingNotSupportedError
+func NewLockingNotSupportedError(remoteName string) error {
+	return &LockingNotSupportedError{remoteName}
+}
+
+// Is an error a LockingNotSupportedError?
+func IsLockingNotSupportedError(err error) bool {
+	_, ok := err.(*LockingNotSupportedError)
+	return ok
 }
 
 // Callback when progress is made uploading / downloading
@@ -123,6 +175,10 @@ func UpgradeToSmartSyncProvider(provider SyncProvider) SmartSyncProvider {
 func InitCoreProviders() {
 	RegisterSyncProvider(&FileSystemSyncProvider{})
 	RegisterSyncProvider(&S3SyncProvider{})
+	RegisterSyncProvider(&AzureBlobSyncProvider{})
+	RegisterSyncProvider(&GCSSyncProvider{})
+	RegisterSyncProvider(&WebDAVSyncProvider{})
+	RegisterSyncProvider(&MirrorSyncProvider{})
 }
 
 // Get the provider name specified for the named remote in the current git repo
@@ -190,6 +246,7 @@ func (self *SyncProgressReader) Read(p []byte) (n int, err error) {
 	return
 }
 
+// Since this is what providers give to upload APIs, reading is limited to git-lob.max-upload-rate
 func NewSyncProgressReader(r io.Reader, filename string, totalBytes int64, callback SyncProgressCallback) *SyncProgressReader {
-	return &SyncProgressReader{r, filename, totalBytes, callback, false, 0}
+	return &SyncProgressReader{util.UploadRateLimiter().Reader(r), filename, totalBytes, callback, false, 0}
 }
@@ -0,0 +1,116 @@
+package providers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// An incomplete upload which we started, so we can carry on with it
+type resumableUpload struct {
+	Bucket string
+	// Object name / key being uploaded
+	Name string
+	Size int64
+	// How the service identifies the upload, e.g. S3 upload ID or GCS session URI
+	Id      string
+	Started time.Time
+}
+
+// Local record of incomplete uploads to a remote, so that uploads can be resumed across runs
+// Stored in a named file in the remote's state dir (see util.GetRemoteStateDir)
+type resumableUploadState struct {
+	path    string
+	mutex   sync.Mutex
+	Uploads []*resumableUpload
+}
+
+func loadResumableUploadState(remoteName, name string) *resumableUploadState {
+	state := &resumableUploadState{}
+	dir := util.GetRemoteStateDir(remoteName)
+	if dir == "" {
+		// Not in a repo, can't resume
+		return state
+	}
+	state.path = filepath.Join(dir, name)
+	data, err := ioutil.ReadFile(state.path)
+	if err != nil {
+		return state
+	}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		util.LogDebugf("Ignoring invalid upload state in %v: %v\n", state.path, err.Error())
+		state.Uploads = nil
+	}
+	return state
+}
+
+// Must be called with mutex held
+func (self *resumableUploadState) save() {
+	if self.path == "" {
+		return
+	}
+	if len(self.Uploads) == 0 {
+		os.Remove(self.path)
+		return
+	}
+	data, err := json.Marshal(self)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(self.path), 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(self.path, data, 0644)
+	}
+	if err != nil {
+		util.LogDebugf("Unable to save upload state to %v: %v\n", self.path, err.Error())
+	}
+}
+
+// Find an upload of the same content; a different size means it can't be carried on with
+func (self *resumableUploadState) Find(bucket, name string, size int64) *resumableUpload {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, u := range self.Uploads {
+		if u.Bucket == bucket && u.Name == name && u.Size == size {
+			return u
+		}
+	}
+	return nil
+}
+
+func (self *resumableUploadState) Add(upload *resumableUpload) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.Uploads = append(self.Uploads, upload)
+	self.save()
+}
+
+func (self *resumableUploadState) Remove(upload *resumableUpload) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for i, u := range self.Uploads {
+		if u == upload {
+			self.Uploads = append(self.Uploads[:i], self.Uploads[i+1:]...)
+			break
+		}
+	}
+	self.save()
+}
+
+// Get the uploads to bucket which were started longer ago than maxAge
+func (self *resumableUploadState) Expired(bucket string, maxAge time.Duration) []*resumableUpload {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	var ret []*resumableUpload
+	for _, u := range self.Uploads {
+		if u.Bucket == bucket && time.Since(u.Started) > maxAge {
+			ret = append(ret, u)
+		}
+	}
+	return ret
+}
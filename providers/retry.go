@@ -0,0 +1,91 @@
+package providers
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// Default number of times a provider should retry an operation which failed for a transient reason
+const DefaultRetries = 3
+
+// Delay before the first retry, doubled for each subsequent attempt
+// Variable so that tests can shorten it
+var RetryBaseDelay = time.Second
+
+// Maximum delay between retries
+const RetryMaxDelay = 30 * time.Second
+
+// Get the number of times to retry transient failures for a remote. Preferences in order:
+// Git setting remote.REMOTENAME.git-lob-retries
+// Git setting git-lob.retries
+// DefaultRetries
+func GetRetryCountForRemote(remoteName string) int {
+	for _, setting := range []string{fmt.Sprintf("remote.%v.git-lob-retries", remoteName), "git-lob.retries"} {
+		if val := strings.TrimSpace(util.GlobalOptions.GitConfig[setting]); val != "" {
+			n, err := strconv.ParseInt(val, 10, 0)
+			if err == nil && n >= 0 {
+				return int(n)
+			}
+			util.LogErrorf("Invalid value for %v: %v\n", setting, val)
+		}
+	}
+	return DefaultRetries
+}
+
+// Run an operation, retrying it with backoff (see GetRetryDelay) if it fails with an error which
+// isRetryable reports as transient, up to 'retries' times. onRetry (if not nil) is called before
+// each retry with the attempt number (starting at 1) and can return true to abort, in which case
+// the last error is returned
+func RetryOperation(retries int, isRetryable func(err error) bool,
+	onRetry func(attempt int, err error) (abort bool), op func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt > retries || !isRetryable(err) {
+			return err
+		}
+		if onRetry != nil && onRetry(attempt, err) {
+			return err
+		}
+		time.Sleep(GetRetryDelay(attempt))
+	}
+}
+
+// Get the delay before retry attempt number 'attempt' (starting at 1)
+// Uses exponential backoff, with jitter so that many clients don't retry in lock-step
+func GetRetryDelay(attempt int) time.Duration {
+	delay := RetryBaseDelay
+	for i := 1; i < attempt && delay < RetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > RetryMaxDelay {
+		delay = RetryMaxDelay
+	}
+	// Randomise between half and all of the delay
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// Retry a transfer of filename on errors which isRetryable reports as transient, using the
+// retry count for remoteName and reporting each retry to callback (if not nil)
+// location describes where the file is, for logging. Returns aborted = true if the callback requested it
+func retryTransfer(isRetryable func(err error) bool, remoteName, location, filename string, size int64,
+	callback SyncProgressCallback, op func() error) (aborted bool, err error) {
+
+	err = RetryOperation(GetRetryCountForRemote(remoteName), isRetryable,
+		func(attempt int, err error) bool {
+			util.LogDebugf("Retrying %v on %v (attempt %d): %v\n", filename, location, attempt, err.Error())
+			if callback != nil && callback(filename, util.ProgressRetry, 0, size) {
+				aborted = true
+			}
+			return aborted
+		}, op)
+	return aborted, err
+}
@@ -0,0 +1,38 @@
+package providers
+
+import (
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Retry", func() {
+
+	AfterEach(func() {
+		delete(GlobalOptions.GitConfig, "git-lob.retries")
+		delete(GlobalOptions.GitConfig, "remote.origin.git-lob-retries")
+	})
+
+	It("Reads retry counts", func() {
+		Expect(GetRetryCountForRemote("origin")).To(Equal(DefaultRetries), "Should use default")
+		GlobalOptions.GitConfig["git-lob.retries"] = "5"
+		Expect(GetRetryCountForRemote("origin")).To(Equal(5), "Should use global setting")
+		GlobalOptions.GitConfig["remote.origin.git-lob-retries"] = "0"
+		Expect(GetRetryCountForRemote("origin")).To(Equal(0), "Remote setting should override global")
+		Expect(GetRetryCountForRemote("other")).To(Equal(5), "Other remotes should use global setting")
+		GlobalOptions.GitConfig["remote.origin.git-lob-retries"] = "lots"
+		Expect(GetRetryCountForRemote("origin")).To(Equal(5), "Invalid remote setting should be ignored")
+	})
+
+	It("Backs off exponentially with jitter", func() {
+		for attempt := 1; attempt <= 4; attempt++ {
+			full := RetryBaseDelay << uint(attempt-1)
+			delay := GetRetryDelay(attempt)
+			Expect(delay).To(BeNumerically(">=", full/2), "Delay should be at least half")
+			Expect(delay).To(BeNumerically("<=", full), "Delay should not exceed full backoff")
+		}
+		Expect(GetRetryDelay(100)).To(BeNumerically("<=", RetryMaxDelay), "Delay should be capped")
+		Expect(GetRetryDelay(100)).To(BeNumerically(">=", RetryMaxDelay/2), "Capped delay should still be jittered")
+	})
+
+})
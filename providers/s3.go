@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -19,6 +21,9 @@ import (
 type S3SyncProvider struct {
 	S3Connection *s3.S3
 	Buckets      []string
+	// The remote S3Connection was configured for, since endpoints & regions can differ per remote
+	// Blank if S3Connection was supplied externally (so use it for everything)
+	connectionRemote string
 }
 
 func (*S3SyncProvider) TypeID() string {
@@ -38,8 +43,46 @@ Required parameters in remote section of .gitconfig:
 Optional parameters in the remote section:
     git-lob-s3-region   The AWS region to use. If not specified will use region settings
                         from your ~/.aws/config. If no region is specified, uses US East.
+    git-lob-s3-endpoint The URL of an S3-compatible store to use instead of AWS, 
+                        e.g. MinIO or Ceph RGW (http://minio.example.com:9000).
+                        The region is still used to sign requests, default 
+                        us-east-1.
+    git-lob-s3-path-style
+                        If true (the default), address the bucket in the URL 
+                        path rather than the host name. Set to false to use
+                        virtual-hosted style (bucket.host) URLs instead, if
+                        your store requires it.
     git-lob-s3-profile  The profile to use to authenticate for this remote. Can also 
                         be set in other ways, see global settings below.
+    git-lob-s3-prefix   A prefix to put in front of every key, so that many repos can
+                        share one bucket, e.g. "repos/myrepo".
+    git-lob-s3-storage-class
+                        The storage class for uploaded files, e.g. STANDARD_IA.
+                        Default is the standard class. Note that classes which
+                        need restoring before download (e.g. GLACIER) will stop
+                        fetch working.
+    git-lob-s3-sse      Server-side encryption for uploaded files: AES256 (S3
+                        managed keys) or aws:kms (KMS managed keys). Default none,
+                        or the bucket default.
+    git-lob-s3-sse-kms-key-id
+                        The KMS key to use with aws:kms. Default is the account's
+                        default S3 key.
+    git-lob-s3-acl      The canned ACL to apply to uploaded files: private, 
+                        public-read, public-read-write, authenticated-read,
+                        bucket-owner-read or bucket-owner-full-control. Default is
+                        the bucket default (private unless changed).
+    git-lob-retries     The number of times to retry a file which fails for a
+                        transient reason, e.g. S3 throttling (503 SlowDown) or
+                        network errors. Default 3, or git-lob.retries if set.
+    git-lob-s3-multipart-threshold
+                        Files larger than this are uploaded in multiple parts, 
+                        which can be uploaded in parallel and resumed if
+                        interrupted. Default 16MB.
+    git-lob-s3-multipart-partsize
+                        The size of each part of a multipart upload. Default 
+                        8MB, minimum 5MB.
+    git-lob-s3-multipart-parallel
+                        The number of parts to upload at once. Default 4.
 
 Example configuration:
     [remote "origin"]
@@ -47,6 +90,13 @@ Example configuration:
         git-lob-provider = s3
         git-lob-s3-bucket = my.binary.bucket
 
+Example configuration for a self-hosted S3-compatible store:
+    [remote "origin"]
+        url = git@blah.com/your/usual/git/repo
+        git-lob-provider = s3
+        git-lob-s3-bucket = binaries
+        git-lob-s3-endpoint = https://minio.example.com:9000
+
 Global AWS settings:
 
   Authentication is performed using the same configuration you'd use with the
@@ -65,11 +115,58 @@ Global AWS settings:
   See:
   http://docs.aws.amazon.com/cli/latest/userguide/cli-chap-getting-started.html
   for more details on the configuration process.
+
+Incomplete multipart uploads:
+
+  Interrupted multipart uploads are recorded in .git/git-lob/state and resumed
+  the next time you push. Ones which are not completed within 7 days are 
+  aborted on a later push. Uploads abandoned elsewhere (e.g. in deleted clones)
+  are invisible but still use storage; to clean those up automatically add a
+  lifecycle rule to the bucket which aborts incomplete multipart uploads.
 `
 }
 
 const S3BufferSize = 131072
 
+// S3 error codes which indicate a temporary problem, so the request is worth retrying
+var s3RetryableErrorCodes = map[string]bool{
+	"SlowDown":           true,
+	"InternalError":      true,
+	"RequestTimeout":     true,
+	"ServiceUnavailable": true,
+}
+
+// S3 error codes which mean no request to this remote can succeed, so there's no point
+// continuing with other files
+var s3FatalErrorCodes = map[string]bool{
+	"AccessDenied":          true,
+	"AccountProblem":        true,
+	"ExpiredToken":          true,
+	"InvalidAccessKeyId":    true,
+	"InvalidToken":          true,
+	"NoSuchBucket":          true,
+	"SignatureDoesNotMatch": true,
+}
+
+// Is an error from S3 transient, i.e. throttling, server-side or network problems?
+func isS3RetryableError(err error) bool {
+	switch e := err.(type) {
+	case *s3.Error:
+		return e.StatusCode >= 500 || s3RetryableErrorCodes[e.Code]
+	case net.Error:
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// Is an error from S3 one which will affect all requests, e.g. authentication or missing bucket?
+func isS3FatalError(err error) bool {
+	if e, ok := err.(*s3.Error); ok {
+		return e.StatusCode == 401 || e.StatusCode == 403 || s3FatalErrorCodes[e.Code]
+	}
+	return false
+}
+
 // Configure the profile to use for a given remote. Preferences in order:
 // Git setting remote.REMOTENAME.git-lob-s3-profile
 // Git setting git-lob.s3-profile
@@ -103,9 +200,15 @@ func (self *S3SyncProvider) getAuth() (aws.Auth, error) {
 	return auth, nil
 }
 
-// get region from the environment or config files
-func (self *S3SyncProvider) getRegion() (aws.Region, error) {
-	regstr := os.Getenv("AWS_DEFAULT_REGION")
+// Get the name of the region to use. Preferences in order:
+// Git setting remote.REMOTENAME.git-lob-s3-region
+// AWS_DEFAULT_REGION environment
+// Region for the current profile in ~/.aws/config
+func (self *S3SyncProvider) getRegionName(remoteName string) string {
+	regstr := strings.TrimSpace(util.GlobalOptions.GitConfig[fmt.Sprintf("remote.%v.git-lob-s3-region", remoteName)])
+	if regstr == "" {
+		regstr = os.Getenv("AWS_DEFAULT_REGION")
+	}
 	if regstr == "" {
 		// Look for config file
 		profile := os.Getenv("AWS_PROFILE")
@@ -127,35 +230,123 @@ func (self *S3SyncProvider) getRegion() (aws.Region, error) {
 			}
 		}
 	}
-	if regstr != "" {
-		reg, ok := aws.Regions[regstr]
-		if ok {
-			return reg, nil
+	return regstr
+}
+
+// Get the custom endpoint URL for S3-compatible stores, or blank for AWS
+func (self *S3SyncProvider) getEndpoint(remoteName string) (string, error) {
+	setting := fmt.Sprintf("remote.%v.git-lob-s3-endpoint", remoteName)
+	endpoint := strings.TrimSpace(util.GlobalOptions.GitConfig[setting])
+	if endpoint == "" {
+		return "", nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("Invalid value for %v, must be an http or https URL: %v", setting, endpoint)
+	}
+	return strings.TrimRight(endpoint, "/"), nil
+}
+
+// Whether to put the bucket name in the path rather than the host name. Defaults to true, since
+// S3-compatible stores often don't have wildcard DNS, and bucket names with dots break SSL
+func (self *S3SyncProvider) getPathStyle(remoteName string) bool {
+	val := strings.ToLower(strings.TrimSpace(util.GlobalOptions.GitConfig[fmt.Sprintf("remote.%v.git-lob-s3-path-style", remoteName)]))
+	return val != "false"
+}
+
+// Turn an endpoint URL into a virtual-hosted style one with the bucket in the host name
+func s3VirtualHostEndpoint(endpoint string) string {
+	parts := strings.SplitN(endpoint, "://", 2)
+	return parts[0] + "://${bucket}." + parts[1]
+}
+
+// get region & endpoints from the git config, environment or config files
+func (self *S3SyncProvider) getRegion(remoteName string) (aws.Region, error) {
+	regstr := self.getRegionName(remoteName)
+	endpoint, err := self.getEndpoint(remoteName)
+	if err != nil {
+		return aws.Region{}, err
+	}
+	var region aws.Region
+	if endpoint != "" {
+		// S3-compatible store; region is only used for signing so any name is OK
+		if regstr == "" {
+			regstr = aws.USEast.Name
 		}
+		region = aws.Region{Name: regstr, S3Endpoint: endpoint}
+	} else {
+		var ok bool
+		region, ok = aws.Regions[regstr]
+		if !ok {
+			// default
+			region = aws.USEast
+		}
+	}
+	if !self.getPathStyle(remoteName) {
+		region.S3BucketEndpoint = s3VirtualHostEndpoint(region.S3Endpoint)
 	}
-	// default
-	return aws.USEast, nil
+	return region, nil
 }
-func (self *S3SyncProvider) initS3() error {
+func (self *S3SyncProvider) initS3(remoteName string) error {
 	// Get auth - try environment first
 	auth, err := self.getAuth()
 	if err != nil {
 		return err
 	}
-	region, err := self.getRegion()
+	region, err := self.getRegion(remoteName)
 	if err != nil {
 		return err
 	}
-	self.S3Connection = s3.New(auth, region)
+	self.S3Connection = newS3Connection(auth, region)
+	self.connectionRemote = remoteName
 
 	// Read bucket list right now since we have no way to probe whether a bucket exists
 	self.S3Connection.ListBuckets()
 
 	return nil
 }
-func (self *S3SyncProvider) getS3Connection() (*s3.S3, error) {
-	if self.S3Connection == nil {
-		err := self.initS3()
+
+// Create a goamz S3 connection which sends the correct Host for the region
+func newS3Connection(auth aws.Auth, region aws.Region) *s3.S3 {
+	conn := s3.New(auth, region)
+	signer := s3.NewV4Signer(auth, "s3", region)
+	signer.IncludeXAmzContentSha256 = true
+	client := &http.Client{Transport: &s3HostTransport{signer: signer, base: http.DefaultTransport}}
+	conn.HTTPClient = func() *http.Client {
+		return client
+	}
+	return conn
+}
+
+// HTTP transport which corrects the Host of requests made by goamz before they're sent
+// goamz always derives the Host from the region endpoint by assuming it starts with
+// https://, which is wrong for plain http S3-compatible endpoints and for virtual-hosted
+// buckets. The Host is part of the signature so requests are re-signed after fixing it.
+type s3HostTransport struct {
+	signer *s3.V4Signer
+	base   http.RoundTripper
+}
+
+func (self *s3HostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Host == req.URL.Host {
+		return self.base.RoundTrip(req)
+	}
+	// Don't modify the caller's request
+	fixed := *req
+	fixed.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		if k != "Authorization" {
+			fixed.Header[k] = v
+		}
+	}
+	fixed.Host = req.URL.Host
+	self.signer.Sign(&fixed)
+	return self.base.RoundTrip(&fixed)
+}
+
+func (self *S3SyncProvider) getS3Connection(remoteName string) (*s3.S3, error) {
+	if self.S3Connection == nil || (self.connectionRemote != "" && self.connectionRemote != remoteName) {
+		err := self.initS3(remoteName)
 		if err != nil {
 			return nil, err
 		}
@@ -165,6 +356,7 @@ func (self *S3SyncProvider) getS3Connection() (*s3.S3, error) {
 
 func (self *S3SyncProvider) Release() {
 	self.S3Connection = nil
+	self.connectionRemote = ""
 	self.Buckets = nil
 }
 
@@ -181,12 +373,12 @@ func (self *S3SyncProvider) getBucket(remoteName string) (*s3.Bucket, error) {
 	if err != nil {
 		return nil, err
 	}
-	conn, err := self.getS3Connection()
+	// Make sure we configure the correct profile for access to bucket
+	self.configureProfile(remoteName)
+	conn, err := self.getS3Connection(remoteName)
 	if err != nil {
 		return nil, err
 	}
-	// Make sure we configure the correct profile for access to bucket
-	self.configureProfile(remoteName)
 	return conn.Bucket(bucketname), nil
 }
 
@@ -195,232 +387,218 @@ func (self *S3SyncProvider) ValidateConfig(remoteName string) error {
 	if err != nil {
 		return err
 	}
+	_, err = self.getUploadOptions(remoteName)
+	if err != nil {
+		return err
+	}
+	_, err = self.getEndpoint(remoteName)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
-func (self *S3SyncProvider) FileExists(remoteName, filename string) bool {
-	bucket, err := self.getBucket(remoteName)
-	if err != nil {
-		return false
+// Get the prefix to put in front of all keys for a remote, so many repos can share a bucket
+// Returns blank or a prefix ending in "/"
+func (self *S3SyncProvider) getKeyPrefix(remoteName string) string {
+	prefix := strings.TrimSpace(util.GlobalOptions.GitConfig[fmt.Sprintf("remote.%v.git-lob-s3-prefix", remoteName)])
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
 	}
-	key, err := bucket.GetKey(filename)
-	return err == nil && key != nil
+	return prefix + "/"
 }
-func (self *S3SyncProvider) FileExistsAndIsOfSize(remoteName, filename string, sz int64) bool {
-	bucket, err := self.getBucket(remoteName)
-	if err != nil {
-		return false
-	}
-	key, err := bucket.GetKey(filename)
-	return err == nil && key != nil && key.Size == sz
+
+// Get the S3 key for a file relative to the root of the store
+func (self *S3SyncProvider) keyName(remoteName, filename string) string {
+	return self.getKeyPrefix(remoteName) + filepath.ToSlash(filename)
 }
 
-func (*S3SyncProvider) uploadSingleFile(remoteName, filename, fromDir string, destBucket *s3.Bucket,
-	force bool, callback SyncProgressCallback) (errorList []string, abort bool) {
-	// Check to see if the file is already there, right size
-	srcfilename := filepath.Join(fromDir, filename)
-	srcfi, err := os.Stat(srcfilename)
-	if err != nil {
-		if callback != nil {
-			if callback(filename, util.ProgressNotFound, 0, 0) {
-				return errorList, true
+// Canned ACLs which can be used for git-lob-s3-acl
+var s3ValidACLs = []s3.ACL{s3.Private, s3.PublicRead, s3.PublicReadWrite, s3.AuthenticatedRead,
+	s3.BucketOwnerRead, s3.BucketOwnerFull}
+
+// Options applied to every object uploaded to a remote
+type s3UploadOptions struct {
+	// Canned ACL, blank to use the bucket default
+	ACL s3.ACL
+	// Content type, storage class & encryption headers
+	Headers map[string][]string
+	// When & how to use multipart uploads
+	Multipart *s3MultipartConfig
+}
+
+// Read upload options for a remote, see HelpTextDetail
+func (self *S3SyncProvider) getUploadOptions(remoteName string) (*s3UploadOptions, error) {
+	opts := &s3UploadOptions{Headers: map[string][]string{"Content-Type": {"binary/octet-stream"}}}
+
+	setting := fmt.Sprintf("remote.%v.git-lob-s3-acl", remoteName)
+	if acl := strings.ToLower(strings.TrimSpace(util.GlobalOptions.GitConfig[setting])); acl != "" {
+		for _, valid := range s3ValidACLs {
+			if acl == string(valid) {
+				opts.ACL = valid
 			}
 		}
-		msg := fmt.Sprintf("Unable to stat %v: %v", srcfilename, err)
-		errorList = append(errorList, msg)
-		// Keep going with other files
-		return errorList, false
-	}
-
-	if !force {
-		// Check if already there before uploading
-		if key, err := destBucket.GetKey(filename); key != nil && err == nil {
-			// File exists on remote, check the size
-			if key.Size == srcfi.Size() {
-				// File already present and correct size, skip
-				if callback != nil {
-					if callback(filename, util.ProgressSkip, srcfi.Size(), srcfi.Size()) {
-						return errorList, true
-					}
-				}
-				return errorList, false
-			}
-
+		if opts.ACL == "" {
+			return nil, fmt.Errorf("Invalid value for %v: %v", setting, acl)
 		}
 	}
 
-	// We don't need to create a temporary file on S3 to deal with interrupted uploads, because
-	// the file is not fully created in the bucket until fully uploaded
-	inf, err := os.OpenFile(srcfilename, os.O_RDONLY, 0644)
-	if err != nil {
-		msg := fmt.Sprintf("Unable to read input file for upload %v: %v", srcfilename, err)
-		errorList = append(errorList, msg)
-		return errorList, false
+	setting = fmt.Sprintf("remote.%v.git-lob-s3-storage-class", remoteName)
+	if class := strings.ToUpper(strings.TrimSpace(util.GlobalOptions.GitConfig[setting])); class != "" {
+		opts.Headers["x-amz-storage-class"] = []string{class}
 	}
-	defer inf.Close()
 
-	// Initial callback
-	if callback != nil {
-		if callback(filename, util.ProgressTransferBytes, 0, srcfi.Size()) {
-			return errorList, true
+	setting = fmt.Sprintf("remote.%v.git-lob-s3-sse", remoteName)
+	kmssetting := fmt.Sprintf("remote.%v.git-lob-s3-sse-kms-key-id", remoteName)
+	kmskey := strings.TrimSpace(util.GlobalOptions.GitConfig[kmssetting])
+	switch sse := strings.TrimSpace(util.GlobalOptions.GitConfig[setting]); strings.ToLower(sse) {
+	case "":
+		if kmskey != "" {
+			return nil, fmt.Errorf("%v requires %v to be set to aws:kms", kmssetting, setting)
+		}
+	case "aes256":
+		if kmskey != "" {
+			return nil, fmt.Errorf("%v requires %v to be set to aws:kms", kmssetting, setting)
+		}
+		opts.Headers["x-amz-server-side-encryption"] = []string{"AES256"}
+	case "aws:kms":
+		opts.Headers["x-amz-server-side-encryption"] = []string{"aws:kms"}
+		if kmskey != "" {
+			opts.Headers["x-amz-server-side-encryption-aws-kms-key-id"] = []string{kmskey}
 		}
+	default:
+		return nil, fmt.Errorf("Invalid value for %v: %v (must be AES256 or aws:kms)", setting, sse)
 	}
 
-	// Create a Reader which reports progress as it is read from
-	progressReader := NewSyncProgressReader(inf, filename, srcfi.Size(), callback)
-	// Note default ACL
-	err = destBucket.PutReader(filename, progressReader, srcfi.Size(), "binary/octet-stream", "")
+	var err error
+	opts.Multipart, err = getS3MultipartConfig(remoteName)
 	if err != nil {
-		errorList = append(errorList, fmt.Sprintf("Problem while uploading %v to %v: %v", filename, remoteName, err))
+		return nil, err
 	}
+	return opts, nil
+}
 
-	return errorList, progressReader.Aborted
+// Get the details of a key, retrying transient errors. Errors include the key not existing.
+func (self *S3SyncProvider) getKey(remoteName, filename string, bucket *s3.Bucket) (*s3.Key, error) {
+	var key *s3.Key
+	_, err := retryTransfer(isS3RetryableError, remoteName, "S3 bucket "+bucket.Name, filename, 0, nil, func() error {
+		var err error
+		key, err = bucket.GetKey(self.keyName(remoteName, filename))
+		return err
+	})
+	return key, err
+}
 
+// Get the single file transfer helper for a remote
+func (self *S3SyncProvider) fileTransfer(remoteName string, bucket *s3.Bucket) *remoteFileTransfer {
+	return &remoteFileTransfer{
+		remoteName:  remoteName,
+		location:    "S3 bucket " + bucket.Name,
+		isRetryable: isS3RetryableError,
+		isFatal:     isS3FatalError,
+		stat: func(filename string) (bool, int64, error) {
+			key, err := self.getKey(remoteName, filename, bucket)
+			if err != nil {
+				if isS3RetryableError(err) {
+					// Not just missing, we couldn't tell
+					return false, 0, err
+				}
+				// Note HEAD responses have no body so we can't tell missing files from access problems
+				// (S3 returns 403 for missing files without list permission); bucket access was checked already
+				return false, 0, nil
+			}
+			return true, key.Size, nil
+		},
+	}
 }
 
-func (self *S3SyncProvider) Upload(remoteName string, filenames []string, fromDir string,
-	force bool, callback SyncProgressCallback) error {
+// Check the bucket is accessible (via HEAD endpoint), retrying transient errors
+// This saves us failing on every file
+func (self *S3SyncProvider) checkBucket(remoteName string, bucket *s3.Bucket) error {
+	_, err := retryTransfer(isS3RetryableError, remoteName, "S3 bucket "+bucket.Name, bucket.Name, 0, nil, func() error {
+		_, err := bucket.Head("/")
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to access S3 bucket '%v' for remote '%v': %v", bucket.Name, remoteName, err.Error())
+	}
+	return nil
+}
 
+func (self *S3SyncProvider) FileExists(remoteName, filename string) bool {
 	bucket, err := self.getBucket(remoteName)
 	if err != nil {
-		return err
+		return false
 	}
-
-	util.LogDebug("Uploading to S3 bucket", bucket.Name)
-
-	// Check bucket exists (via HEAD endpoint)
-	// This saves us failing on every file
-	_, err = bucket.Head("/")
+	key, err := self.getKey(remoteName, filename, bucket)
+	return err == nil && key != nil
+}
+func (self *S3SyncProvider) FileExistsAndIsOfSize(remoteName, filename string, sz int64) bool {
+	bucket, err := self.getBucket(remoteName)
 	if err != nil {
-		return fmt.Errorf("Unable to access S3 bucket '%v' for remote '%v': %v", bucket.Name, err.Error())
+		return false
 	}
+	key, err := self.getKey(remoteName, filename, bucket)
+	return err == nil && key != nil && key.Size == sz
+}
 
-	var errorList []string
-	for _, filename := range filenames {
-		// Allow aborting
-		newerrs, abort := self.uploadSingleFile(remoteName, filename, fromDir, bucket, force, callback)
-		errorList = append(errorList, newerrs...)
-		if abort {
-			break
-		}
-	}
+// Upload one file to key, in parts if it's large
+// We don't need to create a temporary file on S3 to deal with interrupted uploads, because
+// the file is not fully created in the bucket until fully uploaded
+func (self *S3SyncProvider) putFile(remoteName, filename, key string, bucket *s3.Bucket, inf *os.File, size int64,
+	opts *s3UploadOptions, multipartState *resumableUploadState, callback SyncProgressCallback) (userAborted bool, err error) {
 
-	if len(errorList) > 0 {
-		return errors.New(strings.Join(errorList, "\n"))
+	userAborted, err = restartUpload(inf, filename, size, callback)
+	if userAborted || err != nil {
+		return userAborted, err
+	}
+	if size > opts.Multipart.Threshold {
+		// Large files go in parts; failed attempts resume with the parts already uploaded
+		return self.uploadMultipart(remoteName, filename, key, bucket, inf, size, opts, multipartState, callback)
 	}
 
-	return nil
+	// Create a Reader which reports progress as it is read from
+	progressReader := NewSyncProgressReader(inf, filename, size, callback)
+	err = bucket.PutReaderHeader(key, progressReader, size, opts.Headers, opts.ACL)
+	if progressReader.Aborted {
+		return true, nil
+	}
+	return false, err
 }
 
-func (*S3SyncProvider) downloadSingleFile(remoteName, filename string, bucket *s3.Bucket, toDir string,
-	force bool, callback SyncProgressCallback) (errorList []string, abort bool) {
+func (self *S3SyncProvider) Upload(remoteName string, filenames []string, fromDir string,
+	force bool, callback SyncProgressCallback) error {
 
-	// Query for existence & size first; we need the size either way to report d/l progress
-	key, err := bucket.GetKey(filename)
+	bucket, err := self.getBucket(remoteName)
 	if err != nil {
-		// File missing on remote
-		if callback != nil {
-			if callback(filename, util.ProgressNotFound, 0, 0) {
-				return errorList, true
-			}
-		}
-		// Note how we don't add an error to the returned error list
-		// As per provider docs, we simply tell callback it happened & treat it
-		// as a skipped item otherwise, since caller can only request files & not know
-		// if they're on the remote or not
-		// Keep going with other files
-		return errorList, false
-	}
-
-	// Check to see if the file is already there, right size
-	destfilename := filepath.Join(toDir, filename)
-	if !force {
-		if destfi, err := os.Stat(destfilename); err == nil {
-			// File exists locally, check the size
-			if destfi.Size() == key.Size {
-				// File already present and correct size, skip
-				if callback != nil {
-					if callback(filename, util.ProgressSkip, destfi.Size(), destfi.Size()) {
-						return errorList, true
-					}
-				}
-				return errorList, false
-			}
-		}
+		return err
 	}
 
-	// Make sure dest dir exists
-	parentDir := filepath.Dir(destfilename)
-	err = os.MkdirAll(parentDir, 0755)
-	if err != nil {
-		msg := fmt.Sprintf("Unable to create dir %v: %v", parentDir, err)
-		errorList = append(errorList, msg)
-		return errorList, false
-	}
-	// Create a temporary file to download, avoid issues with interruptions
-	// Note this isn't a valid thing to do in security conscious cases but this isn't one
-	// by opening the file we will get a unique temp file name (albeit a predictable one)
-	outf, err := ioutil.TempFile(parentDir, "tempdownload")
-	if err != nil {
-		msg := fmt.Sprintf("Unable to create temp file for download in %v: %v", parentDir, err)
-		errorList = append(errorList, msg)
-		return errorList, false
-	}
-	tmpfilename := outf.Name()
-	// This is safe to do even though we manually close & rename because both calls are no-ops if we succeed
-	defer func() {
-		outf.Close()
-		os.Remove(tmpfilename)
-	}()
-
-	inf, err := bucket.GetReader(filename)
+	util.LogDebug("Uploading to S3 bucket", bucket.Name)
+
+	err = self.checkBucket(remoteName, bucket)
 	if err != nil {
-		msg := fmt.Sprintf("Unable to read file %v from S3 bucket %v for download: %v", filename, bucket.Name, err)
-		errorList = append(errorList, msg)
-		return errorList, false
+		return err
 	}
-	defer inf.Close()
 
-	// Initial callback
-	if callback != nil {
-		if callback(filename, util.ProgressTransferBytes, 0, key.Size) {
-			return errorList, true
-		}
-	}
-	var copysize int64 = 0
-	for {
-		var n int64
-		n, err = io.CopyN(outf, inf, S3BufferSize)
-		copysize += n
-		if n > 0 && callback != nil && key.Size > 0 {
-			if callback(filename, util.ProgressTransferBytes, copysize, key.Size) {
-				return errorList, true
-			}
-		}
-		if err != nil {
-			break
-		}
-	}
-	outf.Close()
-	inf.Close()
-	if copysize != key.Size {
-		os.Remove(tmpfilename)
-		var msg string
-		if err != nil {
-			msg = fmt.Sprintf("Problem while downloading %v from S3 bucket %v: %v", filename, bucket.Name, err)
-		} else {
-			msg = fmt.Sprintf("Download error: number of bytes read from S3 bucket %v in download of %v does not agree (%d/%d)",
-				bucket.Name, filename, copysize, key.Size)
-		}
-		errorList = append(errorList, msg)
-		return errorList, false
+	opts, err := self.getUploadOptions(remoteName)
+	if err != nil {
+		return err
 	}
-	// Otherwise, file data is ok on remote
-	// Move to correct location - remove before to deal with force or bad size cases
-	os.Remove(destfilename)
-	os.Rename(tmpfilename, destfilename)
-	return errorList, false
+	multipartState := loadResumableUploadState(remoteName, "s3_multipart")
+
+	transfer := self.fileTransfer(remoteName, bucket)
+	err = transferEachFile(filenames, func(filename string) ([]string, bool) {
+		return transfer.upload(filename, fromDir, force, callback, func(inf *os.File, size int64) (bool, error) {
+			return self.putFile(remoteName, filename, self.keyName(remoteName, filename), bucket, inf, size,
+				opts, multipartState, callback)
+		}, nil)
+	})
 
+	self.cleanupMultipartUploads(bucket, multipartState)
+
+	return err
 }
 
 func (self *S3SyncProvider) Download(remoteName string, filenames []string, toDir string, force bool, callback SyncProgressCallback) error {
@@ -432,26 +610,15 @@ func (self *S3SyncProvider) Download(remoteName string, filenames []string, toDi
 
 	util.LogDebug("Downloading from S3 bucket", bucket.Name)
 
-	// Check bucket exists (via HEAD endpoint)
-	// This saves us failing on every file
-	_, err = bucket.Head("/")
+	err = self.checkBucket(remoteName, bucket)
 	if err != nil {
-		return fmt.Errorf("Unable to access S3 bucket '%v' for remote '%v': %v", bucket.Name, err.Error())
-	}
-
-	var errorList []string
-	for _, filename := range filenames {
-		// Allow aborting
-		newerrs, abort := self.downloadSingleFile(remoteName, filename, bucket, toDir, force, callback)
-		errorList = append(errorList, newerrs...)
-		if abort {
-			break
-		}
-	}
-
-	if len(errorList) > 0 {
-		return errors.New(strings.Join(errorList, "\n"))
+		return err
 	}
 
-	return nil
+	transfer := self.fileTransfer(remoteName, bucket)
+	return transferEachFile(filenames, func(filename string) ([]string, bool) {
+		return transfer.download(filename, toDir, force, callback, func() (io.ReadCloser, error) {
+			return bucket.GetReader(self.keyName(remoteName, filename))
+		})
+	})
 }
@@ -2,9 +2,11 @@ package providers
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/mitchellh/goamz/aws"
 	"github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/mitchellh/goamz/s3"
@@ -223,12 +225,272 @@ var _ = Describe("S3", func() {
 			os.Remove(absfile)
 		})
 
+		It("Retries transient errors", func() {
+			oldDelay := RetryBaseDelay
+			RetryBaseDelay = time.Millisecond
+			defer func() { RetryBaseDelay = oldDelay }()
+
+			var filesUploaded []string
+			var filesRetried []string
+			callback := func(filename string, progressType ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
+				if progressType == ProgressRetry {
+					// Any progress so far is void, it starts again
+					filesRetried = append(filesRetried, filename)
+					filesUploaded = nil
+				} else if bytesDone == totalBytes {
+					filesUploaded = append(filesUploaded, filename)
+				}
+				return false
+			}
+			tmp, _ := ioutil.TempDir("", "s3test")
+			tempsToDelete = append(tempsToDelete, tmp)
+			filename := filepath.Join(tmp, "file1.txt")
+			CreateRandomFileForTest(100, filename)
+
+			// 1 Check that bucket exists (OK)
+			testServer.Response(200, nil, "")
+			// 2 Check if file exists (404)
+			testServer.Response(404, nil, "")
+			// 3 Upload, throttled
+			testServer.Response(503, nil, "<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>")
+			// 4 Upload again, OK
+			testServer.Response(200, nil, "")
+			err := s3sync.Upload("origin", []string{"file1.txt"}, tmp, false, callback)
+			Expect(err).To(BeNil(), "Should not be error uploading")
+			testServer.WaitRequests(3)
+			req := testServer.WaitRequest()
+			Expect(req.Method).To(Equal("PUT"), "Should have retried upload")
+			Expect(req.Header["Content-Length"]).To(Equal([]string{"100"}), "Should upload the whole file again")
+			Expect(filesRetried).To(ConsistOf([]string{"file1.txt"}), "Retry should be reported")
+			Expect(filesUploaded).To(ConsistOf([]string{"file1.txt"}), "File should be uploaded")
+
+			// Gives up after the retry limit
+			GlobalOptions.GitConfig["remote.origin.git-lob-retries"] = "1"
+			filesRetried = nil
+			testServer.Response(200, nil, "")
+			testServer.Response(404, nil, "")
+			testServer.Responses(2, 500, nil, "<Error><Code>InternalError</Code><Message>Oops</Message></Error>")
+			err = s3sync.Upload("origin", []string{"file1.txt"}, tmp, false, callback)
+			Expect(err).ToNot(BeNil(), "Should be an error once retries are exhausted")
+			testServer.WaitRequests(4)
+			Expect(filesRetried).To(HaveLen(1), "Should retry only once")
+		})
+
+		It("Does not retry fatal errors", func() {
+			oldDelay := RetryBaseDelay
+			RetryBaseDelay = time.Millisecond
+			defer func() { RetryBaseDelay = oldDelay }()
+
+			var filesRetried []string
+			callback := func(filename string, progressType ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
+				if progressType == ProgressRetry {
+					filesRetried = append(filesRetried, filename)
+				}
+				return false
+			}
+			tmp, _ := ioutil.TempDir("", "s3test")
+			tempsToDelete = append(tempsToDelete, tmp)
+			CreateRandomFileForTest(100, filepath.Join(tmp, "file1.txt"))
+			CreateRandomFileForTest(100, filepath.Join(tmp, "file2.txt"))
+
+			// 1 Check that bucket exists (OK)
+			testServer.Response(200, nil, "")
+			// 2 Check if file exists (404)
+			testServer.Response(404, nil, "")
+			// 3 Upload, denied
+			testServer.Response(403, nil, "<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>")
+			err := s3sync.Upload("origin", []string{"file1.txt", "file2.txt"}, tmp, false, callback)
+			Expect(err).ToNot(BeNil(), "Should be an error")
+			reqs := testServer.WaitRequests(3)
+			Expect(reqs[2].URL.Path).To(Equal("/thebucket/file1.txt"), "Should only try first file")
+			Expect(filesRetried).To(BeEmpty(), "Should not retry")
+		})
+
+		It("Applies key prefix and upload options", func() {
+			GlobalOptions.GitConfig["remote.origin.git-lob-s3-prefix"] = "/repos/myrepo/"
+			GlobalOptions.GitConfig["remote.origin.git-lob-s3-storage-class"] = "standard_ia"
+			GlobalOptions.GitConfig["remote.origin.git-lob-s3-sse"] = "aws:kms"
+			GlobalOptions.GitConfig["remote.origin.git-lob-s3-sse-kms-key-id"] = "mykey"
+			GlobalOptions.GitConfig["remote.origin.git-lob-s3-acl"] = "bucket-owner-full-control"
+			tmp, _ := ioutil.TempDir("", "s3test")
+			tempsToDelete = append(tempsToDelete, tmp)
+			CreateRandomFileForTest(100, filepath.Join(tmp, "file1.txt"))
+
+			// bucket, file check, upload
+			testServer.Response(200, nil, "")
+			testServer.Response(404, nil, "")
+			testServer.Response(200, nil, "")
+			err := s3sync.Upload("origin", []string{"file1.txt"}, tmp, false, nil)
+			Expect(err).To(BeNil(), "Should not be error uploading")
+			reqs := testServer.WaitRequests(3)
+			Expect(reqs[1].URL.Path).To(Equal("/thebucket/repos/myrepo/file1.txt"), "Should check prefixed key")
+			Expect(reqs[2].URL.Path).To(Equal("/thebucket/repos/myrepo/file1.txt"), "Should upload to prefixed key")
+			Expect(reqs[2].Header.Get("Content-Type")).To(Equal("binary/octet-stream"), "Should set content type")
+			Expect(reqs[2].Header.Get("x-amz-storage-class")).To(Equal("STANDARD_IA"), "Should set storage class")
+			Expect(reqs[2].Header.Get("x-amz-server-side-encryption")).To(Equal("aws:kms"), "Should set encryption")
+			Expect(reqs[2].Header.Get("x-amz-server-side-encryption-aws-kms-key-id")).To(Equal("mykey"), "Should set KMS key")
+			Expect(reqs[2].Header.Get("x-amz-acl")).To(Equal("bucket-owner-full-control"), "Should set ACL")
+
+			// Downloads use prefix too
+			testServer.Response(200, nil, "")
+			testServer.Response(200, map[string]string{"Content-Length": "5"}, "")
+			testServer.Response(200, map[string]string{"Content-Length": "5"}, "Hello")
+			err = s3sync.Download("origin", []string{"file2.txt"}, tmp, false, nil)
+			Expect(err).To(BeNil(), "Should not be error downloading")
+			reqs = testServer.WaitRequests(3)
+			Expect(reqs[2].URL.Path).To(Equal("/thebucket/repos/myrepo/file2.txt"), "Should download prefixed key")
+
+			GlobalOptions.GitConfig["remote.origin.git-lob-s3-acl"] = "everyone"
+			Expect(s3sync.ValidateConfig("origin")).ToNot(BeNil(), "Invalid ACL should be rejected")
+			GlobalOptions.GitConfig["remote.origin.git-lob-s3-acl"] = "private"
+			GlobalOptions.GitConfig["remote.origin.git-lob-s3-sse"] = "AES256"
+			Expect(s3sync.ValidateConfig("origin")).ToNot(BeNil(), "KMS key without aws:kms should be rejected")
+			delete(GlobalOptions.GitConfig, "remote.origin.git-lob-s3-sse-kms-key-id")
+			Expect(s3sync.ValidateConfig("origin")).To(BeNil(), "Should be valid")
+		})
+
+		It("Uses S3-compatible endpoints", func() {
+			for _, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"} {
+				defer os.Setenv(env, os.Getenv(env))
+			}
+			os.Setenv("AWS_ACCESS_KEY_ID", "abc")
+			os.Setenv("AWS_SECRET_ACCESS_KEY", "123")
+			GlobalOptions.GitConfig["remote.origin.git-lob-s3-endpoint"] = testServer.URL
+			GlobalOptions.GitConfig["remote.origin.git-lob-s3-region"] = "local-region"
+			s3sync = &S3SyncProvider{}
+
+			// 1 List buckets on connect
+			testServer.Response(200, nil, "<ListAllMyBucketsResult></ListAllMyBucketsResult>")
+			// 2 Check file
+			testServer.Response(404, nil, "")
+			exists := s3sync.FileExists("origin", "notafile.txt")
+			Expect(exists).To(BeFalse(), "File should not exist")
+			reqs := testServer.WaitRequests(2)
+			Expect(reqs[1].URL.Path).To(Equal("/thebucket/notafile.txt"), "Should use path-style addressing")
+			Expect(reqs[1].Host).To(Equal("localhost:4444"), "Should send correct host")
+			Expect(reqs[1].Header.Get("Authorization")).To(ContainSubstring("/local-region/s3/aws4_request"), "Should sign for configured region")
+
+			// Virtual-hosted style
+			GlobalOptions.GitConfig["remote.origin.git-lob-s3-path-style"] = "false"
+			region, err := s3sync.getRegion("origin")
+			Expect(err).To(BeNil(), "Should not be an error")
+			Expect(region.S3Endpoint).To(Equal(testServer.URL), "Should use endpoint")
+			Expect(region.S3BucketEndpoint).To(Equal("http://${bucket}.localhost:4444"), "Should put bucket in host name")
+
+			GlobalOptions.GitConfig["remote.origin.git-lob-s3-endpoint"] = "minio.example.com"
+			Expect(s3sync.ValidateConfig("origin")).ToNot(BeNil(), "Endpoint without scheme should be invalid")
+		})
+
+		Context("Multipart uploads", func() {
+			var oldwd, tmp string
+			BeforeEach(func() {
+				// Multipart state is stored in the git dir so work in a fake repo
+				oldwd, _ = os.Getwd()
+				tmp, _ = ioutil.TempDir("", "s3multiparttest")
+				tempsToDelete = append(tempsToDelete, tmp)
+				os.MkdirAll(filepath.Join(tmp, ".git"), 0755)
+				os.Chdir(tmp)
+				GlobalOptions.GitConfig["remote.origin.git-lob-s3-multipart-threshold"] = "5MB"
+				GlobalOptions.GitConfig["remote.origin.git-lob-s3-multipart-partsize"] = "5MB"
+				GlobalOptions.GitConfig["remote.origin.git-lob-s3-multipart-parallel"] = "1"
+				CreateRandomFileForTest(6*1024*1024, filepath.Join(tmp, "content", "bigfile"))
+			})
+			AfterEach(func() {
+				os.Chdir(oldwd)
+			})
+			statefile := func() string {
+				return filepath.Join(tmp, ".git", "git-lob", "state", "remotes", "origin", "s3_multipart")
+			}
+			initResponse := "<InitiateMultipartUploadResult><UploadId>upload1</UploadId></InitiateMultipartUploadResult>"
+
+			It("Uploads large files in parts", func() {
+				var progress []int64
+				callback := func(filename string, progressType ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
+					progress = append(progress, bytesDone)
+					return false
+				}
+				// bucket, file check, initiate, 2 parts, complete
+				testServer.Response(200, nil, "")
+				testServer.Response(404, nil, "")
+				testServer.Response(200, nil, initResponse)
+				testServer.Responses(2, 200, map[string]string{"ETag": `"abc"`}, "")
+				testServer.Response(200, nil, "")
+				err := s3sync.Upload("origin", []string{"bigfile"}, filepath.Join(tmp, "content"), false, callback)
+				Expect(err).To(BeNil(), "Should not be error uploading")
+				reqs := testServer.WaitRequests(6)
+				Expect(reqs[2].Method).To(Equal("POST"), "Should initiate multipart upload")
+				Expect(reqs[2].URL.Query()).To(HaveKey("uploads"), "Should initiate multipart upload")
+				Expect(reqs[2].Header.Get("Content-Type")).To(Equal("binary/octet-stream"), "Should set content type")
+				Expect(reqs[2].Header).ToNot(HaveKey("X-Amz-Acl"), "Should use bucket default ACL")
+				Expect(reqs[3].URL.Query().Get("partNumber")).To(Equal("1"), "Should upload first part")
+				Expect(reqs[3].Header["Content-Length"]).To(Equal([]string{"5242880"}), "First part should be full size")
+				Expect(reqs[4].URL.Query().Get("partNumber")).To(Equal("2"), "Should upload second part")
+				Expect(reqs[4].Header["Content-Length"]).To(Equal([]string{"1048576"}), "Second part should be remainder")
+				Expect(reqs[5].Method).To(Equal("POST"), "Should complete multipart upload")
+				Expect(reqs[5].URL.Query().Get("uploadId")).To(Equal("upload1"), "Should complete correct upload")
+				Expect(progress).To(Equal([]int64{0, 5242880, 6291456}), "Should report progress per part")
+				Expect(FileExists(statefile())).To(BeFalse(), "Should not record completed upload")
+			})
+
+			It("Resumes incomplete uploads", func() {
+				// bucket, file check, initiate, part 1, part 2 fails
+				testServer.Response(200, nil, "")
+				testServer.Response(404, nil, "")
+				testServer.Response(200, nil, initResponse)
+				testServer.Response(200, map[string]string{"ETag": `"abc"`}, "")
+				testServer.Response(400, nil, "<Error><Code>InvalidArgument</Code><Message>Nope</Message></Error>")
+				err := s3sync.Upload("origin", []string{"bigfile"}, filepath.Join(tmp, "content"), false, nil)
+				Expect(err).ToNot(BeNil(), "Should be error uploading")
+				testServer.WaitRequests(5)
+				Expect(FileExists(statefile())).To(BeTrue(), "Should record incomplete upload")
+
+				// Now resume; server says part 1 is there
+				f, _ := os.Open(filepath.Join(tmp, "content", "bigfile"))
+				etag, _ := s3PartETag(io.LimitReader(f, 5*1024*1024))
+				f.Close()
+				listParts := fmt.Sprintf("<ListPartsResult><IsTruncated>false</IsTruncated><Part><PartNumber>1</PartNumber><ETag>%v</ETag><Size>5242880</Size></Part></ListPartsResult>", etag)
+				// bucket, file check, list parts, part 2, complete
+				testServer.Response(200, nil, "")
+				testServer.Response(404, nil, "")
+				testServer.Response(200, nil, listParts)
+				testServer.Response(200, map[string]string{"ETag": `"def"`}, "")
+				testServer.Response(200, nil, "")
+				err = s3sync.Upload("origin", []string{"bigfile"}, filepath.Join(tmp, "content"), false, nil)
+				Expect(err).To(BeNil(), "Should not be error resuming")
+				reqs := testServer.WaitRequests(5)
+				Expect(reqs[2].Method).To(Equal("GET"), "Should list existing parts")
+				Expect(reqs[2].URL.Query().Get("uploadId")).To(Equal("upload1"), "Should resume the same upload")
+				Expect(reqs[3].Method).To(Equal("PUT"), "Should upload missing part")
+				Expect(reqs[3].URL.Query().Get("partNumber")).To(Equal("2"), "Should only upload the missing part")
+				Expect(reqs[4].Method).To(Equal("POST"), "Should complete multipart upload")
+				Expect(FileExists(statefile())).To(BeFalse(), "Should not record completed upload")
+			})
+
+			It("Aborts abandoned uploads", func() {
+				state := loadResumableUploadState("origin", "s3_multipart")
+				state.Add(&resumableUpload{Bucket: "thebucket", Name: "oldfile", Id: "oldupload", Started: time.Now().Add(-S3MultipartExpiry - time.Hour)})
+				state.Add(&resumableUpload{Bucket: "thebucket", Name: "newfile", Id: "newupload", Started: time.Now()})
+
+				// bucket, then abort of old upload
+				testServer.Response(200, nil, "")
+				testServer.Response(204, nil, "")
+				err := s3sync.Upload("origin", []string{}, filepath.Join(tmp, "content"), false, nil)
+				Expect(err).To(BeNil(), "Should not be error")
+				reqs := testServer.WaitRequests(2)
+				Expect(reqs[1].Method).To(Equal("DELETE"), "Should abort upload")
+				Expect(reqs[1].URL.Query().Get("uploadId")).To(Equal("oldupload"), "Should abort the expired upload only")
+				state = loadResumableUploadState("origin", "s3_multipart")
+				Expect(state.Uploads).To(HaveLen(1), "Should keep recent upload")
+				Expect(state.Uploads[0].Id).To(Equal("newupload"), "Should keep recent upload")
+			})
+		})
+
 	})
 
 	/*
 		It("Simple S3 smoke tests", func() {
 			sync := S3SyncProvider{}
-			sync.initS3()
+			sync.initS3("origin")
 			bucket := sync.S3Connection.Bucket("git-lob.test")
 			key, err := bucket.GetKey("test.txt")
 			Expect(err).To(BeNil(), "Should be there")
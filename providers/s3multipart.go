@@ -0,0 +1,306 @@
+package providers
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/mitchellh/goamz/s3"
+	"github.com/atlassian/git-lob/util"
+)
+
+// Files larger than this are uploaded to S3 in multiple parts by default
+const S3DefaultMultipartThreshold = 16 * 1024 * 1024
+
+// Default size of each part in a multipart upload
+const S3DefaultMultipartPartSize = 8 * 1024 * 1024
+
+// S3 requires all parts except the last to be at least this size
+const S3MinMultipartPartSize = 5 * 1024 * 1024
+
+// Default number of parts to upload at once
+const S3DefaultMultipartParallel = 4
+
+// How long we keep an incomplete multipart upload around to resume before aborting it
+const S3MultipartExpiry = 7 * 24 * time.Hour
+
+// Multipart settings for a remote
+type s3MultipartConfig struct {
+	// Files larger than this use multipart uploads
+	Threshold int64
+	// Size of each part
+	PartSize int64
+	// Number of parts to upload in parallel
+	Parallel int
+}
+
+// Read multipart settings for a remote, see HelpTextDetail
+func getS3MultipartConfig(remoteName string) (*s3MultipartConfig, error) {
+	cfg := &s3MultipartConfig{S3DefaultMultipartThreshold, S3DefaultMultipartPartSize, S3DefaultMultipartParallel}
+
+	setting := fmt.Sprintf("remote.%v.git-lob-s3-multipart-threshold", remoteName)
+	if val := strings.TrimSpace(util.GlobalOptions.GitConfig[setting]); val != "" {
+		sz, err := util.ParseSize(val)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for %v: %v", setting, err.Error())
+		}
+		cfg.Threshold = sz
+	}
+	setting = fmt.Sprintf("remote.%v.git-lob-s3-multipart-partsize", remoteName)
+	if val := strings.TrimSpace(util.GlobalOptions.GitConfig[setting]); val != "" {
+		sz, err := util.ParseSize(val)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for %v: %v", setting, err.Error())
+		}
+		if sz < S3MinMultipartPartSize {
+			return nil, fmt.Errorf("Invalid value for %v: must be at least %v", setting, util.FormatSize(S3MinMultipartPartSize))
+		}
+		cfg.PartSize = sz
+	}
+	setting = fmt.Sprintf("remote.%v.git-lob-s3-multipart-parallel", remoteName)
+	if val := strings.TrimSpace(util.GlobalOptions.GitConfig[setting]); val != "" {
+		n, err := strconv.ParseInt(val, 10, 0)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("Invalid value for %v: %v", setting, val)
+		}
+		cfg.Parallel = int(n)
+	}
+	return cfg, nil
+}
+
+// Get the S3 ETag of a section of a file, which for single parts is the quoted MD5
+func s3PartETag(r io.Reader) (string, error) {
+	digest := md5.New()
+	_, err := io.Copy(digest, r)
+	if err != nil {
+		return "", err
+	}
+	return `"` + hex.EncodeToString(digest.Sum(nil)) + `"`, nil
+}
+
+// Initiate a multipart upload of key with our upload headers & ACL
+// goamz's InitMulti only takes a content type and always sends an ACL, so the initiate
+// request is made here; the parts and completion go through goamz as normal
+func s3InitMulti(bucket *s3.Bucket, key string, opts *s3UploadOptions) (*s3.Multi, error) {
+	u, err := url.Parse(bucket.URL(key))
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = "uploads="
+	req, err := http.NewRequest("POST", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, vals := range opts.Headers {
+		for _, v := range vals {
+			req.Header.Add(name, v)
+		}
+	}
+	if opts.ACL != "" {
+		req.Header.Set("x-amz-acl", string(opts.ACL))
+	}
+	signer := s3.NewV4Signer(bucket.Auth, "s3", bucket.Region)
+	signer.IncludeXAmzContentSha256 = true
+	signer.Sign(req)
+	resp, err := bucket.S3.HTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		// Same error type goamz returns so it's classified the same way
+		s3err := &s3.Error{}
+		xml.NewDecoder(resp.Body).Decode(s3err)
+		s3err.StatusCode = resp.StatusCode
+		if s3err.Message == "" {
+			s3err.Message = resp.Status
+		}
+		return nil, s3err
+	}
+	var result struct {
+		UploadId string
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode response initiating multipart upload of %v: %v", key, err.Error())
+	}
+	return &s3.Multi{Bucket: bucket, Key: key, UploadId: result.UploadId}, nil
+}
+
+// Upload a file to key in multiple parts, several at once. If we previously started uploading the
+// same file and didn't finish, parts which were already uploaded are re-used.
+// Incomplete uploads are left for resuming if there's an error or the callback aborts.
+func (self *S3SyncProvider) uploadMultipart(remoteName, filename, key string, bucket *s3.Bucket, inf *os.File, size int64,
+	opts *s3UploadOptions, state *resumableUploadState, callback SyncProgressCallback) (aborted bool, err error) {
+
+	cfg := opts.Multipart
+	var existingParts []s3.Part
+	var multi *s3.Multi
+	upload := state.Find(bucket.Name, key, size)
+	if upload != nil {
+		multi = &s3.Multi{Bucket: bucket, Key: key, UploadId: upload.Id}
+		existingParts, err = multi.ListParts()
+		if err != nil {
+			if isS3RetryableError(err) {
+				return false, err
+			}
+			// Upload has gone (completed, aborted or expired), start again
+			util.LogDebugf("Unable to resume multipart upload of %v, starting again: %v\n", filename, err.Error())
+			state.Remove(upload)
+			upload = nil
+			existingParts = nil
+		} else {
+			util.LogDebugf("Resuming multipart upload of %v (%d parts already uploaded)\n", filename, len(existingParts))
+		}
+	}
+	if upload == nil {
+		multi, err = s3InitMulti(bucket, key, opts)
+		if err != nil {
+			return false, err
+		}
+		upload = &resumableUpload{Bucket: bucket.Name, Name: key, Size: size, Id: multi.UploadId, Started: time.Now()}
+		state.Add(upload)
+	}
+	existingByNumber := make(map[int]s3.Part, len(existingParts))
+	for _, p := range existingParts {
+		existingByNumber[p.N] = p
+	}
+
+	numParts := int((size + cfg.PartSize - 1) / cfg.PartSize)
+	partchan := make(chan int, numParts)
+	for n := 1; n <= numParts; n++ {
+		partchan <- n
+	}
+	close(partchan)
+
+	// Shared between part uploaders
+	var mutex sync.Mutex
+	var parts []s3.Part
+	var firstErr error
+	var bytesDone int64
+	stop := func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return aborted || firstErr != nil
+	}
+	partDone := func(part s3.Part, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return
+		}
+		parts = append(parts, part)
+		bytesDone += part.Size
+		if callback != nil && !aborted {
+			if callback(filename, util.ProgressTransferBytes, bytesDone, size) {
+				aborted = true
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Parallel && i < numParts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range partchan {
+				if stop() {
+					return
+				}
+				offset := int64(n-1) * cfg.PartSize
+				partSize := cfg.PartSize
+				if offset+partSize > size {
+					partSize = size - offset
+				}
+				section := io.NewSectionReader(inf, offset, partSize)
+				if existing, ok := existingByNumber[n]; ok && existing.Size == partSize {
+					etag, err := s3PartETag(section)
+					if err != nil {
+						partDone(s3.Part{}, err)
+						continue
+					}
+					if etag == existing.ETag {
+						partDone(existing, nil)
+						continue
+					}
+				}
+				var partReader io.ReadSeeker = section
+				if limiter := util.UploadRateLimiter(); limiter != nil {
+					partReader = &s3LimitedPartReader{section, limiter.Reader(section), 0}
+				}
+				part, err := multi.PutPart(n, partReader)
+				partDone(part, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if aborted || firstErr != nil {
+		return aborted, firstErr
+	}
+
+	sort.Sort(s3PartsByNumber(parts))
+	err = multi.Complete(parts)
+	if err != nil {
+		return false, err
+	}
+	state.Remove(upload)
+	return false, nil
+}
+
+// Limits the rate a part is sent at. goamz reads each part once to checksum it and
+// then rewinds to send it (again on retries), and only sending should be limited
+type s3LimitedPartReader struct {
+	*io.SectionReader
+	limited io.Reader
+	rewinds int
+}
+
+func (self *s3LimitedPartReader) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == os.SEEK_SET {
+		self.rewinds++
+	}
+	return self.SectionReader.Seek(offset, whence)
+}
+
+func (self *s3LimitedPartReader) Read(p []byte) (int, error) {
+	if self.rewinds > 1 {
+		return self.limited.Read(p)
+	}
+	return self.SectionReader.Read(p)
+}
+
+type s3PartsByNumber []s3.Part
+
+func (s s3PartsByNumber) Len() int           { return len(s) }
+func (s s3PartsByNumber) Less(i, j int) bool { return s[i].N < s[j].N }
+func (s s3PartsByNumber) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Abort multipart uploads to a bucket which we started but never finished, once they're too old
+// to be worth resuming. Incomplete uploads are invisible but still cost money to store.
+func (self *S3SyncProvider) cleanupMultipartUploads(bucket *s3.Bucket, state *resumableUploadState) {
+	for _, u := range state.Expired(bucket.Name, S3MultipartExpiry) {
+		multi := &s3.Multi{Bucket: bucket, Key: u.Name, UploadId: u.Id}
+		err := multi.Abort()
+		if err != nil && isS3RetryableError(err) {
+			// Try again next time
+			util.LogDebugf("Unable to abort abandoned multipart upload of %v: %v\n", u.Name, err.Error())
+			continue
+		}
+		util.LogDebugf("Aborted abandoned multipart upload of %v\n", u.Name)
+		state.Remove(u)
+	}
+}
@@ -6,6 +6,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync/atomic"
+
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
 )
 
 // Transport implementation that uses a persistent connection to perform many
@@ -17,6 +21,10 @@ type PersistentTransport struct {
 	Connection io.ReadWriteCloser
 	// Buffered reader we use to scan for ends of JSON
 	BufferedReader *bufio.Reader
+	// Whether the server has agreed to accept pipelined requests
+	pipelining bool
+	// Whether the connection has dropped (see ConnectionError)
+	broken bool
 }
 
 // Note *not* using net/rpc and net/rpc/jsonrpc because we want more control
@@ -44,17 +52,17 @@ type JsonResponse struct {
 }
 
 var (
-	latestRequestId int = 1
+	// Incremented atomically since many connections may be in use at once
+	latestRequestId int64 = 0
 )
 
 func NewJsonRequest(method string, params interface{}) (*JsonRequest, error) {
 	ret := &JsonRequest{
-		Id:     latestRequestId,
+		Id:     int(atomic.AddInt64(&latestRequestId, 1)),
 		Method: method,
 	}
 	var err error
 	ret.Params, err = embedStructInJsonRawMessage(params)
-	latestRequestId++
 	return ret, err
 }
 
@@ -110,12 +118,14 @@ type ExitResponse struct {
 // Release any resources associated with this transport (including any persostent connections)
 func (self *PersistentTransport) Release() {
 	if self.Connection != nil {
-		// terminate server-side
-		params := ExitRequest{}
-		resp := ExitResponse{}
-		err := self.doFullJSONRequestResponse("Exit", &params, &resp)
-		if err != nil {
-			fmt.Println("Problem exiting persistent transport:", err)
+		// terminate server-side, unless connection already dropped
+		if !self.broken {
+			params := ExitRequest{}
+			resp := ExitResponse{}
+			err := self.doFullJSONRequestResponse("Exit", &params, &resp)
+			if err != nil {
+				fmt.Println("Problem exiting persistent transport:", err)
+			}
 		}
 
 		self.Connection.Close()
@@ -165,6 +175,94 @@ func (self *PersistentTransport) doJSONRequestDownload(method string, params int
 
 }
 
+// Perform a batch of JSON requests of the same method, each with a JSON response
+// If pipelining is enabled, all requests are sent up front and responses are matched back
+// to requests by Id as they arrive, rather than waiting for a round-trip on each one. Otherwise
+// the requests are just performed in serial.
+// Raw data transfers must not be started until this returns, they queue behind the batch
+// The whole batch is always processed so the stream stays in sync; returns the first error
+func (self *PersistentTransport) doPipelinedJSONRequestResponses(method string, params []interface{}, results []interface{}) error {
+
+	if !self.pipelining {
+		var firsterr error
+		for i, p := range params {
+			err := self.doFullJSONRequestResponse(method, p, results[i])
+			if err != nil && firsterr == nil {
+				firsterr = err
+			}
+		}
+		return firsterr
+	}
+
+	reqs := make([]*JsonRequest, 0, len(params))
+	// map of request Id to index in params/results
+	pending := make(map[int]int, len(params))
+	for i, p := range params {
+		req, err := NewJsonRequest(method, p)
+		if err != nil {
+			return err
+		}
+		reqs = append(reqs, req)
+		pending[req.Id] = i
+	}
+
+	// Send requests in the background since the server will start responding before we've
+	// finished sending, and neither end can be allowed to block the other
+	senderr := make(chan error, 1)
+	go func() {
+		for _, req := range reqs {
+			err := self.sendJSONRequest(req)
+			if err != nil {
+				senderr <- err
+				return
+			}
+		}
+		senderr <- nil
+	}()
+
+	// If we have to give up before all responses have been read, the stream can't be used
+	// again; close it so the sender isn't left blocked on a server that's stopped reading,
+	// and wait for the sender to finish before dropping the connection
+	abort := func(err error) error {
+		if !IsConnectionError(err) {
+			err = self.connectionError(err)
+		}
+		self.Connection.Close()
+		<-senderr
+		self.Connection = nil
+		self.BufferedReader = nil
+		return err
+	}
+
+	var firsterr error
+	for len(pending) > 0 {
+		resp, err := self.readJSONResponse()
+		if err != nil {
+			// Includes undecodable responses, which we can't match back to a request
+			return abort(err)
+		}
+		i, ok := pending[resp.Id]
+		if !ok {
+			// Stream is out of sync, can't carry on using it
+			return abort(fmt.Errorf("Response from server has unexpected Id %d during pipelined %v", resp.Id, method))
+		}
+		delete(pending, resp.Id)
+		err = self.checkJSONResponse(nil, resp)
+		if err == nil {
+			err = ExtractStructFromJsonRawMessage(resp.Result, results[i])
+		}
+		if err != nil && firsterr == nil {
+			firsterr = err
+		}
+	}
+	err := <-senderr
+	if err != nil {
+		return err
+	}
+
+	return firsterr
+}
+
 // Late-bind a method-specific structure from the raw message
 func ExtractStructFromJsonRawMessage(raw *json.RawMessage, out interface{}) error {
 	nestedbytes, err := raw.MarshalJSON()
@@ -182,27 +280,30 @@ func ExtractStructFromJsonRawMessage(raw *json.RawMessage, out interface{}) erro
 // Send a JSON request but don't read any response
 func (self *PersistentTransport) sendJSONRequest(req interface{}) error {
 	if self.Connection == nil || self.BufferedReader == nil {
-		return errors.New("Not connected")
+		return self.connectionError(errors.New("Not connected"))
 	}
 
 	reqbytes, err := json.Marshal(req)
 	if err != nil {
-		return fmt.Errorf("Error encoding %v to JSON: %v", err.Error())
+		return fmt.Errorf("Error encoding %v to JSON: %v", req, err.Error())
 	}
 	// Append the binary 0 delimiter that server uses to read up to
 	reqbytes = append(reqbytes, byte(0))
 	_, err = self.Connection.Write(reqbytes)
 	if err != nil {
-		return fmt.Errorf("Error writing request bytes to connection: %v", err.Error())
+		return self.connectionError(fmt.Errorf("Error writing request bytes to connection: %v", err.Error()))
 	}
 
 	return nil
 }
 
 func (self *PersistentTransport) readJSONResponse() (*JsonResponse, error) {
+	if self.BufferedReader == nil {
+		return nil, self.connectionError(errors.New("Not connected"))
+	}
 	jsonbytes, err := self.BufferedReader.ReadBytes(byte(0))
 	if err != nil {
-		return nil, fmt.Errorf("Unable to read response from server: %v", err.Error())
+		return nil, self.connectionError(fmt.Errorf("Unable to read response from server: %v", err.Error()))
 	}
 	// remove terminator before unmarshalling
 	jsonbytes = jsonbytes[:len(jsonbytes)-1]
@@ -255,6 +356,7 @@ func (self *PersistentTransport) sendRawData(sz int64, source io.Reader, callbac
 		return nil
 	}
 
+	source = util.UploadRateLimiter().Reader(source)
 	var copysize int64 = 0
 	for {
 		c := PersistentTransportBufferSize
@@ -264,7 +366,8 @@ func (self *PersistentTransport) sendRawData(sz int64, source io.Reader, callbac
 		if c <= 0 {
 			break
 		}
-		n, err := io.CopyN(self.Connection, source, c)
+		// errors writing to the connection are connection errors, errors reading source are not
+		n, err := io.CopyN(&connectionErrorWriter{self}, source, c)
 		copysize += n
 		if n > 0 && callback != nil && sz > 0 {
 			callback(copysize, sz)
@@ -285,6 +388,7 @@ func (self *PersistentTransport) receiveRawData(sz int64, out io.Writer, callbac
 	if sz == 0 {
 		return nil
 	}
+	limitedIn := util.DownloadRateLimiter().Reader(&connectionErrorReader{self})
 
 	var copysize int64 = 0
 	for {
@@ -296,7 +400,8 @@ func (self *PersistentTransport) receiveRawData(sz int64, out io.Writer, callbac
 			break
 		}
 		// Must read from buffered reader consistently
-		n, err := io.CopyN(out, self.BufferedReader, c)
+		// errors reading from the connection are connection errors, errors writing output are not
+		n, err := io.CopyN(out, limitedIn, c)
 		copysize += n
 		if n > 0 && callback != nil && sz > 0 {
 			callback(copysize, sz)
@@ -313,7 +418,63 @@ func (self *PersistentTransport) receiveRawData(sz int64, out io.Writer, callbac
 }
 
 // Just a specially identified persistent connection error so we can re-try
-type ConnectionError error
+// Returned when the underlying connection has failed (e.g. dropped SSH pipe), at which point
+// the transport is no longer usable and must be replaced
+type ConnectionError struct {
+	Message string
+}
+
+func (self *ConnectionError) Error() string {
+	return self.Message
+}
+
+// Is an error a ConnectionError (or was caused by one)?
+func IsConnectionError(err error) bool {
+	_, ok := err.(*ConnectionError)
+	return ok
+}
+
+// Record that the connection has failed & return a ConnectionError for the cause
+func (self *PersistentTransport) connectionError(err error) error {
+	self.broken = true
+	return &ConnectionError{err.Error()}
+}
+
+// Add context to an error, preserving whether it was a ConnectionError so that callers can still detect it
+func wrapError(err error, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	if IsConnectionError(err) {
+		return &ConnectionError{msg}
+	}
+	return errors.New(msg)
+}
+
+// Writer which converts errors writing to the connection into ConnectionErrors
+type connectionErrorWriter struct {
+	transport *PersistentTransport
+}
+
+func (self *connectionErrorWriter) Write(p []byte) (int, error) {
+	n, err := self.transport.Connection.Write(p)
+	if err != nil {
+		err = self.transport.connectionError(err)
+	}
+	return n, err
+}
+
+// Reader which converts errors reading from the connection into ConnectionErrors
+// Note this includes io.EOF, since the connection should never end part way through data
+type connectionErrorReader struct {
+	transport *PersistentTransport
+}
+
+func (self *connectionErrorReader) Read(p []byte) (int, error) {
+	n, err := self.transport.BufferedReader.Read(p)
+	if err != nil {
+		err = self.transport.connectionError(err)
+	}
+	return n, err
+}
 
 type QueryCapsRequest struct {
 }
@@ -347,6 +508,12 @@ func (self *PersistentTransport) SetEnabledCaps(caps []string) error {
 	if err != nil {
 		return err
 	}
+	self.pipelining = false
+	for _, c := range caps {
+		if c == "pipelining" {
+			self.pipelining = true
+		}
+	}
 	return nil
 }
 
@@ -389,6 +556,23 @@ func (self *PersistentTransport) ChunkExists(lobsha string, chunk int) (bool, in
 	return resp.Exists, resp.Size, nil
 }
 
+// Return whether many files (meta or chunks) exist on the server, and their sizes
+// Results are in the same order as queries. Pipelined if server supports it.
+func (self *PersistentTransport) FilesExist(queries []FileExistsRequest) ([]FileExistsResponse, error) {
+	params := make([]interface{}, len(queries))
+	results := make([]interface{}, len(queries))
+	ret := make([]FileExistsResponse, len(queries))
+	for i := range queries {
+		params[i] = &queries[i]
+		results[i] = &ret[i]
+	}
+	err := self.doPipelinedJSONRequestResponses("FileExists", params, results)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
 type FileExistsOfSizeRequest struct {
 	LobSHA   string
 	Type     string
@@ -436,6 +620,95 @@ func (self *PersistentTransport) LOBExists(lobsha string) (bool, int64, error) {
 	return resp.Exists, resp.Size, nil
 }
 
+type VerifyLOBRequest struct {
+	LobSHA string
+}
+type VerifyLOBResponse struct {
+	Exists bool
+	Valid  bool
+}
+
+// Return whether LOB exists in entirety on the server, and whether the content is correct
+func (self *PersistentTransport) VerifyLOB(lobsha string) (bool, bool, error) {
+	params := VerifyLOBRequest{
+		LobSHA: lobsha,
+	}
+	resp := VerifyLOBResponse{}
+	err := self.doFullJSONRequestResponse("VerifyLOB", &params, &resp)
+	if err != nil {
+		return false, false, err
+	}
+	return resp.Exists, resp.Valid, nil
+}
+
+type LockFileRequest struct {
+	Path string
+}
+type LockFileResponse struct {
+	// False if already locked by someone else
+	Success bool
+	// The lock now held (or the existing lock if Success = false)
+	Lock *providers.FileLock
+}
+
+// Lock a file on the server, for the user the server identifies us as
+func (self *PersistentTransport) LockFile(path string) (bool, *providers.FileLock, error) {
+	params := LockFileRequest{
+		Path: path,
+	}
+	resp := LockFileResponse{}
+	err := self.doFullJSONRequestResponse("LockFile", &params, &resp)
+	if err != nil {
+		return false, nil, err
+	}
+	return resp.Success, resp.Lock, nil
+}
+
+type UnlockFileRequest struct {
+	Path string
+	// Release even if owned by someone else (server may only allow this for some users)
+	Force bool
+}
+type UnlockFileResponse struct {
+	// False if locked by someone else (and not forced)
+	Success bool
+	// The lock which was released (or the existing lock if Success = false), nil if not locked
+	Lock *providers.FileLock
+}
+
+// Release a lock on the server
+func (self *PersistentTransport) UnlockFile(path string, force bool) (bool, *providers.FileLock, error) {
+	params := UnlockFileRequest{
+		Path:  path,
+		Force: force,
+	}
+	resp := UnlockFileResponse{}
+	err := self.doFullJSONRequestResponse("UnlockFile", &params, &resp)
+	if err != nil {
+		return false, nil, err
+	}
+	return resp.Success, resp.Lock, nil
+}
+
+type ListLocksRequest struct {
+}
+type ListLocksResponse struct {
+	Locks []*providers.FileLock
+	// Owner of the locks taken by this client
+	Owner string
+}
+
+// List all locks held on the server, and the owner the server identifies us as
+func (self *PersistentTransport) ListLocks() ([]*providers.FileLock, string, error) {
+	params := ListLocksRequest{}
+	resp := ListLocksResponse{}
+	err := self.doFullJSONRequestResponse("ListLocks", &params, &resp)
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.Locks, resp.Owner, nil
+}
+
 type UploadFileRequest struct {
 	LobSHA   string
 	Type     string
@@ -459,19 +732,19 @@ func (self *PersistentTransport) UploadMetadata(lobsha string, sz int64, data io
 	resp := UploadFileStartResponse{}
 	err := self.doFullJSONRequestResponse("UploadFile", &params, &resp)
 	if err != nil {
-		return fmt.Errorf("Error while uploading metadata for %v (while sending UploadFile JSON request): %v", lobsha, err.Error())
+		return wrapError(err, "Error while uploading metadata for %v (while sending UploadFile JSON request): %v", lobsha, err.Error())
 	}
 	if resp.OKToSend {
 		// Send that data (all at once, metafiles aren't big)
 		err = self.sendRawData(sz, data, nil)
 		if err != nil {
-			return fmt.Errorf("Error while uploading metadata for %v (while sending raw content): %v", lobsha, err.Error())
+			return wrapError(err, "Error while uploading metadata for %v (while sending raw content): %v", lobsha, err.Error())
 		}
 		// Now read response to sent data
 		received := UploadFileCompleteResponse{}
 		err = self.readFullJSONResponse(nil, &received)
 		if err != nil {
-			return fmt.Errorf("Error while uploading metadata for %v (response to raw content): %v", lobsha, err.Error())
+			return wrapError(err, "Error while uploading metadata for %v (response to raw content): %v", lobsha, err.Error())
 		}
 		if !received.ReceivedOK {
 			return fmt.Errorf("Data not fully received while uploading metadata for %v: Unknown server error", lobsha)
@@ -494,19 +767,19 @@ func (self *PersistentTransport) UploadChunk(lobsha string, chunk int, sz int64,
 	resp := UploadFileStartResponse{}
 	err := self.doFullJSONRequestResponse("UploadFile", &params, &resp)
 	if err != nil {
-		return fmt.Errorf("Error while uploading chunk %d for %v (while sending UploadFile JSON request): %v", chunk, lobsha, err.Error())
+		return wrapError(err, "Error while uploading chunk %d for %v (while sending UploadFile JSON request): %v", chunk, lobsha, err.Error())
 	}
 	if resp.OKToSend {
 		// Send data, this does it in batches and calls back
 		err = self.sendRawData(sz, data, callback)
 		if err != nil {
-			return fmt.Errorf("Error while uploading chunk %d for %v (while sending raw content): %v", chunk, lobsha, err.Error())
+			return wrapError(err, "Error while uploading chunk %d for %v (while sending raw content): %v", chunk, lobsha, err.Error())
 		}
 		// Now read response to sent data
 		received := UploadFileCompleteResponse{}
 		err = self.readFullJSONResponse(nil, &received)
 		if err != nil {
-			return fmt.Errorf("Error while uploading chunk %d for %v (response to raw content): %v", chunk, lobsha, err.Error())
+			return wrapError(err, "Error while uploading chunk %d for %v (response to raw content): %v", chunk, lobsha, err.Error())
 		}
 		if !received.ReceivedOK {
 			return fmt.Errorf("Data not fully received while uploading chunk %d for %v: Unknown server error", chunk, lobsha)
@@ -542,7 +815,7 @@ func (self *PersistentTransport) DownloadMetadata(lobsha string, out io.Writer)
 	resp := DownloadFilePrepareResponse{}
 	err := self.doFullJSONRequestResponse("DownloadFilePrepare", &prepparams, &resp)
 	if err != nil {
-		return fmt.Errorf("Error while downloading metadata for %v (while sending DownloadFilePrepare JSON request): %v", lobsha, err.Error())
+		return wrapError(err, "Error while downloading metadata for %v (while sending DownloadFilePrepare JSON request): %v", lobsha, err.Error())
 	}
 	startparams := DownloadFileStartRequest{
 		LobSHA: lobsha,
@@ -553,7 +826,7 @@ func (self *PersistentTransport) DownloadMetadata(lobsha string, out io.Writer)
 	// Response is just raw byte data - no callback as small enough not to need one
 	err = self.doJSONRequestDownload("DownloadFileStart", &startparams, resp.Size, out, nil)
 	if err != nil {
-		return fmt.Errorf("Error while downloading metadata for %v (during download): %v", lobsha, err.Error())
+		return wrapError(err, "Error while downloading metadata for %v (during download): %v", lobsha, err.Error())
 	}
 
 	return nil
@@ -570,7 +843,7 @@ func (self *PersistentTransport) DownloadChunk(lobsha string, chunk int, out io.
 	resp := DownloadFilePrepareResponse{}
 	err := self.doFullJSONRequestResponse("DownloadFilePrepare", &prepparams, &resp)
 	if err != nil {
-		return fmt.Errorf("Error while downloading chunk %d for %v (while sending DownloadFilePrepare JSON request): %v", chunk, lobsha, err.Error())
+		return wrapError(err, "Error while downloading chunk %d for %v (while sending DownloadFilePrepare JSON request): %v", chunk, lobsha, err.Error())
 	}
 	startparams := DownloadFileStartRequest{
 		LobSHA:   lobsha,
@@ -582,7 +855,7 @@ func (self *PersistentTransport) DownloadChunk(lobsha string, chunk int, out io.
 	// Response is just raw byte data - no callback as small enough not to need one
 	err = self.doJSONRequestDownload("DownloadFileStart", &startparams, resp.Size, out, callback)
 	if err != nil {
-		return fmt.Errorf("Error while downloading chunk %d for %v (during download): %v", chunk, lobsha, err.Error())
+		return wrapError(err, "Error while downloading chunk %d for %v (during download): %v", chunk, lobsha, err.Error())
 	}
 
 	return nil
@@ -605,7 +878,7 @@ func (self *PersistentTransport) GetFirstCompleteLOBFromList(candidateSHAs []str
 	resp := GetFirstCompleteLOBFromListResponse{}
 	err := self.doFullJSONRequestResponse("PickCompleteLOB", &params, &resp)
 	if err != nil {
-		return "", fmt.Errorf("Error asking server for first LOB from list %v: %v", candidateSHAs, err.Error())
+		return "", wrapError(err, "Error asking server for first LOB from list %v: %v", candidateSHAs, err.Error())
 	}
 	return resp.FirstSHA, nil
 }
@@ -638,7 +911,7 @@ func (self *PersistentTransport) UploadDelta(baseSHA, targetSHA string, deltaSiz
 	resp := UploadDeltaStartResponse{}
 	err := self.doFullJSONRequestResponse("UploadDelta", &params, &resp)
 	if err != nil {
-		return false, fmt.Errorf("Error calling UploadDelta JSON request from %v to %v: %v", baseSHA, targetSHA, err.Error())
+		return false, wrapError(err, "Error calling UploadDelta JSON request from %v to %v: %v", baseSHA, targetSHA, err.Error())
 	}
 	// Server can opt not to accept the delta, caller should fall back to simpler upload if so
 	var sentOK bool
@@ -646,13 +919,13 @@ func (self *PersistentTransport) UploadDelta(baseSHA, targetSHA string, deltaSiz
 		// Send data, this does it in batches and calls back
 		err = self.sendRawData(deltaSize, data, callback)
 		if err != nil {
-			return false, fmt.Errorf("Error uploading delta content from %v to %v: %v", baseSHA, targetSHA, err.Error())
+			return false, wrapError(err, "Error uploading delta content from %v to %v: %v", baseSHA, targetSHA, err.Error())
 		}
 		// Now read response to sent data
 		received := UploadDeltaCompleteResponse{}
 		err = self.readFullJSONResponse(nil, &received)
 		if err != nil {
-			return false, fmt.Errorf("Error in UploadDelta from %v to %v (response to raw content): %v", baseSHA, targetSHA, err.Error())
+			return false, wrapError(err, "Error in UploadDelta from %v to %v (response to raw content): %v", baseSHA, targetSHA, err.Error())
 		}
 		if !received.ReceivedOK {
 			return false, fmt.Errorf("Data not fully received in UploadDelta from %v to %v: Unknown server error", baseSHA, targetSHA)
@@ -685,7 +958,7 @@ func (self *PersistentTransport) DownloadDeltaPrepare(baseSHA, targetSHA string)
 	resp := DownloadDeltaPrepareResponse{}
 	err := self.doFullJSONRequestResponse("DownloadDeltaPrepare", &prepparams, &resp)
 	if err != nil {
-		return 0, fmt.Errorf("Error in DownloadDeltaPrepare from %v to %v: %v", baseSHA, targetSHA, err.Error())
+		return 0, wrapError(err, "Error in DownloadDeltaPrepare from %v to %v: %v", baseSHA, targetSHA, err.Error())
 	}
 	return resp.Size, nil
 }
@@ -712,7 +985,7 @@ func (self *PersistentTransport) DownloadDelta(baseSHA, targetSHA string, sizeLi
 	// Response is just raw byte data - no callback as small enough not to need one
 	err = self.doJSONRequestDownload("DownloadDeltaStart", &startparams, sz, out, callback)
 	if err != nil {
-		return false, fmt.Errorf("Error while downloading LOB delta from %v to %v: %v", baseSHA, targetSHA, err.Error())
+		return false, wrapError(err, "Error while downloading LOB delta from %v to %v: %v", baseSHA, targetSHA, err.Error())
 	}
 	// It's up to the caller to apply the delta
 	return true, nil
@@ -107,7 +107,7 @@ var _ = Describe("Persistent Transport", func() {
 				err = json.Unmarshal(jsonbytes, &req)
 				Expect(err).To(BeNil(), fmt.Sprintf("Test persistent server: unable to unmarshal json request from client:%v", string(jsonbytes)))
 				var resp *JsonResponse
-				allowedCaps := []string{"Feature1", "Feature2", "OMGSOAWESOME"}
+				allowedCaps := []string{"Feature1", "Feature2", "OMGSOAWESOME", "pipelining"}
 				switch req.Method {
 				case "QueryCaps":
 					result := QueryCapsResponse{Caps: allowedCaps}
@@ -428,7 +428,7 @@ var _ = Describe("Persistent Transport", func() {
 			trans := NewPersistentTransport(cli)
 			caps, err := trans.QueryCaps()
 			Expect(err).To(BeNil(), "Should be no error")
-			Expect(caps).To(ConsistOf([]string{"Feature1", "Feature2", "OMGSOAWESOME"}), "Capabilities should match server")
+			Expect(caps).To(ConsistOf([]string{"Feature1", "Feature2", "OMGSOAWESOME", "pipelining"}), "Capabilities should match server")
 
 		})
 		It("Sets capabilities (client)", func() {
@@ -476,6 +476,79 @@ var _ = Describe("Persistent Transport", func() {
 
 		})
 
+		It("Pipelines file existence queries (client)", func() {
+			cli, srv := net.Pipe()
+			go serve(srv)
+			defer cli.Close()
+
+			trans := NewPersistentTransport(cli)
+			err := trans.SetEnabledCaps([]string{"pipelining"})
+			Expect(err).To(BeNil(), "Should be no error enabling pipelining")
+
+			var queries []FileExistsRequest
+			for _, meta := range metasThatExist {
+				queries = append(queries, FileExistsRequest{LobSHA: meta, Type: "meta"})
+			}
+			for i, chunk := range chunksThatExist {
+				for _, chunkidx := range chunkIndexesThatExist[i] {
+					queries = append(queries, FileExistsRequest{LobSHA: chunk, Type: "chunk", ChunkIdx: chunkidx})
+				}
+			}
+			queries = append(queries, FileExistsRequest{LobSHA: "9999999999999999999999999999999999999999", Type: "meta"})
+			queries = append(queries, FileExistsRequest{LobSHA: chunksThatExist[0], Type: "chunk", ChunkIdx: 99})
+
+			results, err := trans.FilesExist(queries)
+			Expect(err).To(BeNil(), "Should be no error")
+			Expect(results).To(HaveLen(len(queries)), "Should be one result per query")
+			for i, q := range queries[:len(queries)-2] {
+				Expect(results[i].Exists).To(BeTrue(), "File should exist")
+				if q.Type == "meta" {
+					Expect(results[i].Size).To(BeEquivalentTo(len(metacontent)), "Metafile should be right size")
+				} else {
+					Expect(results[i].Size).To(BeEquivalentTo(testchunkdatasz), "Chunk should be right size")
+				}
+			}
+			Expect(results[len(results)-2].Exists).To(BeFalse(), "Meta should not exist")
+			Expect(results[len(results)-1].Exists).To(BeFalse(), "Chunk should not exist")
+
+			// Make sure the connection is still in sync for a following raw data transfer
+			var buf bytes.Buffer
+			err = trans.DownloadMetadata(testsha, &buf)
+			Expect(err).To(BeNil(), "Should not be an error in DownloadFile after pipelining")
+			Expect(string(buf.Bytes())).To(Equal(metacontent), "Should download expected metadata content")
+
+		})
+
+		It("Marks the connection broken on a bad pipelined response (client)", func() {
+			cli, srv := net.Pipe()
+			defer cli.Close()
+			go func() {
+				defer GinkgoRecover()
+				defer srv.Close()
+				// Answer the first request with something that isn't JSON, then stop reading
+				rdr := bufio.NewReader(srv)
+				_, err := rdr.ReadBytes(byte(0))
+				if err != nil {
+					return
+				}
+				srv.Write(append([]byte("not json"), byte(0)))
+			}()
+
+			trans := NewPersistentTransport(cli)
+			trans.pipelining = true
+			queries := make([]FileExistsRequest, 20)
+			for i := range queries {
+				queries[i] = FileExistsRequest{LobSHA: metasThatExist[0], Type: "meta"}
+			}
+			_, err := trans.FilesExist(queries)
+			Expect(err).ToNot(BeNil(), "Should be an error")
+			Expect(IsConnectionError(err)).To(BeTrue(), "Should be a connection error")
+			Expect(trans.broken).To(BeTrue(), "Transport should be marked broken")
+			// Should not try to use the connection again
+			trans.Release()
+
+		})
+
 		It("Queries file sizes (client)", func() {
 			// This also tests multiple requests in sequence (JSON only)
 			cli, srv := net.Pipe()
@@ -519,6 +592,18 @@ var _ = Describe("Persistent Transport", func() {
 			trans := NewPersistentTransport(cli)
 			err := trans.SetEnabledCaps([]string{"Feature1", "THISISWRONG"})
 			Expect(err).ToNot(BeNil(), "Should be an error")
+			Expect(IsConnectionError(err)).To(BeFalse(), "Server errors should not be connection errors")
+		})
+
+		It("Detects dropped connections", func() {
+			cli, srv := net.Pipe()
+			srv.Close()
+			defer cli.Close()
+
+			trans := NewPersistentTransport(cli)
+			_, err := trans.QueryCaps()
+			Expect(err).ToNot(BeNil(), "Should be an error")
+			Expect(IsConnectionError(err)).To(BeTrue(), "Should be a connection error")
 		})
 
 		It("Uploads metadata", func() {
@@ -684,7 +769,7 @@ var _ = Describe("Persistent Transport", func() {
 			// JSON request
 			caps, err := trans.QueryCaps()
 			Expect(err).To(BeNil(), "Should be no error")
-			Expect(caps).To(ConsistOf([]string{"Feature1", "Feature2", "OMGSOAWESOME"}), "Capabilities should match server")
+			Expect(caps).To(ConsistOf([]string{"Feature1", "Feature2", "OMGSOAWESOME", "pipelining"}), "Capabilities should match server")
 
 			// Byte transfer (upload)
 			rdr := strings.NewReader(metacontent)
@@ -0,0 +1,307 @@
+package smart
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+// A single connection to the server, one of a pool used by SmartSyncProviderImpl
+// Each connection negotiates its own capabilities with the server
+type smartConnection struct {
+	// The URL this connection was made to, so we can re-establish it
+	serverUrl *url.URL
+	// The number of times to retry operations which fail due to a dropped connection
+	retries int
+	// The transport which is providing the underlying operations
+	// nil if the connection dropped and has not been re-established yet
+	transport Transport
+	// capabilities which the server has indicated it supports
+	serverCaps []string
+	// capabilities which are enabled
+	enabledCaps []string
+}
+
+// Open a new connection to the server & negotiate caps
+func newSmartConnection(serverUrl *url.URL, retries int) (*smartConnection, error) {
+	conn := &smartConnection{serverUrl: serverUrl, retries: retries}
+	err := conn.reconnect()
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (self *smartConnection) Release() {
+	if self.transport != nil {
+		self.transport.Release()
+		self.transport = nil
+	}
+	self.serverCaps = nil
+	self.enabledCaps = nil
+}
+
+// (Re-)establish the transport & negotiate caps again, since they're per-connection
+func (self *smartConnection) reconnect() error {
+	self.Release()
+	tf := GetTransportFactory(self.serverUrl)
+	if tf == nil {
+		return fmt.Errorf("Unsupported URL: %v", self.serverUrl)
+	}
+	var err error
+	self.transport, err = tf.Connect(self.serverUrl)
+	if err != nil {
+		return err
+	}
+	err = self.determineCaps()
+	if err != nil {
+		self.Release()
+		return err
+	}
+	return nil
+}
+
+// Perform an operation on this connection. If it fails because the connection dropped, the
+// connection is re-established and the operation retried with backoff, up to the retry limit.
+// Operations must be safe to repeat from scratch. Other errors are returned immediately.
+func (self *smartConnection) withRetry(op func(t Transport) error) error {
+	for attempt := 0; ; attempt++ {
+		var err error
+		if self.transport == nil {
+			err = self.reconnect()
+		}
+		if err == nil {
+			err = op(self.transport)
+			if err == nil || !IsConnectionError(err) {
+				return err
+			}
+			// Throw away the dropped connection, re-establish it next time
+			self.Release()
+		}
+		if attempt >= self.retries {
+			return err
+		}
+		delay := providers.GetRetryDelay(attempt + 1)
+		util.LogDebugf("Connection to %v failed, retrying in %v (attempt %d of %d): %v", self.serverUrl, delay, attempt+1, self.retries, err.Error())
+		time.Sleep(delay)
+	}
+}
+
+// Perform an operation on this connection which can't be repeated, but make sure that if the
+// connection drops it's re-established the next time it's used
+func (self *smartConnection) noRetry(op func(t Transport) (bool, error)) (bool, error) {
+	if self.transport == nil {
+		err := self.reconnect()
+		if err != nil {
+			return false, err
+		}
+	}
+	ok, err := op(self.transport)
+	if err != nil && IsConnectionError(err) {
+		self.Release()
+	}
+	return ok, err
+}
+
+// Negotiate with the server to determine capabilities
+func (self *smartConnection) determineCaps() error {
+	var err error
+	self.serverCaps, err = self.transport.QueryCaps()
+	if err != nil {
+		return err
+	}
+	// Always enable deltas & pipelining if available
+	self.enabledCaps = nil
+	for _, c := range self.serverCaps {
+		switch c {
+		case "binary_delta", "pipelining":
+			self.enabledCaps = append(self.enabledCaps, c)
+		}
+	}
+	err = self.transport.SetEnabledCaps(self.enabledCaps)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Whether the server supports a capability (whether enabled or not)
+func (self *smartConnection) serverHasCap(c string) bool {
+	for _, sc := range self.serverCaps {
+		if sc == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Function which transfers a single file over a given connection; same semantics as uploadSingleFile/downloadSingleFile
+type singleFileTransferFunc func(conn *smartConnection, filename string, callback providers.SyncProgressCallback) (errorList []string, abort bool)
+
+// Transfer a list of files, distributing them across a list of connections so that each
+// connection is always busy until there are no files left. Callbacks are serialised (see
+// serialisedProgress) so callers see the same sequence as a single connection would give.
+func transferFilesOverConnections(conns []*smartConnection, filenames []string,
+	callback providers.SyncProgressCallback, transfer singleFileTransferFunc) error {
+
+	var errorList []string
+	if len(conns) == 1 {
+		for _, filename := range filenames {
+			// Allow aborting
+			newerrs, abort := transfer(conns[0], filename, callback)
+			errorList = append(errorList, newerrs...)
+			if abort {
+				break
+			}
+		}
+	} else {
+		progress := newSerialisedProgress(callback)
+		filechan := make(chan string, len(filenames))
+		for _, filename := range filenames {
+			filechan <- filename
+		}
+		close(filechan)
+
+		var errmutex sync.Mutex
+		var wg sync.WaitGroup
+		for _, conn := range conns {
+			wg.Add(1)
+			go func(conn *smartConnection) {
+				defer wg.Done()
+				for filename := range filechan {
+					if progress.IsAborted() {
+						return
+					}
+					newerrs, abort := transfer(conn, filename, progress.Callback)
+					progress.FileFinished(filename)
+					if abort {
+						progress.Abort()
+					}
+					errmutex.Lock()
+					errorList = append(errorList, newerrs...)
+					errmutex.Unlock()
+				}
+			}(conn)
+		}
+		wg.Wait()
+		progress.Flush()
+	}
+
+	if len(errorList) > 0 {
+		return errors.New(strings.Join(errorList, "\n"))
+	}
+
+	return nil
+}
+
+// Progress callbacks for a single file
+type progressEvent struct {
+	filename     string
+	progressType util.ProgressCallbackType
+	bytesDone    int64
+	totalBytes   int64
+}
+
+// Wraps a SyncProgressCallback so that it can be called from many goroutines at once, while
+// still presenting progress of one file at a time to the wrapped callback (callers accumulate
+// totals on the basis that a new file means the previous one is done).
+// Only one file reports intermediate progress at once; others transferring at the same time only
+// report their completion, which is queued until the current file is finished.
+type serialisedProgress struct {
+	callback providers.SyncProgressCallback
+	mutex    sync.Mutex
+	// The file whose progress is currently being reported
+	current string
+	// Events for other files waiting until current is done
+	pending []progressEvent
+	aborted bool
+}
+
+func newSerialisedProgress(callback providers.SyncProgressCallback) *serialisedProgress {
+	return &serialisedProgress{callback: callback}
+}
+
+// Must be called with mutex held
+func (self *serialisedProgress) send(ev progressEvent) {
+	if self.callback != nil && self.callback(ev.filename, ev.progressType, ev.bytesDone, ev.totalBytes) {
+		self.aborted = true
+	}
+}
+
+// Must be called with mutex held
+func (self *serialisedProgress) flushPending() {
+	for _, ev := range self.pending {
+		self.send(ev)
+	}
+	self.pending = nil
+}
+
+// The thread-safe callback to pass to transfers
+func (self *serialisedProgress) Callback(filename string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) (abort bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	ev := progressEvent{filename, progressType, bytesDone, totalBytes}
+	if progressType != util.ProgressTransferBytes {
+		// Skipped / not found are single events
+		if self.current == "" {
+			self.send(ev)
+		} else {
+			self.pending = append(self.pending, ev)
+		}
+		return self.aborted
+	}
+
+	if self.current == "" {
+		self.current = filename
+	}
+	if filename == self.current {
+		self.send(ev)
+		if bytesDone == totalBytes {
+			self.current = ""
+			self.flushPending()
+		}
+	} else if bytesDone == totalBytes {
+		// Another file finished while current still going; just report completion later
+		self.pending = append(self.pending, progressEvent{filename, progressType, totalBytes, totalBytes})
+	}
+	return self.aborted
+}
+
+// Indicate that a file has finished transferring (successfully or not)
+func (self *serialisedProgress) FileFinished(filename string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.current == filename {
+		// Failed part way through, let others report
+		self.current = ""
+		self.flushPending()
+	}
+}
+
+// Report everything outstanding
+func (self *serialisedProgress) Flush() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.current = ""
+	self.flushPending()
+}
+
+func (self *serialisedProgress) Abort() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.aborted = true
+}
+
+func (self *serialisedProgress) IsAborted() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.aborted
+}
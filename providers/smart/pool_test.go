@@ -0,0 +1,191 @@
+package smart
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("Connection pool", func() {
+
+	var filenames []string
+	BeforeEach(func() {
+		filenames = nil
+		for i := 0; i < 20; i++ {
+			filenames = append(filenames, fmt.Sprintf("file%d", i))
+		}
+	})
+
+	// Fake transfer which reports progress in a few steps, with a delay so connections overlap
+	fakeTransfer := func(usedConns map[*smartConnection]int, mutex *sync.Mutex) singleFileTransferFunc {
+		return func(conn *smartConnection, filename string, callback providers.SyncProgressCallback) ([]string, bool) {
+			mutex.Lock()
+			usedConns[conn]++
+			mutex.Unlock()
+			for done := int64(0); done <= 300; done += 100 {
+				if callback(filename, util.ProgressTransferBytes, done, 300) {
+					return nil, true
+				}
+				time.Sleep(time.Millisecond)
+			}
+			return nil, false
+		}
+	}
+
+	It("Distributes transfers across connections", func() {
+		conns := []*smartConnection{&smartConnection{}, &smartConnection{}, &smartConnection{}}
+		usedConns := make(map[*smartConnection]int)
+		var mutex sync.Mutex
+
+		// Record what the callback sees; must look like one file at a time
+		var current string
+		completed := make(map[string]bool)
+		interleaved := false
+		callback := func(filename string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) bool {
+			if current != "" && current != filename {
+				interleaved = true
+			}
+			current = filename
+			if bytesDone == totalBytes {
+				completed[filename] = true
+				current = ""
+			}
+			return false
+		}
+
+		err := transferFilesOverConnections(conns, filenames, callback, fakeTransfer(usedConns, &mutex))
+		Expect(err).To(BeNil(), "Should not be an error")
+		Expect(completed).To(HaveLen(len(filenames)), "Every file should report completion")
+		Expect(interleaved).To(BeFalse(), "Progress for different files should never be interleaved")
+		Expect(usedConns).To(HaveLen(3), "All connections should have been used")
+		total := 0
+		for _, n := range usedConns {
+			total += n
+		}
+		Expect(total).To(Equal(len(filenames)), "Each file should be transferred exactly once")
+	})
+
+	It("Stops all connections on abort", func() {
+		conns := []*smartConnection{&smartConnection{}, &smartConnection{}}
+		usedConns := make(map[*smartConnection]int)
+		var mutex sync.Mutex
+
+		callcount := 0
+		callback := func(filename string, progressType util.ProgressCallbackType, bytesDone, totalBytes int64) bool {
+			callcount++
+			return callcount > 5
+		}
+		transferFilesOverConnections(conns, filenames, callback, fakeTransfer(usedConns, &mutex))
+		total := 0
+		for _, n := range usedConns {
+			total += n
+		}
+		Expect(total).To(BeNumerically("<", len(filenames)), "Should not have transferred all files after abort")
+	})
+
+	Describe("Reconnection", func() {
+		var factory *droppingTransportFactory
+		var serverUrl *url.URL
+		var oldDelay time.Duration
+		BeforeEach(func() {
+			oldDelay = providers.RetryBaseDelay
+			providers.RetryBaseDelay = time.Millisecond
+			serverUrl, _ = url.Parse("droptest://server/path")
+			factory = &droppingTransportFactory{}
+			RegisterTransportFactory(factory)
+		})
+		AfterEach(func() {
+			providers.RetryBaseDelay = oldDelay
+			transportFactories = transportFactories[:len(transportFactories)-1]
+		})
+
+		It("Reconnects and retries after a dropped connection", func() {
+			factory.failures = 2
+			conn, err := newSmartConnection(serverUrl, 3)
+			Expect(err).To(BeNil(), "Should connect")
+			var exists bool
+			err = conn.withRetry(func(t Transport) error {
+				var err error
+				exists, _, err = t.MetadataExists("0123456789abcdef")
+				return err
+			})
+			Expect(err).To(BeNil(), "Should succeed after retries")
+			Expect(exists).To(BeTrue(), "Should get the result")
+			Expect(factory.connects).To(Equal(3), "Should have reconnected for each failure")
+			Expect(conn.enabledCaps).To(ConsistOf("pipelining"), "Should have re-negotiated caps")
+		})
+
+		It("Gives up after the retry limit", func() {
+			factory.failures = 5
+			conn, err := newSmartConnection(serverUrl, 2)
+			Expect(err).To(BeNil(), "Should connect")
+			err = conn.withRetry(func(t Transport) error {
+				_, _, err := t.MetadataExists("0123456789abcdef")
+				return err
+			})
+			Expect(IsConnectionError(err)).To(BeTrue(), "Should return the connection error")
+			Expect(factory.connects).To(Equal(3), "Should have tried once plus 2 retries")
+		})
+
+		It("Does not retry other errors", func() {
+			conn, err := newSmartConnection(serverUrl, 3)
+			Expect(err).To(BeNil(), "Should connect")
+			attempts := 0
+			err = conn.withRetry(func(t Transport) error {
+				attempts++
+				return errors.New("Server says no")
+			})
+			Expect(err).ToNot(BeNil(), "Should be an error")
+			Expect(attempts).To(Equal(1), "Should not have retried")
+			Expect(factory.connects).To(Equal(1), "Should not have reconnected")
+		})
+	})
+
+})
+
+// Factory for transports where metadata queries fail with a dropped connection a set number of times
+type droppingTransportFactory struct {
+	failures int
+	connects int
+}
+
+func (self *droppingTransportFactory) WillHandleUrl(u *url.URL) bool {
+	return u.Scheme == "droptest"
+}
+
+func (self *droppingTransportFactory) Connect(u *url.URL) (Transport, error) {
+	self.connects++
+	return &droppingTransport{factory: self}, nil
+}
+
+// Only implements the methods the tests use
+type droppingTransport struct {
+	Transport
+	factory *droppingTransportFactory
+}
+
+func (self *droppingTransport) Release() {
+}
+
+func (self *droppingTransport) QueryCaps() ([]string, error) {
+	return []string{"pipelining"}, nil
+}
+
+func (self *droppingTransport) SetEnabledCaps(caps []string) error {
+	return nil
+}
+
+func (self *droppingTransport) MetadataExists(lobshaz string) (bool, int64, error) {
+	if self.factory.failures > 0 {
+		self.factory.failures--
+		return false, 0, &ConnectionError{"Connection dropped"}
+	}
+	return true, 100, nil
+}
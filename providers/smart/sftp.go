@@ -0,0 +1,504 @@
+package smart
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/atlassian/git-lob/providers"
+	"github.com/atlassian/git-lob/util"
+)
+
+// SftpSyncProvider implements the basic SyncProvider interface by transferring files over
+// SFTP, which most SSH servers support without installing anything
+type SftpSyncProvider struct {
+	// The remote & URL the current session is for
+	remoteName string
+	serverUrl  *url.URL
+	// Current session, nil if not connected (or the connection dropped)
+	client *sftpClient
+	// Creates the connection to the sftp subsystem; uses ssh if nil
+	connect func(u *url.URL) (io.ReadWriteCloser, error)
+}
+
+func (*SftpSyncProvider) TypeID() string {
+	return "sftp"
+}
+
+func (*SftpSyncProvider) HelpTextSummary() string {
+	return `sftp: transfers binaries to/from any SSH server over SFTP`
+}
+
+func (*SftpSyncProvider) HelpTextDetail() string {
+	return `The "sftp" provider transfers files to a directory on any SSH server which
+supports SFTP (almost all do), without needing to install anything on it. It
+uses your ssh command (or GIT_SSH) so your usual keys and ssh config apply.
+
+Unlike the "smart" provider, binary deltas are not supported, so every changed
+file is transferred in full.
+
+Required parameters in remote section of .gitconfig:
+    git-lob-sftp-url  The host and directory to store binaries in, as either
+                      user@host:path/to/store or ssh://user@host:port/path.
+                      Relative paths are relative to the user's home dir; use
+                      user@host:/path or ssh://user@host//path for absolute
+                      paths. The directory is created if it doesn't exist.
+
+Optional parameters in the remote section:
+    git-lob-retries   The number of times to reconnect and retry a file if the
+                      connection drops. Default 3, or git-lob.retries if set.
+
+Example configuration:
+    [remote "origin"]
+        url = git@blah.com/your/usual/git/repo
+        git-lob-provider = sftp
+        git-lob-sftp-url = me@someserver.com:binaries/myrepo
+
+To avoid partially written files when interrupted, files are uploaded to a
+temporary name and renamed on completion. If forcibly interrupted, temporary
+files called 'tempupload*' may remain; these can be safely deleted if older
+than 24h.
+`
+}
+
+// Parse the sftp URL for a remote; bare user@host:path URLs are supported like git's
+func (self *SftpSyncProvider) getUrl(remoteName string) (*url.URL, error) {
+	setting := fmt.Sprintf("remote.%v.git-lob-sftp-url", remoteName)
+	urlstr := strings.TrimSpace(util.GlobalOptions.GitConfig[setting])
+	if urlstr == "" {
+		return nil, fmt.Errorf("Configuration invalid for 'sftp', missing setting %v", setting)
+	}
+	var u *url.URL
+	if strings.Contains(urlstr, "://") {
+		var err error
+		u, err = url.Parse(urlstr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for %v: %v", setting, err.Error())
+		}
+		if u.Scheme == "sftp" {
+			u.Scheme = "ssh"
+		}
+	} else {
+		// Bare URLs can't be parsed as URLs, this is what cleanupBareUrl expects
+		u = &url.URL{Path: urlstr}
+	}
+	factory := &SshTransportFactory{}
+	u = factory.cleanupBareUrl(u)
+	if u.Scheme != "ssh" {
+		return nil, fmt.Errorf("Invalid value for %v, must be an SSH URL: %v", setting, urlstr)
+	}
+	if host, _ := factory.getHostAndPort(u); host == "" {
+		return nil, fmt.Errorf("Invalid value for %v, no host: %v", setting, urlstr)
+	}
+	return u, nil
+}
+
+// Get the remote path of a file relative to the root directory
+func (self *SftpSyncProvider) remotePath(filename string) string {
+	// Path includes a preceding '/', rooted paths are '//path'
+	root := strings.TrimPrefix(self.serverUrl.Path, "/")
+	if root == "" {
+		root = "."
+	}
+	return path.Join(root, filepath.ToSlash(filename))
+}
+
+func (self *SftpSyncProvider) sshConnect(u *url.URL) (io.ReadWriteCloser, error) {
+	cmd, err := (&SshTransportFactory{}).sshCommand(u, true, func(string) []string {
+		return []string{"sftp"}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return startSshConnection(cmd)
+}
+
+// Make sure we have a session for a remote, reconnecting if it dropped
+func (self *SftpSyncProvider) ensureConnected(remoteName string) error {
+	if self.remoteName != remoteName {
+		self.Release()
+		u, err := self.getUrl(remoteName)
+		if err != nil {
+			return err
+		}
+		self.remoteName = remoteName
+		self.serverUrl = u
+	}
+	if self.client != nil {
+		return nil
+	}
+	connect := self.connect
+	if connect == nil {
+		connect = self.sshConnect
+	}
+	conn, err := connect(self.serverUrl)
+	if err != nil {
+		// Can't even start ssh; no point retrying
+		return err
+	}
+	self.client, err = newSftpClient(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+// Perform an operation, reconnecting and retrying if the connection drops. Operations must be safe
+// to repeat from scratch. Each retry of filename is reported to callback.
+// Returns aborted = true if the callback requested it
+func (self *SftpSyncProvider) withRetry(filename string, size int64, callback providers.SyncProgressCallback,
+	op func(c *sftpClient) error) (aborted bool, err error) {
+
+	err = providers.RetryOperation(providers.GetRetryCountForRemote(self.remoteName), IsConnectionError,
+		func(attempt int, err error) bool {
+			util.LogDebugf("Connection to %v failed, retrying %v (attempt %d): %v\n", self.serverUrl, filename, attempt, err.Error())
+			if callback != nil && callback(filename, util.ProgressRetry, 0, size) {
+				aborted = true
+			}
+			return aborted
+		}, func() error {
+			err := self.ensureConnected(self.remoteName)
+			if err != nil {
+				return err
+			}
+			err = op(self.client)
+			if IsConnectionError(err) {
+				// Throw away the dropped connection, re-establish it next time
+				self.releaseClient()
+			}
+			return err
+		})
+	return aborted, err
+}
+
+func (self *SftpSyncProvider) releaseClient() {
+	if self.client != nil {
+		self.client.Close()
+		self.client = nil
+	}
+}
+
+func (self *SftpSyncProvider) Release() {
+	self.releaseClient()
+	self.remoteName = ""
+	self.serverUrl = nil
+}
+
+func (self *SftpSyncProvider) ValidateConfig(remoteName string) error {
+	_, err := self.getUrl(remoteName)
+	return err
+}
+
+// Get whether a file exists & its size
+func (self *SftpSyncProvider) fileSize(filename string) (exists bool, size int64, err error) {
+	_, err = self.withRetry(filename, 0, nil, func(c *sftpClient) error {
+		attrs, err := c.Stat(self.remotePath(filename))
+		if err != nil {
+			if isSftpNotFound(err) {
+				exists = false
+				return nil
+			}
+			return err
+		}
+		exists = !attrs.IsDir
+		size = attrs.Size
+		return nil
+	})
+	return exists, size, err
+}
+
+func (self *SftpSyncProvider) FileExists(remoteName, filename string) bool {
+	if self.ensureConnected(remoteName) != nil {
+		return false
+	}
+	exists, _, err := self.fileSize(filename)
+	return err == nil && exists
+}
+
+func (self *SftpSyncProvider) FileExistsAndIsOfSize(remoteName, filename string, sz int64) bool {
+	if self.ensureConnected(remoteName) != nil {
+		return false
+	}
+	exists, size, err := self.fileSize(filename)
+	return err == nil && exists && size == sz
+}
+
+// Create a remote directory and any missing parents
+func (self *SftpSyncProvider) mkdirAll(c *sftpClient, dir string) error {
+	if dir == "." || dir == "/" || dir == "" {
+		return nil
+	}
+	if attrs, err := c.Stat(dir); err == nil {
+		if !attrs.IsDir {
+			return fmt.Errorf("%v exists on the server but is not a directory", dir)
+		}
+		return nil
+	} else if !isSftpNotFound(err) {
+		return err
+	}
+	err := self.mkdirAll(c, path.Dir(dir))
+	if err != nil {
+		return err
+	}
+	err = c.Mkdir(dir)
+	if err != nil && !IsConnectionError(err) {
+		// May have been created by someone else in the meantime
+		if attrs, serr := c.Stat(dir); serr == nil && attrs.IsDir {
+			return nil
+		}
+	}
+	return err
+}
+
+func (self *SftpSyncProvider) uploadSingleFile(filename, fromDir string, force bool,
+	callback providers.SyncProgressCallback) (errorList []string, abort bool) {
+	// Check to see if the file is already there, right size
+	srcfilename := filepath.Join(fromDir, filename)
+	srcfi, err := os.Stat(srcfilename)
+	if err != nil {
+		if callback != nil {
+			if callback(filename, util.ProgressNotFound, 0, 0) {
+				return errorList, true
+			}
+		}
+		msg := fmt.Sprintf("Unable to stat %v: %v", srcfilename, err)
+		errorList = append(errorList, msg)
+		// Keep going with other files
+		return errorList, false
+	}
+
+	if !force {
+		// Check if already there before uploading
+		if exists, size, err := self.fileSize(filename); err == nil && exists && size == srcfi.Size() {
+			// File already present and correct size, skip
+			if callback != nil {
+				if callback(filename, util.ProgressSkip, srcfi.Size(), srcfi.Size()) {
+					return errorList, true
+				}
+			}
+			return errorList, false
+		}
+	}
+
+	inf, err := os.OpenFile(srcfilename, os.O_RDONLY, 0644)
+	if err != nil {
+		msg := fmt.Sprintf("Unable to read input file for upload %v: %v", srcfilename, err)
+		errorList = append(errorList, msg)
+		return errorList, false
+	}
+	defer inf.Close()
+
+	destpath := self.remotePath(filename)
+	var randbytes [8]byte
+	rand.Read(randbytes[:])
+	temppath := path.Join(path.Dir(destpath), "tempupload"+hex.EncodeToString(randbytes[:]))
+
+	userAborted := false
+	aborted, err := self.withRetry(filename, srcfi.Size(), callback, func(c *sftpClient) error {
+		err := self.mkdirAll(c, path.Dir(destpath))
+		if err != nil {
+			return err
+		}
+		// Start from the beginning on each attempt
+		if _, err := inf.Seek(0, os.SEEK_SET); err != nil {
+			return err
+		}
+		// Initial callback
+		if callback != nil {
+			if callback(filename, util.ProgressTransferBytes, 0, srcfi.Size()) {
+				userAborted = true
+				return nil
+			}
+		}
+		_, userAborted, err = c.WriteFile(temppath, util.UploadRateLimiter().Reader(inf), func(done int64) bool {
+			return callback != nil && callback(filename, util.ProgressTransferBytes, done, srcfi.Size())
+		})
+		if err != nil || userAborted {
+			return err
+		}
+		return c.Rename(temppath, destpath)
+	})
+	if err != nil || aborted || userAborted {
+		// Clean up the temporary file, if the connection is still there
+		if self.client != nil {
+			self.client.Remove(temppath)
+		}
+	}
+	if err != nil {
+		errorList = append(errorList, fmt.Sprintf("Problem while uploading %v to %v: %v", filename, self.remoteName, err))
+	}
+	return errorList, aborted || userAborted
+}
+
+func (self *SftpSyncProvider) Upload(remoteName string, filenames []string, fromDir string,
+	force bool, callback providers.SyncProgressCallback) error {
+
+	err := self.ensureConnected(remoteName)
+	if err != nil {
+		return err
+	}
+
+	util.LogDebug("Uploading over SFTP to", self.serverUrl)
+
+	var errorList []string
+	for _, filename := range filenames {
+		// Allow aborting
+		newerrs, abort := self.uploadSingleFile(filename, fromDir, force, callback)
+		errorList = append(errorList, newerrs...)
+		if abort {
+			break
+		}
+	}
+
+	if len(errorList) > 0 {
+		return errors.New(strings.Join(errorList, "\n"))
+	}
+
+	return nil
+}
+
+func (self *SftpSyncProvider) downloadSingleFile(filename, toDir string, force bool,
+	callback providers.SyncProgressCallback) (errorList []string, abort bool) {
+
+	// Query for existence & size first; we need the size either way to report d/l progress
+	exists, size, err := self.fileSize(filename)
+	if err != nil {
+		errorList = append(errorList, fmt.Sprintf("Unable to check %v on %v: %v", filename, self.remoteName, err))
+		return errorList, false
+	}
+	if !exists {
+		// File missing on remote
+		if callback != nil {
+			if callback(filename, util.ProgressNotFound, 0, 0) {
+				return errorList, true
+			}
+		}
+		// Note how we don't add an error to the returned error list
+		// As per provider docs, we simply tell callback it happened & treat it
+		// as a skipped item otherwise, since caller can only request files & not know
+		// if they're on the remote or not
+		// Keep going with other files
+		return errorList, false
+	}
+
+	// Check to see if the file is already there, right size
+	destfilename := filepath.Join(toDir, filename)
+	if !force {
+		if destfi, err := os.Stat(destfilename); err == nil {
+			// File exists locally, check the size
+			if destfi.Size() == size {
+				// File already present and correct size, skip
+				if callback != nil {
+					if callback(filename, util.ProgressSkip, destfi.Size(), destfi.Size()) {
+						return errorList, true
+					}
+				}
+				return errorList, false
+			}
+		}
+	}
+
+	// Make sure dest dir exists
+	parentDir := filepath.Dir(destfilename)
+	err = os.MkdirAll(parentDir, 0755)
+	if err != nil {
+		msg := fmt.Sprintf("Unable to create dir %v: %v", parentDir, err)
+		errorList = append(errorList, msg)
+		return errorList, false
+	}
+	// Create a temporary file to download, avoid issues with interruptions
+	outf, err := ioutil.TempFile(parentDir, "tempdownload")
+	if err != nil {
+		msg := fmt.Sprintf("Unable to create temp file for download in %v: %v", parentDir, err)
+		errorList = append(errorList, msg)
+		return errorList, false
+	}
+	tmpfilename := outf.Name()
+	// This is safe to do even though we manually close & rename because both calls are no-ops if we succeed
+	defer func() {
+		outf.Close()
+		os.Remove(tmpfilename)
+	}()
+
+	userAborted := false
+	var copysize int64
+	aborted, err := self.withRetry(filename, size, callback, func(c *sftpClient) error {
+		// Start from scratch on each attempt
+		if err := outf.Truncate(0); err != nil {
+			return err
+		}
+		// Initial callback
+		if callback != nil {
+			if callback(filename, util.ProgressTransferBytes, 0, size) {
+				userAborted = true
+				return nil
+			}
+		}
+		var err error
+		// Reads are pipelined so just hold up progress to limit the rate
+		limiter := util.DownloadRateLimiter()
+		var limited int64
+		copysize, userAborted, err = c.ReadFile(self.remotePath(filename), size, outf, func(done int64) bool {
+			limiter.Wait(done - limited)
+			limited = done
+			return callback != nil && callback(filename, util.ProgressTransferBytes, done, size)
+		})
+		return err
+	})
+	if aborted || userAborted {
+		return errorList, true
+	}
+	outf.Close()
+	if err != nil || copysize != size {
+		os.Remove(tmpfilename)
+		var msg string
+		if err != nil {
+			msg = fmt.Sprintf("Problem while downloading %v from %v: %v", filename, self.remoteName, err)
+		} else {
+			msg = fmt.Sprintf("Download error: number of bytes read from %v in download of %v does not agree (%d/%d)",
+				self.remoteName, filename, copysize, size)
+		}
+		errorList = append(errorList, msg)
+		return errorList, false
+	}
+	// Move to correct location - remove before to deal with force or bad size cases
+	os.Remove(destfilename)
+	os.Rename(tmpfilename, destfilename)
+	return errorList, false
+}
+
+func (self *SftpSyncProvider) Download(remoteName string, filenames []string, toDir string, force bool,
+	callback providers.SyncProgressCallback) error {
+
+	err := self.ensureConnected(remoteName)
+	if err != nil {
+		return err
+	}
+
+	util.LogDebug("Downloading over SFTP from", self.serverUrl)
+
+	var errorList []string
+	for _, filename := range filenames {
+		// Allow aborting
+		newerrs, abort := self.downloadSingleFile(filename, toDir, force, callback)
+		errorList = append(errorList, newerrs...)
+		if abort {
+			break
+		}
+	}
+
+	if len(errorList) > 0 {
+		return errors.New(strings.Join(errorList, "\n"))
+	}
+
+	return nil
+}
@@ -0,0 +1,337 @@
+package smart
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/atlassian/git-lob/providers"
+	. "github.com/atlassian/git-lob/util"
+)
+
+var _ = Describe("SFTP", func() {
+	var serverRoot, localRoot string
+	var sftp *SftpSyncProvider
+	var connects int
+	var dropAfterWrites int
+	var maxRead int
+	var oldDelay time.Duration
+	BeforeEach(func() {
+		serverRoot, _ = ioutil.TempDir("", "sftpserver")
+		localRoot, _ = ioutil.TempDir("", "sftplocal")
+		connects = 0
+		dropAfterWrites = -1
+		maxRead = 0
+		sftp = &SftpSyncProvider{connect: func(u *url.URL) (io.ReadWriteCloser, error) {
+			connects++
+			// Needs buffering like a real ssh connection, so use a socket rather than net.Pipe
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				return nil, err
+			}
+			defer listener.Close()
+			client, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				return nil, err
+			}
+			server, err := listener.Accept()
+			if err != nil {
+				return nil, err
+			}
+			fake := &fakeSftpServer{root: serverRoot, conn: server, dropAfterWrites: dropAfterWrites, maxRead: maxRead}
+			go fake.serve()
+			return client, nil
+		}}
+		GlobalOptions.GitConfig["remote.origin.git-lob-sftp-url"] = "me@host.com:store/binaries"
+		oldDelay = providers.RetryBaseDelay
+		providers.RetryBaseDelay = time.Millisecond
+	})
+	AfterEach(func() {
+		sftp.Release()
+		GlobalOptions = NewOptions()
+		providers.RetryBaseDelay = oldDelay
+		os.RemoveAll(serverRoot)
+		os.RemoveAll(localRoot)
+	})
+
+	It("Parses URLs", func() {
+		u, err := sftp.getUrl("origin")
+		Expect(err).To(BeNil(), "Should parse bare URL")
+		Expect(u.User.Username()).To(Equal("me"), "Should get user")
+		Expect(u.Host).To(Equal("host.com"), "Should get host")
+		Expect(u.Path).To(Equal("/store/binaries"), "Should get path")
+		GlobalOptions.GitConfig["remote.origin.git-lob-sftp-url"] = "sftp://me@host.com:2222//abs/path"
+		u, err = sftp.getUrl("origin")
+		Expect(err).To(BeNil(), "Should parse sftp URL")
+		Expect(u.Scheme).To(Equal("ssh"), "Should treat as ssh")
+		Expect(u.Host).To(Equal("host.com:2222"), "Should get host & port")
+		sftp.serverUrl = u
+		Expect(sftp.remotePath("ab/file")).To(Equal("/abs/path/ab/file"), "Should use absolute path")
+		Expect(sftp.ValidateConfig("other")).ToNot(BeNil(), "Should require URL")
+	})
+
+	It("Builds the ssh command for the sftp subsystem", func() {
+		u, _ := sftp.getUrl("origin")
+		cmd, err := (&SshTransportFactory{}).sshCommand(u, true, func(string) []string { return []string{"sftp"} })
+		Expect(err).To(BeNil(), "Should build command")
+		Expect(cmd.Args[1:]).To(Equal([]string{"-s", "me@host.com", "sftp"}), "Should request subsystem")
+	})
+
+	It("Uploads, checks and downloads files", func() {
+		filename := filepath.Join("ab", "cd", "file1.bin")
+		createRandomFileForSftpTest(100000, filepath.Join(localRoot, "up", filename))
+		var uploaded, skipped []string
+		callback := func(file string, progressType ProgressCallbackType, bytesDone, totalBytes int64) bool {
+			if bytesDone == totalBytes {
+				if progressType == ProgressSkip {
+					skipped = append(skipped, file)
+				} else if progressType == ProgressTransferBytes {
+					uploaded = append(uploaded, file)
+				}
+			}
+			return false
+		}
+		err := sftp.Upload("origin", []string{filename}, filepath.Join(localRoot, "up"), false, callback)
+		Expect(err).To(BeNil(), "Should upload")
+		Expect(uploaded).To(ConsistOf(filename), "Should report upload")
+		remoteFile := filepath.Join(serverRoot, "store", "binaries", filename)
+		original, _ := ioutil.ReadFile(filepath.Join(localRoot, "up", filename))
+		content, err := ioutil.ReadFile(remoteFile)
+		Expect(err).To(BeNil(), "Should create remote file")
+		Expect(content).To(Equal(original), "Should upload content")
+		entries, _ := ioutil.ReadDir(filepath.Dir(remoteFile))
+		Expect(entries).To(HaveLen(1), "Should not leave temporary files")
+
+		Expect(sftp.FileExists("origin", filename)).To(BeTrue(), "Should exist")
+		Expect(sftp.FileExistsAndIsOfSize("origin", filename, 100000)).To(BeTrue(), "Should exist with size")
+		Expect(sftp.FileExistsAndIsOfSize("origin", filename, 99)).To(BeFalse(), "Should detect wrong size")
+		Expect(sftp.FileExists("origin", "missing.bin")).To(BeFalse(), "Should not exist")
+		Expect(sftp.FileExists("origin", "ab")).To(BeFalse(), "Directories are not files")
+
+		err = sftp.Upload("origin", []string{filename}, filepath.Join(localRoot, "up"), false, callback)
+		Expect(err).To(BeNil(), "Should not be an error")
+		Expect(skipped).To(ConsistOf(filename), "Should skip existing file")
+
+		var downloaded, notfound []string
+		dlcallback := func(file string, progressType ProgressCallbackType, bytesDone, totalBytes int64) bool {
+			if progressType == ProgressNotFound {
+				notfound = append(notfound, file)
+			} else if progressType == ProgressTransferBytes && bytesDone == totalBytes {
+				downloaded = append(downloaded, file)
+			}
+			return false
+		}
+		err = sftp.Download("origin", []string{filename, "missing.bin"}, filepath.Join(localRoot, "down"), false, dlcallback)
+		Expect(err).To(BeNil(), "Should download")
+		Expect(downloaded).To(ConsistOf(filename), "Should report download")
+		Expect(notfound).To(ConsistOf("missing.bin"), "Should report missing file")
+		content, err = ioutil.ReadFile(filepath.Join(localRoot, "down", filename))
+		Expect(err).To(BeNil(), "Should have written file")
+		Expect(content).To(Equal(original), "Downloaded content should match")
+		Expect(connects).To(Equal(1), "Should re-use the connection")
+	})
+
+	It("Reconnects and retries when the connection drops", func() {
+		createRandomFileForSftpTest(100000, filepath.Join(localRoot, "file1.bin"))
+		dropAfterWrites = 1
+		retries := 0
+		callback := func(file string, progressType ProgressCallbackType, bytesDone, totalBytes int64) bool {
+			if progressType == ProgressRetry {
+				retries++
+				// Behave next time
+				dropAfterWrites = -1
+			}
+			return false
+		}
+		err := sftp.Upload("origin", []string{"file1.bin"}, localRoot, false, callback)
+		Expect(err).To(BeNil(), "Should succeed after reconnecting")
+		Expect(retries).To(Equal(1), "Should report retry")
+		Expect(connects).To(Equal(2), "Should have reconnected")
+		info, err := os.Stat(filepath.Join(serverRoot, "store", "binaries", "file1.bin"))
+		Expect(err).To(BeNil(), "Should upload")
+		Expect(info.Size()).To(BeEquivalentTo(100000), "Should upload whole file")
+	})
+
+	It("Downloads from servers which return short reads", func() {
+		// Big enough that the rest of each short read is requested while other reads are outstanding
+		createRandomFileForSftpTest(1000000, filepath.Join(serverRoot, "store", "binaries", "file1.bin"))
+		maxRead = 10000
+		retries := 0
+		callback := func(file string, progressType ProgressCallbackType, bytesDone, totalBytes int64) bool {
+			if progressType == ProgressRetry {
+				retries++
+			}
+			return false
+		}
+		err := sftp.Download("origin", []string{"file1.bin"}, localRoot, false, callback)
+		Expect(err).To(BeNil(), "Should download")
+		Expect(retries).To(Equal(0), "Should not need to retry")
+		original, _ := ioutil.ReadFile(filepath.Join(serverRoot, "store", "binaries", "file1.bin"))
+		content, err := ioutil.ReadFile(filepath.Join(localRoot, "file1.bin"))
+		Expect(err).To(BeNil(), "Should have written file")
+		Expect(content).To(Equal(original), "Downloaded content should match")
+	})
+})
+
+func createRandomFileForSftpTest(sz int, filename string) {
+	os.MkdirAll(filepath.Dir(filename), 0755)
+	data := make([]byte, sz)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	ioutil.WriteFile(filename, data, 0644)
+}
+
+// Minimal SFTP v3 server on the local filesystem, paths relative to root
+type fakeSftpServer struct {
+	root    string
+	conn    net.Conn
+	handles []*os.File
+	// Close the connection after this many writes, -1 for never
+	dropAfterWrites int
+	// Return at most this many bytes for each read, 0 for no limit
+	maxRead int
+}
+
+func (self *fakeSftpServer) serve() {
+	defer self.conn.Close()
+	for {
+		var lenbuf [4]byte
+		if _, err := io.ReadFull(self.conn, lenbuf[:]); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint32(lenbuf[:]))
+		if _, err := io.ReadFull(self.conn, data); err != nil {
+			return
+		}
+		r := &sftpReader{data: data[1:]}
+		if data[0] == sftpPacketInit {
+			var b sftpBuffer
+			b.byte(sftpPacketVersion)
+			b.uint32(3)
+			self.send(b)
+			continue
+		}
+		id := r.uint32()
+		var b sftpBuffer
+		status := func(err error) {
+			b.byte(sftpPacketStatus)
+			b.uint32(id)
+			switch {
+			case err == nil:
+				b.uint32(sftpStatusOk)
+			case os.IsNotExist(err):
+				b.uint32(sftpStatusNoSuchFile)
+			case err == io.EOF:
+				b.uint32(sftpStatusEOF)
+			default:
+				b.uint32(sftpStatusFailure)
+			}
+			if err != nil {
+				b.string(err.Error())
+			} else {
+				b.string("")
+			}
+			b.string("")
+		}
+		local := func(p string) string {
+			return filepath.Join(self.root, filepath.FromSlash(strings.TrimPrefix(p, "/")))
+		}
+		switch data[0] {
+		case sftpPacketStat:
+			info, err := os.Stat(local(r.string()))
+			if err != nil {
+				status(err)
+				break
+			}
+			b.byte(sftpPacketAttrs)
+			b.uint32(id)
+			b.uint32(sftpAttrSize | sftpAttrPermissions)
+			b.uint64(uint64(info.Size()))
+			perm := uint32(0100644)
+			if info.IsDir() {
+				perm = 0040755
+			}
+			b.uint32(perm)
+		case sftpPacketMkdir:
+			status(os.Mkdir(local(r.string()), 0755))
+		case sftpPacketRemove:
+			status(os.Remove(local(r.string())))
+		case sftpPacketRename:
+			from, to := local(r.string()), local(r.string())
+			if _, err := os.Stat(to); err == nil {
+				status(os.ErrExist)
+			} else {
+				status(os.Rename(from, to))
+			}
+		case sftpPacketOpen:
+			p := r.string()
+			flags := r.uint32()
+			var f *os.File
+			var err error
+			if flags&sftpFlagWrite != 0 {
+				f, err = os.OpenFile(local(p), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+			} else {
+				f, err = os.Open(local(p))
+			}
+			if err != nil {
+				status(err)
+				break
+			}
+			self.handles = append(self.handles, f)
+			b.byte(sftpPacketHandle)
+			b.uint32(id)
+			b.string(strconv.Itoa(len(self.handles) - 1))
+		case sftpPacketClose:
+			h := self.handle(r)
+			status(self.handles[h].Close())
+		case sftpPacketWrite:
+			if self.dropAfterWrites == 0 {
+				return
+			}
+			self.dropAfterWrites--
+			h := self.handle(r)
+			offset := r.uint64()
+			_, err := self.handles[h].WriteAt(r.stringBytes(), int64(offset))
+			status(err)
+		case sftpPacketRead:
+			h := self.handle(r)
+			offset := r.uint64()
+			buf := make([]byte, r.uint32())
+			if self.maxRead > 0 && len(buf) > self.maxRead {
+				buf = buf[:self.maxRead]
+			}
+			n, err := self.handles[h].ReadAt(buf, int64(offset))
+			if n == 0 {
+				status(err)
+				break
+			}
+			b.byte(sftpPacketData)
+			b.uint32(id)
+			b.bytes(buf[:n])
+		default:
+			status(os.ErrInvalid)
+		}
+		self.send(b)
+	}
+}
+
+func (self *fakeSftpServer) handle(r *sftpReader) int {
+	h, _ := strconv.Atoi(r.string())
+	return h
+}
+
+func (self *fakeSftpServer) send(b sftpBuffer) {
+	var lenbuf [4]byte
+	binary.BigEndian.PutUint32(lenbuf[:], uint32(len(b)))
+	self.conn.Write(append(lenbuf[:], b...))
+}
@@ -0,0 +1,554 @@
+package smart
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Minimal client for version 3 of the SFTP protocol, which is what OpenSSH and most other servers speak
+// See https://tools.ietf.org/html/draft-ietf-secsh-filexfer-02
+// Only the operations the sftp provider needs are implemented.
+
+const (
+	sftpPacketInit     = 1
+	sftpPacketVersion  = 2
+	sftpPacketOpen     = 3
+	sftpPacketClose    = 4
+	sftpPacketRead     = 5
+	sftpPacketWrite    = 6
+	sftpPacketRemove   = 13
+	sftpPacketMkdir    = 14
+	sftpPacketStat     = 17
+	sftpPacketRename   = 18
+	sftpPacketStatus   = 101
+	sftpPacketHandle   = 102
+	sftpPacketData     = 103
+	sftpPacketAttrs    = 105
+	sftpPacketExtended = 200
+)
+
+const (
+	sftpFlagRead  = 0x01
+	sftpFlagWrite = 0x02
+	sftpFlagCreat = 0x08
+	sftpFlagTrunc = 0x10
+)
+
+const (
+	sftpAttrSize        = 0x01
+	sftpAttrUidGid      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrAcModTime   = 0x08
+	sftpAttrExtended    = 0x80000000
+)
+
+const (
+	sftpStatusOk           = 0
+	sftpStatusEOF          = 1
+	sftpStatusNoSuchFile   = 2
+	sftpStatusPermDenied   = 3
+	sftpStatusFailure      = 4
+	sftpStatusConnLost     = 7
+	sftpMaxPacket          = 256 * 1024
+	sftpTransferSize       = 32 * 1024
+	sftpMaxOutstanding     = 16
+	sftpPosixRenameExtName = "posix-rename@openssh.com"
+)
+
+// Error status returned by the server
+type SftpStatusError struct {
+	Code    uint32
+	Message string
+}
+
+func (self *SftpStatusError) Error() string {
+	if self.Message != "" {
+		return fmt.Sprintf("%v (SFTP status %d)", self.Message, self.Code)
+	}
+	return fmt.Sprintf("SFTP status %d", self.Code)
+}
+
+func isSftpNotFound(err error) bool {
+	e, ok := err.(*SftpStatusError)
+	return ok && e.Code == sftpStatusNoSuchFile
+}
+
+// File attributes, only size is used
+type sftpAttrs struct {
+	Size  int64
+	IsDir bool
+}
+
+type sftpClient struct {
+	conn   io.ReadWriteCloser
+	nextId uint32
+	// Extensions the server supports
+	extensions map[string]string
+}
+
+// Start an SFTP session over a connection to a server's sftp subsystem
+func newSftpClient(conn io.ReadWriteCloser) (*sftpClient, error) {
+	c := &sftpClient{conn: conn, extensions: make(map[string]string)}
+	var b sftpBuffer
+	b.byte(sftpPacketInit)
+	b.uint32(3)
+	err := c.send(b)
+	if err != nil {
+		return nil, &ConnectionError{fmt.Sprintf("Unable to start SFTP session: %v", err.Error())}
+	}
+	typ, data, err := c.recv()
+	if err != nil {
+		return nil, &ConnectionError{fmt.Sprintf("Unable to start SFTP session: %v", err.Error())}
+	}
+	if typ != sftpPacketVersion {
+		return nil, fmt.Errorf("Unexpected SFTP response %d to init", typ)
+	}
+	r := sftpReader{data: data}
+	version := r.uint32()
+	if version < 3 {
+		return nil, fmt.Errorf("Unsupported SFTP version %d", version)
+	}
+	for r.err == nil && len(r.data) > 0 {
+		name := r.string()
+		val := r.string()
+		if r.err == nil {
+			c.extensions[name] = val
+		}
+	}
+	return c, nil
+}
+
+func (self *sftpClient) Close() error {
+	return self.conn.Close()
+}
+
+// Write a packet, adding the length prefix
+func (self *sftpClient) send(b sftpBuffer) error {
+	var lenbuf [4]byte
+	binary.BigEndian.PutUint32(lenbuf[:], uint32(len(b)))
+	_, err := self.conn.Write(append(lenbuf[:], b...))
+	if err != nil {
+		return &ConnectionError{err.Error()}
+	}
+	return nil
+}
+
+// Read a packet, returning type and the rest of the payload
+func (self *sftpClient) recv() (byte, []byte, error) {
+	var lenbuf [4]byte
+	_, err := io.ReadFull(self.conn, lenbuf[:])
+	if err != nil {
+		return 0, nil, &ConnectionError{err.Error()}
+	}
+	l := binary.BigEndian.Uint32(lenbuf[:])
+	if l < 1 || l > sftpMaxPacket+1024 {
+		return 0, nil, &ConnectionError{fmt.Sprintf("Invalid SFTP packet length %d", l)}
+	}
+	data := make([]byte, l)
+	_, err = io.ReadFull(self.conn, data)
+	if err != nil {
+		return 0, nil, &ConnectionError{err.Error()}
+	}
+	return data[0], data[1:], nil
+}
+
+// Start a request packet with a new id
+func (self *sftpClient) newRequest(typ byte) (sftpBuffer, uint32) {
+	self.nextId++
+	var b sftpBuffer
+	b.byte(typ)
+	b.uint32(self.nextId)
+	return b, self.nextId
+}
+
+// Read a response & check it's for request id; returns the payload after the id
+func (self *sftpClient) response(id uint32) (byte, *sftpReader, error) {
+	typ, data, err := self.recv()
+	if err != nil {
+		return 0, nil, err
+	}
+	r := &sftpReader{data: data}
+	if respId := r.uint32(); respId != id {
+		return 0, nil, &ConnectionError{fmt.Sprintf("SFTP response out of sequence (expected %d, got %d)", id, respId)}
+	}
+	return typ, r, nil
+}
+
+// Convert a status response to an error, nil if OK
+func sftpStatus(typ byte, r *sftpReader) error {
+	if typ != sftpPacketStatus {
+		return fmt.Errorf("Unexpected SFTP response %d", typ)
+	}
+	code := r.uint32()
+	msg := r.string()
+	if code == sftpStatusOk {
+		return nil
+	}
+	return &SftpStatusError{code, msg}
+}
+
+// Send a request which only returns a status
+func (self *sftpClient) statusRequest(b sftpBuffer, id uint32) error {
+	err := self.send(b)
+	if err != nil {
+		return err
+	}
+	typ, r, err := self.response(id)
+	if err != nil {
+		return err
+	}
+	return sftpStatus(typ, r)
+}
+
+func (self *sftpClient) Stat(path string) (*sftpAttrs, error) {
+	b, id := self.newRequest(sftpPacketStat)
+	b.string(path)
+	err := self.send(b)
+	if err != nil {
+		return nil, err
+	}
+	typ, r, err := self.response(id)
+	if err != nil {
+		return nil, err
+	}
+	if typ != sftpPacketAttrs {
+		return nil, sftpStatus(typ, r)
+	}
+	return r.attrs(), r.err
+}
+
+func (self *sftpClient) Mkdir(path string) error {
+	b, id := self.newRequest(sftpPacketMkdir)
+	b.string(path)
+	b.uint32(sftpAttrPermissions)
+	b.uint32(0755)
+	return self.statusRequest(b, id)
+}
+
+func (self *sftpClient) Remove(path string) error {
+	b, id := self.newRequest(sftpPacketRemove)
+	b.string(path)
+	return self.statusRequest(b, id)
+}
+
+// Rename a file, replacing the destination if it exists
+func (self *sftpClient) Rename(from, to string) error {
+	if _, ok := self.extensions[sftpPosixRenameExtName]; ok {
+		b, id := self.newRequest(sftpPacketExtended)
+		b.string(sftpPosixRenameExtName)
+		b.string(from)
+		b.string(to)
+		return self.statusRequest(b, id)
+	}
+	// Standard rename fails if the destination exists
+	err := self.Remove(to)
+	if err != nil && !isSftpNotFound(err) {
+		return err
+	}
+	b, id := self.newRequest(sftpPacketRename)
+	b.string(from)
+	b.string(to)
+	return self.statusRequest(b, id)
+}
+
+func (self *sftpClient) open(path string, flags uint32) (string, error) {
+	b, id := self.newRequest(sftpPacketOpen)
+	b.string(path)
+	b.uint32(flags)
+	if flags&sftpFlagCreat != 0 {
+		b.uint32(sftpAttrPermissions)
+		b.uint32(0644)
+	} else {
+		b.uint32(0)
+	}
+	err := self.send(b)
+	if err != nil {
+		return "", err
+	}
+	typ, r, err := self.response(id)
+	if err != nil {
+		return "", err
+	}
+	if typ != sftpPacketHandle {
+		return "", sftpStatus(typ, r)
+	}
+	handle := r.string()
+	return handle, r.err
+}
+
+func (self *sftpClient) close(handle string) error {
+	b, id := self.newRequest(sftpPacketClose)
+	b.string(handle)
+	return self.statusRequest(b, id)
+}
+
+// Upload the contents of a reader to a new file, truncating it if it exists
+// Several writes are sent before waiting for responses to avoid waiting for round-trips
+// progress is called after each block is acknowledged with the total bytes written; return true to abort
+func (self *sftpClient) WriteFile(path string, in io.Reader, progress func(done int64) bool) (written int64, aborted bool, err error) {
+	handle, err := self.open(path, sftpFlagWrite|sftpFlagCreat|sftpFlagTrunc)
+	if err != nil {
+		return 0, false, err
+	}
+	var pending []uint32
+	var offset int64
+	// Collect the oldest outstanding response
+	ack := func() error {
+		id := pending[0]
+		pending = pending[1:]
+		typ, r, err := self.response(id)
+		if err != nil {
+			return err
+		}
+		return sftpStatus(typ, r)
+	}
+	buf := make([]byte, sftpTransferSize)
+	eof := false
+	for !eof || len(pending) > 0 {
+		if !eof && !aborted && len(pending) < sftpMaxOutstanding {
+			n, rerr := io.ReadFull(in, buf)
+			if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+				eof = true
+			} else if rerr != nil {
+				err = rerr
+				eof = true
+			}
+			if n > 0 {
+				b, id := self.newRequest(sftpPacketWrite)
+				b.string(handle)
+				b.uint64(uint64(offset))
+				b.bytes(buf[:n])
+				if serr := self.send(b); serr != nil {
+					// Connection is unusable, don't wait for responses
+					return written, aborted, serr
+				}
+				pending = append(pending, id)
+				offset += int64(n)
+			}
+			continue
+		}
+		aerr := ack()
+		if aerr != nil {
+			if IsConnectionError(aerr) {
+				return written, aborted, aerr
+			}
+			if err == nil {
+				err = aerr
+			}
+			eof = true
+			continue
+		}
+		written += sftpTransferSize
+		if written > offset {
+			written = offset
+		}
+		if progress != nil && !aborted && err == nil && progress(written) {
+			aborted = true
+			eof = true
+		}
+	}
+	cerr := self.close(handle)
+	if err == nil && cerr != nil {
+		err = cerr
+	}
+	return written, aborted, err
+}
+
+// Download a file of known size to out
+// Several reads are sent before waiting for responses to avoid waiting for round-trips
+// progress is called after each block is received with the total bytes read; return true to abort
+func (self *sftpClient) ReadFile(path string, size int64, out io.WriterAt, progress func(done int64) bool) (read int64, aborted bool, err error) {
+	handle, err := self.open(path, sftpFlagRead)
+	if err != nil {
+		return 0, false, err
+	}
+	type readReq struct {
+		id     uint32
+		offset int64
+		length int
+	}
+	var pending []readReq
+	// Remainders of short reads which still need requesting
+	var remaining []readReq
+	var offset int64
+	eof := false
+	for {
+		more := !eof && !aborted && err == nil && (offset < size || len(remaining) > 0)
+		if !more && len(pending) == 0 {
+			break
+		}
+		if more && len(pending) < sftpMaxOutstanding {
+			req := readReq{offset: offset, length: sftpTransferSize}
+			if len(remaining) > 0 {
+				req = remaining[0]
+				remaining = remaining[1:]
+			} else {
+				offset += sftpTransferSize
+			}
+			b, id := self.newRequest(sftpPacketRead)
+			b.string(handle)
+			b.uint64(uint64(req.offset))
+			b.uint32(uint32(req.length))
+			if serr := self.send(b); serr != nil {
+				return read, aborted, serr
+			}
+			req.id = id
+			pending = append(pending, req)
+			continue
+		}
+		req := pending[0]
+		pending = pending[1:]
+		typ, r, rerr := self.response(req.id)
+		if rerr != nil {
+			return read, aborted, rerr
+		}
+		if typ != sftpPacketData {
+			serr := sftpStatus(typ, r)
+			if e, ok := serr.(*SftpStatusError); ok && e.Code == sftpStatusEOF {
+				eof = true
+			} else if err == nil {
+				err = serr
+			}
+			continue
+		}
+		data := r.stringBytes()
+		if r.err != nil {
+			return read, aborted, &ConnectionError{r.err.Error()}
+		}
+		if err != nil || aborted {
+			// Just draining responses
+			continue
+		}
+		if len(data) == 0 {
+			err = fmt.Errorf("SFTP server returned no data reading %v at %d", path, req.offset)
+			continue
+		}
+		if len(data) > req.length {
+			data = data[:req.length]
+		}
+		if len(data) < req.length && req.offset+int64(len(data)) < size {
+			// Servers may return less than asked for; queue a request for the rest
+			remaining = append(remaining, readReq{offset: req.offset + int64(len(data)), length: req.length - len(data)})
+		}
+		_, werr := out.WriteAt(data, req.offset)
+		if werr != nil {
+			err = werr
+			continue
+		}
+		read += int64(len(data))
+		if progress != nil && progress(read) {
+			aborted = true
+		}
+	}
+	cerr := self.close(handle)
+	if err == nil && cerr != nil {
+		err = cerr
+	}
+	return read, aborted, err
+}
+
+// Builds SFTP packets
+type sftpBuffer []byte
+
+func (self *sftpBuffer) byte(v byte) {
+	*self = append(*self, v)
+}
+
+func (self *sftpBuffer) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	*self = append(*self, b[:]...)
+}
+
+func (self *sftpBuffer) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	*self = append(*self, b[:]...)
+}
+
+func (self *sftpBuffer) string(v string) {
+	self.uint32(uint32(len(v)))
+	*self = append(*self, v...)
+}
+
+func (self *sftpBuffer) bytes(v []byte) {
+	self.uint32(uint32(len(v)))
+	*self = append(*self, v...)
+}
+
+// Parses SFTP packets; after the first error all values are zero
+type sftpReader struct {
+	data []byte
+	err  error
+}
+
+var errSftpShortPacket = errors.New("SFTP packet too short")
+
+func (self *sftpReader) take(n int) []byte {
+	if self.err != nil {
+		return nil
+	}
+	if n < 0 || len(self.data) < n {
+		self.err = errSftpShortPacket
+		return nil
+	}
+	ret := self.data[:n]
+	self.data = self.data[n:]
+	return ret
+}
+
+func (self *sftpReader) uint32() uint32 {
+	b := self.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (self *sftpReader) uint64() uint64 {
+	b := self.take(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (self *sftpReader) stringBytes() []byte {
+	n := self.uint32()
+	return self.take(int(n))
+}
+
+func (self *sftpReader) string() string {
+	return string(self.stringBytes())
+}
+
+func (self *sftpReader) attrs() *sftpAttrs {
+	attrs := &sftpAttrs{}
+	flags := self.uint32()
+	if flags&sftpAttrSize != 0 {
+		attrs.Size = int64(self.uint64())
+	}
+	if flags&sftpAttrUidGid != 0 {
+		self.uint32()
+		self.uint32()
+	}
+	if flags&sftpAttrPermissions != 0 {
+		perm := self.uint32()
+		// S_IFDIR
+		attrs.IsDir = perm&0170000 == 0040000
+	}
+	if flags&sftpAttrAcModTime != 0 {
+		self.uint32()
+		self.uint32()
+	}
+	if flags&sftpAttrExtended != 0 {
+		count := self.uint32()
+		for i := uint32(0); i < count && self.err == nil; i++ {
+			self.string()
+			self.string()
+		}
+	}
+	return attrs
+}
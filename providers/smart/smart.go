@@ -1,7 +1,6 @@
 package smart
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -27,12 +26,9 @@ type SmartSyncProviderImpl struct {
 	// The parsed url we're using
 	serverUrl *url.URL
 
-	// The transport which is providing the underlying operations
-	transport Transport
-	// capabilities which the server has indicated it supports
-	serverCaps []string
-	// capabilities which are enabled
-	enabledCaps []string
+	// Pool of connections to the server, the first of which is used for all non-transfer requests
+	// Uploads and downloads are distributed across all of them
+	connections []*smartConnection
 }
 
 // See doc/smart_protocol.md for protocol definition
@@ -59,6 +55,13 @@ Required parameters in remote section of .gitconfig:
     git-lob-url    URL which can be used to establish a connection
                    (SSH URLs only for now - more options in future)
 
+Optional parameters in the remote section:
+    git-lob-connections  The number of connections to open to the server so
+                   that uploads and downloads can run in parallel. Default 1.
+    git-lob-retries  The number of times to reconnect and retry an operation
+                   if the connection to the server drops. Default 3, or the
+                   value of git-lob.retries if set.
+
 Example configuration:
     [remote "origin"]
         url = git@blah.com/your/usual/git/repo
@@ -74,15 +77,18 @@ in the target file structure and can be safely deleted if older than 24h.
 }
 
 func (self *SmartSyncProviderImpl) ValidateConfig(remoteName string) error {
+	_, err := self.getMaxConnections(remoteName)
+	if err != nil {
+		return err
+	}
 	return self.retrieveUrl(remoteName)
 }
 
 func (self *SmartSyncProviderImpl) Release() {
-	if self.transport != nil {
-		self.transport.Release()
-		self.transport = nil
+	for _, conn := range self.connections {
+		conn.Release()
 	}
-	self.serverCaps = nil
+	self.connections = nil
 	self.serverUrl = nil
 	self.remoteName = ""
 }
@@ -102,63 +108,79 @@ func (self *SmartSyncProviderImpl) retrieveUrl(remoteName string) error {
 	return nil
 }
 
+// Get the maximum number of connections to use for a remote
+func (self *SmartSyncProviderImpl) getMaxConnections(remoteName string) (int, error) {
+	setting := fmt.Sprintf("remote.%v.git-lob-connections", remoteName)
+	val := strings.TrimSpace(util.GlobalOptions.GitConfig[setting])
+	if val == "" {
+		return 1, nil
+	}
+	n, err := strconv.ParseInt(val, 10, 0)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("Configuration invalid for 'smart', %v must be a number greater than 0", setting)
+	}
+	return int(n), nil
+}
+
 // Internal method to make sure we've established a connection
-// we re-use connections where possible (TODO disconnection issues?)
+// we re-use connections where possible; if they drop, operations re-establish them (see smartConnection.withRetry)
 func (self *SmartSyncProviderImpl) connect(remoteName string) error {
-	if remoteName != self.remoteName || self.transport == nil {
-		if self.transport != nil {
-			self.transport.Release()
-			self.transport = nil
+	if remoteName != self.remoteName || len(self.connections) == 0 {
+		for _, conn := range self.connections {
+			conn.Release()
 		}
-		self.serverCaps = nil
-		self.enabledCaps = nil
-		if self.serverUrl == nil {
+		self.connections = nil
+		if self.serverUrl == nil || remoteName != self.remoteName {
 			err := self.retrieveUrl(remoteName)
 			if err != nil {
 				return err
 			}
 		}
-		// use serverURL to establish transport
-		tf := GetTransportFactory(self.serverUrl)
-		if tf == nil {
-			return fmt.Errorf("Unsupported URL: %v", self.serverUrl)
-		}
-		var err error
-		self.transport, err = tf.Connect(self.serverUrl)
+		conn, err := newSmartConnection(self.serverUrl, providers.GetRetryCountForRemote(remoteName))
 		if err != nil {
 			return err
 		}
+		self.connections = append(self.connections, conn)
 		self.remoteName = remoteName
-
-		err = self.determineCaps()
-		if err != nil {
-			return err
-		}
 	}
 	return nil
 }
 
-// Negotiate with the server to determine capabilities
-func (self *SmartSyncProviderImpl) determineCaps() error {
-	var err error
-	self.serverCaps, err = self.transport.QueryCaps()
+// Make sure we have as many connections as we're allowed to use to transfer numFiles files
+// and return them. Always returns at least the primary connection, if extra connections
+// can't be established we just carry on with what we have.
+func (self *SmartSyncProviderImpl) connectPool(remoteName string, numFiles int) ([]*smartConnection, error) {
+	err := self.connect(remoteName)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	maxconns, err := self.getMaxConnections(remoteName)
+	if err != nil {
+		return nil, err
 	}
-	// Always enable deltas if available
-	self.enabledCaps = nil
-	for _, c := range self.serverCaps {
-		if c == "binary_delta" {
-			self.enabledCaps = append(self.enabledCaps, c)
+	if numFiles < maxconns {
+		maxconns = numFiles
+	}
+	for len(self.connections) < maxconns {
+		conn, err := newSmartConnection(self.serverUrl, providers.GetRetryCountForRemote(remoteName))
+		if err != nil {
+			util.LogDebugf("Unable to open extra connection to %v, continuing with %d: %v", self.serverUrl, len(self.connections), err.Error())
+			break
 		}
-		// nothing else for now
+		self.connections = append(self.connections, conn)
 	}
-	err = self.transport.SetEnabledCaps(self.enabledCaps)
-	if err != nil {
-		return err
+	if maxconns < 1 {
+		maxconns = 1
 	}
+	if maxconns > len(self.connections) {
+		maxconns = len(self.connections)
+	}
+	return self.connections[:maxconns], nil
+}
 
-	return nil
+// The primary connection, used for all non-transfer requests
+func (self *SmartSyncProviderImpl) primary() *smartConnection {
+	return self.connections[0]
 }
 
 // This is the file-based upload (i.e. a meta or a chunk) so no deltas here
@@ -166,26 +188,21 @@ func (self *SmartSyncProviderImpl) determineCaps() error {
 func (self *SmartSyncProviderImpl) Upload(remoteName string, filenames []string, fromDir string,
 	force bool, callback providers.SyncProgressCallback) error {
 
-	err := self.connect(remoteName)
+	conns, err := self.connectPool(remoteName, len(filenames))
 	if err != nil {
 		return err
 	}
 
-	var errorList []string
-	for _, filename := range filenames {
-		// Allow aborting
-		newerrs, abort := self.uploadSingleFile(remoteName, filename, fromDir, force, callback)
-		errorList = append(errorList, newerrs...)
-		if abort {
-			break
-		}
-	}
-
-	if len(errorList) > 0 {
-		return errors.New(strings.Join(errorList, "\n"))
+	// Query what's on the remote for all files up front, so transport can pipeline
+	var remoteFiles map[string]*FileExistsResponse
+	if !force {
+		remoteFiles = self.queryFilesExist(filenames)
 	}
 
-	return nil
+	return transferFilesOverConnections(conns, filenames, callback,
+		func(conn *smartConnection, filename string, cb providers.SyncProgressCallback) ([]string, bool) {
+			return self.uploadSingleFile(conn, remoteName, filename, fromDir, remoteFiles[filename], force, cb)
+		})
 }
 
 // This is the file-based download (i.e. a meta or a chunk) so no deltas here
@@ -193,26 +210,18 @@ func (self *SmartSyncProviderImpl) Upload(remoteName string, filenames []string,
 func (self *SmartSyncProviderImpl) Download(remoteName string, filenames []string, toDir string,
 	force bool, callback providers.SyncProgressCallback) error {
 
-	err := self.connect(remoteName)
+	conns, err := self.connectPool(remoteName, len(filenames))
 	if err != nil {
 		return err
 	}
 
-	var errorList []string
-	for _, filename := range filenames {
-		// Allow aborting
-		newerrs, abort := self.downloadSingleFile(remoteName, filename, toDir, force, callback)
-		errorList = append(errorList, newerrs...)
-		if abort {
-			break
-		}
-	}
+	// Query what's on the remote for all files up front, so transport can pipeline
+	remoteFiles := self.queryFilesExist(filenames)
 
-	if len(errorList) > 0 {
-		return errors.New(strings.Join(errorList, "\n"))
-	}
-
-	return nil
+	return transferFilesOverConnections(conns, filenames, callback,
+		func(conn *smartConnection, filename string, cb providers.SyncProgressCallback) ([]string, bool) {
+			return self.downloadSingleFile(conn, remoteName, filename, toDir, remoteFiles[filename], force, cb)
+		})
 }
 
 func (self *SmartSyncProviderImpl) parseFilename(filename string) (sha string, ischunk bool, chunk int) {
@@ -239,6 +248,36 @@ func (self *SmartSyncProviderImpl) parseFilename(filename string) (sha string, i
 	}
 }
 
+// Query existence & size of a list of files in one batch, keyed on filename
+// Returns nil if the batch failed, callers should fall back on querying each file
+func (self *SmartSyncProviderImpl) queryFilesExist(filenames []string) map[string]*FileExistsResponse {
+	queries := make([]FileExistsRequest, 0, len(filenames))
+	for _, filename := range filenames {
+		sha, ischunk, chunk := self.parseFilename(filename)
+		q := FileExistsRequest{LobSHA: sha, Type: "meta"}
+		if ischunk {
+			q.Type = "chunk"
+			q.ChunkIdx = chunk
+		}
+		queries = append(queries, q)
+	}
+	var results []FileExistsResponse
+	err := self.primary().withRetry(func(t Transport) error {
+		var err error
+		results, err = t.FilesExist(queries)
+		return err
+	})
+	if err != nil {
+		util.LogDebugf("Unable to query files in batch, falling back on individual queries: %v", err.Error())
+		return nil
+	}
+	ret := make(map[string]*FileExistsResponse, len(filenames))
+	for i, filename := range filenames {
+		ret[filename] = &results[i]
+	}
+	return ret
+}
+
 func (self *SmartSyncProviderImpl) FileExists(remoteName, filename string) bool {
 	err := self.connect(remoteName)
 	if err != nil {
@@ -247,12 +286,15 @@ func (self *SmartSyncProviderImpl) FileExists(remoteName, filename string) bool
 
 	sha, ischunk, chunk := self.parseFilename(filename)
 	var exists bool
-	if ischunk {
-		exists, _, _ = self.transport.ChunkExists(sha, chunk)
-	} else {
-		exists, _, _ = self.transport.MetadataExists(sha)
-		return exists
-	}
+	self.primary().withRetry(func(t Transport) error {
+		var err error
+		if ischunk {
+			exists, _, err = t.ChunkExists(sha, chunk)
+		} else {
+			exists, _, err = t.MetadataExists(sha)
+		}
+		return err
+	})
 	return exists
 }
 func (self *SmartSyncProviderImpl) FileExistsAndIsOfSize(remoteName, filename string, sz int64) bool {
@@ -260,27 +302,61 @@ func (self *SmartSyncProviderImpl) FileExistsAndIsOfSize(remoteName, filename st
 	if err != nil {
 		return false
 	}
+	return self.fileExistsAndIsOfSize(self.primary(), filename, sz)
+}
+
+// Implementation of FileExistsAndIsOfSize on a specific connection
+func (self *SmartSyncProviderImpl) fileExistsAndIsOfSize(conn *smartConnection, filename string, sz int64) bool {
 	sha, ischunk, chunk := self.parseFilename(filename)
 	var exists bool
-	if ischunk {
-		exists, _ = self.transport.ChunkExistsAndIsOfSize(sha, chunk, sz)
-	} else {
-		// Never check size for meta
-		exists, _, _ = self.transport.MetadataExists(sha)
-	}
+	conn.withRetry(func(t Transport) error {
+		var err error
+		if ischunk {
+			exists, err = t.ChunkExistsAndIsOfSize(sha, chunk, sz)
+		} else {
+			// Never check size for meta
+			exists, _, err = t.MetadataExists(sha)
+		}
+		return err
+	})
 	return exists
 }
 
-func (self *SmartSyncProviderImpl) downloadSingleFile(remoteName, filename, toDir string,
+// remoteFile is the result of a prior existence query if available, otherwise nil
+func (self *SmartSyncProviderImpl) downloadSingleFile(conn *smartConnection, remoteName, filename, toDir string, remoteFile *FileExistsResponse,
 	force bool, callback providers.SyncProgressCallback) (errorList []string, abort bool) {
 
 	sha, ischunk, chunk := self.parseFilename(filename)
 	var exists bool
 	var sz int64
-	if ischunk {
-		exists, sz, _ = self.transport.ChunkExists(sha, chunk)
+	queryFile := func(t Transport) error {
+		var err error
+		if ischunk {
+			exists, sz, err = t.ChunkExists(sha, chunk)
+		} else {
+			exists, sz, err = t.MetadataExists(sha)
+		}
+		return err
+	}
+	if remoteFile != nil {
+		exists, sz = remoteFile.Exists, remoteFile.Size
 	} else {
-		exists, sz, _ = self.transport.MetadataExists(sha)
+		conn.withRetry(queryFile)
+	}
+	if !exists {
+		// File queries only cover what the server holds itself, but asking about the whole LOB
+		// lets a caching proxy fetch it from its upstream first
+		conn.withRetry(func(t Transport) error {
+			if !conn.serverHasCap("upstream") {
+				// Not a proxy, so the file is just missing
+				return nil
+			}
+			lobExists, _, err := t.LOBExists(sha)
+			if err != nil || !lobExists {
+				return err
+			}
+			return queryFile(t)
+		})
 	}
 	if !exists {
 		if callback != nil {
@@ -355,11 +431,19 @@ func (self *SmartSyncProviderImpl) downloadSingleFile(remoteName, filename, toDi
 			return errorList, true
 		}
 	}
-	if ischunk {
-		err = self.transport.DownloadChunk(sha, chunk, outf, localcallback)
-	} else {
-		err = self.transport.DownloadMetadata(sha, outf)
-	}
+	err = conn.withRetry(func(t Transport) error {
+		// Start again from scratch if retrying
+		if _, err := outf.Seek(0, os.SEEK_SET); err != nil {
+			return err
+		}
+		if err := outf.Truncate(0); err != nil {
+			return err
+		}
+		if ischunk {
+			return t.DownloadChunk(sha, chunk, outf, localcallback)
+		}
+		return t.DownloadMetadata(sha, outf)
+	})
 	outf.Close()
 	if err != nil {
 		os.Remove(tmpfilename)
@@ -379,7 +463,8 @@ func (self *SmartSyncProviderImpl) downloadSingleFile(remoteName, filename, toDi
 	return errorList, abortAfterThisFile
 }
 
-func (self *SmartSyncProviderImpl) uploadSingleFile(remoteName, filename, fromDir string,
+// remoteFile is the result of a prior existence query if available, otherwise nil
+func (self *SmartSyncProviderImpl) uploadSingleFile(conn *smartConnection, remoteName, filename, fromDir string, remoteFile *FileExistsResponse,
 	force bool, callback providers.SyncProgressCallback) (errorList []string, abort bool) {
 
 	// Check to see if the file is already there, right size
@@ -397,9 +482,18 @@ func (self *SmartSyncProviderImpl) uploadSingleFile(remoteName, filename, fromDi
 		return errorList, false
 	}
 
+	sha, ischunk, chunk := self.parseFilename(filename)
+
 	if !force {
 		// Check existence & size before uploading
-		if self.FileExistsAndIsOfSize(remoteName, filename, srcfi.Size()) {
+		var upToDate bool
+		if remoteFile != nil {
+			// Never check size for meta
+			upToDate = remoteFile.Exists && (!ischunk || remoteFile.Size == srcfi.Size())
+		} else {
+			upToDate = self.fileExistsAndIsOfSize(conn, filename, srcfi.Size())
+		}
+		if upToDate {
 			// File already present and correct size, skip
 			if callback != nil {
 				if callback(filename, util.ProgressSkip, srcfi.Size(), srcfi.Size()) {
@@ -410,8 +504,6 @@ func (self *SmartSyncProviderImpl) uploadSingleFile(remoteName, filename, fromDi
 		}
 	}
 
-	sha, ischunk, chunk := self.parseFilename(filename)
-
 	// Initial callback
 	if callback != nil {
 		if callback(filename, util.ProgressTransferBytes, 0, srcfi.Size()) {
@@ -438,11 +530,16 @@ func (self *SmartSyncProviderImpl) uploadSingleFile(remoteName, filename, fromDi
 		return errorList, abortAfterThisFile
 	}
 	defer inf.Close()
-	if ischunk {
-		err = self.transport.UploadChunk(sha, chunk, srcfi.Size(), inf, localcallback)
-	} else {
-		err = self.transport.UploadMetadata(sha, srcfi.Size(), inf)
-	}
+	err = conn.withRetry(func(t Transport) error {
+		// Start again from scratch if retrying
+		if _, err := inf.Seek(0, os.SEEK_SET); err != nil {
+			return err
+		}
+		if ischunk {
+			return t.UploadChunk(sha, chunk, srcfi.Size(), inf, localcallback)
+		}
+		return t.UploadMetadata(sha, srcfi.Size(), inf)
+	})
 	if err != nil {
 		msg := fmt.Sprintf("Problem while uploading %v to %v: %v", srcfilename, remoteName, err)
 		errorList = append(errorList, msg)
@@ -465,16 +562,82 @@ func (self *SmartSyncProviderImpl) LOBExists(remoteName, sha string) (ex bool, s
 		return false, 0
 	}
 
-	exists, sz, _ := self.transport.LOBExists(sha)
+	var exists bool
+	self.primary().withRetry(func(t Transport) error {
+		var err error
+		exists, sz, err = t.LOBExists(sha)
+		return err
+	})
 	return exists, sz
 }
 
+// Check that a LOB exists in full on the remote and that the server's copy of the content is correct
+func (self *SmartSyncProviderImpl) VerifyLOB(remoteName, sha string) (ex bool, valid bool, e error) {
+	err := self.connect(remoteName)
+	if err != nil {
+		return false, false, err
+	}
+	conn := self.primary()
+	err = conn.withRetry(func(t Transport) error {
+		// Caps are only known once connected, which may happen in withRetry
+		if !conn.serverHasCap("verify") {
+			return fmt.Errorf("Server for %v does not support verifying content", remoteName)
+		}
+		var err error
+		ex, valid, err = t.VerifyLOB(sha)
+		return err
+	})
+	return ex, valid, err
+}
+
+// Run a locking operation on the primary connection, checking the server supports it
+func (self *SmartSyncProviderImpl) withLocking(remoteName string, op func(t Transport) error) error {
+	err := self.connect(remoteName)
+	if err != nil {
+		return err
+	}
+	conn := self.primary()
+	return conn.withRetry(func(t Transport) error {
+		if !conn.serverHasCap("locking") {
+			return providers.NewLockingNotSupportedError(remoteName)
+		}
+		return op(t)
+	})
+}
+
+func (self *SmartSyncProviderImpl) LockFile(remoteName, path string) (ok bool, lock *providers.FileLock, e error) {
+	err := self.withLocking(remoteName, func(t Transport) error {
+		var err error
+		ok, lock, err = t.LockFile(path)
+		return err
+	})
+	return ok, lock, err
+}
+
+func (self *SmartSyncProviderImpl) UnlockFile(remoteName, path string, force bool) (ok bool, lock *providers.FileLock, e error) {
+	err := self.withLocking(remoteName, func(t Transport) error {
+		var err error
+		ok, lock, err = t.UnlockFile(path, force)
+		return err
+	})
+	return ok, lock, err
+}
+
+func (self *SmartSyncProviderImpl) ListLocks(remoteName string) (locks []*providers.FileLock, owner string, e error) {
+	err := self.withLocking(remoteName, func(t Transport) error {
+		var err error
+		locks, owner, err = t.ListLocks()
+		return err
+	})
+	return locks, owner, err
+}
+
 func (self *SmartSyncProviderImpl) PrepareDeltaForDownload(remoteName, sha string, candidateBaseSHAs []string) (size int64, base string, e error) {
 	err := self.connect(remoteName)
 	if err != nil {
 		return 0, "", err
 	}
-	baseSHA, err := self.transport.GetFirstCompleteLOBFromList(candidateBaseSHAs)
+	baseSHA, err := self.GetFirstCompleteLOBFromList(remoteName, candidateBaseSHAs)
 	if err != nil {
 		return 0, "", err
 	}
@@ -482,7 +645,12 @@ func (self *SmartSyncProviderImpl) PrepareDeltaForDownload(remoteName, sha strin
 		// no common base
 		return 0, "", nil
 	}
-	sz, err := self.transport.DownloadDeltaPrepare(baseSHA, sha)
+	var sz int64
+	err = self.primary().withRetry(func(t Transport) error {
+		var err error
+		sz, err = t.DownloadDeltaPrepare(baseSHA, sha)
+		return err
+	})
 	if err != nil {
 		return 0, baseSHA, err
 	}
@@ -499,7 +667,11 @@ func (self *SmartSyncProviderImpl) DownloadDelta(remoteName, basesha, targetsha
 	localcallback := func(bytesDone, totalBytes int64) {
 		callback(description, util.ProgressTransferBytes, bytesDone, totalBytes)
 	}
-	ok, err := self.transport.DownloadDelta(basesha, targetsha, 1024*1024*1024, out, localcallback)
+	// Can't retry this since we can't rewind out, but make sure the connection gets re-established
+	// for subsequent calls if it drops (caller will fall back to non-delta download)
+	ok, err := self.primary().noRetry(func(t Transport) (bool, error) {
+		return t.DownloadDelta(basesha, targetsha, 1024*1024*1024, out, localcallback)
+	})
 	if !ok {
 		return fmt.Errorf("Server chose not to provide a delta for %v", targetsha)
 	}
@@ -511,7 +683,13 @@ func (self *SmartSyncProviderImpl) GetFirstCompleteLOBFromList(remoteName string
 	if err != nil {
 		return "", err
 	}
-	return self.transport.GetFirstCompleteLOBFromList(candidateSHAs)
+	var sha string
+	err = self.primary().withRetry(func(t Transport) error {
+		var err error
+		sha, err = t.GetFirstCompleteLOBFromList(candidateSHAs)
+		return err
+	})
+	return sha, err
 }
 
 // Upload delta of LOB content (must be calculated first)
@@ -524,7 +702,11 @@ func (self *SmartSyncProviderImpl) UploadDelta(remoteName, basesha, targetsha st
 	localcallback := func(bytesDone, totalBytes int64) {
 		callback(description, util.ProgressTransferBytes, bytesDone, totalBytes)
 	}
-	ok, err := self.transport.UploadDelta(basesha, targetsha, size, in, localcallback)
+	// Can't retry this since we can't rewind in, but make sure the connection gets re-established
+	// for subsequent calls if it drops (caller will fall back to non-delta upload)
+	ok, err := self.primary().noRetry(func(t Transport) (bool, error) {
+		return t.UploadDelta(basesha, targetsha, size, in, localcallback)
+	})
 	if !ok {
 		return fmt.Errorf("Server chose not to accept a delta for %v", targetsha)
 	}
@@ -539,4 +721,6 @@ func InitCoreProviders() {
 	// from a URL. Only implementation right now is persistent/SSH but can have different modes (e.g. transient)
 	// and different underlying network protocols (e.g. REST)
 	providers.RegisterSyncProvider(&SmartSyncProviderImpl{})
+	// SFTP reuses the SSH connection handling but is a plain sync provider
+	providers.RegisterSyncProvider(&SftpSyncProvider{})
 }
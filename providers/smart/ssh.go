@@ -68,6 +68,24 @@ func (self *SshTransportFactory) WillHandleUrl(u *url.URL) bool {
 	return newu.Scheme == "ssh"
 }
 func (self *SshTransportFactory) Connect(u *url.URL) (Transport, error) {
+	cmd, err := self.sshCommand(u, false, func(path string) []string {
+		// Remote program and path
+		return []string{util.GlobalOptions.SSHServerCommand, path}
+	})
+	if err != nil {
+		return nil, err
+	}
+	conn, err := startSshConnection(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return NewPersistentTransport(conn), nil
+}
+
+// Build the ssh command line to connect to the host in an SSH URL (ssh:// or bare user@host:path form)
+// remoteArgs is given the path from the URL and returns what to run on the remote end. If subsystem
+// is true, remoteArgs should return the name of an SSH subsystem (e.g. sftp) instead of a command.
+func (self *SshTransportFactory) sshCommand(u *url.URL, subsystem bool, remoteArgs func(path string) []string) (*exec.Cmd, error) {
 	ssh := os.Getenv("GIT_SSH")
 	basessh := filepath.Base(ssh)
 	// Strip extension for easier comparison
@@ -107,10 +125,16 @@ func (self *SshTransportFactory) Connect(u *url.URL) (Transport, error) {
 		}
 		args = append(args, port)
 	}
-	args = append(args, host)
+	if subsystem {
+		// Same option for ssh and plink
+		args = append(args, "-s")
+	}
+	if urlCleaned.User != nil && urlCleaned.User.Username() != "" {
+		args = append(args, fmt.Sprintf("%v@%v", urlCleaned.User.Username(), host))
+	} else {
+		args = append(args, host)
+	}
 
-	// Now add remote program and path
-	args = append(args, util.GlobalOptions.SSHServerCommand)
 	// u.Path includes a preceding '/', strip off manually
 	// rooted paths in the URL will be '//path/to/blah'
 	// this is just how Go's URL parsing works
@@ -118,12 +142,15 @@ func (self *SshTransportFactory) Connect(u *url.URL) (Transport, error) {
 	if len(path) > 0 && strings.HasPrefix(path, "/") {
 		path = path[1:]
 	}
-	args = append(args, path)
+	args = append(args, remoteArgs(path)...)
 
 	util.LogDebugf("SSH command is: %v %v", ssh, strings.Join(args, " "))
 
-	cmd := exec.Command(ssh, args...)
+	return exec.Command(ssh, args...), nil
+}
 
+// Start an ssh command and connect to its stdin/stdout
+func startSshConnection(cmd *exec.Cmd) (*SshConnection, error) {
 	outp, err := cmd.StdoutPipe()
 	if err != nil {
 		return nil, fmt.Errorf("Unable to connect to ssh stdout: %v", err.Error())
@@ -148,9 +175,9 @@ func (self *SshTransportFactory) Connect(u *url.URL) (Transport, error) {
 		stderr: errp,
 	}
 
-	util.LogDebugf("SSH connection successful to %v", host)
+	util.LogDebugf("SSH connection successful")
 
-	return NewPersistentTransport(conn), nil
+	return conn, nil
 
 }
 
@@ -177,6 +204,8 @@ func (self *SshConnection) Write(p []byte) (n int, err error) {
 	return self.stdin.Write(p)
 }
 func (self *SshConnection) Close() error {
+	// Let the remote end know we're done, in case it's waiting for more input
+	self.stdin.Close()
 	// Docs say "It is incorrect to call Wait before all writes to the pipe have completed."
 	// But that actually means in parallel https://github.com/golang/go/issues/9307 so we're ok here
 	errbytes, readerr := ioutil.ReadAll(self.stderr)
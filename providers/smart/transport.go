@@ -3,6 +3,8 @@ package smart
 import (
 	"io"
 	"net/url"
+
+	"github.com/atlassian/git-lob/providers"
 )
 
 type TransportProgressCallback func(bytesDone, totalBytes int64)
@@ -25,8 +27,25 @@ type Transport interface {
 	ChunkExists(lobsha string, chunk int) (ex bool, sz int64, e error)
 	// Return whether LOB chunk content exists on the server, and is of a specific size
 	ChunkExistsAndIsOfSize(lobsha string, chunk int, sz int64) (bool, error)
+	// Query whether many files (meta or chunk) exist on the server & their sizes, results in same order
+	// Transports should pipeline these queries where possible rather than do a round-trip for each
+	FilesExist(queries []FileExistsRequest) ([]FileExistsResponse, error)
 	// Entire LOB exists? Also returns entire content size
 	LOBExists(lobsha string) (ex bool, sz int64, e error)
+	// Entire LOB exists, and the SHA of the content is correct? Server must recalculate the SHA
+	// Only available if the server has the "verify" capability
+	VerifyLOB(lobsha string) (ex bool, valid bool, e error)
+
+	// Lock a file for the user the server identifies us as
+	// If already locked by someone else returns false & the existing lock
+	// Only available if the server has the "locking" capability
+	LockFile(path string) (ok bool, lock *providers.FileLock, e error)
+	// Release a lock; if locked by someone else & not force returns false & the existing lock
+	// Only available if the server has the "locking" capability
+	UnlockFile(path string, force bool) (ok bool, lock *providers.FileLock, e error)
+	// List all locks held on the server, and the owner our own locks have
+	// Only available if the server has the "locking" capability
+	ListLocks() (locks []*providers.FileLock, owner string, e error)
 
 	// Upload metadata for a LOB (from a stream); no progress callback as very small
 	UploadMetadata(lobsha string, sz int64, data io.Reader) error
@@ -6,12 +6,18 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
+	"time"
 
 	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
 )
 
 // generate a list of (relative) file names
@@ -64,3 +70,137 @@ func CreateRandomFileForTest(sz int64, filename string) {
 	}
 
 }
+
+// Common parts of in-memory stand-ins for HTTP storage services: records requests and
+// fails some of them on demand. Embed in a fake & call failRequest first in ServeHTTP
+type fakeHTTPServerForTest struct {
+	mutex    sync.Mutex
+	requests []*http.Request
+	// Number of requests to fail with 503 before behaving
+	failures int
+	// Number of uploads to fail with 503 after receiving the content
+	uploadFailures int
+}
+
+// Lock, record a request & fail it if required; returns true if the request has been dealt with
+// The caller must unlock the mutex when done
+func (self *fakeHTTPServerForTest) failRequest(w http.ResponseWriter, r *http.Request) bool {
+	self.mutex.Lock()
+	self.requests = append(self.requests, r)
+	if self.failures > 0 {
+		self.failures--
+		w.WriteHeader(503)
+		return true
+	}
+	return false
+}
+
+// Read the content of an upload, failing it if required; returns ok = false if failed
+func (self *fakeHTTPServerForTest) receiveUpload(w http.ResponseWriter, r *http.Request) (data []byte, ok bool) {
+	data, _ = ioutil.ReadAll(r.Body)
+	if self.uploadFailures > 0 {
+		self.uploadFailures--
+		w.WriteHeader(503)
+		return nil, false
+	}
+	return data, true
+}
+
+// Check that a provider accepts the test configuration for origin, rejects it with each of
+// the settings in invalid changed (blank to remove it), and rejects an unconfigured remote
+func CheckValidateConfigForTest(provider SyncProvider, invalid map[string]string) {
+	Expect(provider.ValidateConfig("origin")).To(BeNil(), "Should be valid")
+	for setting, val := range invalid {
+		oldval, wasSet := GlobalOptions.GitConfig[setting]
+		if val == "" {
+			delete(GlobalOptions.GitConfig, setting)
+		} else {
+			GlobalOptions.GitConfig[setting] = val
+		}
+		Expect(provider.ValidateConfig("origin")).ToNot(BeNil(), fmt.Sprintf("Should reject %v = %q", setting, val))
+		if wasSet {
+			GlobalOptions.GitConfig[setting] = oldval
+		} else {
+			delete(GlobalOptions.GitConfig, setting)
+		}
+	}
+	Expect(provider.ValidateConfig("other")).ToNot(BeNil(), "Should require configuration for other remotes")
+}
+
+// Upload a file with a provider, check it exists, upload it again to make sure it's skipped
+// then download it again along with a file which doesn't exist
+// remoteContent should return what the remote has stored for the file
+func CheckUploadDownloadForTest(provider SyncProvider, tmp string, remoteContent func() []byte) {
+	filename := filepath.Join("ab", "cd", "file1.bin")
+	CreateRandomFileForTest(1000, filepath.Join(tmp, "up", filename))
+	var uploaded, skipped []string
+	callback := func(file string, progressType ProgressCallbackType, bytesDone, totalBytes int64) bool {
+		if bytesDone == totalBytes {
+			if progressType == ProgressSkip {
+				skipped = append(skipped, file)
+			} else if progressType == ProgressTransferBytes {
+				uploaded = append(uploaded, file)
+			}
+		}
+		return false
+	}
+	err := provider.Upload("origin", []string{filename}, filepath.Join(tmp, "up"), false, callback)
+	Expect(err).To(BeNil(), "Should upload")
+	Expect(uploaded).To(ConsistOf(filename), "Should report upload")
+	Expect(remoteContent()).To(HaveLen(1000), "Should upload all content")
+
+	Expect(provider.FileExists("origin", filename)).To(BeTrue(), "Should exist")
+	Expect(provider.FileExistsAndIsOfSize("origin", filename, 1000)).To(BeTrue(), "Should exist with size")
+	Expect(provider.FileExistsAndIsOfSize("origin", filename, 999)).To(BeFalse(), "Should detect wrong size")
+	Expect(provider.FileExists("origin", "missing.bin")).To(BeFalse(), "Should not exist")
+
+	// Second upload is skipped
+	err = provider.Upload("origin", []string{filename}, filepath.Join(tmp, "up"), false, callback)
+	Expect(err).To(BeNil(), "Should not be an error")
+	Expect(skipped).To(ConsistOf(filename), "Should skip existing file")
+
+	var downloaded, notfound []string
+	dlcallback := func(file string, progressType ProgressCallbackType, bytesDone, totalBytes int64) bool {
+		if progressType == ProgressNotFound {
+			notfound = append(notfound, file)
+		} else if progressType == ProgressTransferBytes && bytesDone == totalBytes {
+			downloaded = append(downloaded, file)
+		}
+		return false
+	}
+	err = provider.Download("origin", []string{filename, "missing.bin"}, filepath.Join(tmp, "down"), false, dlcallback)
+	Expect(err).To(BeNil(), "Should download")
+	Expect(downloaded).To(ConsistOf(filename), "Should report download")
+	Expect(notfound).To(ConsistOf("missing.bin"), "Should report missing file")
+	content, err := ioutil.ReadFile(filepath.Join(tmp, "down", filename))
+	Expect(err).To(BeNil(), "Should have written file")
+	Expect(content).To(Equal(remoteContent()), "Downloaded content should match")
+}
+
+// Check that a provider retries uploads which fail on the fake server & reports it, and
+// that it gives up on downloads once retries are exhausted
+func CheckRetriesForTest(provider SyncProvider, fake *fakeHTTPServerForTest, tmp string) {
+	oldDelay := RetryBaseDelay
+	RetryBaseDelay = time.Millisecond
+	defer func() { RetryBaseDelay = oldDelay }()
+
+	CreateRandomFileForTest(100, filepath.Join(tmp, "file1.bin"))
+	retries := 0
+	callback := func(file string, progressType ProgressCallbackType, bytesDone, totalBytes int64) bool {
+		if progressType == ProgressRetry {
+			retries++
+		}
+		return false
+	}
+	fake.uploadFailures = 2
+	err := provider.Upload("origin", []string{"file1.bin"}, tmp, true, callback)
+	Expect(err).To(BeNil(), "Should succeed after retries")
+	Expect(retries).To(Equal(2), "Should report upload retries")
+	Expect(provider.FileExistsAndIsOfSize("origin", "file1.bin", 100)).To(BeTrue(), "Should upload")
+
+	fake.failures = 10
+	err = provider.Download("origin", []string{"file1.bin"}, filepath.Join(tmp, "down"), false, callback)
+	Expect(err).ToNot(BeNil(), "Should fail after retries exhausted")
+	Expect(err.Error()).To(ContainSubstring("503"), "Should report service error")
+	fake.failures = 0
+}
@@ -0,0 +1,269 @@
+package providers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// Size of the buffer used to copy downloads from a remoteFileTransfer
+const remoteFileBufferSize = 131072
+
+// Common single file upload & download logic for providers which store files in a remote
+// service one request at a time (S3, Azure, GCS, WebDAV). The provider supplies how to query
+// and transfer a file, this deals with skipping, temporary files, progress and retries.
+type remoteFileTransfer struct {
+	remoteName string
+	// Where files are stored, for messages e.g. "S3 bucket foo"
+	location string
+	// Whether an error is transient & worth retrying
+	isRetryable func(err error) bool
+	// Whether an error will affect all files, so there's no point carrying on
+	isFatal func(err error) bool
+	// Get whether a file exists on the remote & its size
+	stat func(filename string) (exists bool, size int64, err error)
+}
+
+// Retry an operation on transient errors, reporting each retry of filename to callback
+// Returns aborted = true if the callback requested it
+func (self *remoteFileTransfer) retry(filename string, size int64, callback SyncProgressCallback,
+	op func() error) (aborted bool, err error) {
+	return retryTransfer(self.isRetryable, self.remoteName, self.location, filename, size, callback, op)
+}
+
+// Prepare to send a file from the start for an upload attempt, making the initial callback
+func restartUpload(inf *os.File, filename string, size int64, callback SyncProgressCallback) (userAborted bool, err error) {
+	if _, err := inf.Seek(0, os.SEEK_SET); err != nil {
+		return false, err
+	}
+	if callback != nil {
+		if callback(filename, util.ProgressTransferBytes, 0, size) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Upload a single file, unless it's already on the remote at the right size (or force)
+// put is called for each attempt with the open file, & should call restartUpload unless it
+// carries on from where a previous attempt got to. cleanup (optional) is called if the upload
+// fails or is aborted
+func (self *remoteFileTransfer) upload(filename, fromDir string, force bool, callback SyncProgressCallback,
+	put func(inf *os.File, size int64) (userAborted bool, err error), cleanup func()) (errorList []string, abort bool) {
+	// Check to see if the file is already there, right size
+	srcfilename := filepath.Join(fromDir, filename)
+	srcfi, err := os.Stat(srcfilename)
+	if err != nil {
+		if callback != nil {
+			if callback(filename, util.ProgressNotFound, 0, 0) {
+				return errorList, true
+			}
+		}
+		msg := fmt.Sprintf("Unable to stat %v: %v", srcfilename, err)
+		errorList = append(errorList, msg)
+		// Keep going with other files
+		return errorList, false
+	}
+
+	if !force {
+		// Check if already there before uploading
+		if exists, size, err := self.stat(filename); err == nil && exists && size == srcfi.Size() {
+			// File already present and correct size, skip
+			if callback != nil {
+				if callback(filename, util.ProgressSkip, srcfi.Size(), srcfi.Size()) {
+					return errorList, true
+				}
+			}
+			return errorList, false
+		}
+	}
+
+	inf, err := os.OpenFile(srcfilename, os.O_RDONLY, 0644)
+	if err != nil {
+		msg := fmt.Sprintf("Unable to read input file for upload %v: %v", srcfilename, err)
+		errorList = append(errorList, msg)
+		return errorList, false
+	}
+	defer inf.Close()
+
+	userAborted := false
+	aborted, err := self.retry(filename, srcfi.Size(), callback, func() error {
+		var err error
+		userAborted, err = put(inf, srcfi.Size())
+		if userAborted {
+			// Don't retry
+			return nil
+		}
+		return err
+	})
+	if cleanup != nil && (err != nil || aborted || userAborted) {
+		cleanup()
+	}
+	if err != nil {
+		errorList = append(errorList, fmt.Sprintf("Problem while uploading %v to %v: %v", filename, self.remoteName, err))
+	}
+
+	return errorList, aborted || userAborted || self.isFatal(err)
+}
+
+// Download a single file, unless it's already present locally at the right size (or force)
+// get is called for each attempt to open the content on the remote
+func (self *remoteFileTransfer) download(filename, toDir string, force bool, callback SyncProgressCallback,
+	get func() (io.ReadCloser, error)) (errorList []string, abort bool) {
+
+	// Query for existence & size first; we need the size either way to report d/l progress
+	exists, size, err := self.stat(filename)
+	if err != nil {
+		errorList = append(errorList, fmt.Sprintf("Unable to check %v in %v: %v", filename, self.location, err))
+		return errorList, self.isFatal(err)
+	}
+	if !exists {
+		// File missing on remote
+		if callback != nil {
+			if callback(filename, util.ProgressNotFound, 0, 0) {
+				return errorList, true
+			}
+		}
+		// Note how we don't add an error to the returned error list
+		// As per provider docs, we simply tell callback it happened & treat it
+		// as a skipped item otherwise, since caller can only request files & not know
+		// if they're on the remote or not
+		// Keep going with other files
+		return errorList, false
+	}
+
+	// Check to see if the file is already there, right size
+	destfilename := filepath.Join(toDir, filename)
+	if !force {
+		if destfi, err := os.Stat(destfilename); err == nil {
+			// File exists locally, check the size
+			if destfi.Size() == size {
+				// File already present and correct size, skip
+				if callback != nil {
+					if callback(filename, util.ProgressSkip, destfi.Size(), destfi.Size()) {
+						return errorList, true
+					}
+				}
+				return errorList, false
+			}
+		}
+	}
+
+	// Make sure dest dir exists
+	parentDir := filepath.Dir(destfilename)
+	err = os.MkdirAll(parentDir, 0755)
+	if err != nil {
+		msg := fmt.Sprintf("Unable to create dir %v: %v", parentDir, err)
+		errorList = append(errorList, msg)
+		return errorList, false
+	}
+	// Create a temporary file to download, avoid issues with interruptions
+	// Note this isn't a valid thing to do in security conscious cases but this isn't one
+	// by opening the file we will get a unique temp file name (albeit a predictable one)
+	outf, err := ioutil.TempFile(parentDir, "tempdownload")
+	if err != nil {
+		msg := fmt.Sprintf("Unable to create temp file for download in %v: %v", parentDir, err)
+		errorList = append(errorList, msg)
+		return errorList, false
+	}
+	tmpfilename := outf.Name()
+	// This is safe to do even though we manually close & rename because both calls are no-ops if we succeed
+	defer func() {
+		outf.Close()
+		os.Remove(tmpfilename)
+	}()
+
+	userAborted := false
+	var copysize int64
+	aborted, err := self.retry(filename, size, callback, func() error {
+		// Start from scratch on each attempt
+		copysize = 0
+		if _, err := outf.Seek(0, os.SEEK_SET); err != nil {
+			return err
+		}
+		if err := outf.Truncate(0); err != nil {
+			return err
+		}
+		inf, err := get()
+		if err != nil {
+			return err
+		}
+		defer inf.Close()
+
+		// Initial callback
+		if callback != nil {
+			if callback(filename, util.ProgressTransferBytes, 0, size) {
+				userAborted = true
+				return nil
+			}
+		}
+		limitedOut := util.DownloadRateLimiter().Writer(outf)
+		for {
+			n, err := io.CopyN(limitedOut, inf, remoteFileBufferSize)
+			copysize += n
+			if n > 0 && callback != nil && size > 0 {
+				if callback(filename, util.ProgressTransferBytes, copysize, size) {
+					userAborted = true
+					return nil
+				}
+			}
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+		if copysize < size {
+			// Connection ended early, worth another go
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	})
+	if aborted || userAborted {
+		return errorList, true
+	}
+	outf.Close()
+	if err != nil || copysize != size {
+		os.Remove(tmpfilename)
+		var msg string
+		if err != nil {
+			msg = fmt.Sprintf("Problem while downloading %v from %v: %v", filename, self.location, err)
+		} else {
+			msg = fmt.Sprintf("Download error: number of bytes read from %v in download of %v does not agree (%d/%d)",
+				self.location, filename, copysize, size)
+		}
+		errorList = append(errorList, msg)
+		return errorList, self.isFatal(err)
+	}
+	// Otherwise, file data is ok on remote
+	// Move to correct location - remove before to deal with force or bad size cases
+	os.Remove(destfilename)
+	os.Rename(tmpfilename, destfilename)
+	return errorList, false
+}
+
+// Transfer each of filenames in turn, stopping early if a transfer says to abort
+// Returns the errors from all the transfers combined
+func transferEachFile(filenames []string, transfer func(filename string) (errorList []string, abort bool)) error {
+	var errorList []string
+	for _, filename := range filenames {
+		// Allow aborting
+		newerrs, abort := transfer(filename)
+		errorList = append(errorList, newerrs...)
+		if abort {
+			break
+		}
+	}
+
+	if len(errorList) > 0 {
+		return errors.New(strings.Join(errorList, "\n"))
+	}
+
+	return nil
+}
@@ -0,0 +1,416 @@
+package providers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/atlassian/git-lob/util"
+)
+
+// WebDAVSyncProvider implements the basic SyncProvider interface for WebDAV servers
+type WebDAVSyncProvider struct {
+	// Client used for all requests, http.DefaultClient if nil
+	HTTPClient *http.Client
+	// Collections we know exist, by URL, so we don't MKCOL them for every file
+	collections     map[string]bool
+	collectionMutex sync.Mutex
+}
+
+func (*WebDAVSyncProvider) TypeID() string {
+	return "webdav"
+}
+
+func (*WebDAVSyncProvider) HelpTextSummary() string {
+	return `webdav: transfers binaries to/from a WebDAV server`
+}
+
+func (*WebDAVSyncProvider) HelpTextDetail() string {
+	return `The "webdav" provider synchronises files with a collection on a WebDAV server,
+e.g. Nextcloud, ownCloud, Apache mod_dav or SharePoint.
+
+Required parameters in remote section of .gitconfig:
+    git-lob-webdav-url  The URL of the collection to use as the root remote store.
+                        Must already exist. Sub-collections are created as needed.
+
+Optional parameters in the remote section:
+    git-lob-webdav-user The user name to authenticate as (HTTP basic auth).
+    git-lob-webdav-password
+                        The password to authenticate with. Can also be set in
+                        other ways, see below.
+    git-lob-retries     The number of times to retry a file which fails for a
+                        transient reason, e.g. server errors or network
+                        problems. Default 3, or git-lob.retries if set.
+
+Example configuration:
+    [remote "origin"]
+        url = git@blah.com/your/usual/git/repo
+        git-lob-provider = webdav
+        git-lob-webdav-url = https://cloud.example.com/remote.php/dav/files/me/binaries
+        git-lob-webdav-user = me
+
+Authentication:
+
+  The password is read in this order:
+
+  1. remote.REMOTE.git-lob-webdav-password in your git config
+  2. GIT_LOB_WEBDAV_PASSWORD in your environment
+  3. The user info part of git-lob-webdav-url, if present
+
+  Many servers (e.g. Nextcloud) let you create an app password so you don't
+  have to store your real password.
+
+Files are uploaded to a temporary name and then moved into place, so that
+partially uploaded files are never visible to other clients.
+`
+}
+
+// Prefix of temporary upload names; these are never valid binary names
+const webDAVTempPrefix = ".git-lob-upload-"
+
+// Connection details for one remote
+type webDAVRemote struct {
+	// Root collection URL, with trailing "/" and no user info
+	root     *url.URL
+	user     string
+	password string
+}
+
+// Error response from the WebDAV server
+type WebDAVError struct {
+	StatusCode int
+	Message    string
+}
+
+func (self *WebDAVError) Error() string {
+	return fmt.Sprintf("%v (%d)", self.Message, self.StatusCode)
+}
+
+// Is an error transient, i.e. server-side or network problems?
+func isWebDAVRetryableError(err error) bool {
+	switch e := err.(type) {
+	case *WebDAVError:
+		return e.StatusCode >= 500 || e.StatusCode == 408 || e.StatusCode == 429
+	case net.Error:
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// Is an error one which will affect all requests, e.g. authentication?
+func isWebDAVFatalError(err error) bool {
+	if e, ok := err.(*WebDAVError); ok {
+		return e.StatusCode == 401 || e.StatusCode == 403
+	}
+	return false
+}
+
+func (self *WebDAVSyncProvider) getRemote(remoteName string) (*webDAVRemote, error) {
+	setting := fmt.Sprintf("remote.%v.git-lob-webdav-url", remoteName)
+	rooturl := strings.TrimSpace(util.GlobalOptions.GitConfig[setting])
+	if rooturl == "" {
+		return nil, fmt.Errorf("Configuration invalid for 'webdav', missing setting %v", setting)
+	}
+	u, err := url.Parse(rooturl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid value for %v, must be an http or https URL: %v", setting, rooturl)
+	}
+	remote := &webDAVRemote{}
+	if u.User != nil {
+		remote.user = u.User.Username()
+		remote.password, _ = u.User.Password()
+		u.User = nil
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+		u.RawPath = ""
+	}
+	remote.root = u
+
+	if user := strings.TrimSpace(util.GlobalOptions.GitConfig[fmt.Sprintf("remote.%v.git-lob-webdav-user", remoteName)]); user != "" {
+		remote.user = user
+	}
+	if password := util.GlobalOptions.GitConfig[fmt.Sprintf("remote.%v.git-lob-webdav-password", remoteName)]; password != "" {
+		remote.password = password
+	} else if password := os.Getenv("GIT_LOB_WEBDAV_PASSWORD"); password != "" {
+		remote.password = password
+	}
+	return remote, nil
+}
+
+func (self *WebDAVSyncProvider) client() *http.Client {
+	if self.HTTPClient != nil {
+		return self.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Get the URL of a file (or collection, if relpath ends in "/") under the root
+func (self *WebDAVSyncProvider) fileURL(remote *webDAVRemote, relpath string) string {
+	var segments []string
+	for _, s := range strings.Split(filepath.ToSlash(relpath), "/") {
+		segments = append(segments, url.PathEscape(s))
+	}
+	u := *remote.root
+	u.RawPath = ""
+	return u.String() + strings.Join(segments, "/")
+}
+
+// Perform a request, returning a *WebDAVError for failure responses other than those in okStatus
+func (self *WebDAVSyncProvider) do(remote *webDAVRemote, method, u string, body io.Reader, size int64,
+	headers map[string]string, okStatus ...int) (*http.Response, error) {
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if remote.user != "" {
+		req.SetBasicAuth(remote.user, remote.password)
+	}
+	resp, err := self.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range okStatus {
+		if resp.StatusCode == s {
+			return resp, nil
+		}
+	}
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, &WebDAVError{resp.StatusCode, fmt.Sprintf("%v %v", method, resp.Status)}
+	}
+	return resp, nil
+}
+
+// PROPFIND response, only the parts we need
+type webDAVMultistatus struct {
+	Responses []struct {
+		Propstats []struct {
+			Status        string `xml:"status"`
+			ContentLength string `xml:"prop>getcontentlength"`
+			Collection    *struct {
+			} `xml:"prop>resourcetype>collection"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+const webDAVPropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:getcontentlength/><D:resourcetype/></D:prop></D:propfind>`
+
+// Get whether a file exists & its size using PROPFIND, retrying transient errors
+func (self *WebDAVSyncProvider) fileSize(remoteName string, remote *webDAVRemote, filename string) (exists bool, size int64, err error) {
+	_, err = retryTransfer(isWebDAVRetryableError, remoteName, "WebDAV server", filename, 0, nil, func() error {
+		resp, err := self.do(remote, "PROPFIND", self.fileURL(remote, filename), strings.NewReader(webDAVPropfindBody),
+			int64(len(webDAVPropfindBody)), map[string]string{"Depth": "0", "Content-Type": "application/xml; charset=utf-8"}, 404)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == 404 {
+			exists = false
+			return nil
+		}
+		var ms webDAVMultistatus
+		err = xml.NewDecoder(resp.Body).Decode(&ms)
+		if err != nil {
+			return fmt.Errorf("Invalid PROPFIND response for %v: %v", filename, err.Error())
+		}
+		for _, r := range ms.Responses {
+			for _, ps := range r.Propstats {
+				if !strings.Contains(ps.Status, " 200 ") || ps.Collection != nil {
+					continue
+				}
+				size, err = strconv.ParseInt(strings.TrimSpace(ps.ContentLength), 10, 64)
+				if err == nil {
+					exists = true
+					return nil
+				}
+			}
+		}
+		// A collection, or no size; either way not a file we can use
+		exists = false
+		return nil
+	})
+	return exists, size, err
+}
+
+// Make sure a collection (relative to the root, ending in "/") exists, creating parents as needed
+func (self *WebDAVSyncProvider) ensureCollection(remote *webDAVRemote, dir string) error {
+	if dir == "" || dir == "/" {
+		// Root must already exist
+		return nil
+	}
+	u := self.fileURL(remote, dir)
+	self.collectionMutex.Lock()
+	known := self.collections[u]
+	self.collectionMutex.Unlock()
+	if known {
+		return nil
+	}
+	// 405 means it already exists
+	resp, err := self.do(remote, "MKCOL", u, nil, 0, nil, 405)
+	if e, ok := err.(*WebDAVError); ok && e.StatusCode == 409 {
+		// Parent missing, create that first then try again
+		err = self.ensureCollection(remote, path.Dir(strings.TrimSuffix(dir, "/"))+"/")
+		if err == nil {
+			resp, err = self.do(remote, "MKCOL", u, nil, 0, nil, 405)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	self.collectionMutex.Lock()
+	if self.collections == nil {
+		self.collections = make(map[string]bool)
+	}
+	self.collections[u] = true
+	self.collectionMutex.Unlock()
+	return nil
+}
+
+// Get the single file transfer helper for a remote
+func (self *WebDAVSyncProvider) fileTransfer(remoteName string, remote *webDAVRemote) *remoteFileTransfer {
+	return &remoteFileTransfer{
+		remoteName:  remoteName,
+		location:    "WebDAV server",
+		isRetryable: isWebDAVRetryableError,
+		isFatal:     isWebDAVFatalError,
+		stat: func(filename string) (bool, int64, error) {
+			return self.fileSize(remoteName, remote, filename)
+		},
+	}
+}
+
+func (self *WebDAVSyncProvider) ValidateConfig(remoteName string) error {
+	_, err := self.getRemote(remoteName)
+	return err
+}
+
+func (self *WebDAVSyncProvider) Release() {
+	// Nothing to do, HTTP connections are pooled by the client
+}
+
+func (self *WebDAVSyncProvider) FileExists(remoteName, filename string) bool {
+	remote, err := self.getRemote(remoteName)
+	if err != nil {
+		return false
+	}
+	exists, _, err := self.fileSize(remoteName, remote, filename)
+	return err == nil && exists
+}
+
+func (self *WebDAVSyncProvider) FileExistsAndIsOfSize(remoteName, filename string, sz int64) bool {
+	remote, err := self.getRemote(remoteName)
+	if err != nil {
+		return false
+	}
+	exists, size, err := self.fileSize(remoteName, remote, filename)
+	return err == nil && exists && size == sz
+}
+
+// Upload one file to a temporary name in the same collection, then move it into place
+func (self *WebDAVSyncProvider) putFile(remote *webDAVRemote, filename, dir, tempname string, inf *os.File, size int64,
+	callback SyncProgressCallback) (userAborted bool, err error) {
+
+	err = self.ensureCollection(remote, dir)
+	if err != nil {
+		return false, err
+	}
+	userAborted, err = restartUpload(inf, filename, size, callback)
+	if userAborted || err != nil {
+		return userAborted, err
+	}
+
+	// Create a Reader which reports progress as it is read from
+	progressReader := NewSyncProgressReader(inf, filename, size, callback)
+	resp, err := self.do(remote, "PUT", self.fileURL(remote, tempname), progressReader, size,
+		map[string]string{"Content-Type": "application/octet-stream"})
+	if progressReader.Aborted {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	resp, err = self.do(remote, "MOVE", self.fileURL(remote, tempname), nil, 0,
+		map[string]string{"Destination": self.fileURL(remote, filename), "Overwrite": "T"})
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return false, nil
+}
+
+func (self *WebDAVSyncProvider) Upload(remoteName string, filenames []string, fromDir string,
+	force bool, callback SyncProgressCallback) error {
+
+	remote, err := self.getRemote(remoteName)
+	if err != nil {
+		return err
+	}
+
+	util.LogDebug("Uploading to WebDAV", remote.root)
+
+	transfer := self.fileTransfer(remoteName, remote)
+	return transferEachFile(filenames, func(filename string) ([]string, bool) {
+		dir := path.Dir(filepath.ToSlash(filename)) + "/"
+		if dir == "./" {
+			dir = ""
+		}
+		var randbytes [8]byte
+		rand.Read(randbytes[:])
+		tempname := dir + webDAVTempPrefix + hex.EncodeToString(randbytes[:])
+		return transfer.upload(filename, fromDir, force, callback, func(inf *os.File, size int64) (bool, error) {
+			return self.putFile(remote, filename, dir, tempname, inf, size, callback)
+		}, func() {
+			// Clean up the temporary file, if it got that far
+			if resp, delerr := self.do(remote, "DELETE", self.fileURL(remote, tempname), nil, 0, nil, 404); delerr == nil {
+				resp.Body.Close()
+			}
+		})
+	})
+}
+
+func (self *WebDAVSyncProvider) Download(remoteName string, filenames []string, toDir string, force bool, callback SyncProgressCallback) error {
+
+	remote, err := self.getRemote(remoteName)
+	if err != nil {
+		return err
+	}
+
+	util.LogDebug("Downloading from WebDAV", remote.root)
+
+	transfer := self.fileTransfer(remoteName, remote)
+	return transferEachFile(filenames, func(filename string) ([]string, bool) {
+		return transfer.download(filename, toDir, force, callback, func() (io.ReadCloser, error) {
+			resp, err := self.do(remote, "GET", self.fileURL(remote, filename), nil, 0, nil)
+			if err != nil {
+				return nil, err
+			}
+			return resp.Body, nil
+		})
+	})
+}
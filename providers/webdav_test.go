@@ -0,0 +1,160 @@
+package providers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+	. "github.com/atlassian/git-lob/util"
+)
+
+// Minimal in-memory WebDAV server, enough for the provider
+// Collections must be created before files can be put in them, like a real server
+type fakeWebDAVServer struct {
+	fakeHTTPServerForTest
+	files       map[string][]byte
+	collections map[string]bool
+}
+
+func (self *fakeWebDAVServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer self.mutex.Unlock()
+	if self.failRequest(w, r) {
+		return
+	}
+	if user, pass, _ := r.BasicAuth(); user != "me" || pass != "secret" {
+		w.WriteHeader(401)
+		return
+	}
+	p := r.URL.Path
+	parent := path.Dir(strings.TrimSuffix(p, "/")) + "/"
+	switch r.Method {
+	case "PROPFIND":
+		data, ok := self.files[p]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		w.WriteHeader(207)
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><D:multistatus xmlns:D="DAV:"><D:response><D:href>%v</D:href>`+
+			`<D:propstat><D:prop><D:resourcetype/><D:getcontentlength>%d</D:getcontentlength></D:prop>`+
+			`<D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response></D:multistatus>`, p, len(data))
+	case "MKCOL":
+		if self.collections[p] {
+			w.WriteHeader(405)
+		} else if !self.collections[parent] {
+			w.WriteHeader(409)
+		} else {
+			self.collections[p] = true
+			w.WriteHeader(201)
+		}
+	case "PUT":
+		data, ok := self.receiveUpload(w, r)
+		if !ok {
+			return
+		} else if !self.collections[parent] {
+			w.WriteHeader(409)
+		} else {
+			self.files[p] = data
+			w.WriteHeader(201)
+		}
+	case "MOVE":
+		dest, _ := url.Parse(r.Header.Get("Destination"))
+		data, ok := self.files[p]
+		if !ok || dest == nil {
+			w.WriteHeader(404)
+			return
+		}
+		delete(self.files, p)
+		self.files[dest.Path] = data
+		w.WriteHeader(201)
+	case "DELETE":
+		if _, ok := self.files[p]; !ok {
+			w.WriteHeader(404)
+			return
+		}
+		delete(self.files, p)
+		w.WriteHeader(204)
+	case "GET":
+		data, ok := self.files[p]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write(data)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+var _ = Describe("WebDAV", func() {
+	var server *httptest.Server
+	var fake *fakeWebDAVServer
+	var webdav *WebDAVSyncProvider
+	var tmp string
+	BeforeEach(func() {
+		fake = &fakeWebDAVServer{files: make(map[string][]byte), collections: map[string]bool{"/": true, "/dav/": true}}
+		server = httptest.NewServer(fake)
+		webdav = &WebDAVSyncProvider{}
+		GlobalOptions.GitConfig["remote.origin.git-lob-webdav-url"] = server.URL + "/dav"
+		GlobalOptions.GitConfig["remote.origin.git-lob-webdav-user"] = "me"
+		GlobalOptions.GitConfig["remote.origin.git-lob-webdav-password"] = "secret"
+		tmp, _ = ioutil.TempDir("", "webdavtest")
+	})
+	AfterEach(func() {
+		server.Close()
+		GlobalOptions = NewOptions()
+		os.RemoveAll(tmp)
+	})
+
+	It("Validates configuration", func() {
+		CheckValidateConfigForTest(webdav, map[string]string{
+			"remote.origin.git-lob-webdav-url": "ftp://nope",
+		})
+	})
+
+	It("Uploads, checks and downloads files", func() {
+		CheckUploadDownloadForTest(webdav, tmp, func() []byte { return fake.files["/dav/ab/cd/file1.bin"] })
+		Expect(fake.collections).To(HaveKey("/dav/ab/cd/"), "Should create collections")
+		Expect(fake.files).To(HaveLen(1), "Should not leave temporary files")
+		var puts, moves int
+		for _, req := range fake.requests {
+			if strings.HasPrefix(req.URL.Path, "/dav/ab/cd/.git-lob-upload-") {
+				if req.Method == "PUT" {
+					puts++
+				} else if req.Method == "MOVE" {
+					moves++
+				}
+			}
+		}
+		Expect(puts).To(Equal(1), "Should upload to a temporary name")
+		Expect(moves).To(Equal(1), "Should move into place")
+	})
+
+	It("Retries transient errors", func() {
+		CheckRetriesForTest(webdav, &fake.fakeHTTPServerForTest, tmp)
+	})
+
+	It("Fails on authentication errors", func() {
+		CreateRandomFileForTest(100, filepath.Join(tmp, "file1.bin"))
+		CreateRandomFileForTest(100, filepath.Join(tmp, "file2.bin"))
+		GlobalOptions.GitConfig["remote.origin.git-lob-webdav-password"] = "wrong"
+		err := webdav.Upload("origin", []string{"file1.bin", "file2.bin"}, tmp, true, nil)
+		Expect(err).ToNot(BeNil(), "Should fail")
+		Expect(err.Error()).To(ContainSubstring("401"), "Should report authentication failure")
+		puts := 0
+		for _, req := range fake.requests {
+			if req.Method == "PUT" {
+				puts++
+			}
+		}
+		Expect(puts).To(Equal(1), "Should stop after authentication failure")
+	})
+})
@@ -66,10 +66,17 @@ type Options struct {
 	FetchIncludePaths []string
 	// List of paths to exclude when fetching
 	FetchExcludePaths []string
+	// Named fetch profile whose include/exclude paths are in use, blank for none
+	FetchProfile string
+	// Size above which binaries aren't fetched unless explicitly requested, 0 for unlimited
+	FetchMaxSize int64
 	// Size above which we'll try to download deltas on fetch (smart servers only)
 	FetchDeltasAboveSize int64
 	// Size above which we'll try to upload deltas on push (smart servers only)
 	PushDeltasAboveSize int64
+	// Maximum bytes per second to upload / download in total, 0 for unlimited
+	MaxUploadRate   int64
+	MaxDownloadRate int64
 	// The command to run over SSH on a remote smart server to push/pull (default "git-lob-server")
 	SSHServerCommand string
 	// Combination of root .gitconfig and repository config as map
@@ -192,17 +199,16 @@ func parseConfig(configmap map[string]string, opts *Options) {
 		}
 	}
 	if fetchincludes := configmap["git-lob.fetch-include"]; fetchincludes != "" {
-		// Split on comma
-		for _, inc := range strings.Split(fetchincludes, ",") {
-			inc = strings.TrimSpace(inc)
-			opts.FetchIncludePaths = append(opts.FetchIncludePaths, inc)
-		}
+		opts.FetchIncludePaths = append(opts.FetchIncludePaths, parseConfigPathList(fetchincludes)...)
 	}
 	if fetchexcludes := configmap["git-lob.fetch-exclude"]; fetchexcludes != "" {
-		// Split on comma
-		for _, ex := range strings.Split(fetchexcludes, ",") {
-			ex = strings.TrimSpace(ex)
-			opts.FetchExcludePaths = append(opts.FetchExcludePaths, ex)
+		opts.FetchExcludePaths = append(opts.FetchExcludePaths, parseConfigPathList(fetchexcludes)...)
+	}
+	// git-lob.fetch-profile (can be overridden with --profile)
+	if profile := strings.TrimSpace(configmap["git-lob.fetch-profile"]); profile != "" {
+		err := ApplyFetchProfile(opts, profile)
+		if err != nil {
+			LogErrorf("Invalid value for git-lob.fetch-profile: %v\n", err.Error())
 		}
 	}
 	if pruneremote := strings.TrimSpace(configmap["git-lob.prune-check-remote"]); pruneremote != "" {
@@ -227,7 +233,65 @@ func parseConfig(configmap map[string]string, opts *Options) {
 			opts.PushDeltasAboveSize = int64(n)
 		}
 	}
+	if maxsize := configmap["git-lob.fetch-max-size"]; maxsize != "" {
+		n, err := ParseSize(maxsize)
+		if err == nil {
+			opts.FetchMaxSize = n
+		} else {
+			LogErrorf("Invalid value for git-lob.fetch-max-size: %v\n", maxsize)
+		}
+	}
+	// Rates are per second, e.g. 500k
+	if rate := configmap["git-lob.max-upload-rate"]; rate != "" {
+		n, err := ParseSize(rate)
+		if err == nil {
+			opts.MaxUploadRate = n
+		} else {
+			LogErrorf("Invalid value for git-lob.max-upload-rate: %v\n", rate)
+		}
+	}
+	if rate := configmap["git-lob.max-download-rate"]; rate != "" {
+		n, err := ParseSize(rate)
+		if err == nil {
+			opts.MaxDownloadRate = n
+		} else {
+			LogErrorf("Invalid value for git-lob.max-download-rate: %v\n", rate)
+		}
+	}
+
+}
+
+// Split a comma-separated list of paths from config
+func parseConfigPathList(list string) []string {
+	var ret []string
+	for _, p := range strings.Split(list, ",") {
+		ret = append(ret, strings.TrimSpace(p))
+	}
+	return ret
+}
 
+// Use a named fetch profile from git config instead of git-lob.fetch-include/exclude
+// Profiles are defined by git-lob.profile.<name>.include and git-lob.profile.<name>.exclude,
+// with the same format as fetch-include/exclude. They limit what's fetched, auto-fetched,
+// checked out and retained when pruning, so different people (or machines) can work with
+// different subsets of the same repo
+func ApplyFetchProfile(opts *Options, name string) error {
+	key := "git-lob.profile." + strings.ToLower(name)
+	includes, incok := opts.GitConfig[key+".include"]
+	excludes, exok := opts.GitConfig[key+".exclude"]
+	if !incok && !exok {
+		return fmt.Errorf("Fetch profile '%v' is not defined, set %v.include and/or %v.exclude", name, key, key)
+	}
+	opts.FetchProfile = name
+	opts.FetchIncludePaths = []string{}
+	opts.FetchExcludePaths = []string{}
+	if includes != "" {
+		opts.FetchIncludePaths = parseConfigPathList(includes)
+	}
+	if excludes != "" {
+		opts.FetchExcludePaths = parseConfigPathList(excludes)
+	}
+	return nil
 }
 
 // Read .gitconfig / .git/config for specific options to override
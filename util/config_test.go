@@ -185,6 +185,53 @@ var _ = Describe("Config", func() {
 			Expect(opts.FetchExcludePaths).To(Equal(correctExcludes), "Excludes should be correct")
 
 		})
+		It("Parses fetch profiles", func() {
+			configText := `[git-lob]
+    fetch-include = everything
+    fetch-profile = Audio
+[git-lob "profile.audio"]
+    include = sound, music/*.wav
+[git-lob "profile.levels"]
+    exclude = sound,music
+`
+			config, err := ReadConfigStream(bytes.NewBufferString(configText), "")
+			Expect(err).To(BeNil(), "Shouldn't encounter an error when reading config stream")
+			opts := NewOptions()
+			parseConfig(config, opts)
+			Expect(opts.FetchProfile).To(Equal("Audio"), "Default profile should be used")
+			Expect(opts.FetchIncludePaths).To(Equal([]string{"sound", "music/*.wav"}), "Profile includes should replace fetch-include")
+			Expect(opts.FetchExcludePaths).To(BeEmpty(), "No excludes in profile")
+
+			err = ApplyFetchProfile(opts, "levels")
+			Expect(err).To(BeNil(), "Should be able to switch profile")
+			Expect(opts.FetchProfile).To(Equal("levels"))
+			Expect(opts.FetchIncludePaths).To(BeEmpty(), "No includes in profile")
+			Expect(opts.FetchExcludePaths).To(Equal([]string{"sound", "music"}), "Profile excludes should be used")
+
+			err = ApplyFetchProfile(opts, "textures")
+			Expect(err).ToNot(BeNil(), "Undefined profile should be an error")
+			Expect(opts.FetchProfile).To(Equal("levels"), "Failed profile should not change settings")
+		})
+		It("Parses fetch max size", func() {
+			config, err := ReadConfigStream(bytes.NewBufferString("[git-lob]\n    fetch-max-size = 2GB\n"), "")
+			Expect(err).To(BeNil(), "Shouldn't encounter an error when reading config stream")
+			opts := NewOptions()
+			Expect(opts.FetchMaxSize).To(BeZero(), "Default should be unlimited")
+			parseConfig(config, opts)
+			Expect(opts.FetchMaxSize).To(BeEquivalentTo(2*1024*1024*1024), "Max size should be correct")
+		})
+		It("Parses transfer rate limits", func() {
+			configText := `[git-lob]
+    max-upload-rate = 500k
+    max-download-rate=2MB
+`
+			config, err := ReadConfigStream(bytes.NewBufferString(configText), "")
+			Expect(err).To(BeNil(), "Shouldn't encounter an error when reading config stream")
+			opts := NewOptions()
+			parseConfig(config, opts)
+			Expect(opts.MaxUploadRate).To(BeEquivalentTo(500*1024), "Upload rate should be correct")
+			Expect(opts.MaxDownloadRate).To(BeEquivalentTo(2*1024*1024), "Download rate should be correct")
+		})
 
 	})
 
@@ -0,0 +1,173 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Reading & writing git's pkt-line format, as used by the long-running filter process protocol
+// Each packet is a 4 digit hex length (including the 4 bytes of the length itself) followed by
+// the data; a length of 0000 is a flush packet which ends a list or a stream of content
+
+// Largest amount of data git will accept in a single packet
+const PktLineMaxData = 65516
+
+type PktLineReader struct {
+	reader *bufio.Reader
+}
+
+func NewPktLineReader(r io.Reader) *PktLineReader {
+	return &PktLineReader{bufio.NewReader(r)}
+}
+
+// Read a single packet; flush = true for a flush packet (data is nil)
+// Returns io.EOF only if the stream ended cleanly before a packet
+func (self *PktLineReader) ReadPacket() (data []byte, flush bool, err error) {
+	lenbytes := make([]byte, 4)
+	_, err = io.ReadFull(self.reader, lenbytes)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, false, fmt.Errorf("Truncated pkt-line length")
+		}
+		return nil, false, err
+	}
+	pktlen, err := strconv.ParseUint(string(lenbytes), 16, 16)
+	if err != nil {
+		return nil, false, fmt.Errorf("Invalid pkt-line length %q", string(lenbytes))
+	}
+	if pktlen == 0 {
+		return nil, true, nil
+	}
+	if pktlen <= 4 {
+		return nil, false, fmt.Errorf("Unsupported pkt-line length %q", string(lenbytes))
+	}
+	data = make([]byte, pktlen-4)
+	_, err = io.ReadFull(self.reader, data)
+	if err != nil {
+		return nil, false, fmt.Errorf("Truncated pkt-line: %v", err.Error())
+	}
+	return data, false, nil
+}
+
+// Read text packets up to the next flush, with trailing LFs removed
+func (self *PktLineReader) ReadTextList() ([]string, error) {
+	var ret []string
+	for {
+		data, flush, err := self.ReadPacket()
+		if err != nil {
+			return ret, err
+		}
+		if flush {
+			return ret, nil
+		}
+		ret = append(ret, strings.TrimSuffix(string(data), "\n"))
+	}
+}
+
+// Get a reader for content sent as packets up to the next flush
+// The content must be read to EOF before reading anything else
+func (self *PktLineReader) ContentReader() io.Reader {
+	return &pktLineContentReader{pktreader: self}
+}
+
+type pktLineContentReader struct {
+	pktreader *PktLineReader
+	current   []byte
+	done      bool
+	err       error
+}
+
+func (self *pktLineContentReader) Read(p []byte) (int, error) {
+	for len(self.current) == 0 {
+		if self.done {
+			return 0, io.EOF
+		}
+		if self.err != nil {
+			return 0, self.err
+		}
+		data, flush, err := self.pktreader.ReadPacket()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			self.err = err
+		} else if flush {
+			self.done = true
+		} else {
+			self.current = data
+		}
+	}
+	n := copy(p, self.current)
+	self.current = self.current[n:]
+	return n, nil
+}
+
+type PktLineWriter struct {
+	writer *bufio.Writer
+}
+
+// Output is buffered until each flush packet
+func NewPktLineWriter(w io.Writer) *PktLineWriter {
+	return &PktLineWriter{bufio.NewWriter(w)}
+}
+
+// Write data as a single packet, must be no larger than PktLineMaxData
+func (self *PktLineWriter) WritePacket(data []byte) error {
+	if len(data) > PktLineMaxData {
+		return fmt.Errorf("pkt-line data too long (%d bytes)", len(data))
+	}
+	_, err := fmt.Fprintf(self.writer, "%04x", len(data)+4)
+	if err != nil {
+		return err
+	}
+	_, err = self.writer.Write(data)
+	return err
+}
+
+// Write a flush packet & send everything written so far
+func (self *PktLineWriter) WriteFlush() error {
+	_, err := self.writer.WriteString("0000")
+	if err != nil {
+		return err
+	}
+	return self.writer.Flush()
+}
+
+// Write each line as a text packet (with LF), followed by a flush
+func (self *PktLineWriter) WriteTextList(lines ...string) error {
+	for _, line := range lines {
+		err := self.WritePacket([]byte(line + "\n"))
+		if err != nil {
+			return err
+		}
+	}
+	return self.WriteFlush()
+}
+
+// Get a writer which sends content as packets; caller must call WriteFlush at the end
+func (self *PktLineWriter) ContentWriter() io.Writer {
+	return &pktLineContentWriter{self}
+}
+
+type pktLineContentWriter struct {
+	pktwriter *PktLineWriter
+}
+
+func (self *pktLineContentWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		block := p[written:]
+		if len(block) > PktLineMaxData {
+			block = block[:PktLineMaxData]
+		}
+		err := self.pktwriter.WritePacket(block)
+		if err != nil {
+			return written, err
+		}
+		written += len(block)
+	}
+	return written, nil
+}
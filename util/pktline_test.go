@@ -0,0 +1,69 @@
+package util
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("PktLine", func() {
+
+	It("writes text lists", func() {
+		var buf bytes.Buffer
+		w := NewPktLineWriter(&buf)
+		err := w.WriteTextList("git-filter-server", "version=2")
+		Expect(err).To(BeNil(), "Should write without error")
+		Expect(buf.String()).To(Equal("0016git-filter-server\n000eversion=2\n0000"))
+	})
+
+	It("reads text lists", func() {
+		r := NewPktLineReader(bytes.NewBufferString("0016git-filter-client\n000eversion=2\n00000009third0000"))
+		lines, err := r.ReadTextList()
+		Expect(err).To(BeNil(), "Should read without error")
+		Expect(lines).To(Equal([]string{"git-filter-client", "version=2"}))
+		lines, err = r.ReadTextList()
+		Expect(err).To(BeNil(), "Should read without error")
+		Expect(lines).To(Equal([]string{"third"}), "Should not require LF")
+		lines, err = r.ReadTextList()
+		Expect(err).To(Equal(io.EOF), "Should be EOF at end")
+		Expect(lines).To(BeEmpty())
+	})
+
+	It("detects bad input", func() {
+		r := NewPktLineReader(bytes.NewBufferString("00zz"))
+		_, _, err := r.ReadPacket()
+		Expect(err).ToNot(BeNil(), "Should reject invalid length")
+		r = NewPktLineReader(bytes.NewBufferString("0010short"))
+		_, _, err = r.ReadPacket()
+		Expect(err).ToNot(BeNil(), "Should reject truncated packet")
+		r = NewPktLineReader(bytes.NewBufferString("0009short"))
+		_, err = ioutil.ReadAll(r.ContentReader())
+		Expect(err).To(Equal(io.ErrUnexpectedEOF), "Content without flush should be truncated")
+	})
+
+	It("splits and joins content", func() {
+		content := make([]byte, PktLineMaxData*2+100)
+		for i := range content {
+			content[i] = byte(i % 251)
+		}
+		var buf bytes.Buffer
+		w := NewPktLineWriter(&buf)
+		_, err := w.ContentWriter().Write(content)
+		Expect(err).To(BeNil(), "Should write without error")
+		Expect(w.WriteFlush()).To(BeNil())
+		w.WriteTextList("status=success")
+		// 3 packets, a flush, then the list
+		Expect(buf.Len()).To(Equal(len(content) + 3*4 + 4 + 19 + 4))
+
+		r := NewPktLineReader(&buf)
+		readContent, err := ioutil.ReadAll(r.ContentReader())
+		Expect(err).To(BeNil(), "Should read without error")
+		Expect(readContent).To(Equal(content), "Content should round trip")
+		lines, err := r.ReadTextList()
+		Expect(err).To(BeNil(), "Should read without error")
+		Expect(lines).To(Equal([]string{"status=success"}), "Should carry on after content")
+	})
+})
@@ -19,6 +19,8 @@ const (
 	ProgressNotFound ProgressCallbackType = iota
 	// Non-fatal error
 	ProgressError ProgressCallbackType = iota
+	// Transient error, the item is being retried (progress for the item starts again)
+	ProgressRetry ProgressCallbackType = iota
 )
 
 // Collected callback data for a progress operation
@@ -93,6 +95,9 @@ func ReportProgressToConsole(callbackChan <-chan *ProgressCallbackData, op strin
 				case ProgressError:
 					finalDownloadProgress = nil
 					LogConsole(data.Desc)
+				case ProgressRetry:
+					finalDownloadProgress = nil
+					LogConsolef("Retrying: %v (transient error)\n", data.Desc)
 				case ProgressSkip:
 					finalDownloadProgress = nil
 					results.SkippedCount++
@@ -0,0 +1,130 @@
+package util
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Limits the combined throughput of everything using it to a number of bytes per second
+// All methods can be called on a nil *RateLimiter, which means no limit
+type RateLimiter struct {
+	bytesPerSecond int64
+	mutex          sync.Mutex
+	// When the bytes accounted for so far will have been transferred at the limit
+	next time.Time
+}
+
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+// Block until it's OK to have transferred another n bytes
+func (self *RateLimiter) Wait(n int64) {
+	if self == nil || n <= 0 {
+		return
+	}
+	self.mutex.Lock()
+	now := time.Now()
+	if self.next.Before(now) {
+		// Idle time doesn't build up a burst allowance
+		self.next = now
+	}
+	self.next = self.next.Add(time.Duration(n * int64(time.Second) / self.bytesPerSecond))
+	delay := self.next.Sub(now)
+	self.mutex.Unlock()
+	time.Sleep(delay)
+}
+
+// Largest amount to read or write at once, so that waits are frequent & short (~100ms)
+func (self *RateLimiter) blockSize() int {
+	sz := self.bytesPerSecond / 10
+	if sz < 1024 {
+		sz = 1024
+	}
+	return int(sz)
+}
+
+// Wrap a reader so that reading from it is limited; returns r if there's no limit
+func (self *RateLimiter) Reader(r io.Reader) io.Reader {
+	if self == nil {
+		return r
+	}
+	return &rateLimitedReader{r, self}
+}
+
+// Wrap a writer so that writing to it is limited; returns w if there's no limit
+func (self *RateLimiter) Writer(w io.Writer) io.Writer {
+	if self == nil {
+		return w
+	}
+	return &rateLimitedWriter{w, self}
+}
+
+type rateLimitedReader struct {
+	internalReader io.Reader
+	limiter        *RateLimiter
+}
+
+func (self *rateLimitedReader) Read(p []byte) (int, error) {
+	if max := self.limiter.blockSize(); len(p) > max {
+		p = p[:max]
+	}
+	n, err := self.internalReader.Read(p)
+	self.limiter.Wait(int64(n))
+	return n, err
+}
+
+type rateLimitedWriter struct {
+	internalWriter io.Writer
+	limiter        *RateLimiter
+}
+
+func (self *rateLimitedWriter) Write(p []byte) (int, error) {
+	max := self.limiter.blockSize()
+	written := 0
+	for written < len(p) {
+		block := p[written:]
+		if len(block) > max {
+			block = block[:max]
+		}
+		self.limiter.Wait(int64(len(block)))
+		n, err := self.internalWriter.Write(block)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+var (
+	rateLimiterMutex sync.Mutex
+	uploadLimiter    *RateLimiter
+	downloadLimiter  *RateLimiter
+)
+
+// Get a limiter shared by everything in the process, for a rate which may change
+func sharedRateLimiter(existing **RateLimiter, bytesPerSecond int64) *RateLimiter {
+	rateLimiterMutex.Lock()
+	defer rateLimiterMutex.Unlock()
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	if *existing == nil || (*existing).bytesPerSecond != bytesPerSecond {
+		*existing = NewRateLimiter(bytesPerSecond)
+	}
+	return *existing
+}
+
+// Get the limiter for all uploads, as configured by git-lob.max-upload-rate
+// Returns nil (which is a valid limiter) if there is no limit
+func UploadRateLimiter() *RateLimiter {
+	return sharedRateLimiter(&uploadLimiter, GlobalOptions.MaxUploadRate)
+}
+
+// Get the limiter for all downloads, as configured by git-lob.max-download-rate
+// Returns nil (which is a valid limiter) if there is no limit
+func DownloadRateLimiter() *RateLimiter {
+	return sharedRateLimiter(&downloadLimiter, GlobalOptions.MaxDownloadRate)
+}
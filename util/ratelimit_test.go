@@ -0,0 +1,52 @@
+package util
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"time"
+
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/atlassian/git-lob/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("RateLimiter", func() {
+	AfterEach(func() {
+		GlobalOptions = NewOptions()
+	})
+
+	It("Passes through when there's no limit", func() {
+		var limiter *RateLimiter
+		r := bytes.NewReader([]byte("data"))
+		Expect(limiter.Reader(r) == io.Reader(r)).To(BeTrue(), "Should not wrap reader")
+		Expect(UploadRateLimiter()).To(BeNil(), "Should be unlimited by default")
+	})
+
+	It("Limits readers and writers sharing a limit", func() {
+		// 20KB/s, so 8KB read + 8KB written should take ~800ms
+		limiter := NewRateLimiter(20 * 1024)
+		data := make([]byte, 8*1024)
+		start := time.Now()
+		n, err := io.Copy(ioutil.Discard, limiter.Reader(bytes.NewReader(data)))
+		Expect(err).To(BeNil(), "Should read")
+		Expect(n).To(BeEquivalentTo(len(data)), "Should read all data")
+		var out bytes.Buffer
+		w, err := limiter.Writer(&out).Write(data)
+		Expect(err).To(BeNil(), "Should write")
+		Expect(w).To(Equal(len(data)), "Should write all data")
+		Expect(out.Bytes()).To(Equal(data), "Should write correct data")
+		elapsed := time.Since(start)
+		Expect(elapsed).To(BeNumerically(">=", 700*time.Millisecond), "Should be limited")
+		Expect(elapsed).To(BeNumerically("<", 2*time.Second), "Should not be over-limited")
+	})
+
+	It("Shares limiters configured in options", func() {
+		GlobalOptions.MaxUploadRate = 1024
+		limiter := UploadRateLimiter()
+		Expect(limiter).ToNot(BeNil(), "Should be limited")
+		Expect(UploadRateLimiter() == limiter).To(BeTrue(), "Should share limiter")
+		Expect(DownloadRateLimiter()).To(BeNil(), "Download should be separate")
+		GlobalOptions.MaxUploadRate = 2048
+		Expect(UploadRateLimiter().bytesPerSecond).To(BeEquivalentTo(2048), "Should pick up changed limit")
+	})
+})
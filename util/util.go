@@ -83,6 +83,16 @@ func GetGitDir() string {
 
 }
 
+// Gets the directory where local state about a remote is kept (.git/git-lob/state/remotes/<remote>)
+// Returns "" if not in a git repo. Doesn't create the directory
+func GetRemoteStateDir(remoteName string) string {
+	gitDir := GetGitDir()
+	if gitDir == "" {
+		return ""
+	}
+	return filepath.Join(gitDir, "git-lob", "state", "remotes", remoteName)
+}
+
 // Utility method to determine if a file/dir exists
 func FileOrDirExists(path string) (exists bool, isDir bool) {
 	fi, err := os.Stat(path)